@@ -312,7 +312,7 @@ func nextImageAnnotate(annotateTUI *AnnotateTUI, t time.Time) {
 
 	/*annotateTUI.summary.Clear()
 	fmt.Fprintf(annotateTUI.summary, "image %d/%d\n%s\n%s\n\n%s", annotateTUI.currentImage+1, len(annotateTUI.selectedDatasets),
-		annotateTUI.selectedSeriesInformation.SeriesDescription, strings.Join(annotateTUI.selectedSeriesInformation.ClassifyTypes, ","),
+		annotateTUI.selectedSeriesInformation.SeriesDescription, annotateTUI.selectedSeriesInformation.classifyTypesSummary(),
 		sAllInfo)
 	annotateTUI.summary.ScrollToBeginning() */
 }
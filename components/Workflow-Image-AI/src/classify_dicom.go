@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/suyashkumar/dicom"
 	"github.com/suyashkumar/dicom/pkg/tag"
@@ -23,6 +31,7 @@ type Class struct {
 	Id          string `json:"id"`
 	Description string `json:"description"`
 	Rules       []Rule `json:"rules"`
+	Exclusive   string `json:"exclusive,omitempty"` // classes with the same value should not match the same series
 }
 
 type Rule struct {
@@ -32,6 +41,7 @@ type Rule struct {
 	Operator string      `json:"operator"`
 	Negate   string      `json:"negate"`
 	Rule     string      `json:"rule"`
+	Index    *int        `json:"index,omitempty"` // optional, only look at this value of a multi-valued tag (e.g. PixelSpacing[0])
 }
 
 type RuleSet struct {
@@ -53,6 +63,85 @@ type RuleTreeSet struct {
 	Rs   RuleSetL
 }
 
+// HavingRule is an aggregate test on all series of a study or patient, e.g. count(study) >= 3
+type HavingRule struct {
+	Function string    // count or span
+	Level    string    // count only: project, patient, study, series or image
+	Name     string    // count only: series assigned to this named where-clause
+	Rs       *RuleSetL `json:",omitempty"` // count only: series that match these rules
+	Tag      []string  `json:",omitempty"` // span only: the tag that is aggregated
+	Index    *int      `json:",omitempty"`
+	Operator string    // ==, <, >, <= or >=
+	Value    float64
+}
+
+// tagIndexRegexp matches a tag name with a value index like "PixelSpacing[0]"
+var tagIndexRegexp = regexp.MustCompile(`^(.+)\[([0-9]+)\]$`)
+
+// splitTagIndex removes a trailing value index from a tag name, returns -1 as index if there is none
+func splitTagIndex(name string) (string, int) {
+	m := tagIndexRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return name, -1
+	}
+	idx, err := strconv.Atoi(m[2])
+	if err != nil {
+		return name, -1
+	}
+	return m[1], idx
+}
+
+// selectIndex returns the values a rule should look at, if the rule has an index only
+// that single value is returned. If the index does not exist the second return value is false.
+func (rule Rule) selectIndex(values []string) ([]string, bool) {
+	if rule.Index == nil {
+		return values, true
+	}
+	if *rule.Index < 0 || *rule.Index >= len(values) {
+		return []string{}, false
+	}
+	return []string{values[*rule.Index]}, true
+}
+
+// numericRuleValue returns the value of a rule as a number (values from the parser are float64, from json they can be strings)
+func numericRuleValue(v interface{}) (float64, error) {
+	switch obj := v.(type) {
+	case float64:
+		return obj, nil
+	case float32:
+		return float64(obj), nil
+	case int:
+		return float64(obj), nil
+	case int32:
+		return float64(obj), nil
+	case []interface{}:
+		if len(obj) > 0 {
+			return numericRuleValue(obj[0])
+		}
+	}
+	return strconv.ParseFloat(strings.TrimSpace(fmt.Sprintf("%v", v)), 64)
+}
+
+// approxEpsilon is the tolerance used by the approx operator
+const approxEpsilon = 1e-3
+
+// compareNumeric applies one of the numeric operators <, <=, >, >= or approx to a pair of values
+func compareNumeric(operator string, a float64, b float64) bool {
+	switch operator {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "approx":
+		return math.Abs(a-b) <= approxEpsilon
+	}
+	return false
+}
+
 // dataInfo.checkRules(rule, SeriesInstanceUID1, SeriesInstanceUID2)
 func evalCheckRule(rule Rule, SeriesInstanceUID1 string, SeriesInstanceUID2 string, dataInfo map[string]map[string]SeriesInfo) bool {
 	// we already have the series instance uids for both series in the rule
@@ -151,6 +240,13 @@ func (data SeriesInfo) evalRulesTree(ruleSetL RuleSetL) (bool, string) {
 	} else if ruleSetL.Operator == "OR" {
 		return left || right, failureReasonL + failureReasonR
 	} else if ruleSetL.Operator == "NOT" {
+		if left { // the negated rule matched, say which one
+			if ruleSetL.Rs1 != nil {
+				failureReasonL = fmt.Sprintf("Negated rule matched: %s\n", strings.TrimSpace(ruleSetL.Rs1.toString()))
+			} else if ruleSetL.Leaf1 != nil {
+				failureReasonL = fmt.Sprintf("Negated rule matched: %s\n", strings.TrimSpace(ruleSetL.Leaf1.toString()))
+			}
+		}
 		return !left, failureReasonL
 	} else if ruleSetL.Operator == "FIRST" {
 		return left, failureReasonL // ignore the other branch
@@ -161,18 +257,14 @@ func (data SeriesInfo) evalRulesTree(ruleSetL RuleSetL) (bool, string) {
 	return false, failureReasonL + failureReasonR
 }
 
-func (data SeriesInfo) evalLeaf(rule Rule) (bool, string) {
-	var matches bool = true
+// ruleValues returns the values of the tag referenced by the rule (with the value index applied).
+// If the tag cannot be found the second return value explains why.
+func (data SeriesInfo) ruleValues(rule Rule) ([]string, string) {
 	var failureReason string = ""
 	foundValue := false
 	t := rule.Tag
 	o := rule.Operator
 	v := rule.Value
-	// "always true" rules (e.g. `series ... HAS everything`) are stored by the
-	// parser with an empty Tag, so they must be answered before we look at any tag entries
-	if o == "true" || o == "everything" {
-		return true, ""
-	}
 	dataData := []string{""}
 	// if we have two fields, one for group, one for tag we need to look into the all fields to find it
 	if len(t) == 2 {
@@ -186,12 +278,9 @@ func (data SeriesInfo) evalLeaf(rule Rule) (bool, string) {
 		// following test false
 		foundValue, dataData = data.getData(group_str, tag_str)
 		if !foundValue { // nothing can make this correct again
-			matches = false
 			failureReason = fmt.Sprintf("Could not find tag (%s,%s)\n", group_str, tag_str)
 		}
-		foundValue = false // set this to false again so we can do a test of the value as well
 	} else if len(t) == 0 { // a rule without a tag has nothing to compare against
-		matches = false
 		failureReason = fmt.Sprintf("Rule has no tag, operator %s with value %v\n", o, v)
 	} else { // we have a single entry (really?) and treat it as the name of a variable
 		if t[0] == "ClassifyType" {
@@ -222,121 +311,110 @@ func (data SeriesInfo) evalLeaf(rule Rule) (bool, string) {
 			dataData = []string{data.PatientID}
 		} else if t[0] == "PatientName" {
 			dataData = []string{data.PatientName}
-		} else {
-			// We need to look for named entities here as well. So names that appear in all as groups.
-
-			fmt.Println("Warning: unknown value selected")
-		}
-	}
-	if o == "contains" {
-		for _, vv := range dataData {
-			if vv == v {
-				foundValue = true
-			}
-		}
-	} else if o == "<" {
-		for _, vv := range dataData {
-			if vv == "" { // no value matches nothing
-				foundValue = false
-				continue
+		} else if t[0] == "SubSeries" {
+			dataData = []string{data.SubSeries}
+		} else if t[0] == "QCStatus" {
+			status, _ := data.qc()
+			dataData = []string{status}
+		} else if t[0] == "QCIssues" {
+			_, dataData = data.qc()
+		} else if _, ok := geometryFields[t[0]]; ok {
+			// computed from the orientation and position of the images (series_geometry.go)
+			if value, ok := data.geometry().value(t[0]); ok {
+				dataData = []string{value}
+			} else {
+				failureReason = fmt.Sprintf("Series has no geometry for %s\n", t[0])
 			}
-			numValue, err := strconv.ParseFloat(vv, 32)
+		} else if looksLikeTagPath(t[0]) {
+			// a tag inside a sequence, e.g. SharedFunctionalGroupsSequence[0].MRTimingAndRelatedParametersSequence[0].RepetitionTime
+			values, ok, err := data.pathValues(t[0])
 			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\"\n rule: %v", vv, rule)
-				exitGracefully(err)
-			}
-			tmp_str := fmt.Sprintf("%v", v)
-			if tmp_str == "" { // no value matches nothing
-				foundValue = false
-				continue
+				failureReason = fmt.Sprintf("Could not parse tag path: %s\n", err.Error())
+			} else if !ok {
+				failureReason = fmt.Sprintf("Could not find tag %s\n", t[0])
+			} else {
+				dataData = values
 			}
-			numValue2, err := strconv.ParseFloat(tmp_str, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\" rule: %v\n", v, rule)
-				exitGracefully(err)
-			}
-			if numValue < numValue2 {
-				foundValue = true
+		} else if tt, ok := findTagByName(t[0], data.lookupTag); ok {
+			// any other DICOM keyword or a name from the private dictionary
+			foundValue, dataData = data.getData(fmt.Sprintf("%x", tt.Group), fmt.Sprintf("%x", tt.Element))
+			if !foundValue {
+				failureReason = fmt.Sprintf("Could not find tag %s (%04x,%04x)\n", t[0], tt.Group, tt.Element)
 			}
+		} else if isKnownTagName(t[0]) {
+			// a private tag whose creator is not in this series
+			failureReason = fmt.Sprintf("Could not find private tag %s\n", t[0])
+		} else {
+			failureReason = fmt.Sprintf("Unknown tag name %s\n", t[0])
 		}
-	} else if o == ">=" {
-		for _, vv := range dataData {
-			if vv == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue, err := strconv.ParseFloat(vv, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\"\n rule: %v", vv, rule)
-				exitGracefully(err)
-			}
-			tmp_str := fmt.Sprintf("%v", v)
-			if tmp_str == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue2, err := strconv.ParseFloat(tmp_str, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\" rule: %v\n", v, rule)
-				exitGracefully(err)
-			}
-			if numValue >= numValue2 {
-				foundValue = true
-			}
+	}
+	if rule.Index != nil {
+		var ok bool
+		if dataData, ok = rule.selectIndex(dataData); !ok && failureReason == "" {
+			failureReason = fmt.Sprintf("Tag %v has no value at index %d\n", t, *rule.Index)
 		}
-	} else if o == "<=" {
+	}
+	return dataData, failureReason
+}
+
+func (data SeriesInfo) evalLeaf(rule Rule) (bool, string) {
+	var matches bool = true
+	foundValue := false
+	t := rule.Tag
+	o := rule.Operator
+	v := rule.Value
+	// "always true" rules (e.g. `series ... HAS everything`) are stored by the
+	// parser with an empty Tag, so they must be answered before we look at any tag entries
+	if o == "true" || o == "everything" {
+		return true, ""
+	}
+	dataData, failureReason := data.ruleValues(rule)
+	if failureReason != "" {
+		matches = false
+	}
+	if o == "contains" {
 		for _, vv := range dataData {
-			if vv == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue, err := strconv.ParseFloat(vv, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\"\n rule: %v", vv, rule)
-				exitGracefully(err)
-			}
-			tmp_str := fmt.Sprintf("%v", v)
-			if tmp_str == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue2, err := strconv.ParseFloat(tmp_str, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\" rule: %v\n", v, rule)
-				exitGracefully(err)
-			}
-			if numValue <= numValue2 {
+			if vv == v {
 				foundValue = true
 			}
 		}
-	} else if o == ">" {
-		for _, vv := range dataData {
-			if vv == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue, err := strconv.ParseFloat(vv, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\"\n rule: %v", vv, rule)
-				exitGracefully(err)
-			}
-			tmp_str := fmt.Sprintf("%v", v)
-			if tmp_str == "" { // no value matches nothing
-				foundValue = false
-				continue
-			}
-			numValue2, err := strconv.ParseFloat(tmp_str, 32)
-			if err != nil {
-				fmt.Printf("Error: could not convert value to numeric: \"%s\"\n rule: %v", v, rule)
-				exitGracefully(err)
+	} else if o == "<" || o == ">" || o == "<=" || o == ">=" || o == "approx" {
+		// numeric tests work on any numeric value representation (DS, IS, FL, FD, US, SS, UL, SL)
+		// for multi-valued tags any value can match, for approx all values need to match
+		numValue2, err := numericRuleValue(v)
+		if err != nil {
+			fmt.Printf("Error: could not convert value to numeric: \"%v\" rule: %v\n", v, rule)
+		} else {
+			allMatch := true
+			numFound := 0
+			for _, vv := range dataData {
+				vv = strings.TrimSpace(vv)
+				if vv == "" { // no value matches nothing
+					continue
+				}
+				numValue, err := strconv.ParseFloat(vv, 64)
+				if err != nil { // a non-numeric value never matches a numeric test
+					allMatch = false
+					continue
+				}
+				numFound++
+				if compareNumeric(o, numValue, numValue2) {
+					foundValue = true
+				} else {
+					allMatch = false
+				}
 			}
-			if numValue > numValue2 {
-				foundValue = true
+			if o == "approx" {
+				foundValue = allMatch && numFound > 0
 			}
 		}
 	} else if o == "regexp" { // on every single item
+		// the statement can come from an editor (ror lsp) while it is typed, a broken expression is a failure and not a panic
+		rRegex, err := regexp.Compile(fmt.Sprintf("%v", v))
+		if err != nil {
+			return false, fmt.Sprintf("Invalid regular expression \"%v\": %s\n", v, err.Error())
+		}
 		for _, vv := range dataData {
-			var rRegex = regexp.MustCompile(fmt.Sprintf("%v", v))
 			if rRegex.MatchString(vv) {
 				foundValue = true
 			}
@@ -361,17 +439,30 @@ func (data SeriesInfo) evalLeaf(rule Rule) (bool, string) {
 	} else {
 		fmt.Printf("Error: unknown operator: %s\n", o)
 	}
-	if !foundValue { // any one rule that does not match will result in false
+	if !foundValue && failureReason == "" { // any one rule that does not match will result in false
 		matches = false
+		indexStr := ""
+		if rule.Index != nil {
+			indexStr = fmt.Sprintf("[%d]", *rule.Index)
+		}
 		// show t as hex number 0x0000,0x0000
+		// show the values we actually found, that is what the user needs to fix the rule
+		actual := fmt.Sprintf("%q", dataData)
+		if len(actual) > 200 {
+			actual = actual[:200] + "..."
+		}
 		if len(t) == 2 {
-			t1_val, _ := strconv.ParseInt(t[0], 16, 64)
+			t1_val, _ := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(t[0]), "0x"), 16, 64)
 			properTagStr1 := fmt.Sprintf("%04x", t1_val)
-			t2_val, _ := strconv.ParseInt(t[1], 16, 64)
+			t2_val, _ := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(t[1]), "0x"), 16, 64)
 			properTagStr2 := fmt.Sprintf("%04x", t2_val)
-			failureReason = fmt.Sprintf("Value check failed for %s|%s, operator %s with value %v\n", properTagStr1, properTagStr2, o, v)
+			name := ""
+			if info, err := tag.Find(tag.Tag{Group: uint16(t1_val), Element: uint16(t2_val)}); err == nil {
+				name = " " + info.Keyword
+			}
+			failureReason = fmt.Sprintf("Value check failed for %s|%s%s%s, operator %s with value %v, actual value %s\n", properTagStr1, properTagStr2, name, indexStr, o, v, actual)
 		} else {
-			failureReason = fmt.Sprintf("Value check failed for %s operator %s with value %v\n", t, o, v)
+			failureReason = fmt.Sprintf("Value check failed for %s%s operator %s with value %v, actual value %s\n", t, indexStr, o, v, actual)
 		}
 	}
 	return matches, failureReason
@@ -437,6 +528,16 @@ func (data SeriesInfo) evalRules(ruleList []Rule) bool {
 						dataData = []string{data.PatientID}
 					} else if t[0] == "PatientName" {
 						dataData = []string{data.PatientName}
+					} else if t[0] == "SubSeries" {
+						dataData = []string{data.SubSeries}
+					} else if t[0] == "QCStatus" {
+						status, _ := data.qc()
+						dataData = []string{status}
+					} else if _, ok := geometryFields[t[0]]; ok {
+						dataData = []string{""}
+						if value, ok := data.geometry().value(t[0]); ok {
+							dataData = []string{value}
+						}
 					} else {
 						// We need to look for named entities here as well. So names that appear in all as groups.
 
@@ -550,8 +651,12 @@ func (data SeriesInfo) evalRules(ruleList []Rule) bool {
 						}
 					}
 				} else if o == "regexp" { // on every single item
+					rRegex, err := regexp.Compile(fmt.Sprintf("%v", v))
+					if err != nil {
+						matches = false
+						continue
+					}
 					for _, vv := range dataData {
-						var rRegex = regexp.MustCompile(fmt.Sprintf("%v", v))
 						if rRegex.MatchString(vv) {
 							foundValue = true
 						}
@@ -581,115 +686,481 @@ func (data SeriesInfo) evalRules(ruleList []Rule) bool {
 	return matches
 }
 
-func evalRules(dataset dicom.Dataset, ruleList []Rule, classifications Classes, typesList []string) bool {
-	// foreach of the rules we need a truth value for the dataset
-	var theseRulesWork bool = true // even if one if false we cancel here with false
-	for _, r := range ruleList {
-		//fmt.Println("rule is now:", r)
+// Classifier is a compiled set of classification rules. All rules are checked once when the
+// classifier is created, regular expressions are compiled once and rule references are resolved
+// to the class they point to. A Classifier is not changed after it was compiled and can be used
+// for all images of an import.
+type Classifier struct {
+	Source      string   // file the rules are from, used in error messages
+	Fingerprint string   // hash of the rules, stored with the data cache to find out if the rules changed
+	Warnings    []string // conditions that are ignored, names that are not a DICOM keyword or in the private dictionary
+	classes     []compiledClass
+}
 
-		var t tag.Tag
-		var foundTag bool = false
-		var tagValue string
-		// if there is a tag get its value
-		if len(r.Tag) == 1 { // its a name
-			//fmt.Println("We have a single tag value in this rule")
-			// we need to find out what tag this string is from tagDict
-			Info, err := tag.FindByName(r.Tag[0])
-			if err == nil {
-				// is the name the right one? We found the tag
-				t = Info.Tag
-				foundTag = true
+type compiledClass struct {
+	Type      string
+	Id        string
+	Exclusive string
+	rules     []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	name string         // tag name (without a value index) for a single tag
+	pair *tag.Tag       // tag for a (group, element) pair
+	ref  int            // index of the referenced class for a rule reference, -1 otherwise
+	re   *regexp.Regexp // the value of a regular expression rule (no operator)
+}
+
+// classifyOperators are the operators allowed in classification rules, no operator is a regular expression
+var classifyOperators = map[string]bool{"": true, "contains": true, "==": true, "<": true, "<=": true, ">": true, ">=": true, "approx": true}
+
+// compileClassifier reads classification rules (json) and checks them. All problems are reported
+// together, each with the file and the id (or number and type) of the rule.
+func compileClassifier(source string, content string) (*Classifier, error) {
+	var classifications Classes
+	if err := json.Unmarshal([]byte(content), &classifications); err != nil {
+		return nil, fmt.Errorf("%s: could not read classification rules: %s", source, err.Error())
+	}
+	c := Classifier{Source: source, Fingerprint: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}
+	// references use the first class with that id
+	ids := make(map[string]int)
+	for i, class := range classifications {
+		if _, ok := ids[class.Id]; class.Id != "" && !ok {
+			ids[class.Id] = i
+		}
+	}
+	problems := []string{}
+	for i, class := range classifications {
+		name := fmt.Sprintf("rule #%d (type \"%s\")", i+1, class.Type)
+		if class.Id != "" {
+			name = fmt.Sprintf("rule \"%s\"", class.Id)
+		}
+		cc := compiledClass{Type: class.Type, Id: class.Id, Exclusive: class.Exclusive}
+		for j, r := range class.Rules {
+			problem := func(format string, a ...interface{}) {
+				problems = append(problems, fmt.Sprintf("%s: %s, condition %d: %s", source, name, j+1, fmt.Sprintf(format, a...)))
 			}
-		} else if len(r.Tag) == 2 { // its a tag pair
-			//fmt.Println("We have two tag values in this rule")
-			var t1, t2 uint16
-			var ok int = 0
-			t1_val, err := strconv.ParseInt(r.Tag[0], 0, 16)
-			if err == nil {
-				t1 = uint16(t1_val)
-				ok++
+			warning := func(format string, a ...interface{}) {
+				c.Warnings = append(c.Warnings, fmt.Sprintf("%s: %s, condition %d: %s", source, name, j+1, fmt.Sprintf(format, a...)))
 			}
-			t2_val, err := strconv.ParseInt(r.Tag[1], 0, 16)
-			if err == nil {
-				t2 = uint16(t2_val)
-				ok++
+			cr := compiledRule{Rule: r, ref: -1}
+			if !classifyOperators[r.Operator] {
+				problem("unknown operator \"%s\"", r.Operator)
 			}
-			if ok == 2 {
-				t = tag.Tag{Group: t1, Element: t2}
-				foundTag = true
+			switch v := r.Value.(type) {
+			case nil, string, float64:
+			case []interface{}:
+				for _, e := range v {
+					if _, ok := e.(float64); !ok {
+						problem("a list of values can only contain numbers, found %v", e)
+						break
+					}
+				}
+			default:
+				problem("unknown value type %T", r.Value)
 			}
-		} else {
-			// no tag value specified, could be another rule here that is referenced
-			//fmt.Println("No tag, we reference another rule here?", r.Rule)
-			// recurse with that rule only to get a single truth value for it
-			foundRule := false
-			var rs []Rule
-			for _, v := range classifications {
-				//fmt.Println("Check if this is the rule", v.Id, "for", r.Rule)
-				if v.Id == r.Rule {
-					rs = v.Rules
-					foundRule = true
-					break
+			if r.Operator == "" {
+				re, err := regexp.Compile(fmt.Sprintf("%v", valueOrEmpty(r.Value)))
+				if err != nil {
+					problem("invalid regular expression \"%v\": %s", r.Value, err.Error())
 				}
+				cr.re = re
 			}
-			if foundRule {
-				//fmt.Println("We need to check rule ", r.Rule)
-				o := evalRules(dataset, rs, classifications, typesList)
-				// if all of the outs are true we are true for this rule
-				if !o {
-					// at least one of the rules did not work return false for all
-					//fmt.Println(" RULE fails")
-					theseRulesWork = false
-					return theseRulesWork
+			switch len(r.Tag) {
+			case 0:
+				if r.Rule == "" {
+					problem("needs a tag or a rule reference")
+				} else if idx, ok := ids[r.Rule]; ok {
+					cr.ref = idx
+				} else {
+					problem("references the unknown rule \"%s\"", r.Rule)
 				}
-			} else {
-				fmt.Println("We did not find the referenced rule for", r.Rule)
+			case 1:
+				name, idx := splitTagIndex(r.Tag[0])
+				if idx > -1 && cr.Index == nil {
+					cr.Index = &idx
+				}
+				if looksLikeTagPath(name) {
+					if _, _, err := parseTagPath(name); err != nil {
+						problem("%s", err.Error())
+					}
+				} else if name != "ClassifyType" && !isKnownTagName(name) {
+					// older rules (the default rules of ror init) use names like NumImages, skip these conditions
+					warning("unknown tag name \"%s\", the condition is ignored", name)
+					continue
+				}
+				cr.name = name
+			case 2:
+				group, err1 := strconv.ParseInt(r.Tag[0], 0, 32)
+				element, err2 := strconv.ParseInt(r.Tag[1], 0, 32)
+				if err1 != nil || err2 != nil || group < 0 || group > 0xFFFF || element < 0 || element > 0xFFFF {
+					problem("tag [%s, %s] is not a (group, element) pair", r.Tag[0], r.Tag[1])
+				} else {
+					cr.pair = &tag.Tag{Group: uint16(group), Element: uint16(element)}
+				}
+			default:
+				problem("a tag is either a name or a (group, element) pair, found %d entries", len(r.Tag))
 			}
+			cc.rules = append(cc.rules, cr)
 		}
-		if foundTag {
-			dataElement, err := dataset.FindElementByTag(t)
-			if err == nil {
-				if dataElement.Value.ValueType() == dicom.Strings {
-					tagValue = strings.Join(dataElement.Value.GetValue().([]string), ", ")
-				} else if dataElement.Value.ValueType() == dicom.Ints {
-					tagValue = strings.Trim(strings.Join(strings.Split(fmt.Sprint(dataElement.Value.GetValue().([]int)), " "), ", "), "[]")
-				} else {
-					tagValue = fmt.Sprintf("tag value is not string but: %d", dataElement.Value.ValueType())
+		c.classes = append(c.classes, cc)
+	}
+	// rule references have to form a DAG, a cycle would never stop
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(c.classes))
+	var visit func(i int, path []string) bool
+	visit = func(i int, path []string) bool {
+		path = append(path, c.classes[i].Id)
+		if state[i] == visiting {
+			problems = append(problems, fmt.Sprintf("%s: rule references form a cycle: %s", source, strings.Join(path, " -> ")))
+			return false
+		}
+		if state[i] == done {
+			return true
+		}
+		state[i] = visiting
+		for _, r := range c.classes[i].rules {
+			if r.ref > -1 && !visit(r.ref, path) {
+				state[i] = done
+				return false
+			}
+		}
+		state[i] = done
+		return true
+	}
+	for i := range c.classes {
+		visit(i, nil)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return &c, nil
+}
+
+func valueOrEmpty(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// classifyRulesFile is the project file with classification rules (.ror/classifyDICOM.json). A list
+// of classes replaces the built-in rules, an object {"extends": "default", "rules": [...]} adds
+// the classes to the built-in rules, a class with the id of a built-in class replaces that class.
+const classifyRulesFile = "classifyDICOM.json"
+
+// classifyRulesStub is the classifyDICOM.json of a new project, it keeps the built-in rules so changes
+// of the built-in rules reach the project
+const classifyRulesStub = "{\n  \"extends\": \"default\",\n  \"rules\": []\n}\n"
+
+type classifyRulesExtension struct {
+	Extends string  `json:"extends"`
+	Rules   Classes `json:"rules"`
+}
+
+// projectClassifyRules returns the file name, the rules (json) and a description of how the rules
+// of a project are used. The classes of installed rule packs are added at the end.
+func projectClassifyRules(dir string) (string, string, string, error) {
+	path := filepath.Join(dir, ".ror", classifyRulesFile)
+	source, content, usage := "built-in rules", classifyRules, "built-in rules"
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		source, content, usage, err = readClassifyRules(path)
+		if err != nil {
+			return source, content, usage, err
+		}
+	}
+	content, usage, err := withRulePacks(dir, content, usage)
+	return source, content, usage, err
+}
+
+// readClassifyRules reads a rules file, a list of classes or an object that extends the built-in rules
+func readClassifyRules(path string) (string, string, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return path, "", "", err
+	}
+	if trimmed := strings.TrimSpace(string(content)); !strings.HasPrefix(trimmed, "{") {
+		return path, string(content), "replaces the built-in rules", nil
+	}
+	var extension classifyRulesExtension
+	if err := json.Unmarshal(content, &extension); err != nil {
+		return path, "", "", fmt.Errorf("%s: could not read classification rules: %s", path, err.Error())
+	}
+	if extension.Extends != "default" {
+		return path, "", "", fmt.Errorf("%s: \"extends\" should be \"default\", found \"%s\"", path, extension.Extends)
+	}
+	var classes Classes
+	if err := json.Unmarshal([]byte(classifyRules), &classes); err != nil {
+		return path, "", "", err
+	}
+	// project classes replace built-in classes with the same id, all others are added at the end
+	for _, class := range extension.Rules {
+		replaced := false
+		for i := range classes {
+			if class.Id != "" && classes[i].Id == class.Id {
+				classes[i] = class
+				replaced = true
+			}
+		}
+		if !replaced {
+			classes = append(classes, class)
+		}
+	}
+	merged, err := json.Marshal(classes)
+	if err != nil {
+		return path, "", "", err
+	}
+	return path, string(merged), "extends the built-in rules", nil
+}
+
+var classifierCache struct {
+	sync.Mutex
+	path       string
+	mtime      time.Time
+	size       int64
+	packs      string
+	classifier *Classifier
+	usage      string
+	err        error
+}
+
+// projectClassifier returns the compiled classification rules of a project, they are only compiled
+// again if the rules file or the rule packs changed. The second value describes how the rules are used.
+func projectClassifier(dir string) (*Classifier, string, error) {
+	path := filepath.Join(dir, ".ror", classifyRulesFile)
+	var mtime time.Time
+	var size int64 = -1
+	if info, err := os.Stat(path); err == nil {
+		mtime = info.ModTime()
+		size = info.Size()
+	}
+	packs := rulePacksStamp(dir)
+	classifierCache.Lock()
+	defer classifierCache.Unlock()
+	if (classifierCache.classifier != nil || classifierCache.err != nil) && classifierCache.path == path &&
+		classifierCache.mtime.Equal(mtime) && classifierCache.size == size && classifierCache.packs == packs {
+		return classifierCache.classifier, classifierCache.usage, classifierCache.err
+	}
+	source, content, usage, err := projectClassifyRules(dir)
+	var classifier *Classifier
+	if err == nil {
+		classifier, err = compileClassifier(source, content)
+	}
+	classifierCache.path = path
+	classifierCache.mtime = mtime
+	classifierCache.size = size
+	classifierCache.packs = packs
+	classifierCache.classifier = classifier
+	classifierCache.usage = usage
+	classifierCache.err = err
+	return classifier, usage, err
+}
+
+// classifyInput is what classification rules are tested on, a DICOM file during the import or
+// an image of a series in the data cache if the rules changed after the import
+type classifyInput interface {
+	tagValues(t tag.Tag) ([]string, bool)
+	lookup() func(t tag.Tag) ([]string, bool) // string values, used to find the creator of private tags
+	sequenceValues(segments []tagPathSegment, t tag.Tag) ([]string, bool)
+}
+
+type datasetInput struct {
+	dataset dicom.Dataset
+}
+
+func (d datasetInput) tagValues(t tag.Tag) ([]string, bool) {
+	dataElement, err := d.dataset.FindElementByTag(t)
+	if err != nil {
+		return nil, false
+	}
+	var values []string
+	if dataElement.Value.ValueType() == dicom.Strings {
+		values = dataElement.Value.GetValue().([]string)
+	} else if dataElement.Value.ValueType() == dicom.Ints {
+		for _, v := range dataElement.Value.GetValue().([]int) {
+			values = append(values, fmt.Sprintf("%d", v))
+		}
+	} else if dataElement.Value.ValueType() == dicom.Floats {
+		for _, v := range dataElement.Value.GetValue().([]float64) {
+			values = append(values, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	} else {
+		values = []string{fmt.Sprintf("tag value is not string but: %d", dataElement.Value.ValueType())}
+	}
+	return values, true
+}
+
+func (d datasetInput) lookup() func(t tag.Tag) ([]string, bool) {
+	return datasetLookup(d.dataset)
+}
+
+func (d datasetInput) sequenceValues(segments []tagPathSegment, t tag.Tag) ([]string, bool) {
+	return datasetPathValues(d.dataset.Elements, segments, t)
+}
+
+type seriesInput struct {
+	data SeriesInfo
+}
+
+func (s seriesInput) tagValues(t tag.Tag) ([]string, bool) {
+	for _, v := range s.data.All {
+		if v.Tag == t {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (s seriesInput) lookup() func(t tag.Tag) ([]string, bool) {
+	return s.data.lookupTag
+}
+
+func (s seriesInput) sequenceValues(segments []tagPathSegment, t tag.Tag) ([]string, bool) {
+	found := false
+	var values []string
+	for _, v := range s.data.Sequences {
+		if v.Tag == t && matchesPath(v.Path, segments) {
+			found = true
+			values = append(values, v.Value...)
+		}
+	}
+	return values, found
+}
+
+// Classify returns the types of all classes that match the dataset
+func (c *Classifier) Classify(dataset dicom.Dataset) []string {
+	return c.classify(datasetInput{dataset: dataset})
+}
+
+// ClassifySeries classifies a series of the data cache without reading the DICOM files again. Like
+// during the import each image is classified and the series gets the types found for any of its images.
+func (c *Classifier) ClassifySeries(data SeriesInfo) []string {
+	types, _ := c.ClassifySeriesCounts(data)
+	return types
+}
+
+// ClassifySeriesCounts is ClassifySeries together with the number of images found for each type.
+// Series that mix localizers, derived images or several echoes have types that only some images match.
+func (c *Classifier) ClassifySeriesCounts(data SeriesInfo) ([]string, map[string]int) {
+	if len(data.Instances) == 0 {
+		types := c.classify(seriesInput{data: data})
+		counts := make(map[string]int)
+		for _, t := range types {
+			counts[t] = data.NumImages
+		}
+		return types, counts
+	}
+	types := make([]string, 0)
+	counts := make(map[string]int)
+	for _, instance := range data.Instances {
+		for _, t := range c.classify(seriesInput{data: data.instanceView(instance)}) {
+			if counts[t] == 0 {
+				types = append(types, t)
+			}
+			counts[t]++
+		}
+	}
+	return types, counts
+}
+
+func (c *Classifier) classify(in classifyInput) []string {
+	var classes []string = make([]string, 0)
+	// referenced rules are evaluated only once per dataset
+	memo := make(map[int]bool)
+	// we need to match all classes one after another to the data, whenever one fits we
+	// can add it to the output array
+	for i, v := range c.classes {
+		// walk through all rules, if one fails cancel
+		if c.evalClass(in, i, classes, memo) {
+			classes = append(classes, v.Type)
+		}
+	}
+	return classes
+}
+
+func (c *Classifier) evalClass(in classifyInput, idx int, typesList []string, memo map[int]bool) bool {
+	if v, ok := memo[idx]; ok {
+		return v
+	}
+	result := c.evalRules(in, c.classes[idx].rules, typesList, memo)
+	memo[idx] = result
+	return result
+}
+
+func (c *Classifier) evalRules(in classifyInput, ruleList []compiledRule, typesList []string, memo map[int]bool) bool {
+	// foreach of the rules we need a truth value for the dataset
+	for _, r := range ruleList {
+		var t tag.Tag
+		var foundTag bool = false
+		// if there is a tag get its value
+		if r.name != "" { // its a name
+			// we need to find out what tag this string is from tagDict (or the private dictionary)
+			if looksLikeTagPath(r.name) {
+				// tags inside of sequences are tested right here
+				segments, pt, err := parseTagPath(r.name)
+				if err != nil {
+					return false
 				}
-				//tagValue = dataElement.Value
-				//fmt.Println("tag value is:", tagValue, "does it match with", r.Value, "?")
-
-				// call applyOperator
-				var thisCheck bool = applyOperator(r, tagValue)
-				if !thisCheck {
-					theseRulesWork = false
-					return theseRulesWork
+				values, ok := in.sequenceValues(segments, pt)
+				if !ok {
+					return false
 				}
-			} else {
-				//fmt.Println("Tag", t, "does not exist in dataset ", t, "SHOULD WE PANIC HERE?")
+				if values, ok = r.selectIndex(values); !ok {
+					return false
+				}
+				if !applyOperator(r, strings.Join(values, ", ")) {
+					return false
+				}
+				continue
+			} else if tt, ok := findTagByName(r.name, in.lookup()); ok {
+				// is the name the right one? We found the tag
+				t = tt
+				foundTag = true
+			} else if isKnownTagName(r.name) {
+				// private tag without its creator in this dataset
+				return false
+			} else if r.name != "ClassifyType" {
+				// compileClassifier skips conditions on unknown names, they never make a rule true
 				return false
-				// we assume everything is still fine
 			}
-		} else {
+		} else if r.pair != nil { // its a tag pair
+			t = *r.pair
+			foundTag = true
+		} else if r.ref > -1 {
+			// another rule is referenced here, it has to be true as well
+			if !c.evalClass(in, r.ref, typesList, memo) {
+				return false
+			}
+		}
+		if foundTag {
+			values, ok := in.tagValues(t)
+			if !ok {
+				return false
+			}
+			values, ok = r.selectIndex(values)
+			if !ok {
+				return false
+			}
+			if !applyOperator(r, strings.Join(values, ", ")) {
+				return false
+			}
+		} else if r.name == "ClassifyType" {
 			// even if there is no tag we might still have something like "ClassifyType" in the first argument
-			if len(r.Tag) == 1 && r.Tag[0] == "ClassifyType" {
-				// check the operator with that typesList
-				var tagValue = strings.Join(typesList, ", ")
-				//fmt.Println(" CLASSIFYTYPE OPERATOR: ", tagValue)
-				var thisCheck bool = applyOperator(r, tagValue)
-				if !thisCheck {
-					theseRulesWork = false
-					return theseRulesWork
-				}
-				//fmt.Println("WORKS")
+			// check the operator with that typesList
+			if !applyOperator(r, strings.Join(typesList, ", ")) {
+				return false
 			}
 		}
-
 	}
-	return theseRulesWork
+	return true
 }
 
-func applyOperator(r Rule, tagValue string) bool {
+func applyOperator(r compiledRule, tagValue string) bool {
 	// what is r.Value?
 	var value_string string
 	var value_array []float32
@@ -756,61 +1227,63 @@ func applyOperator(r Rule, tagValue string) bool {
 	} else if operator == "" {
 		// if operator is empty string we assume regexp?
 		//fmt.Printf("regular expression \"%s\" compare with \"%s\"\n", value_string, tagValue)
-		var rRegex = regexp.MustCompile(value_string)
-		if !rRegex.MatchString(tagValue) {
+		// the regular expression is compiled with the rules
+		if r.re == nil || !r.re.MatchString(tagValue) {
 			thisCheck = false
 		} //else {
 		//	fmt.Println("YES MATCHES, test next")
 		//}
-	} else if operator == "<" {
-		var1, err1 := strconv.ParseFloat(tagValue, 32)
-		var2, err2 := strconv.ParseFloat(value_string, 32)
-		//fmt.Println("WE are checking < for", var1, var2)
-		if err1 != nil && err2 != nil && var1 < var2 {
-			//fmt.Println("== sign operator false for", tagValue, r.Value)
-			thisCheck = false
-		}
-	} else if operator == "<=" {
-		var1, err1 := strconv.ParseFloat(tagValue, 32)
-		var2, err2 := strconv.ParseFloat(value_string, 32)
-		if err1 != nil && err2 != nil && var1 <= var2 {
-			//fmt.Println("== sign operator false for", tagValue, r.Value)
-			thisCheck = false
-		}
-	} else if operator == ">" {
-		var1, err1 := strconv.ParseFloat(tagValue, 32)
-		var2, err2 := strconv.ParseFloat(value_string, 32)
-		if err1 != nil && err2 != nil && var1 > var2 {
-			//fmt.Println("== sign operator false for", tagValue, r.Value)
-			thisCheck = false
+	} else if operator == "<" || operator == "<=" || operator == ">" || operator == ">=" {
+		// any of the values of a multi-valued tag can match
+		thisCheck = false
+		var limit float64
+		var err error
+		if len(value_array) > 0 {
+			limit = float64(value_array[0])
+		} else {
+			limit, err = strconv.ParseFloat(strings.TrimSpace(value_string), 64)
 		}
-	} else if operator == ">=" {
-		var1, err1 := strconv.ParseFloat(tagValue, 32)
-		var2, err2 := strconv.ParseFloat(value_string, 32)
-		if err1 != nil && err2 != nil && var1 >= var2 {
-			//fmt.Println("== sign operator false for", tagValue, r.Value)
-			thisCheck = false
+		if err == nil {
+			for _, v := range strings.Split(tagValue, ", ") {
+				val, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err == nil && compareNumeric(operator, val, limit) {
+					thisCheck = true
+					break
+				}
+			}
 		}
 	} else if operator == "approx" {
 		// tagValue, r.Value
 		// split tagValue into array of floats
 		tmp := strings.Split(tagValue, ", ")
-		var tag_array []float32
+		var tag_array []float64
 		for _, v := range tmp {
-			v, err := strconv.ParseFloat(v, 32)
+			v, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
 			if err == nil {
-				tag_array = append(tag_array, float32(v))
+				tag_array = append(tag_array, v)
 			} else {
 				fmt.Println("Could not read as float32!")
 			}
 		}
+		if len(value_array) == 0 {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value_string), 64); err == nil {
+				value_array = append(value_array, float32(v))
+			}
+		}
+		if len(tag_array) == 0 || len(value_array) == 0 {
+			thisCheck = false
+		}
 		// now check each pair, if one pair has a larger value count the whole list as false
-		var e float32 = 1e-3
-		//var ok = true
-		//fmt.Println(len(tag_array), " and ", len(value_array))
-		for i, j := 0, 0; i < len(tag_array) && j < len(value_array); i, j = i+1, j+1 {
-			//fmt.Println("CHECK ", tag_array[i], value_array[j], "value is:", math.Abs(float64(tag_array[i]-value_array[j])), ">", e)
-			if math.Abs(float64(tag_array[i]-value_array[j])) > float64(e) {
+		// a single value is compared against all values of the tag
+		for i := 0; i < len(tag_array); i++ {
+			j := i
+			if len(value_array) == 1 {
+				j = 0
+			}
+			if j >= len(value_array) {
+				break
+			}
+			if !compareNumeric("approx", tag_array[i], float64(value_array[j])) {
 				thisCheck = false
 				break
 			}
@@ -827,32 +1300,536 @@ func applyOperator(r Rule, tagValue string) bool {
 	return thisCheck
 }
 
-func ClassifyDICOM(dataset dicom.Dataset) []string {
+// PrivateTag is an entry of the private dictionary (.ror/privateDictionary.json). Private tags are
+// reserved by a creator string in (gggg,0010-00FF), the element number we store is the
+// lower byte only as the block of the creator can be different for every file.
+type PrivateTag struct {
+	Creator string `json:"creator"`
+	Group   string `json:"group"`
+	Element string `json:"element"`
+	Name    string `json:"name"`
+	VR      string `json:"vr"`
+}
 
-	// parse the classifyRules using its structure
-	var classifications Classes
+var privateDictionaryCache struct {
+	sync.Mutex
+	path  string
+	mtime time.Time
+	tags  []PrivateTag
+}
 
-	// we unmarshal our byteArray which contains our
-	// jsonFile's content into 'users' which we defined above
-	json.Unmarshal([]byte(classifyRules), &classifications)
+// privateDictionary returns the entries of the private dictionary of the current project (if any)
+func privateDictionary() []PrivateTag {
+	if input_dir == "" {
+		return nil
+	}
+	path_string := filepath.Join(input_dir, ".ror", "privateDictionary.json")
+	fileInfo, err := os.Stat(path_string)
+	if err != nil {
+		return nil
+	}
+	privateDictionaryCache.Lock()
+	defer privateDictionaryCache.Unlock()
+	if privateDictionaryCache.path == path_string && privateDictionaryCache.mtime.Equal(fileInfo.ModTime()) {
+		return privateDictionaryCache.tags
+	}
+	var tags []PrivateTag
+	byteValue, err := os.ReadFile(path_string)
+	if err == nil {
+		err = json.Unmarshal(byteValue, &tags)
+	}
+	if err != nil {
+		fmt.Printf("Warning: could not read private dictionary %s: %s\n", path_string, err.Error())
+		tags = nil
+	}
+	privateDictionaryCache.path = path_string
+	privateDictionaryCache.mtime = fileInfo.ModTime()
+	privateDictionaryCache.tags = tags
+	return tags
+}
 
-	var classes []string = make([]string, 0)
+// findPrivateTagByName returns the private dictionary entry for a keyword
+func findPrivateTagByName(name string) (PrivateTag, bool) {
+	for _, p := range privateDictionary() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return PrivateTag{}, false
+}
 
-	// we need to match all classes one after another to the data, whenever one fits we
-	// can add it to the output array
-	//dcmMeta, err := json.Marshal(dataset)
-	//if err != nil {
-	//	return classes
-	//}
-	for _, v := range classifications {
-		//fmt.Println("check for type:", v.Type)
-		// walk through all rules, if one fails cancel
-		// rules can reference other rules, in that case we need to recurse here
-		//fmt.Println("rule is now:", v.Rules)
-		if evalRules(dataset, v.Rules, classifications, classes) {
-			classes = append(classes, v.Type)
+// resolve finds the tag of a private dictionary entry in a dataset. The lookup function
+// returns the value(s) for a tag. We search the creator element in the group and
+// combine its block number with the lower byte of the element.
+func (p PrivateTag) resolve(lookup func(t tag.Tag) ([]string, bool)) (tag.Tag, bool) {
+	group, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(p.Group), "0x"), 16, 16)
+	if err != nil {
+		return tag.Tag{}, false
+	}
+	element, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(p.Element), "0x"), 16, 16)
+	if err != nil {
+		return tag.Tag{}, false
+	}
+	for block := uint16(0x10); block <= 0xFF; block++ {
+		values, ok := lookup(tag.Tag{Group: uint16(group), Element: block})
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if strings.TrimSpace(values[0]) == p.Creator {
+			return tag.Tag{Group: uint16(group), Element: block<<8 | uint16(element&0xFF)}, true
 		}
 	}
+	return tag.Tag{}, false
+}
 
-	return classes
+// findTagByName returns the DICOM tag for a standard keyword or private dictionary name. As
+// private tags depend on the creator block in the data the lookup function is required.
+func findTagByName(name string, lookup func(t tag.Tag) ([]string, bool)) (tag.Tag, bool) {
+	if info, err := tag.FindByName(name); err == nil {
+		return info.Tag, true
+	}
+	if p, ok := findPrivateTagByName(name); ok && lookup != nil {
+		return p.resolve(lookup)
+	}
+	return tag.Tag{}, false
+}
+
+// isKnownTagName is true if the name is a standard DICOM keyword or in the private dictionary
+func isKnownTagName(name string) bool {
+	if _, err := tag.FindByName(name); err == nil {
+		return true
+	}
+	_, ok := findPrivateTagByName(name)
+	return ok
+}
+
+// lookupTag returns the values of a tag in the series information
+func (data SeriesInfo) lookupTag(t tag.Tag) ([]string, bool) {
+	for _, v := range data.All {
+		if v.Tag == t && v.Value != nil {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+// datasetLookup returns a lookup function for tags in a DICOM dataset
+func datasetLookup(dataset dicom.Dataset) func(t tag.Tag) ([]string, bool) {
+	return func(t tag.Tag) ([]string, bool) {
+		dataElement, err := dataset.FindElementByTag(t)
+		if err != nil || dataElement.Value.ValueType() != dicom.Strings {
+			return nil, false
+		}
+		return dataElement.Value.GetValue().([]string), true
+	}
+}
+
+// tagPathSegment is one sequence item on the way to a tag inside a sequence, Index -1 means any item
+type tagPathSegment struct {
+	Tag   tag.Tag
+	Index int
+}
+
+// tagPathRegexp is the syntax of a tag path, keywords (or hexadecimal "gggg,eeee" tags) of sequences with an
+// optional item index separated by dots and a final tag
+var tagPathRegexp = regexp.MustCompile(`^(?:(?:[A-Za-z][A-Za-z0-9]*|(?:0x)?[0-9A-Fa-f]{4},?[0-9A-Fa-f]{4})(?:\[[0-9]+\])?\.)+(?:[A-Za-z][A-Za-z0-9]*|(?:0x)?[0-9A-Fa-f]{4},?[0-9A-Fa-f]{4})$`)
+
+// isTagPath is true for names like "SharedFunctionalGroupsSequence[0].MRTimingAndRelatedParametersSequence[0].RepetitionTime"
+func isTagPath(name string) bool {
+	return tagPathRegexp.MatchString(name)
+}
+
+// looksLikeTagPath is true for names with a dot, they are parsed as tag paths so malformed paths are
+// reported as such and not as unknown tag names
+func looksLikeTagPath(name string) bool {
+	return strings.Contains(name, ".")
+}
+
+// parseTagName returns the tag for a keyword or a hexadecimal "ggggeeee" (or "gggg,eeee") string
+func parseTagName(name string) (tag.Tag, error) {
+	// stored paths use the hexadecimal form, test that first as the dictionary lookup is slow
+	hex := strings.Replace(strings.TrimPrefix(strings.ToLower(name), "0x"), ",", "", -1)
+	if len(hex) == 8 {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return tag.Tag{Group: uint16(v >> 16), Element: uint16(v & 0xFFFF)}, nil
+		}
+	}
+	if info, err := tag.FindByName(name); err == nil {
+		return info.Tag, nil
+	}
+	return tag.Tag{}, fmt.Errorf("unknown tag name \"%s\"", name)
+}
+
+// parseTagPath splits a path into its sequence items and the final tag. A sequence without an
+// index matches any of its items.
+func parseTagPath(path string) ([]tagPathSegment, tag.Tag, error) {
+	if !isTagPath(path) {
+		return nil, tag.Tag{}, fmt.Errorf("malformed tag path \"%s\", expected Sequence[n].Keyword with keywords of sequences and an optional item index", path)
+	}
+	parts := strings.Split(path, ".")
+	var segments []tagPathSegment
+	for i, part := range parts {
+		name, idx := splitTagIndex(part)
+		t, err := parseTagName(name)
+		if err != nil {
+			return nil, tag.Tag{}, fmt.Errorf("%s in path %s", err.Error(), path)
+		}
+		if i == len(parts)-1 {
+			return segments, t, nil
+		}
+		segments = append(segments, tagPathSegment{Tag: t, Index: idx})
+	}
+	return nil, tag.Tag{}, fmt.Errorf("empty tag path")
+}
+
+// matchesPath is true if a stored sequence path ("5200,9229[0].0018,9112[0]") matches the segments
+func matchesPath(stored string, segments []tagPathSegment) bool {
+	parts := strings.Split(stored, ".")
+	if len(parts) != len(segments) {
+		return false
+	}
+	for i, part := range parts {
+		name, idx := splitTagIndex(part)
+		t, err := parseTagName(name)
+		if err != nil || t != segments[i].Tag {
+			return false
+		}
+		if segments[i].Index > -1 && segments[i].Index != idx {
+			return false
+		}
+	}
+	return true
+}
+
+// pathValues returns the values of a tag inside sequences of the series
+func (data SeriesInfo) pathValues(path string) ([]string, bool, error) {
+	segments, t, err := parseTagPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	found := false
+	var values []string
+	for _, v := range data.Sequences {
+		if v.Tag == t && matchesPath(v.Path, segments) {
+			found = true
+			values = append(values, v.Value...)
+		}
+	}
+	return values, found, nil
+}
+
+// datasetPathValues returns the values of a tag inside sequences of a DICOM dataset
+func datasetPathValues(elements []*dicom.Element, segments []tagPathSegment, t tag.Tag) ([]string, bool) {
+	if len(segments) == 0 {
+		for _, e := range elements {
+			if e.Tag != t {
+				continue
+			}
+			if tav, ok := elementToTagAndValue(e); ok {
+				return tav.Value, true
+			}
+		}
+		return nil, false
+	}
+	found := false
+	var values []string
+	for _, e := range elements {
+		if e.Tag != segments[0].Tag || e.Value.ValueType() != dicom.Sequences {
+			continue
+		}
+		for idx, item := range e.Value.GetValue().([]*dicom.SequenceItemValue) {
+			if segments[0].Index > -1 && segments[0].Index != idx {
+				continue
+			}
+			if v, ok := datasetPathValues(item.GetValue().([]*dicom.Element), segments[1:], t); ok {
+				found = true
+				values = append(values, v...)
+			}
+		}
+	}
+	return values, found
+}
+
+// pathName converts a stored sequence path and tag into a readable path with DICOM keywords
+func pathName(stored string, t tag.Tag) string {
+	var parts []string
+	if stored != "" {
+		for _, part := range strings.Split(stored, ".") {
+			name, idx := splitTagIndex(part)
+			if st, err := parseTagName(name); err == nil {
+				if info, err := tag.Find(st); err == nil {
+					name = info.Keyword
+				}
+			}
+			parts = append(parts, fmt.Sprintf("%s[%d]", name, idx))
+		}
+	}
+	name := fmt.Sprintf("%04x,%04x", t.Group, t.Element)
+	if info, err := tag.Find(t); err == nil {
+		name = info.Keyword
+	}
+	return strings.Join(append(parts, name), ".")
+}
+
+// readExpectedLabels reads the expected classes for 'ror classify test' from a csv file. Each row has
+// a SeriesInstanceUID followed by the expected classes (more than one class in a cell are separated
+// by ';'). An optional header row starts with "SeriesInstanceUID".
+func readExpectedLabels(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	expected := make(map[string][]string)
+	for i, row := range rows {
+		if len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		uid := strings.TrimSpace(row[0])
+		if i == 0 && strings.EqualFold(uid, "SeriesInstanceUID") {
+			continue
+		}
+		labels := make([]string, 0)
+		for _, cell := range row[1:] {
+			for _, label := range strings.Split(cell, ";") {
+				if label = strings.TrimSpace(label); label != "" {
+					labels = append(labels, label)
+				}
+			}
+		}
+		expected[uid] = append(expected[uid], labels...)
+	}
+	return expected, nil
+}
+
+// annotationLabels uses the annotations of 'ror annotate' as expected classes
+func annotationLabels(dataInfo map[string]map[string]SeriesInfo) map[string][]string {
+	expected := make(map[string][]string)
+	for _, study := range dataInfo {
+		for seriesInstanceUID, series := range study {
+			for _, a := range series.Annotations {
+				label := a.Name
+				if label == "" {
+					label = a.CodeMeaning
+				}
+				if label != "" {
+					expected[seriesInstanceUID] = append(expected[seriesInstanceUID], label)
+				}
+			}
+		}
+	}
+	return expected
+}
+
+// classifyTest runs the classification rules over all series of the data cache. The report lists
+// for each class the number of matching series, the series without a class and the series that
+// match classes that exclude each other (classes with the same "exclusive" value, or one of the
+// groups given). If expected classes are provided a confusion matrix is added. Returns the report
+// and the number of series with other classes than expected (regressions).
+func classifyTest(classifier *Classifier, dataInfo map[string]map[string]SeriesInfo, expected map[string][]string, exclusive [][]string) (string, int) {
+	var b strings.Builder
+	describe := func(uid string, series SeriesInfo) string {
+		return fmt.Sprintf("%s \"%s\" (patient %s)", uid, series.SeriesDescription, series.patientIdentifier())
+	}
+	// classify in a stable order
+	type seriesResult struct {
+		uid    string
+		series SeriesInfo
+		types  []string
+	}
+	results := make([]seriesResult, 0)
+	for _, study := range dataInfo {
+		for uid, series := range study {
+			results = append(results, seriesResult{uid: uid, series: series, types: classifier.ClassifySeries(series)})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].uid < results[j].uid })
+
+	// classes with the same exclusive value form a group as well
+	groups := make(map[string][]string)
+	for _, class := range classifier.classes {
+		if class.Exclusive != "" && !slices.Contains(groups[class.Exclusive], class.Type) {
+			groups[class.Exclusive] = append(groups[class.Exclusive], class.Type)
+		}
+	}
+	for _, g := range exclusive {
+		groups[strings.Join(g, ",")] = g
+	}
+	groupNames := make([]string, 0, len(groups))
+	for name := range groups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+
+	counts := make(map[string]int)
+	unmatched := []string{}
+	conflicts := []string{}
+	for _, r := range results {
+		for _, t := range r.types {
+			counts[t]++
+		}
+		if len(r.types) == 0 {
+			unmatched = append(unmatched, describe(r.uid, r.series))
+		}
+		for _, name := range groupNames {
+			found := []string{}
+			for _, t := range groups[name] {
+				if slices.Contains(r.types, t) {
+					found = append(found, t)
+				}
+			}
+			if len(found) > 1 {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s (exclusive %s)", describe(r.uid, r.series), strings.Join(found, ", "), name))
+			}
+		}
+	}
+
+	// several rules can add the same class
+	types := []string{}
+	width := len("Class")
+	for _, class := range classifier.classes {
+		if !slices.Contains(types, class.Type) {
+			types = append(types, class.Type)
+			width = max(width, len(class.Type))
+		}
+	}
+	fmt.Fprintf(&b, "Classification rules: %s, %d rules for %d classes\n", classifier.Source, len(classifier.classes), len(types))
+	fmt.Fprintf(&b, "Series: %d, with a class: %d, without a class: %d\n\n", len(results), len(results)-len(unmatched), len(unmatched))
+	fmt.Fprintf(&b, "%-*s  Series\n", width, "Class")
+	for _, t := range types {
+		fmt.Fprintf(&b, "%-*s  %d\n", width, t, counts[t])
+	}
+	if len(unmatched) > 0 {
+		fmt.Fprintf(&b, "\nSeries without a class:\n")
+		for _, u := range unmatched {
+			fmt.Fprintf(&b, "  %s\n", u)
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Fprintf(&b, "\nSeries with classes that exclude each other:\n")
+		for _, c := range conflicts {
+			fmt.Fprintf(&b, "  %s\n", c)
+		}
+	}
+	if expected == nil {
+		return b.String(), 0
+	}
+
+	// only the classes that are expected somewhere are compared
+	labels := []string{}
+	for _, l := range expected {
+		for _, label := range l {
+			if !slices.Contains(labels, label) {
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	const none = "(none)"
+	matrix := make(map[string]map[string]int)
+	count := func(e string, f string) {
+		if matrix[e] == nil {
+			matrix[e] = make(map[string]int)
+		}
+		matrix[e][f]++
+	}
+	regressions := []string{}
+	tested := 0
+	for _, r := range results {
+		want, ok := expected[r.uid]
+		if !ok {
+			continue
+		}
+		tested++
+		found := []string{}
+		for _, t := range r.types {
+			if slices.Contains(labels, t) && !slices.Contains(found, t) {
+				found = append(found, t)
+			}
+		}
+		missing := []string{}
+		for _, e := range want {
+			if slices.Contains(found, e) {
+				count(e, e)
+			} else if !slices.Contains(missing, e) {
+				missing = append(missing, e)
+			}
+		}
+		extra := []string{}
+		for _, f := range found {
+			if !slices.Contains(want, f) {
+				extra = append(extra, f)
+			}
+		}
+		for _, m := range missing {
+			if len(extra) == 0 {
+				count(m, none)
+			}
+			for _, e := range extra {
+				count(m, e)
+			}
+		}
+		if len(missing) == 0 {
+			for _, e := range extra {
+				count(none, e)
+			}
+		}
+		if len(missing) > 0 || len(extra) > 0 {
+			regressions = append(regressions, fmt.Sprintf("%s: expected %s, found %s", describe(r.uid, r.series), listOrNone(want), listOrNone(found)))
+		}
+	}
+	fmt.Fprintf(&b, "\nConfusion matrix for %d series with expected classes (rows: expected, columns: found)\n", tested)
+	rows := append(append([]string{}, labels...), none)
+	width = len(none)
+	for _, l := range rows {
+		width = max(width, len(l))
+	}
+	fmt.Fprintf(&b, "%-*s", width, "")
+	for _, c := range rows {
+		fmt.Fprintf(&b, "  %*s", max(len(c), 3), c)
+	}
+	fmt.Fprintf(&b, "\n")
+	for _, e := range rows {
+		fmt.Fprintf(&b, "%-*s", width, e)
+		for _, c := range rows {
+			fmt.Fprintf(&b, "  %*d", max(len(c), 3), matrix[e][c])
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	for uid := range expected {
+		if _, _, ok := findSeries(dataInfo, uid); !ok {
+			fmt.Fprintf(&b, "Warning: series %s with expected classes is not in the data\n", uid)
+		}
+	}
+	if len(regressions) > 0 {
+		fmt.Fprintf(&b, "\nSeries with other classes than expected:\n")
+		for _, r := range regressions {
+			fmt.Fprintf(&b, "  %s\n", r)
+		}
+	}
+	return b.String(), len(regressions)
+}
+
+func listOrNone(l []string) string {
+	if len(l) == 0 {
+		return "no class"
+	}
+	return strings.Join(l, ", ")
+}
+
+// findSeries returns the study and the series for a SeriesInstanceUID
+func findSeries(dataInfo map[string]map[string]SeriesInfo, seriesInstanceUID string) (string, SeriesInfo, bool) {
+	for studyInstanceUID, study := range dataInfo {
+		if series, ok := study[seriesInstanceUID]; ok {
+			return studyInstanceUID, series, true
+		}
+	}
+	return "", SeriesInfo{}, false
 }
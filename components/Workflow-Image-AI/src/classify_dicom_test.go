@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// the rules of projects made by ror init use names that are not DICOM keywords, these conditions are
+// ignored with a warning and the rules still work
+func TestCompileClassifierUnknownTagNames(t *testing.T) {
+	classifier, err := compileClassifier("built-in rules", classifyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(classifier.Warnings) == 0 {
+		t.Errorf("expected warnings for NumImages and the other unknown names")
+	}
+	for _, w := range classifier.Warnings {
+		if !strings.Contains(w, "the condition is ignored") {
+			t.Errorf("unexpected warning %s", w)
+		}
+	}
+
+	classifier, err = compileClassifier("test", `[{"type": "T1", "rules": [{"tag": ["TYPO"], "value": "x"}, {"tag": ["Modality"], "value": "MR"}]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(classifier.Warnings) != 1 || len(classifier.classes[0].rules) != 1 {
+		t.Errorf("expected the TYPO condition to be skipped, got %v", classifier.Warnings)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sjwhitworth/golearn/base"
+	"github.com/sjwhitworth/golearn/trees"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// learnedRule and learnedClass are written in the format of classifyDICOM.json, without the
+// fields a learned rule does not use
+type learnedRule struct {
+	Tag      []string    `json:"tag"`
+	Value    interface{} `json:"value"`
+	Operator string      `json:"operator,omitempty"`
+}
+
+type learnedClass struct {
+	Type        string        `json:"type"`
+	Id          string        `json:"id"`
+	Description string        `json:"description"`
+	Rules       []learnedRule `json:"rules"`
+}
+
+// learnFeatureVRs are the value representations that can describe a kind of series, identifiers,
+// dates, names and binary data are specific to a single series or patient
+var learnFeatureVRs = map[string]bool{
+	"CS": true, "LO": true, "SH": true, "ST": true, "LT": true, "UT": true, "AE": true, "AS": true,
+	"IS": true, "DS": true, "US": true, "SS": true, "UL": true, "SL": true, "FL": true, "FD": true,
+}
+
+// learnIgnoredTags change from image to image, the value stored for the series is the one of a
+// single image and says nothing about the kind of series
+var learnIgnoredTags = []tag.Tag{
+	tag.InstanceNumber, tag.AcquisitionNumber, tag.AcquisitionTime, tag.ContentTime, tag.TemporalPositionIdentifier,
+	tag.TriggerTime, tag.SliceLocation, tag.ImagePositionPatient, tag.WindowCenter, tag.WindowWidth,
+}
+
+type learnFeature struct {
+	name    string // tag keyword, or "0xgggg,0xeeee" if the tag has no keyword
+	tag     tag.Tag
+	numeric bool
+}
+
+// learnFeatures collects the tags of the training series that are used to build the tree. Tags of
+// the patient and private tags are ignored. Categorical tags that have a different value for every
+// series would only learn the series by heart and are ignored as well.
+func learnFeatures(series []SeriesInfo) []learnFeature {
+	features := make(map[tag.Tag]*learnFeature)
+	values := make(map[tag.Tag]map[string]bool)
+	for _, s := range series {
+		for _, v := range s.All {
+			if v.Tag.Group%2 == 1 || v.Tag.Group == 0x0002 || v.Tag.Group == 0x0010 || len(v.Value) == 0 || slices.Contains(learnIgnoredTags, v.Tag) {
+				continue
+			}
+			info, err := tag.Find(v.Tag)
+			if err != nil || !learnFeatureVRs[info.VRs[0]] {
+				continue
+			}
+			if _, ok := features[v.Tag]; !ok {
+				features[v.Tag] = &learnFeature{name: info.Keyword, tag: v.Tag, numeric: v.Type == "numeric"}
+				values[v.Tag] = make(map[string]bool)
+			}
+			values[v.Tag][strings.Join(v.Value, ", ")] = true
+		}
+	}
+	result := []learnFeature{}
+	for t, f := range features {
+		if !f.numeric && len(series) > 2 && len(values[t]) == len(series) {
+			continue
+		}
+		if f.name == "" {
+			f.name = fmt.Sprintf("0x%04x,0x%04x", t.Group, t.Element)
+		}
+		result = append(result, *f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// learnClassifyRules trains an ID3 decision tree that separates the series with the label from the
+// other series. Every path of the tree that ends in the label becomes a class with the label as type,
+// the conditions on that path are the rules of the class.
+func learnClassifyRules(label string, series []SeriesInfo, positive []bool) ([]learnedClass, error) {
+	features := learnFeatures(series)
+	if len(features) == 0 {
+		return nil, fmt.Errorf("no DICOM tags found that could describe the series with label \"%s\"", label)
+	}
+	instances := base.NewDenseInstances()
+	attributes := make([]base.Attribute, len(features))
+	specs := make([]base.AttributeSpec, len(features))
+	byName := make(map[string]learnFeature)
+	for i, f := range features {
+		if f.numeric {
+			attributes[i] = base.NewFloatAttribute(f.name)
+		} else {
+			a := base.NewCategoricalAttribute()
+			a.SetName(f.name)
+			attributes[i] = a
+		}
+		specs[i] = instances.AddAttribute(attributes[i])
+		byName[f.name] = f
+	}
+	classAttr := base.NewCategoricalAttribute()
+	classAttr.SetName("label")
+	classSpec := instances.AddAttribute(classAttr)
+	instances.AddClassAttribute(classAttr)
+	instances.Extend(len(series))
+
+	other := "other"
+	if label == other {
+		other = "not " + label
+	}
+	for row, s := range series {
+		for i, f := range features {
+			value, ok := seriesInput{data: s}.tagValues(f.tag)
+			v := strings.Join(value, ", ")
+			if f.numeric {
+				// missing or unreadable numbers are 0 (like in generateAST)
+				if !ok || len(value) == 0 {
+					v = "0"
+				} else if _, err := strconv.ParseFloat(strings.TrimSpace(value[0]), 64); err != nil {
+					v = "0"
+				} else {
+					v = strings.TrimSpace(value[0])
+				}
+			}
+			instances.Set(specs[i], row, attributes[i].GetSysValFromString(v))
+		}
+		if positive[row] {
+			instances.Set(classSpec, row, classAttr.GetSysValFromString(label))
+		} else {
+			instances.Set(classSpec, row, classAttr.GetSysValFromString(other))
+		}
+	}
+
+	root := trees.InferID3Tree(instances, learnRuleGenerator{})
+	paths := [][]learnedRule{}
+	learnedPaths(root, label, byName, []learnedRule{}, &paths)
+
+	id := strings.ToUpper(regexp.MustCompile("[^A-Za-z0-9]+").ReplaceAllString(label, "-"))
+	classes := []learnedClass{}
+	for i, p := range paths {
+		classes = append(classes, learnedClass{
+			Type:  label,
+			Id:    fmt.Sprintf("%s-LEARNED-%d", id, i+1),
+			Rules: p,
+		})
+	}
+	return classes, nil
+}
+
+// learnRuleGenerator splits like the information gain rule generator of golearn, but prefers a split
+// on a categorical tag (Modality, ImageType, ...) over a numeric tag that separates the series as well.
+// Those rules are easier to read and to review.
+type learnRuleGenerator struct{}
+
+func (learnRuleGenerator) GenerateSplitRule(f base.FixedDataGrid) *trees.DecisionTreeRule {
+	candidates := base.AttributeDifferenceReferences(f.AllAttributes(), f.AllClassAttributes())
+	numeric, categorical := []base.Attribute{}, []base.Attribute{}
+	for _, a := range candidates {
+		if _, ok := a.(*base.FloatAttribute); ok {
+			numeric = append(numeric, a)
+		} else {
+			categorical = append(categorical, a)
+		}
+	}
+	ig := new(trees.InformationGainRuleGenerator)
+	if len(numeric) == 0 {
+		return ig.GetSplitRuleFromSelection(categorical, f)
+	}
+	if len(categorical) == 0 {
+		return ig.GetSplitRuleFromSelection(numeric, f)
+	}
+	c := ig.GetSplitRuleFromSelection(categorical, f)
+	n := ig.GetSplitRuleFromSelection(numeric, f)
+	if splitEntropy(base.DecomposeOnAttributeValues(f, c.SplitAttr)) <= splitEntropy(base.DecomposeOnNumericAttributeThreshold(f, n.SplitAttr, n.SplitVal))+1e-9 {
+		return c
+	}
+	return n
+}
+
+// splitEntropy is the entropy of the labels after a split, weighted by the size of each part
+func splitEntropy(parts map[string]base.FixedDataGrid) float64 {
+	total := 0
+	for _, p := range parts {
+		_, rows := p.Size()
+		total += rows
+	}
+	entropy := 0.0
+	for _, p := range parts {
+		_, rows := p.Size()
+		for _, count := range base.GetClassDistribution(p) {
+			q := float64(count) / float64(rows)
+			entropy -= float64(rows) / float64(total) * q * math.Log2(q)
+		}
+	}
+	return entropy
+}
+
+// learnedPaths walks the tree and adds the conditions of every path that ends in a leaf with the label.
+// Leaves below the same categorical split are combined into a single regular expression.
+func learnedPaths(node *trees.DecisionTreeNode, label string, features map[string]learnFeature, conditions []learnedRule, paths *[][]learnedRule) {
+	if node.Children == nil || node.SplitRule == nil || node.SplitRule.SplitAttr == nil {
+		if node.Class == label {
+			*paths = append(*paths, append([]learnedRule{}, conditions...))
+		}
+		return
+	}
+	f := features[node.SplitRule.SplitAttr.GetName()]
+	var tagName []string
+	if info, err := tag.Find(f.tag); err == nil && info.Keyword != "" {
+		tagName = []string{info.Keyword}
+	} else {
+		tagName = []string{fmt.Sprintf("0x%04x", f.tag.Group), fmt.Sprintf("0x%04x", f.tag.Element)}
+	}
+	keys := make([]string, 0, len(node.Children))
+	for k := range node.Children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if f.numeric {
+		// child "0" has the values up to the split value, child "1" the larger values
+		limit, _ := strconv.ParseFloat(strconv.FormatFloat(node.SplitRule.SplitVal, 'g', 6, 64), 64)
+		for _, k := range keys {
+			operator := "<="
+			if k == "1" {
+				operator = ">"
+			}
+			rule := learnedRule{Tag: tagName, Value: limit, Operator: operator}
+			learnedPaths(node.Children[k], label, features, append(conditions[:len(conditions):len(conditions)], rule), paths)
+		}
+		return
+	}
+	leaves := []string{}
+	for _, k := range keys {
+		child := node.Children[k]
+		if child.Children == nil && child.Class == label {
+			leaves = append(leaves, regexp.QuoteMeta(k))
+			continue
+		}
+		rule := learnedRule{Tag: tagName, Value: "^" + regexp.QuoteMeta(k) + "$"}
+		learnedPaths(child, label, features, append(conditions[:len(conditions):len(conditions)], rule), paths)
+	}
+	if len(leaves) == 1 {
+		*paths = append(*paths, append(conditions[:len(conditions):len(conditions)], learnedRule{Tag: tagName, Value: "^" + leaves[0] + "$"}))
+	} else if len(leaves) > 1 {
+		*paths = append(*paths, append(conditions[:len(conditions):len(conditions)], learnedRule{Tag: tagName, Value: "^(" + strings.Join(leaves, "|") + ")$"}))
+	}
+}
+
+// classifyLearn learns rules for each label from the annotated series of the data cache. Series
+// without annotations are used as examples without the label if all is set. The rules are tested
+// with the classifier on the same series, precision and recall are added to the description of each
+// class and to the report. The returned json extends the built-in rules and can be tested with
+// 'ror classify test --rules'.
+func classifyLearn(dataInfo map[string]map[string]SeriesInfo, labels []string, all bool) (string, string, error) {
+	annotations := annotationLabels(dataInfo)
+	uids := []string{}
+	series := make(map[string]SeriesInfo)
+	for _, study := range dataInfo {
+		for uid, s := range study {
+			if len(annotations[uid]) > 0 || all {
+				uids = append(uids, uid)
+				series[uid] = s
+			}
+		}
+	}
+	sort.Strings(uids)
+	training := make([]SeriesInfo, len(uids))
+	for i, uid := range uids {
+		training[i] = series[uid]
+	}
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "Training series: %d\n", len(uids))
+	output := []learnedClass{}
+	for _, label := range labels {
+		positive := make([]bool, len(uids))
+		count := 0
+		for i, uid := range uids {
+			for _, l := range annotations[uid] {
+				if l == label {
+					positive[i] = true
+				}
+			}
+			if positive[i] {
+				count++
+			}
+		}
+		if count == 0 {
+			return "", report.String(), fmt.Errorf("no series are annotated with \"%s\"", label)
+		}
+		if count == len(uids) {
+			return "", report.String(), fmt.Errorf("all %d training series have the label \"%s\", annotate series without it or use --all to learn from the series without annotations as well", count, label)
+		}
+		classes, err := learnClassifyRules(label, training, positive)
+		if err != nil {
+			return "", report.String(), err
+		}
+		if len(classes) == 0 {
+			fmt.Fprintf(&report, "%s: no rules found for %d series\n", label, count)
+			continue
+		}
+		// test the rules the same way the project classifies series
+		content, err := json.Marshal(classes)
+		if err != nil {
+			return "", report.String(), err
+		}
+		classifier, err := compileClassifier("learned rules for "+label, string(content))
+		if err != nil {
+			return "", report.String(), err
+		}
+		tp, fp, fn := 0, 0, 0
+		for i, s := range training {
+			found := len(classifier.ClassifySeries(s)) > 0
+			if found && positive[i] {
+				tp++
+			} else if found {
+				fp++
+			} else if positive[i] {
+				fn++
+			}
+		}
+		precision, recall := 0.0, 0.0
+		if tp+fp > 0 {
+			precision = float64(tp) / float64(tp+fp)
+		}
+		if tp+fn > 0 {
+			recall = float64(tp) / float64(tp+fn)
+		}
+		fmt.Fprintf(&report, "%s: %d series, %d rules, precision %.2f, recall %.2f (true positive %d, false positive %d, false negative %d)\n",
+			label, count, len(classes), precision, recall, tp, fp, fn)
+		for i := range classes {
+			classes[i].Description = fmt.Sprintf("learned from %d of %d series with label \"%s\" (all rules: precision %.2f, recall %.2f)", count, len(uids), label, precision, recall)
+		}
+		output = append(output, classes...)
+	}
+	// keep operators like "<=" readable
+	var rules strings.Builder
+	encoder := json.NewEncoder(&rules)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Extends string         `json:"extends"`
+		Rules   []learnedClass `json:"rules"`
+	}{Extends: "default", Rules: output}); err != nil {
+		return "", report.String(), err
+	}
+	return rules.String(), report.String(), nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rule packs shipped with ror, add them to a project with 'ror classify add-pack brain-mri'
+//
+//go:embed templates/packs/*.json
+var shippedRulePacks embed.FS
+
+// classifyPacksDir is the project folder with the installed rule packs (.ror/classifyPacks/<name>.json)
+const classifyPacksDir = "classifyPacks"
+
+// RulePack is a versioned set of classification rules. The ids of its classes are prefixed with the
+// namespace of the pack (brain.T1W-SIEMENS) so they cannot collide with the ids of the project or
+// of other packs. References to rules of the same pack use the id without the namespace.
+type RulePack struct {
+	Name        string  `json:"name"`
+	Version     string  `json:"version"`
+	Namespace   string  `json:"namespace"`
+	Description string  `json:"description"`
+	Rules       Classes `json:"rules"`
+}
+
+var rulePackName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseRulePack reads and checks a rule pack
+func parseRulePack(source string, content []byte) (RulePack, error) {
+	var pack RulePack
+	if err := json.Unmarshal(content, &pack); err != nil {
+		return pack, fmt.Errorf("%s: could not read rule pack: %s", source, err.Error())
+	}
+	if !rulePackName.MatchString(pack.Name) {
+		return pack, fmt.Errorf("%s: a rule pack needs a \"name\" (letters, numbers, - and _), found \"%s\"", source, pack.Name)
+	}
+	if !rulePackName.MatchString(pack.Namespace) {
+		return pack, fmt.Errorf("%s: a rule pack needs a \"namespace\" (letters, numbers, - and _), found \"%s\"", source, pack.Namespace)
+	}
+	if _, ok := versionNumbers(pack.Version); !ok {
+		return pack, fmt.Errorf("%s: a rule pack needs a \"version\" like 1.0.0, found \"%s\"", source, pack.Version)
+	}
+	if len(pack.Rules) == 0 {
+		return pack, fmt.Errorf("%s: rule pack %s has no rules", source, pack.Name)
+	}
+	return pack, nil
+}
+
+// versionNumbers splits a version like 1.2.0 into its numbers
+func versionNumbers(version string) ([]int, bool) {
+	numbers := []int{}
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, true
+}
+
+// compareVersions returns -1, 0 or 1 if version a is older, the same or newer than b
+func compareVersions(a string, b string) int {
+	na, _ := versionNumbers(a)
+	nb, _ := versionNumbers(b)
+	for i := 0; i < len(na) || i < len(nb); i++ {
+		x, y := 0, 0
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// classes returns the rules of the pack with the namespace added to the ids
+func (pack RulePack) classes() Classes {
+	local := make(map[string]bool)
+	for _, class := range pack.Rules {
+		if class.Id != "" {
+			local[class.Id] = true
+		}
+	}
+	classes := make(Classes, 0, len(pack.Rules))
+	for _, class := range pack.Rules {
+		if class.Id != "" {
+			class.Id = pack.Namespace + "." + class.Id
+		}
+		rules := make([]Rule, len(class.Rules))
+		for i, r := range class.Rules {
+			if r.Rule != "" && local[r.Rule] {
+				r.Rule = pack.Namespace + "." + r.Rule
+			}
+			rules[i] = r
+		}
+		class.Rules = rules
+		classes = append(classes, class)
+	}
+	return classes
+}
+
+func (pack RulePack) String() string {
+	return fmt.Sprintf("%s %s", pack.Name, pack.Version)
+}
+
+// shippedRulePackNames lists the rule packs that come with ror
+func shippedRulePackNames() []string {
+	names := []string{}
+	entries, _ := shippedRulePacks.ReadDir("templates/packs")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// projectRulePacks returns the rule packs installed in a project sorted by name
+func projectRulePacks(dir string) ([]RulePack, error) {
+	files, _ := filepath.Glob(filepath.Join(dir, ".ror", classifyPacksDir, "*.json"))
+	sort.Strings(files)
+	packs := []RulePack{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pack, err := parseRulePack(file, content)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	return packs, nil
+}
+
+// withRulePacks adds the classes of the installed packs to the rules (json) of a project
+func withRulePacks(dir string, content string, usage string) (string, string, error) {
+	packs, err := projectRulePacks(dir)
+	if err != nil || len(packs) == 0 {
+		return content, usage, err
+	}
+	var classes Classes
+	if err := json.Unmarshal([]byte(content), &classes); err != nil {
+		return content, usage, err
+	}
+	names := []string{}
+	for _, pack := range packs {
+		classes = append(classes, pack.classes()...)
+		names = append(names, pack.String())
+	}
+	merged, err := json.Marshal(classes)
+	if err != nil {
+		return content, usage, err
+	}
+	return string(merged), fmt.Sprintf("%s and packs %s", usage, strings.Join(names, ", ")), nil
+}
+
+// readRulePacks reads the packs from a file, all json files of a directory or the name of a pack
+// shipped with ror
+func readRulePacks(arg string) ([]RulePack, [][]byte, error) {
+	files := []string{}
+	if info, err := os.Stat(arg); err == nil && info.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(arg, "*.json"))
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("no rule packs (*.json) in %s", arg)
+		}
+	} else if err == nil {
+		files = append(files, arg)
+	}
+	packs := []RulePack{}
+	contents := [][]byte{}
+	if len(files) == 0 {
+		content, err := shippedRulePacks.ReadFile("templates/packs/" + arg + ".json")
+		if err != nil {
+			return nil, nil, fmt.Errorf("\"%s\" is not a file, a directory or a rule pack of ror (%s)", arg, strings.Join(shippedRulePackNames(), ", "))
+		}
+		pack, err := parseRulePack(arg, content)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []RulePack{pack}, [][]byte{content}, nil
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		pack, err := parseRulePack(file, content)
+		if err != nil {
+			return nil, nil, err
+		}
+		packs = append(packs, pack)
+		contents = append(contents, content)
+	}
+	return packs, contents, nil
+}
+
+// addRulePacks installs rule packs in a project. A pack with the same name is replaced by a newer
+// version. The rules of the project together with all packs have to compile, otherwise nothing
+// is changed.
+func addRulePacks(dir string, arg string) ([]string, error) {
+	packs, contents, err := readRulePacks(arg)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := projectRulePacks(dir)
+	if err != nil {
+		return nil, err
+	}
+	packDir := filepath.Join(dir, ".ror", classifyPacksDir)
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return nil, err
+	}
+	// check all packs before anything is written
+	olds := make([]*RulePack, len(packs))
+	for i, pack := range packs {
+		for j := range installed {
+			if installed[j].Name == pack.Name {
+				olds[i] = &installed[j]
+			} else if installed[j].Namespace == pack.Namespace {
+				return nil, fmt.Errorf("the namespace \"%s\" of %s is already used by %s", pack.Namespace, pack, installed[j])
+			}
+		}
+		for _, other := range packs[:i] {
+			if other.Name == pack.Name || other.Namespace == pack.Namespace {
+				return nil, fmt.Errorf("%s and %s use the same name or namespace", other, pack)
+			}
+		}
+		if olds[i] != nil && compareVersions(pack.Version, olds[i].Version) < 0 {
+			return nil, fmt.Errorf("%s is older than the installed %s, remove %s first", pack, olds[i], filepath.Join(packDir, pack.Name+".json"))
+		}
+	}
+	messages := []string{}
+	written := make(map[string][]byte) // file -> previous content, nil if it did not exist
+	for i, pack := range packs {
+		file := filepath.Join(packDir, pack.Name+".json")
+		previous, err := os.ReadFile(file)
+		if err != nil {
+			previous = nil
+		}
+		if err := os.WriteFile(file, contents[i], 0644); err != nil {
+			return nil, err
+		}
+		written[file] = previous
+		switch old := olds[i]; {
+		case old == nil:
+			messages = append(messages, fmt.Sprintf("Added rule pack %s (namespace %s, %d classes)", pack, pack.Namespace, len(pack.Rules)))
+		case old.Version == pack.Version:
+			messages = append(messages, fmt.Sprintf("Replaced rule pack %s (namespace %s, %d classes)", pack, pack.Namespace, len(pack.Rules)))
+		default:
+			messages = append(messages, fmt.Sprintf("Updated rule pack %s from version %s to %s (namespace %s, %d classes)", pack.Name, old.Version, pack.Version, pack.Namespace, len(pack.Rules)))
+		}
+	}
+	// all rules together have to work, restore the previous packs otherwise
+	source, content, _, err := projectClassifyRules(dir)
+	if err == nil {
+		_, err = compileClassifier(source, content)
+	}
+	if err != nil {
+		for file, previous := range written {
+			if previous == nil {
+				os.Remove(file)
+			} else {
+				os.WriteFile(file, previous, 0644)
+			}
+		}
+		return nil, fmt.Errorf("the rule pack does not work with the classification rules of the project:\n%s", err.Error())
+	}
+	return messages, nil
+}
+
+// rulePacksSummary lists the installed rule packs for ror status
+func rulePacksSummary(dir string) string {
+	packs, err := projectRulePacks(dir)
+	if err != nil {
+		return fmt.Sprintf("Rule packs are not valid: %s\n", err.Error())
+	}
+	summary := ""
+	for _, pack := range packs {
+		summary += fmt.Sprintf("Rule pack %s (namespace %s, %d classes): %s\n", pack, pack.Namespace, len(pack.Rules), pack.Description)
+	}
+	return summary
+}
+
+// rulePacksStamp changes if a rule pack of the project is added, changed or removed
+func rulePacksStamp(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, ".ror", classifyPacksDir, "*.json"))
+	sort.Strings(files)
+	stamp := ""
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", filepath.Base(file), info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return stamp
+}
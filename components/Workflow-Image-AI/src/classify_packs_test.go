@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// seriesDescriptionClasses returns the classes of a rule pack whose SeriesDescription rule matches
+func seriesDescriptionClasses(t *testing.T, pack RulePack, description string) []string {
+	classes := []string{}
+	for _, class := range pack.Rules {
+		for _, r := range class.Rules {
+			if len(r.Tag) != 1 || r.Tag[0] != "SeriesDescription" {
+				continue
+			}
+			re, err := regexp.Compile(fmt.Sprintf("%v", r.Value))
+			if err != nil {
+				t.Fatalf("%s: %s", class.Type, err)
+			}
+			if re.MatchString(description) {
+				classes = append(classes, class.Type)
+			}
+		}
+	}
+	return classes
+}
+
+// series descriptions of CT scanners, the phase words must not match inside of other words
+func TestCTPhasesSeriesDescriptions(t *testing.T) {
+	content, err := shippedRulePacks.ReadFile("templates/packs/ct-phases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := parseRulePack("ct-phases.json", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		description string
+		classes     []string
+	}{
+		{"Abdomen W/O 5.0 B30f", []string{"non-contrast"}},
+		{"CT ABD PEL WO CONTRAST", []string{"non-contrast"}},
+		{"Non-Contrast Head 5mm", []string{"non-contrast"}},
+		{"NONCON CHEST", []string{"non-contrast"}},
+		{"Nativ 1.0 Br40", []string{"non-contrast"}},
+		{"Unenhanced Abdomen", []string{"non-contrast"}},
+		{"Arterial Phase 1.0 B26f", []string{"arterial"}},
+		{"CTA Chest 1.0 CE", []string{"arterial"}},
+		{"CT Angiography Runoff", []string{"arterial"}},
+		{"Portal Venous 3.0 B30f", []string{"portal-venous"}},
+		{"PV Phase Abd", []string{"portal-venous"}},
+		{"Venous 5mm", []string{"portal-venous"}},
+		{"Delayed 5min Abdomen", []string{"delayed"}},
+		{"Late Phase Liver", []string{"delayed"}},
+		{"Excretory Urogram", []string{"delayed"}},
+		{"Equilibrium 3mm", []string{"delayed"}},
+		// words that contain the phase names
+		{"Lateral Scout", []string{}},
+		{"Topogram 0.6 T20s LAT", []string{}},
+		{"Body 2.0 with intravenous contrast", []string{}},
+		{"Chest two views", []string{}},
+		{"Cartilage Knee", []string{}},
+		{"Dose Report", []string{}},
+		{"Patient Protocol", []string{}},
+		{"Sagittal Bone 2mm", []string{}},
+		{"Plaintext Summary", []string{}},
+	}
+	for _, test := range tests {
+		if got := seriesDescriptionClasses(t, pack, test.description); !reflect.DeepEqual(got, test.classes) {
+			t.Errorf("\"%s\": got %v, expected %v", test.description, got, test.classes)
+		}
+	}
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// deidentifyDir is the project folder with the mapping files of the de-identified trigger runs
+// (.ror/deidentify/<trigger folder>.csv), it is never mounted into the container
+const deidentifyDir = "deidentify"
+
+// deidentifyOptions are the names used by 'config --deidentify' for the DICOM PS3.15 Basic Application
+// Level Confidentiality Profile and its options, together with the codes for the
+// DeidentificationMethodCodeSequence (CID 7050). pseudonymize keeps the dates but moves them by a
+// number of days per patient (Modified Dates Option).
+var deidentifyOptions = []struct {
+	name    string
+	code    string
+	meaning string
+}{
+	{"basic", "113100", "Basic Application Confidentiality Profile"},
+	{"retain-dates", "113106", "Retain Longitudinal Temporal Information Full Dates Option"},
+	{"retain-uids", "113110", "Retain UIDs Option"},
+	{"retain-patient-characteristics", "113108", "Retain Patient Characteristics Option"},
+	{"clean-descriptors", "113105", "Clean Descriptors Option"},
+	{"pseudonymize", "113107", "Retain Longitudinal Temporal Information Modified Dates Option"},
+}
+
+// deidentifyActions is the part of PS3.15 Table E.1-1 for the attributes found in images. The first letter is
+// the action of the basic profile: X remove, Z empty (or dummy) value, D dummy value, U new UID. Where the
+// table allows several actions we use the strictest one that keeps the file valid. A "C" marks attributes
+// kept and cleaned with clean-descriptors, a "P" attributes kept with retain-patient-characteristics. Dates
+// and times (DA, DT and TM) are kept with retain-dates (shifted with pseudonymize), all UIDs with retain-uids. Sequences that are not
+// listed are kept and their items de-identified as well.
+var deidentifyActions = map[tag.Tag]string{
+	{Group: 0x0002, Element: 0x0003}: "U",  // Media Storage SOP Instance UID
+	{Group: 0x0004, Element: 0x1511}: "U",  // Referenced SOP Instance UID in File
+	{Group: 0x0008, Element: 0x0014}: "U",  // Instance Creator UID
+	{Group: 0x0008, Element: 0x0018}: "U",  // SOP Instance UID
+	{Group: 0x0008, Element: 0x0020}: "Z",  // Study Date
+	{Group: 0x0008, Element: 0x0021}: "X",  // Series Date
+	{Group: 0x0008, Element: 0x0022}: "Z",  // Acquisition Date
+	{Group: 0x0008, Element: 0x0023}: "D",  // Content Date
+	{Group: 0x0008, Element: 0x0024}: "X",  // Overlay Date
+	{Group: 0x0008, Element: 0x0025}: "X",  // Curve Date
+	{Group: 0x0008, Element: 0x002A}: "X",  // Acquisition DateTime
+	{Group: 0x0008, Element: 0x0030}: "Z",  // Study Time
+	{Group: 0x0008, Element: 0x0031}: "X",  // Series Time
+	{Group: 0x0008, Element: 0x0032}: "Z",  // Acquisition Time
+	{Group: 0x0008, Element: 0x0033}: "D",  // Content Time
+	{Group: 0x0008, Element: 0x0034}: "X",  // Overlay Time
+	{Group: 0x0008, Element: 0x0035}: "X",  // Curve Time
+	{Group: 0x0008, Element: 0x0050}: "Z",  // Accession Number
+	{Group: 0x0008, Element: 0x0058}: "U",  // Failed SOP Instance UID List
+	{Group: 0x0008, Element: 0x0080}: "X",  // Institution Name
+	{Group: 0x0008, Element: 0x0081}: "X",  // Institution Address
+	{Group: 0x0008, Element: 0x0082}: "X",  // Institution Code Sequence
+	{Group: 0x0008, Element: 0x0090}: "Z",  // Referring Physician's Name
+	{Group: 0x0008, Element: 0x0092}: "X",  // Referring Physician's Address
+	{Group: 0x0008, Element: 0x0094}: "X",  // Referring Physician's Telephone Numbers
+	{Group: 0x0008, Element: 0x0096}: "X",  // Referring Physician Identification Sequence
+	{Group: 0x0008, Element: 0x0201}: "X",  // Timezone Offset From UTC
+	{Group: 0x0008, Element: 0x1010}: "X",  // Station Name
+	{Group: 0x0008, Element: 0x1030}: "XC", // Study Description
+	{Group: 0x0008, Element: 0x103E}: "XC", // Series Description
+	{Group: 0x0008, Element: 0x1040}: "X",  // Institutional Department Name
+	{Group: 0x0008, Element: 0x1048}: "X",  // Physician(s) of Record
+	{Group: 0x0008, Element: 0x1049}: "X",  // Physician(s) of Record Identification Sequence
+	{Group: 0x0008, Element: 0x1050}: "X",  // Performing Physicians' Name
+	{Group: 0x0008, Element: 0x1052}: "X",  // Performing Physician Identification Sequence
+	{Group: 0x0008, Element: 0x1060}: "X",  // Name of Physician(s) Reading Study
+	{Group: 0x0008, Element: 0x1062}: "X",  // Physician(s) Reading Study Identification Sequence
+	{Group: 0x0008, Element: 0x1070}: "X",  // Operators' Name
+	{Group: 0x0008, Element: 0x1072}: "X",  // Operator Identification Sequence
+	{Group: 0x0008, Element: 0x1080}: "XC", // Admitting Diagnoses Description
+	{Group: 0x0008, Element: 0x1084}: "XC", // Admitting Diagnoses Code Sequence
+	{Group: 0x0008, Element: 0x1110}: "X",  // Referenced Study Sequence
+	{Group: 0x0008, Element: 0x1111}: "X",  // Referenced Performed Procedure Step Sequence
+	{Group: 0x0008, Element: 0x1120}: "X",  // Referenced Patient Sequence
+	{Group: 0x0008, Element: 0x1155}: "U",  // Referenced SOP Instance UID
+	{Group: 0x0008, Element: 0x1195}: "U",  // Transaction UID
+	{Group: 0x0008, Element: 0x2111}: "XC", // Derivation Description
+	{Group: 0x0008, Element: 0x3010}: "U",  // Irradiation Event UID
+	{Group: 0x0008, Element: 0x4000}: "X",  // Identifying Comments
+	{Group: 0x0010, Element: 0x0010}: "Z",  // Patient's Name
+	{Group: 0x0010, Element: 0x0020}: "Z",  // Patient ID
+	{Group: 0x0010, Element: 0x0021}: "X",  // Issuer of Patient ID
+	{Group: 0x0010, Element: 0x0030}: "Z",  // Patient's Birth Date
+	{Group: 0x0010, Element: 0x0032}: "X",  // Patient's Birth Time
+	{Group: 0x0010, Element: 0x0040}: "ZP", // Patient's Sex
+	{Group: 0x0010, Element: 0x0050}: "X",  // Patient's Insurance Plan Code Sequence
+	{Group: 0x0010, Element: 0x0101}: "X",  // Patient's Primary Language Code Sequence
+	{Group: 0x0010, Element: 0x0102}: "X",  // Patient's Primary Language Modifier Code Sequence
+	{Group: 0x0010, Element: 0x1000}: "X",  // Other Patient IDs
+	{Group: 0x0010, Element: 0x1001}: "X",  // Other Patient Names
+	{Group: 0x0010, Element: 0x1002}: "X",  // Other Patient IDs Sequence
+	{Group: 0x0010, Element: 0x1005}: "X",  // Patient's Birth Name
+	{Group: 0x0010, Element: 0x1010}: "XP", // Patient's Age
+	{Group: 0x0010, Element: 0x1020}: "XP", // Patient's Size
+	{Group: 0x0010, Element: 0x1030}: "XP", // Patient's Weight
+	{Group: 0x0010, Element: 0x1040}: "X",  // Patient's Address
+	{Group: 0x0010, Element: 0x1050}: "X",  // Insurance Plan Identification
+	{Group: 0x0010, Element: 0x1060}: "X",  // Patient's Mother's Birth Name
+	{Group: 0x0010, Element: 0x1080}: "X",  // Military Rank
+	{Group: 0x0010, Element: 0x1081}: "X",  // Branch of Service
+	{Group: 0x0010, Element: 0x1090}: "X",  // Medical Record Locator
+	{Group: 0x0010, Element: 0x2000}: "X",  // Medical Alerts
+	{Group: 0x0010, Element: 0x2110}: "X",  // Allergies
+	{Group: 0x0010, Element: 0x2150}: "X",  // Country of Residence
+	{Group: 0x0010, Element: 0x2152}: "X",  // Region of Residence
+	{Group: 0x0010, Element: 0x2154}: "X",  // Patient's Telephone Numbers
+	{Group: 0x0010, Element: 0x2160}: "XP", // Ethnic Group
+	{Group: 0x0010, Element: 0x2180}: "X",  // Occupation
+	{Group: 0x0010, Element: 0x21A0}: "XP", // Smoking Status
+	{Group: 0x0010, Element: 0x21B0}: "XC", // Additional Patient History
+	{Group: 0x0010, Element: 0x21C0}: "XP", // Pregnancy Status
+	{Group: 0x0010, Element: 0x21D0}: "X",  // Last Menstrual Date
+	{Group: 0x0010, Element: 0x21F0}: "X",  // Patient's Religious Preference
+	{Group: 0x0010, Element: 0x2203}: "XP", // Patient's Sex Neutered
+	{Group: 0x0010, Element: 0x2297}: "X",  // Responsible Person
+	{Group: 0x0010, Element: 0x2299}: "X",  // Responsible Organization
+	{Group: 0x0010, Element: 0x4000}: "XC", // Patient Comments
+	{Group: 0x0018, Element: 0x0010}: "DC", // Contrast/Bolus Agent
+	{Group: 0x0018, Element: 0x1000}: "X",  // Device Serial Number
+	{Group: 0x0018, Element: 0x1002}: "U",  // Device UID
+	{Group: 0x0018, Element: 0x1004}: "X",  // Plate ID
+	{Group: 0x0018, Element: 0x1005}: "X",  // Generator ID
+	{Group: 0x0018, Element: 0x1007}: "X",  // Cassette ID
+	{Group: 0x0018, Element: 0x1008}: "X",  // Gantry ID
+	{Group: 0x0018, Element: 0x1030}: "XC", // Protocol Name
+	{Group: 0x0018, Element: 0x1400}: "XC", // Acquisition Device Processing Description
+	{Group: 0x0018, Element: 0x4000}: "XC", // Acquisition Comments
+	{Group: 0x0018, Element: 0x700A}: "D",  // Detector ID
+	{Group: 0x0018, Element: 0x9424}: "XC", // Acquisition Protocol Description
+	{Group: 0x0018, Element: 0xA003}: "XC", // Contribution Description
+	{Group: 0x0020, Element: 0x000D}: "U",  // Study Instance UID
+	{Group: 0x0020, Element: 0x000E}: "U",  // Series Instance UID
+	{Group: 0x0020, Element: 0x0010}: "Z",  // Study ID
+	{Group: 0x0020, Element: 0x0052}: "U",  // Frame of Reference UID
+	{Group: 0x0020, Element: 0x0200}: "U",  // Synchronization Frame of Reference UID
+	{Group: 0x0020, Element: 0x3401}: "X",  // Modifying Device ID
+	{Group: 0x0020, Element: 0x3404}: "X",  // Modifying Device Manufacturer
+	{Group: 0x0020, Element: 0x3406}: "X",  // Modified Image Description
+	{Group: 0x0020, Element: 0x4000}: "XC", // Image Comments
+	{Group: 0x0020, Element: 0x9158}: "XC", // Frame Comments
+	{Group: 0x0020, Element: 0x9161}: "U",  // Concatenation UID
+	{Group: 0x0020, Element: 0x9164}: "U",  // Dimension Organization UID
+	{Group: 0x0028, Element: 0x1199}: "U",  // Palette Color Lookup Table UID
+	{Group: 0x0028, Element: 0x1214}: "U",  // Large Palette Color Lookup Table UID
+	{Group: 0x0028, Element: 0x4000}: "X",  // Image Presentation Comments
+	{Group: 0x0032, Element: 0x0012}: "X",  // Study ID Issuer
+	{Group: 0x0032, Element: 0x1020}: "X",  // Scheduled Study Location
+	{Group: 0x0032, Element: 0x1021}: "X",  // Scheduled Study Location AE Title
+	{Group: 0x0032, Element: 0x1030}: "XC", // Reason for Study
+	{Group: 0x0032, Element: 0x1032}: "X",  // Requesting Physician
+	{Group: 0x0032, Element: 0x1033}: "X",  // Requesting Service
+	{Group: 0x0032, Element: 0x1060}: "XC", // Requested Procedure Description
+	{Group: 0x0032, Element: 0x1070}: "XC", // Requested Contrast Agent
+	{Group: 0x0032, Element: 0x4000}: "XC", // Study Comments
+	{Group: 0x0038, Element: 0x0004}: "X",  // Referenced Patient Alias Sequence
+	{Group: 0x0038, Element: 0x0010}: "X",  // Admission ID
+	{Group: 0x0038, Element: 0x0011}: "X",  // Issuer of Admission ID
+	{Group: 0x0038, Element: 0x001E}: "X",  // Scheduled Patient Institution Residence
+	{Group: 0x0038, Element: 0x0020}: "X",  // Admitting Date
+	{Group: 0x0038, Element: 0x0021}: "X",  // Admitting Time
+	{Group: 0x0038, Element: 0x0040}: "XC", // Discharge Diagnosis Description
+	{Group: 0x0038, Element: 0x0050}: "X",  // Special Needs
+	{Group: 0x0038, Element: 0x0060}: "X",  // Service Episode ID
+	{Group: 0x0038, Element: 0x0061}: "X",  // Issuer of Service Episode ID
+	{Group: 0x0038, Element: 0x0062}: "XC", // Service Episode Description
+	{Group: 0x0038, Element: 0x0300}: "X",  // Current Patient Location
+	{Group: 0x0038, Element: 0x0400}: "X",  // Patient's Institution Residence
+	{Group: 0x0038, Element: 0x0500}: "XC", // Patient State
+	{Group: 0x0038, Element: 0x4000}: "XC", // Visit Comments
+	{Group: 0x0040, Element: 0x0001}: "X",  // Scheduled Station AE Title
+	{Group: 0x0040, Element: 0x0002}: "X",  // Scheduled Procedure Step Start Date
+	{Group: 0x0040, Element: 0x0003}: "X",  // Scheduled Procedure Step Start Time
+	{Group: 0x0040, Element: 0x0004}: "X",  // Scheduled Procedure Step End Date
+	{Group: 0x0040, Element: 0x0005}: "X",  // Scheduled Procedure Step End Time
+	{Group: 0x0040, Element: 0x0006}: "X",  // Scheduled Performing Physician's Name
+	{Group: 0x0040, Element: 0x0007}: "XC", // Scheduled Procedure Step Description
+	{Group: 0x0040, Element: 0x000B}: "X",  // Scheduled Performing Physician Identification Sequence
+	{Group: 0x0040, Element: 0x0010}: "X",  // Scheduled Station Name
+	{Group: 0x0040, Element: 0x0011}: "X",  // Scheduled Procedure Step Location
+	{Group: 0x0040, Element: 0x0012}: "X",  // Pre-Medication
+	{Group: 0x0040, Element: 0x0241}: "X",  // Performed Station AE Title
+	{Group: 0x0040, Element: 0x0242}: "X",  // Performed Station Name
+	{Group: 0x0040, Element: 0x0243}: "X",  // Performed Location
+	{Group: 0x0040, Element: 0x0244}: "X",  // Performed Procedure Step Start Date
+	{Group: 0x0040, Element: 0x0245}: "X",  // Performed Procedure Step Start Time
+	{Group: 0x0040, Element: 0x0250}: "X",  // Performed Procedure Step End Date
+	{Group: 0x0040, Element: 0x0251}: "X",  // Performed Procedure Step End Time
+	{Group: 0x0040, Element: 0x0253}: "X",  // Performed Procedure Step ID
+	{Group: 0x0040, Element: 0x0254}: "XC", // Performed Procedure Step Description
+	{Group: 0x0040, Element: 0x0275}: "X",  // Request Attributes Sequence
+	{Group: 0x0040, Element: 0x0280}: "XC", // Comments on the Performed Procedure Step
+	{Group: 0x0040, Element: 0x0555}: "X",  // Acquisition Context Sequence
+	{Group: 0x0040, Element: 0x1001}: "X",  // Requested Procedure ID
+	{Group: 0x0040, Element: 0x1004}: "X",  // Patient Transport Arrangements
+	{Group: 0x0040, Element: 0x1005}: "X",  // Requested Procedure Location
+	{Group: 0x0040, Element: 0x1010}: "X",  // Names of Intended Recipients of Results
+	{Group: 0x0040, Element: 0x1011}: "X",  // Intended Recipients of Results Identification Sequence
+	{Group: 0x0040, Element: 0x1101}: "X",  // Person Identification Code Sequence
+	{Group: 0x0040, Element: 0x1102}: "X",  // Person's Address
+	{Group: 0x0040, Element: 0x1103}: "X",  // Person's Telephone Numbers
+	{Group: 0x0040, Element: 0x1400}: "X",  // Requested Procedure Comments
+	{Group: 0x0040, Element: 0x2001}: "X",  // Reason for the Imaging Service Request
+	{Group: 0x0040, Element: 0x2008}: "X",  // Order Entered By
+	{Group: 0x0040, Element: 0x2009}: "X",  // Order Enterer's Location
+	{Group: 0x0040, Element: 0x2010}: "X",  // Order Callback Phone Number
+	{Group: 0x0040, Element: 0x2016}: "Z",  // Placer Order Number / Imaging Service Request
+	{Group: 0x0040, Element: 0x2017}: "Z",  // Filler Order Number / Imaging Service Request
+	{Group: 0x0040, Element: 0x2400}: "XC", // Imaging Service Request Comments
+	{Group: 0x0040, Element: 0x3001}: "X",  // Confidentiality Constraint on Patient Data Description
+	{Group: 0x0040, Element: 0x4023}: "U",  // Referenced General Purpose Scheduled Procedure Step Transaction UID
+	{Group: 0x0040, Element: 0x4025}: "X",  // Scheduled Station Name Code Sequence
+	{Group: 0x0040, Element: 0x4027}: "X",  // Scheduled Station Geographic Location Code Sequence
+	{Group: 0x0040, Element: 0x4028}: "X",  // Performed Station Name Code Sequence
+	{Group: 0x0040, Element: 0x4030}: "X",  // Performed Station Geographic Location Code Sequence
+	{Group: 0x0040, Element: 0x4034}: "X",  // Scheduled Human Performers Sequence
+	{Group: 0x0040, Element: 0x4035}: "X",  // Actual Human Performers Sequence
+	{Group: 0x0040, Element: 0x4036}: "X",  // Human Performer's Organization
+	{Group: 0x0040, Element: 0x4037}: "X",  // Human Performer's Name
+	{Group: 0x0040, Element: 0xA027}: "X",  // Verifying Organization
+	{Group: 0x0040, Element: 0xA073}: "X",  // Verifying Observer Sequence
+	{Group: 0x0040, Element: 0xA075}: "D",  // Verifying Observer Name
+	{Group: 0x0040, Element: 0xA078}: "X",  // Author Observer Sequence
+	{Group: 0x0040, Element: 0xA07A}: "X",  // Participant Sequence
+	{Group: 0x0040, Element: 0xA07C}: "X",  // Custodial Organization Sequence
+	{Group: 0x0040, Element: 0xA088}: "Z",  // Verifying Observer Identification Code Sequence
+	{Group: 0x0040, Element: 0xA123}: "D",  // Person Name
+	{Group: 0x0040, Element: 0xA124}: "U",  // UID
+	{Group: 0x0040, Element: 0xA730}: "X",  // Content Sequence
+	{Group: 0x0040, Element: 0xDB0C}: "U",  // Template Extension Organization UID
+	{Group: 0x0040, Element: 0xDB0D}: "U",  // Template Extension Creator UID
+	{Group: 0x0070, Element: 0x0001}: "X",  // Graphic Annotation Sequence
+	{Group: 0x0070, Element: 0x0084}: "Z",  // Content Creator's Name
+	{Group: 0x0070, Element: 0x0086}: "X",  // Content Creator's Identification Code Sequence
+	{Group: 0x0070, Element: 0x031A}: "U",  // Fiducial UID
+	{Group: 0x0088, Element: 0x0140}: "U",  // Storage Media File-set UID
+	{Group: 0x0088, Element: 0x0200}: "X",  // Icon Image Sequence
+	{Group: 0x0088, Element: 0x0904}: "X",  // Topic Title
+	{Group: 0x0088, Element: 0x0906}: "X",  // Topic Subject
+	{Group: 0x0088, Element: 0x0910}: "X",  // Topic Author
+	{Group: 0x0088, Element: 0x0912}: "X",  // Topic Keywords
+	{Group: 0x0400, Element: 0x0100}: "X",  // Digital Signature UID
+	{Group: 0x0400, Element: 0x0402}: "X",  // Referenced Digital Signature Sequence
+	{Group: 0x0400, Element: 0x0403}: "X",  // Referenced SOP Instance MAC Sequence
+	{Group: 0x0400, Element: 0x0404}: "X",  // MAC
+	{Group: 0x0400, Element: 0x0550}: "X",  // Modified Attributes Sequence
+	{Group: 0x0400, Element: 0x0561}: "X",  // Original Attributes Sequence
+	{Group: 0x2030, Element: 0x0020}: "X",  // Text String
+	{Group: 0x3006, Element: 0x0024}: "U",  // Referenced Frame of Reference UID
+	{Group: 0x3006, Element: 0x00C2}: "U",  // Related Frame of Reference UID
+	{Group: 0x300E, Element: 0x0008}: "X",  // Reviewer Name
+	{Group: 0x4000, Element: 0x0010}: "X",  // Arbitrary
+	{Group: 0x4000, Element: 0x4000}: "X",  // Text Comments
+	{Group: 0x4008, Element: 0x0042}: "X",  // Results ID Issuer
+	{Group: 0x4008, Element: 0x0102}: "X",  // Interpretation Recorder
+	{Group: 0x4008, Element: 0x010A}: "X",  // Interpretation Transcriber
+	{Group: 0x4008, Element: 0x010B}: "X",  // Interpretation Text
+	{Group: 0x4008, Element: 0x010C}: "X",  // Interpretation Author
+	{Group: 0x4008, Element: 0x0111}: "X",  // Interpretation Approver Sequence
+	{Group: 0x4008, Element: 0x0114}: "X",  // Physician Approving Interpretation
+	{Group: 0x4008, Element: 0x0115}: "X",  // Interpretation Diagnosis Description
+	{Group: 0x4008, Element: 0x0118}: "X",  // Results Distribution List Sequence
+	{Group: 0x4008, Element: 0x0119}: "X",  // Distribution Name
+	{Group: 0x4008, Element: 0x011A}: "X",  // Distribution Address
+	{Group: 0x4008, Element: 0x0202}: "X",  // Interpretation ID Issuer
+	{Group: 0x4008, Element: 0x0300}: "X",  // Impressions
+	{Group: 0x4008, Element: 0x4000}: "X",  // Results Comments
+	{Group: 0xFFFA, Element: 0xFFFA}: "X",  // Digital Signatures Sequence
+	{Group: 0xFFFC, Element: 0xFFFC}: "X",  // Data Set Trailing Padding
+}
+
+// DeidentifyProfile is the basic profile with the options selected by 'config --deidentify'
+type DeidentifyProfile struct {
+	RetainDates                  bool
+	RetainUIDs                   bool
+	RetainPatientCharacteristics bool
+	CleanDescriptors             bool
+	Pseudonymize                 bool // stable pseudonyms and shifted dates from the key of the project (pseudonym.go)
+}
+
+// parseDeidentifyProfile reads a profile like "basic,retain-dates,clean-descriptors", returns nil for "" and "none"
+func parseDeidentifyProfile(profile string) (*DeidentifyProfile, error) {
+	profile = strings.TrimSpace(profile)
+	if profile == "" || profile == "none" {
+		return nil, nil
+	}
+	names := []string{}
+	for _, option := range deidentifyOptions {
+		names = append(names, option.name)
+	}
+	var p DeidentifyProfile
+	for _, option := range strings.Split(profile, ",") {
+		switch strings.TrimSpace(option) {
+		case "basic":
+		case "retain-dates":
+			p.RetainDates = true
+		case "retain-uids":
+			p.RetainUIDs = true
+		case "retain-patient-characteristics":
+			p.RetainPatientCharacteristics = true
+		case "clean-descriptors":
+			p.CleanDescriptors = true
+		case "pseudonymize":
+			p.Pseudonymize = true
+		default:
+			return nil, fmt.Errorf("unknown de-identification option \"%s\", use \"none\" or a comma separated list of %s", strings.TrimSpace(option), strings.Join(names, ", "))
+		}
+	}
+	return &p, nil
+}
+
+// selected returns the options of the profile, the basic profile is always the first entry
+func (p DeidentifyProfile) selected() []int {
+	idx := []int{0}
+	for i, on := range []bool{p.RetainDates, p.RetainUIDs, p.RetainPatientCharacteristics, p.CleanDescriptors, p.Pseudonymize} {
+		if on {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+// String is the canonical form of the profile as stored in the config and in descr.json
+func (p DeidentifyProfile) String() string {
+	names := []string{}
+	for _, i := range p.selected() {
+		names = append(names, deidentifyOptions[i].name)
+	}
+	return strings.Join(names, ",")
+}
+
+// deidentifier applies a profile to the images of a trigger run. UIDs and patients are replaced with
+// the same values for all images of the run and each replacement is remembered for the mapping file.
+// With pseudonymize the replacements come from the keyed hash of the project and are the same in
+// all runs.
+type deidentifier struct {
+	profile  DeidentifyProfile
+	pseudo   *pseudonymizer
+	uids     map[string]string
+	patients map[string]string
+	mapping  [][]string // type, original, replacement
+}
+
+func newDeidentifier(profile DeidentifyProfile, pseudo *pseudonymizer) *deidentifier {
+	return &deidentifier{
+		profile:  profile,
+		pseudo:   pseudo,
+		uids:     make(map[string]string),
+		patients: make(map[string]string),
+	}
+}
+
+// projectDeidentifier returns the deidentifier for a profile (config --deidentify) of the project in dir,
+// nil if the images are not de-identified
+func projectDeidentifier(dir string, config Config) (*deidentifier, error) {
+	profile, err := parseDeidentifyProfile(config.Deidentify)
+	if err != nil || profile == nil {
+		return nil, err
+	}
+	var pseudo *pseudonymizer
+	if profile.Pseudonymize {
+		if pseudo, err = projectPseudonymizer(dir, config.ProjectName); err != nil {
+			return nil, err
+		}
+	}
+	return newDeidentifier(*profile, pseudo), nil
+}
+
+// deidentifyContext is what the elements of one image are de-identified with
+type deidentifyContext struct {
+	clean     *regexp.Regexp // identifying words for clean-descriptors
+	pseudonym string
+	shift     int // days the dates are moved with pseudonymize
+}
+
+// newUID creates a UID from a random UUID (2.25.<128 bit integer>)
+func newUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// without random bytes all UIDs would be the same, de-identification cannot continue
+		exitGracefully(fmt.Errorf("could not create a random UID: %s", err.Error()))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant
+	return "2.25." + new(big.Int).SetBytes(b).String()
+}
+
+// uid returns the replacement of a UID
+func (d *deidentifier) uid(original string) string {
+	original = strings.TrimRight(original, "\x00 ")
+	if original == "" || d.profile.RetainUIDs {
+		return original
+	}
+	if replacement, ok := d.uids[original]; ok {
+		return replacement
+	}
+	replacement := newUID()
+	if d.pseudo != nil {
+		replacement = d.pseudo.uid(original)
+	}
+	d.uids[original] = replacement
+	d.mapping = append(d.mapping, []string{"uid", original, replacement})
+	return replacement
+}
+
+// patient returns the pseudonym used as PatientID and PatientName of a patient
+func (d *deidentifier) patient(id string, name string) string {
+	key := id
+	if key == "" {
+		key = name
+	}
+	if pseudonym, ok := d.patients[key]; ok {
+		return pseudonym
+	}
+	pseudonym := fmt.Sprintf("ANON-%04d", len(d.patients)+1)
+	if d.pseudo != nil {
+		pseudonym = d.pseudo.patientID(key)
+	}
+	d.patients[key] = pseudonym
+	d.mapping = append(d.mapping, []string{"PatientID", id, pseudonym})
+	d.mapping = append(d.mapping, []string{"PatientName", name, pseudonym})
+	if d.pseudo != nil && !d.profile.RetainDates {
+		d.mapping = append(d.mapping, []string{"DateShift", id, fmt.Sprintf("-%d", d.pseudo.dateShift(key))})
+	}
+	return pseudonym
+}
+
+// firstString returns the first value of a string element in the dataset
+func firstString(dataset *dicom.Dataset, t tag.Tag) string {
+	element, err := dataset.FindElementByTag(t)
+	if err != nil || element.Value == nil || element.Value.ValueType() != dicom.Strings {
+		return ""
+	}
+	values := dicom.MustGetStrings(element.Value)
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+// apply de-identifies a dataset in place
+func (d *deidentifier) apply(dataset *dicom.Dataset) error {
+	patientID := firstString(dataset, tag.PatientID)
+	patientName := firstString(dataset, tag.PatientName)
+	ctx := deidentifyContext{pseudonym: d.patient(patientID, patientName)}
+	if d.pseudo != nil {
+		key := patientID
+		if key == "" {
+			key = patientName
+		}
+		ctx.shift = d.pseudo.dateShift(key)
+	}
+
+	// words that identify the patient and are removed from descriptors by clean-descriptors
+	identifying := []string{patientID, firstString(dataset, tag.AccessionNumber), firstString(dataset, tag.PatientBirthDate)}
+	identifying = append(identifying, strings.FieldsFunc(patientName, func(r rune) bool { return r == '^' || r == ' ' || r == '=' })...)
+	parts := []string{}
+	for _, word := range identifying {
+		if len(word) > 1 {
+			parts = append(parts, regexp.QuoteMeta(word))
+		}
+	}
+	if len(parts) > 0 {
+		ctx.clean = regexp.MustCompile("(?i)" + strings.Join(parts, "|"))
+	}
+
+	elements, err := d.elements(dataset.Elements, ctx)
+	if err != nil {
+		return err
+	}
+	dataset.Elements = elements
+
+	// record what was done (PS3.15 E.1.1)
+	methods := []string{}
+	codes := [][]*dicom.Element{}
+	for _, i := range d.profile.selected() {
+		option := deidentifyOptions[i]
+		if option.name == "pseudonymize" {
+			methods = append(methods, "Pseudonyms from a keyed hash (AutoID)")
+			if d.profile.RetainDates {
+				continue // the dates are not modified
+			}
+		}
+		methods = append(methods, option.meaning)
+		item := []*dicom.Element{}
+		for _, v := range []struct {
+			t     tag.Tag
+			value string
+		}{{tag.CodeValue, option.code}, {tag.CodingSchemeDesignator, "DCM"}, {tag.CodeMeaning, option.meaning}} {
+			element, err := dicom.NewElement(v.t, []string{v.value})
+			if err != nil {
+				return err
+			}
+			item = append(item, element)
+		}
+		codes = append(codes, item)
+	}
+	temporal := "REMOVED"
+	if d.profile.RetainDates {
+		temporal = "UNMODIFIED"
+	} else if d.pseudo != nil {
+		temporal = "MODIFIED"
+	}
+	for _, v := range []struct {
+		t     tag.Tag
+		value any
+	}{
+		{tag.PatientIdentityRemoved, []string{"YES"}},
+		{tag.DeidentificationMethod, methods},
+		{tag.DeidentificationMethodCodeSequence, codes},
+		{tag.LongitudinalTemporalInformationModified, []string{temporal}},
+	} {
+		element, err := dicom.NewElement(v.t, v.value)
+		if err != nil {
+			return err
+		}
+		replaced := false
+		for i, e := range dataset.Elements {
+			if e.Tag == v.t {
+				dataset.Elements[i] = element
+				replaced = true
+			}
+		}
+		if !replaced {
+			dataset.Elements = append(dataset.Elements, element)
+		}
+	}
+	sort.SliceStable(dataset.Elements, func(i, j int) bool {
+		a, b := dataset.Elements[i].Tag, dataset.Elements[j].Tag
+		return a.Group < b.Group || (a.Group == b.Group && a.Element < b.Element)
+	})
+	return nil
+}
+
+// action returns the action of the profile for an element, "K" keeps the element
+func (d *deidentifier) action(e *dicom.Element) string {
+	action, ok := deidentifyActions[e.Tag]
+	if !ok {
+		return "K"
+	}
+	vr := e.RawValueRepresentation
+	switch {
+	case action[0] == 'U' && d.profile.RetainUIDs:
+		return "K"
+	case (vr == "DA" || vr == "DT" || vr == "TM") && d.profile.RetainDates:
+		return "K"
+	case (vr == "DA" || vr == "DT") && d.pseudo != nil:
+		return "S" // shifted by the days of the patient
+	case vr == "TM" && d.pseudo != nil:
+		return "K"
+	case strings.Contains(action, "P") && d.profile.RetainPatientCharacteristics:
+		return "K"
+	case strings.Contains(action, "C") && d.profile.CleanDescriptors:
+		return "C"
+	}
+	return action[:1]
+}
+
+// elements de-identifies the elements of a dataset or of a sequence item
+func (d *deidentifier) elements(elements []*dicom.Element, ctx deidentifyContext) ([]*dicom.Element, error) {
+	kept := []*dicom.Element{}
+	for _, e := range elements {
+		group := e.Tag.Group
+		if group%2 == 1 {
+			continue // private tags
+		}
+		if group&0xFF00 == 0x5000 || (group&0xFF00 == 0x6000 && (e.Tag.Element == 0x3000 || e.Tag.Element == 0x4000)) {
+			continue // curve data, overlay data and overlay comments
+		}
+		if e.Tag == tag.PatientName || e.Tag == tag.PatientID {
+			value, err := dicom.NewValue([]string{ctx.pseudonym})
+			if err != nil {
+				return nil, err
+			}
+			e.Value = value
+			kept = append(kept, e)
+			continue
+		}
+		action := d.action(e)
+		if action == "X" {
+			continue
+		}
+		if e.Value == nil {
+			kept = append(kept, e)
+			continue
+		}
+		var value any
+		switch action {
+		case "Z":
+			value = zeroValue(e)
+		case "D":
+			value = dummyValue(e)
+		case "U":
+			if e.Value.ValueType() == dicom.Strings {
+				uids := []string{}
+				for _, v := range dicom.MustGetStrings(e.Value) {
+					uids = append(uids, d.uid(v))
+				}
+				value = uids
+			}
+		case "C":
+			if e.Value.ValueType() == dicom.Strings && ctx.clean != nil {
+				values := []string{}
+				for _, v := range dicom.MustGetStrings(e.Value) {
+					values = append(values, strings.TrimSpace(ctx.clean.ReplaceAllString(v, "")))
+				}
+				value = values
+			}
+		case "S":
+			if e.Value.ValueType() == dicom.Strings {
+				values := []string{}
+				for _, v := range dicom.MustGetStrings(e.Value) {
+					values = append(values, shiftDate(v, ctx.shift))
+				}
+				value = values
+			}
+		}
+		// the items of kept sequences are de-identified as well
+		if value == nil && e.Value.ValueType() == dicom.Sequences {
+			items := [][]*dicom.Element{}
+			for _, item := range e.Value.GetValue().([]*dicom.SequenceItemValue) {
+				itemElements, err := d.elements(item.GetValue().([]*dicom.Element), ctx)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, itemElements)
+			}
+			value = items
+		}
+		if value != nil {
+			v, err := dicom.NewValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("could not de-identify %s: %s", e.Tag.String(), err.Error())
+			}
+			e.Value = v
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// zeroValue is an empty value of the same type
+func zeroValue(e *dicom.Element) any {
+	switch e.Value.ValueType() {
+	case dicom.Strings:
+		return []string{""}
+	case dicom.Ints:
+		return []int{}
+	case dicom.Floats:
+		return []float64{}
+	case dicom.Sequences:
+		return [][]*dicom.Element{}
+	}
+	return []byte{}
+}
+
+// dummyValue is a value that fits the VR of the element but does not carry information
+func dummyValue(e *dicom.Element) any {
+	switch e.Value.ValueType() {
+	case dicom.Strings:
+		switch e.RawValueRepresentation {
+		case "DA":
+			return []string{"19000101"}
+		case "TM":
+			return []string{"000000"}
+		case "DT":
+			return []string{"19000101000000"}
+		case "IS", "DS":
+			return []string{"0"}
+		case "AS":
+			return []string{"000Y"}
+		case "UI":
+			return []string{newUID()}
+		}
+		return []string{"ANONYMOUS"}
+	case dicom.Ints:
+		return []int{0}
+	case dicom.Floats:
+		return []float64{0}
+	}
+	return zeroValue(e)
+}
+
+// encode de-identifies the dataset and returns the new DICOM file
+func (d *deidentifier) encode(dataset *dicom.Dataset) ([]byte, error) {
+	if err := d.apply(dataset); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := dicom.Write(&buf, *dataset, dicom.SkipVRVerification()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMapping stores the original and the replaced values of a trigger run in the project
+// (.ror/deidentify/<trigger folder>.csv), outside of the folders mounted into the container. New
+// pseudonyms are added to the AutoID records of the project.
+func (d *deidentifier) writeMapping(projectDir string, triggerDir string) (string, error) {
+	if d.pseudo != nil {
+		if err := d.pseudo.save(); err != nil {
+			return "", err
+		}
+	}
+	mappingDir := filepath.Join(projectDir, ".ror", deidentifyDir)
+	if err := os.MkdirAll(mappingDir, 0700); err != nil {
+		return "", err
+	}
+	file := filepath.Join(mappingDir, filepath.Base(triggerDir)+".csv")
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"type", "original", "replacement"})
+	w.WriteAll(d.mapping)
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return file, os.WriteFile(file, buf.Bytes(), 0600)
+}
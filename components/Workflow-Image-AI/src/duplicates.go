@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// policies for duplicated UIDs during import (config --duplicates)
+const (
+	duplicatesKeepFirst = "keep-first" // ignore the images of a second study or file (default)
+	duplicatesKeepAll   = "keep-all"   // keep all of them, a re-used SeriesInstanceUID is a distinct series in each study
+	duplicatesFail      = "fail"       // stop the import
+)
+
+var duplicatePolicies = []string{duplicatesKeepFirst, duplicatesKeepAll, duplicatesFail}
+
+// duplicateCheck finds SeriesInstanceUIDs that are used in more than one study and SOPInstanceUIDs
+// that appear in more than one file during an import. The problems are reported for each series
+// in SeriesInfo.Duplicates.
+type duplicateCheck struct {
+	policy  string
+	studyOf map[string]string   // SeriesInstanceUID -> StudyInstanceUID where we have seen it first
+	fileOf  map[string]string   // SOPInstanceUID -> file where we have seen it first
+	hashes  map[string]string   // file -> sha256 of the content
+	reports map[string][]string // StudyInstanceUID/SeriesInstanceUID -> problems
+}
+
+func newDuplicateCheck(policy string, datasets map[string]map[string]SeriesInfo) *duplicateCheck {
+	if policy == "" {
+		policy = duplicatesKeepFirst
+	}
+	d := &duplicateCheck{
+		policy:  policy,
+		studyOf: make(map[string]string),
+		fileOf:  make(map[string]string),
+		hashes:  make(map[string]string),
+		reports: make(map[string][]string),
+	}
+	// the series and images that are already in the data cache
+	studies := make([]string, 0, len(datasets))
+	for study := range datasets {
+		studies = append(studies, study)
+	}
+	sort.Strings(studies)
+	for _, study := range studies {
+		for key, series := range datasets[study] {
+			uid := series.seriesInstanceUID(key)
+			if _, ok := d.studyOf[uid]; !ok {
+				d.studyOf[uid] = study
+			}
+			for _, instance := range series.Instances {
+				if _, ok := d.fileOf[instance.SOPInstanceUID]; !ok && instance.Path != "" {
+					d.fileOf[instance.SOPInstanceUID] = instance.Path
+				}
+			}
+		}
+	}
+	return d
+}
+
+func (d *duplicateCheck) report(study string, series string, problem string) {
+	key := study + "/" + series
+	if !slices.Contains(d.reports[key], problem) {
+		d.reports[key] = append(d.reports[key], problem)
+	}
+}
+
+// hash returns the sha256 of a file, files that cannot be read have no hash
+func (d *duplicateCheck) hash(path string) string {
+	if h, ok := d.hashes[path]; ok {
+		return h
+	}
+	h := ""
+	if f, err := os.Open(path); err == nil {
+		sum := sha256.New()
+		if _, err := io.Copy(sum, f); err == nil {
+			h = fmt.Sprintf("%x", sum.Sum(nil))
+		}
+		f.Close()
+	}
+	d.hashes[path] = h
+	return h
+}
+
+// check returns true if the image should be added to the series. It returns an error if the
+// policy is fail and the image is a duplicate.
+func (d *duplicateCheck) check(study string, series string, sop string, path string) (bool, error) {
+	if first, ok := d.studyOf[series]; !ok {
+		d.studyOf[series] = study
+	} else if first != study {
+		switch d.policy {
+		case duplicatesFail:
+			return false, fmt.Errorf("SeriesInstanceUID %s is used in study %s and in study %s (%s)", series, first, study, path)
+		case duplicatesKeepAll:
+			d.report(first, series, fmt.Sprintf("SeriesInstanceUID also used in study %s", study))
+			d.report(study, series, fmt.Sprintf("SeriesInstanceUID also used in study %s", first))
+		default:
+			d.report(first, series, fmt.Sprintf("SeriesInstanceUID also used in study %s, those images are ignored", study))
+			return false, nil
+		}
+	}
+
+	if sop == "" {
+		return true, nil
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	first, ok := d.fileOf[sop]
+	if !ok {
+		d.fileOf[sop] = path
+		return true, nil
+	}
+	if first == path {
+		return false, nil // the same file listed twice
+	}
+	var problem string
+	if h := d.hash(path); h != "" && h == d.hash(first) {
+		problem = fmt.Sprintf("same images imported from %s and %s", filepath.Dir(first), filepath.Dir(path))
+	} else {
+		problem = fmt.Sprintf("SOPInstanceUID %s has different content in %s and %s", sop, first, path)
+	}
+	switch d.policy {
+	case duplicatesFail:
+		return false, fmt.Errorf("%s", problem)
+	case duplicatesKeepAll:
+		d.report(study, series, problem)
+		return true, nil
+	}
+	d.report(study, series, problem+", keep the first")
+	return false, nil
+}
+
+// apply stores the problems found with the series they belong to
+func (d *duplicateCheck) apply(datasets map[string]map[string]SeriesInfo) int {
+	count := 0
+	for key, problems := range d.reports {
+		study, uid, _ := strings.Cut(key, "/")
+		for seriesKey, series := range datasets[study] {
+			if series.seriesInstanceUID(seriesKey) != uid {
+				continue
+			}
+			for _, problem := range problems {
+				if !slices.Contains(series.Duplicates, problem) {
+					series.Duplicates = append(append([]string{}, series.Duplicates...), problem)
+					count++
+				}
+			}
+			datasets[study][seriesKey] = series
+		}
+	}
+	return count
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// bidsVersion is the version of the BIDS specification written into dataset_description.json
+const bidsVersion = "1.9.0"
+
+// bidsDatatypes maps the BIDS suffixes to the folder of the datatype
+var bidsDatatypes = map[string]string{
+	"T1w": "anat", "T2w": "anat", "PDw": "anat", "T2starw": "anat", "FLAIR": "anat", "inplaneT1": "anat",
+	"inplaneT2": "anat", "PDT2": "anat", "angio": "anat", "T1map": "anat", "T2map": "anat", "T2starmap": "anat",
+	"R1map": "anat", "R2map": "anat", "PDmap": "anat", "UNIT1": "anat", "MP2RAGE": "anat",
+	"bold": "func", "cbv": "func", "sbref": "func", "dwi": "dwi",
+	"phasediff": "fmap", "phase1": "fmap", "phase2": "fmap", "magnitude": "fmap", "magnitude1": "fmap",
+	"magnitude2": "fmap", "fieldmap": "fmap", "epi": "fmap",
+	"asl": "perf", "m0scan": "perf",
+}
+
+// bidsEntityOrder is the order of the entities in a BIDS file name
+var bidsEntityOrder = []string{"task", "acq", "ce", "rec", "dir", "run", "mod", "echo", "flip", "inv", "mt", "part"}
+
+var bidsNonAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// bidsLabel removes all characters that are not allowed in a BIDS label
+func bidsLabel(s string) string {
+	return bidsNonAlphanumeric.ReplaceAllString(s, "")
+}
+
+// bidsScan is a single series of the export
+type bidsScan struct {
+	series   SeriesInfo
+	sops     []string // only these images (select image), all images if empty
+	name     string   // name of the where-clause in the select statement
+	uid      string   // key of the series in the data cache
+	subject  string
+	study    string
+	session  string
+	datatype string
+	entities [][2]string
+	suffix   string
+}
+
+// fileName is the name of the scan without extension, e.g. sub-01_ses-01_task-rest_run-1_bold
+func (scan bidsScan) fileName() string {
+	parts := []string{"sub-" + scan.subject, "ses-" + scan.session}
+	for _, e := range scan.entities {
+		parts = append(parts, e[0]+"-"+e[1])
+	}
+	return strings.Join(append(parts, scan.suffix), "_")
+}
+
+// key identifies scans that need a run entity to be distinct
+func (scan bidsScan) key() string {
+	return scan.subject + "/" + scan.session + "/" + scan.datatype + "/" + strings.TrimPrefix(scan.fileName(), "sub-"+scan.subject+"_ses-"+scan.session)
+}
+
+// parseBIDSName splits the name of a where-clause like "task-rest_bold" into entities and the suffix
+func parseBIDSName(name string) ([][2]string, string, error) {
+	parts := strings.Split(name, "_")
+	suffix := bidsLabel(parts[len(parts)-1])
+	if suffix == "" {
+		return nil, "", fmt.Errorf("\"%s\" does not end with a BIDS suffix like T1w, bold or dwi", name)
+	}
+	entities := [][2]string{}
+	for _, part := range parts[:len(parts)-1] {
+		key, value, ok := strings.Cut(part, "-")
+		if !ok || bidsLabel(key) == "" || bidsLabel(value) == "" {
+			return nil, "", fmt.Errorf("\"%s\" in \"%s\" is not a BIDS entity like task-rest or acq-highres", part, name)
+		}
+		entities = append(entities, [2]string{bidsLabel(key), bidsLabel(value)})
+	}
+	return entities, suffix, nil
+}
+
+// sortEntities puts the entities of a file name into the order of the BIDS specification
+func sortEntities(entities [][2]string) {
+	rank := func(key string) int {
+		if idx := slices.Index(bidsEntityOrder, key); idx > -1 {
+			return idx
+		}
+		return len(bidsEntityOrder)
+	}
+	sort.SliceStable(entities, func(a, b int) bool {
+		return rank(entities[a][0]) < rank(entities[b][0])
+	})
+}
+
+// writeTSV writes a tab separated file with a header row
+func writeTSV(path string, header []string, rows [][]string) error {
+	lines := []string{strings.Join(header, "\t")}
+	for _, row := range rows {
+		lines = append(lines, strings.Join(row, "\t"))
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// bidsAge converts a DICOM age string (AS, "052Y", "018M", "003W" or "010D") into years, BIDS
+// expects a number in participants.tsv
+func bidsAge(as string) string {
+	as = strings.ToUpper(strings.TrimSpace(as))
+	if len(as) < 2 {
+		return "n/a"
+	}
+	n, err := strconv.Atoi(as[:len(as)-1])
+	if err != nil || n < 0 {
+		return "n/a"
+	}
+	days := map[byte]float64{'Y': 0, 'M': 365.25 / 12, 'W': 7, 'D': 1}
+	perUnit, ok := days[as[len(as)-1]]
+	if !ok {
+		return "n/a"
+	}
+	if perUnit == 0 {
+		return strconv.Itoa(n)
+	}
+	return strconv.FormatFloat(math.Round(float64(n)*perUnit/365.25*100)/100, 'f', -1, 64)
+}
+
+// bidsParticipantsJSON describes the columns of participants.tsv
+var bidsParticipantsJSON = map[string]interface{}{
+	"participant_id": map[string]string{"Description": "label of the subject, the pseudonym of the PatientID"},
+	"age":            map[string]string{"Description": "age of the subject at the time of the scan (PatientAge)", "Units": "year"},
+	"sex": map[string]interface{}{"Description": "sex of the subject (PatientSex)",
+		"Levels": map[string]string{"M": "male", "F": "female", "O": "other"}},
+}
+
+// orNA returns "n/a" for empty values in tsv files
+func orNA(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "n/a"
+	}
+	return strings.TrimSpace(s)
+}
+
+// exportBIDS converts the series matched by the select statement of the config into a BIDS dataset.
+// The names of the where-clauses are the BIDS suffixes (with optional entities like task-rest_bold),
+// patients become subjects and their studies become sessions in the order of the StudyDate.
+func exportBIDS(config Config, out string) error {
+	if config.SeriesFilterType != "select" {
+		return fmt.Errorf("export bids needs a select statement that names the series, e.g.\n\t%s config --select 'select patient from study where series named \"T1w\" has ClassifyType containing T1'", own_name)
+	}
+	ast, errs := Parse(config.SeriesFilter)
+	if len(errs) > 0 {
+		return fmt.Errorf("could not parse the select statement: %s", parseErrorsString(errs, " "))
+	}
+	matches, complains := findMatchingSets(ast, config.Data.DataInfo)
+	for _, c := range complains {
+		fmt.Println(c)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no series match the select statement")
+	}
+
+	// the series of all jobs, a series can be part of several jobs but is exported once
+	scans := []bidsScan{}
+	seen := make(map[string]bool)
+	for _, set := range matches {
+		for _, entry := range set {
+			key := entry.StudyInstanceUID + "/" + entry.SeriesInstanceUID
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			series, ok := config.Data.DataInfo[entry.StudyInstanceUID][entry.SeriesInstanceUID]
+			if !ok {
+				continue
+			}
+			if entry.Name == "" || entry.Name == "no-name" {
+				fmt.Printf("Warning: series %s has no name in the select statement, use 'series named \"T1w\" has ...' to export it\n", entry.SeriesInstanceUID)
+				continue
+			}
+			entities, suffix, err := parseBIDSName(entry.Name)
+			if err != nil {
+				return err
+			}
+			datatype, ok := bidsDatatypes[suffix]
+			if !ok {
+				fmt.Printf("Warning: \"%s\" is not a BIDS suffix, series %s is exported to anat\n", suffix, entry.SeriesInstanceUID)
+				datatype = "anat"
+			}
+			if datatype == "func" && !slices.ContainsFunc(entities, func(e [2]string) bool { return e[0] == "task" }) {
+				entities = append(entities, [2]string{"task", "rest"})
+			}
+			// the echoes of a series split by EchoNumbers (config --split-series)
+			if echo, ok := strings.CutPrefix(series.SubSeries, "EchoNumbers="); ok && bidsLabel(echo) != "" {
+				entities = append(entities, [2]string{"echo", bidsLabel(echo)})
+			}
+			scans = append(scans, bidsScan{
+				series:   series,
+				sops:     entry.SOPInstanceUIDs,
+				name:     entry.Name,
+				uid:      entry.SeriesInstanceUID,
+				study:    entry.StudyInstanceUID,
+				datatype: datatype,
+				entities: entities,
+				suffix:   suffix,
+			})
+		}
+	}
+	if len(scans) == 0 {
+		return fmt.Errorf("none of the matching series has a name in the select statement")
+	}
+
+	// with de-identification (config --deidentify) the images are de-identified before the conversion
+	// and the subjects are named after the pseudonyms of the patients
+	deid, err := projectDeidentifier(input_dir, config)
+	if err != nil {
+		return err
+	}
+
+	// subjects by PatientID, sessions by the date of the study
+	patients := []string{}
+	names := make(map[string]string)
+	for _, scan := range scans {
+		if id := scan.series.PatientID; !slices.Contains(patients, id) {
+			patients = append(patients, id)
+			names[id] = scan.series.PatientName
+		}
+	}
+	sort.Strings(patients)
+	// without de-identification the subjects are named after the AutoID pseudonyms of the project, the
+	// PatientID never becomes part of the BIDS dataset
+	var pseudo *pseudonymizer
+	if deid == nil {
+		if pseudo, err = projectPseudonymizer(input_dir, config.ProjectName); err != nil {
+			return err
+		}
+	}
+	subjects := make(map[string]string)
+	used := make(map[string]bool)
+	for i, id := range patients {
+		var label string
+		if deid != nil {
+			label = bidsLabel(deid.patient(id, names[id]))
+		} else if id != "" {
+			label = bidsLabel(pseudo.patientID(id))
+		} else {
+			label = bidsLabel(pseudo.patientID(names[id]))
+		}
+		if label == "" || used[label] {
+			label = fmt.Sprintf("%02d", i+1)
+		}
+		used[label] = true
+		subjects[id] = label
+	}
+	if pseudo != nil {
+		if err := pseudo.save(); err != nil {
+			return err
+		}
+	}
+	sessions := make(map[string]map[string]string) // PatientID -> StudyInstanceUID -> date for sorting
+	for _, scan := range scans {
+		id := scan.series.PatientID
+		if sessions[id] == nil {
+			sessions[id] = make(map[string]string)
+		}
+		sessions[id][scan.study] = tagValue(scan.series.All, tag.StudyDate) + tagValue(scan.series.All, tag.StudyTime)
+	}
+	for i := range scans {
+		id := scans[i].series.PatientID
+		studies := []string{}
+		for study := range sessions[id] {
+			studies = append(studies, study)
+		}
+		sort.Slice(studies, func(a, b int) bool {
+			if sessions[id][studies[a]] != sessions[id][studies[b]] {
+				return sessions[id][studies[a]] < sessions[id][studies[b]]
+			}
+			return studies[a] < studies[b]
+		})
+		scans[i].subject = subjects[id]
+		scans[i].session = fmt.Sprintf("%02d", slices.Index(studies, scans[i].study)+1)
+	}
+
+	// scans with the same name in a session get a run number in the order of the SeriesNumber
+	sort.SliceStable(scans, func(a, b int) bool {
+		if scans[a].key() != scans[b].key() {
+			return scans[a].key() < scans[b].key()
+		}
+		return scans[a].series.SeriesNumber < scans[b].series.SeriesNumber
+	})
+	runs := make(map[string]int)
+	for _, scan := range scans {
+		runs[scan.key()]++
+	}
+	run := make(map[string]int)
+	for i := range scans {
+		key := scans[i].key()
+		if runs[key] > 1 {
+			run[key]++
+			scans[i].entities = append(scans[i].entities, [2]string{"run", fmt.Sprintf("%d", run[key])})
+		}
+		sortEntities(scans[i].entities)
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	description := map[string]interface{}{
+		"Name":        config.ProjectName,
+		"BIDSVersion": bidsVersion,
+		"DatasetType": "raw",
+		"GeneratedBy": []map[string]string{{
+			"Name":        "ror",
+			"Version":     version,
+			"Description": config.SeriesFilter,
+		}},
+	}
+	if config.ProjectName == "" {
+		description["Name"] = "ror export"
+	}
+	content, _ := json.MarshalIndent(description, "", "  ")
+	if err := os.WriteFile(filepath.Join(out, "dataset_description.json"), content, 0644); err != nil {
+		return err
+	}
+
+	scansTSV := make(map[string][][]string) // session folder -> rows of scans.tsv
+	participants := make(map[string][]string)
+	failed := 0
+	for _, scan := range scans {
+		sessionDir := filepath.Join(out, "sub-"+scan.subject, "ses-"+scan.session)
+		dir := filepath.Join(sessionDir, scan.datatype)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		files := []string{}
+		for _, instance := range scan.series.Instances {
+			if len(scan.sops) == 0 || slices.Contains(scan.sops, instance.SOPInstanceUID) {
+				files = append(files, instance.Path)
+			}
+		}
+		if len(files) == 0 {
+			fmt.Printf("Warning: no images known for series %s (%s), import the data again with '%s config --data'\n", scan.uid, scan.name, own_name)
+			failed++
+			continue
+		}
+		var nifti niftiSeries
+		var err error
+		for _, path := range files {
+			var dataset dicom.Dataset
+			if dataset, err = dicom.ParseFile(path, nil); err != nil {
+				err = fmt.Errorf("%s: %s", path, err.Error())
+				break
+			}
+			if deid != nil {
+				if err = deid.apply(&dataset); err != nil {
+					err = fmt.Errorf("%s: %s", path, err.Error())
+					break
+				}
+			}
+			if err = nifti.add(dataset); err != nil {
+				err = fmt.Errorf("%s: %s", path, err.Error())
+				break
+			}
+		}
+		if err == nil {
+			for _, e := range scan.entities {
+				if e[0] == "task" {
+					nifti.sidecar["TaskName"] = e[1]
+				}
+			}
+			_, err = nifti.write(filepath.Join(dir, scan.fileName()))
+		}
+		if err != nil {
+			fmt.Printf("Warning: could not convert %s (%s): %s\n", scan.series.SeriesDescription, scan.name, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("%s/%s.nii.gz (%d images)\n", strings.TrimPrefix(dir, filepath.Clean(out)+string(filepath.Separator)), scan.fileName(), len(files))
+		scansTSV[sessionDir] = append(scansTSV[sessionDir], []string{scan.datatype + "/" + scan.fileName() + ".nii.gz", orNA(nifti.acquisition)})
+		if _, ok := participants[scan.subject]; !ok {
+			participants[scan.subject] = []string{"sub-" + scan.subject, "n/a", "n/a"}
+			if deid == nil || deid.profile.RetainPatientCharacteristics {
+				participants[scan.subject] = []string{"sub-" + scan.subject, bidsAge(tagValue(scan.series.All, tag.PatientAge)), orNA(tagValue(scan.series.All, tag.PatientSex))}
+			}
+		}
+	}
+
+	for sessionDir, rows := range scansTSV {
+		name := filepath.Base(filepath.Dir(sessionDir)) + "_" + filepath.Base(sessionDir) + "_scans.tsv"
+		if err := writeTSV(filepath.Join(sessionDir, name), []string{"filename", "acq_time"}, rows); err != nil {
+			return err
+		}
+	}
+	rows := [][]string{}
+	for _, row := range participants {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(a, b int) bool { return rows[a][0] < rows[b][0] })
+	if err := writeTSV(filepath.Join(out, "participants.tsv"), []string{"participant_id", "age", "sex"}, rows); err != nil {
+		return err
+	}
+	content, _ = json.MarshalIndent(bidsParticipantsJSON, "", "  ")
+	if err := os.WriteFile(filepath.Join(out, "participants.json"), content, 0644); err != nil {
+		return err
+	}
+	if deid != nil {
+		// the mapping stays in the project, like for trigger
+		abs, _ := filepath.Abs(out)
+		mappingFile, err := deid.writeMapping(input_dir, "bids_"+filepath.Base(abs))
+		if err != nil {
+			return fmt.Errorf("could not write the de-identification mapping: %s", err.Error())
+		}
+		fmt.Printf("De-identified with profile %s, mapping in %s\n", deid.profile, mappingFile)
+	}
+	fmt.Printf("Exported %d series of %d subjects to %s\n", len(scans)-failed, len(participants), out)
+	if failed > 0 {
+		return fmt.Errorf("%d series could not be exported", failed)
+	}
+	return nil
+}
@@ -0,0 +1,900 @@
+package main
+
+// A language server (LSP) for select statements. Editors start it with 'ror lsp' and
+// talk to it over stdin/stdout (JSON-RPC with Content-Length headers). It reports parse
+// errors with their position, completes keywords, tag names, ClassifyTypes and the names
+// of where-clauses, and shows for each where-clause how many series of the project match.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+type lspRequest struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"` // 1 error, 2 warning, 3 information
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label      string `json:"label"`
+	Kind       int    `json:"kind"` // 5 field, 6 variable, 12 value, 14 keyword
+	Detail     string `json:"detail,omitempty"`
+	InsertText string `json:"insertText,omitempty"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspServer struct {
+	reader    *bufio.Reader
+	writer    io.Writer
+	documents map[string]string // uri -> text
+	rootDir   string            // project directory used if a document is not inside a project
+}
+
+// selectFields are the names a select statement can use that are not DICOM keywords
+var selectFields = map[string]string{
+	"ClassifyType":          "list of the classification results for the series",
+	"ClassifyTypes":         "list of the classification results for the series",
+	"SeriesDescription":     "DICOM SeriesDescription",
+	"NumImages":             "number of images of the series",
+	"NumSlices":             "number of images of the series",
+	"SeriesNumber":          "DICOM SeriesNumber",
+	"SequenceName":          "DICOM SequenceName",
+	"Modality":              "DICOM Modality",
+	"StudyDescription":      "DICOM StudyDescription",
+	"Manufacturer":          "DICOM Manufacturer",
+	"ManufacturerModelName": "DICOM ManufacturerModelName",
+	"Path":                  "directory of the series",
+	"PatientID":             "DICOM PatientID",
+	"PatientName":           "DICOM PatientName",
+	"SubSeries":             "values that define a sub-series (config --split-series), e.g. EchoNumbers=2",
+	"QCStatus":              "complete, incomplete or unknown, result of the checks for missing or inconsistent images",
+	"QCIssues":              "list of problems found by the checks, e.g. missing InstanceNumber 5-7",
+}
+
+func init() {
+	// computed geometry fields of a series, see series_geometry.go
+	for name, description := range geometryFields {
+		selectFields[name] = description
+	}
+}
+
+var selectKeywords = []string{"SELECT", "FROM", "WHERE", "HAS", "AND", "OR", "NOT", "ALSO", "NAMED", "CHECK", "HAVING", "DECLARE",
+	"containing", "regexp", "approx", "everything", "count", "span", "project", "patient", "study", "series", "image"}
+
+// startLSP runs the language server until the editor sends exit
+func startLSP(dir string) {
+	yyErrorVerbose = true // tell the editor which tokens are expected
+	s := lspServer{
+		reader:    bufio.NewReader(os.Stdin),
+		writer:    os.Stdout,
+		documents: make(map[string]string),
+		rootDir:   dir,
+	}
+	for {
+		msg, err := s.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "ror lsp: %s\n", err.Error())
+			return
+		}
+		if s.handle(msg) {
+			return
+		}
+	}
+}
+
+func (s *lspServer) readMessage() (lspRequest, error) {
+	var msg lspRequest
+	length := -1
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return msg, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return msg, fmt.Errorf("bad Content-Length header: %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return msg, fmt.Errorf("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return msg, err
+	}
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+func (s *lspServer) send(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// handle answers a single message, returns true if the server should stop
+func (s *lspServer) handle(msg lspRequest) bool {
+	reply := func(result interface{}) {
+		if msg.ID != nil {
+			s.send(lspResponse{JSONRPC: "2.0", ID: msg.ID, Result: result})
+		}
+	}
+	switch msg.Method {
+	case "initialize":
+		var params struct {
+			RootURI  string `json:"rootUri"`
+			RootPath string `json:"rootPath"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if root := lspURIToPath(params.RootURI); root != "" {
+			if _, err := os.Stat(filepath.Join(root, ".ror", "config")); err == nil {
+				s.rootDir = root
+			}
+		} else if params.RootPath != "" {
+			if _, err := os.Stat(filepath.Join(params.RootPath, ".ror", "config")); err == nil {
+				s.rootDir = params.RootPath
+			}
+		}
+		reply(map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // always the full text
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"@", "\"", "("}},
+				"hoverProvider":      true,
+			},
+			"serverInfo": map[string]string{"name": "ror", "version": version},
+		})
+	case "shutdown":
+		reply(nil)
+	case "exit":
+		return true
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil {
+			s.documents[params.TextDocument.URI] = params.TextDocument.Text
+			s.publishDiagnostics(params.TextDocument.URI)
+		}
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil && len(params.ContentChanges) > 0 {
+			s.documents[params.TextDocument.URI] = params.ContentChanges[len(params.ContentChanges)-1].Text
+			s.publishDiagnostics(params.TextDocument.URI)
+		}
+	case "textDocument/didSave":
+		var params lspTextDocumentPosition
+		if json.Unmarshal(msg.Params, &params) == nil {
+			s.publishDiagnostics(params.TextDocument.URI)
+		}
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(s.documents, params.TextDocument.URI)
+			s.send(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics",
+				Params: map[string]interface{}{"uri": params.TextDocument.URI, "diagnostics": []lspDiagnostic{}}})
+		}
+	case "textDocument/completion":
+		var params lspTextDocumentPosition
+		if json.Unmarshal(msg.Params, &params) != nil {
+			reply(nil)
+			break
+		}
+		reply(map[string]interface{}{"isIncomplete": false, "items": s.completion(params.TextDocument.URI, params.Position)})
+	case "textDocument/hover":
+		var params lspTextDocumentPosition
+		if json.Unmarshal(msg.Params, &params) != nil {
+			reply(nil)
+			break
+		}
+		text := s.hover(params.TextDocument.URI, params.Position)
+		if text == "" {
+			reply(nil)
+		} else {
+			reply(map[string]interface{}{"contents": map[string]string{"kind": "markdown", "value": text}})
+		}
+	default:
+		if msg.ID != nil && !strings.HasPrefix(msg.Method, "$/") {
+			s.send(lspResponse{JSONRPC: "2.0", ID: msg.ID, Error: &lspError{Code: -32601, Message: "method not supported: " + msg.Method}})
+		}
+	}
+	return false
+}
+
+func lspURIToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return u.Path
+}
+
+// projectConfig reads the config of the project the document belongs to (the first parent
+// directory with a .ror folder), or of the directory the server was started in
+func (s *lspServer) projectConfig(uri string) (Config, bool) {
+	dir := s.rootDir
+	if p := lspURIToPath(uri); p != "" {
+		for d := filepath.Dir(p); ; d = filepath.Dir(d) {
+			if _, err := os.Stat(filepath.Join(d, ".ror", "config")); err == nil {
+				dir = d
+				break
+			}
+			if filepath.Dir(d) == d {
+				break
+			}
+		}
+	}
+	config, err := readConfig(filepath.Join(dir, ".ror", "config"))
+	if err != nil {
+		return Config{}, false
+	}
+	input_dir = dir // the private dictionary is read from the project
+	return config, true
+}
+
+// lspDocument is a select statement found in a document. The document can be the statement
+// itself or the json select.statement file of a project with the statement in "select".
+type lspDocument struct {
+	text      string // the document
+	statement string // the select statement
+	offsets   []int  // offset in the document for each byte of the statement (and the end)
+	masked    string // the statement with comments and declarations replaced by spaces and parameters by values
+	ast       AST
+	parsed    bool
+	errors    []ParseError
+	paramErr  error
+	regexErrs []lspRegexpError // regular expressions of the rules that do not compile
+}
+
+// lspRegexpError is the value of a regexp rule that is not a valid regular expression
+type lspRegexpError struct {
+	pattern string
+	err     error
+}
+
+var lspJSONSelect = regexp.MustCompile(`"select"\s*:\s*"`)
+
+func newLSPDocument(text string) lspDocument {
+	doc := lspDocument{text: text}
+	doc.statement = text
+	doc.offsets = make([]int, len(text)+1)
+	for i := range doc.offsets {
+		doc.offsets[i] = i
+	}
+	// a json file, the statement is the (escaped) string in "select"
+	if loc := lspJSONSelect.FindStringIndex(text); loc != nil && strings.HasPrefix(strings.TrimSpace(text), "{") {
+		var b strings.Builder
+		offsets := []int{}
+		i := loc[1]
+		for i < len(text) && text[i] != '"' {
+			if text[i] == '\\' && i+1 < len(text) {
+				start := i
+				var r rune = -1
+				switch text[i+1] {
+				case 'n':
+					r = '\n'
+				case 't':
+					r = '\t'
+				case 'r':
+					r = '\r'
+				case 'b':
+					r = '\b'
+				case 'f':
+					r = '\f'
+				case 'u':
+					if i+6 <= len(text) {
+						if v, err := strconv.ParseUint(text[i+2:i+6], 16, 32); err == nil {
+							r = rune(v)
+							i += 4
+						}
+					}
+				default:
+					r = rune(text[i+1])
+				}
+				i += 2
+				if r == -1 {
+					continue
+				}
+				for k := 0; k < utf8.RuneLen(r); k++ {
+					offsets = append(offsets, start)
+				}
+				b.WriteRune(r)
+				continue
+			}
+			offsets = append(offsets, i)
+			b.WriteByte(text[i])
+			i++
+		}
+		doc.statement = b.String()
+		doc.offsets = append(offsets, i)
+	}
+
+	// comments and declarations are replaced by spaces, parameters by values of the same length
+	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
+	masked := []byte(comments.ReplaceAllStringFunc(doc.statement, func(c string) string { return strings.Repeat(" ", len(c)) }))
+	declared := make(map[string]string)
+	values := make(map[string]string)
+	for _, loc := range selectParameterDeclaration.FindAllSubmatchIndex(masked, -1) {
+		name := string(masked[loc[2]:loc[3]])
+		declared[name] = strings.ToLower(string(masked[loc[4]:loc[5]]))
+		if declared[name] == "number" {
+			values[name] = "1"
+		} else {
+			values[name] = "x"
+		}
+		for k := loc[0]; k < loc[1]; k++ {
+			masked[k] = ' '
+		}
+	}
+	_, doc.paramErr = bindSelectParameters(doc.statement, values)
+	var quote byte
+	for i := 0; i < len(masked); i++ {
+		c := masked[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' {
+			quote = c
+			continue
+		}
+		if c != '$' {
+			continue
+		}
+		m := selectParameterUse.Find(masked[i:])
+		if m == nil {
+			continue
+		}
+		name := string(m[1:])
+		value := "1"
+		if declared[name] == "string" {
+			value = "\"\""
+		}
+		if len(value) > len(m) {
+			value = value[:len(m)]
+		}
+		copy(masked[i:], value+strings.Repeat(" ", len(m)-len(value)))
+		i += len(m) - 1
+	}
+	doc.masked = string(masked)
+
+	doc.ast, doc.errors = Parse(doc.masked)
+	doc.parsed = len(doc.errors) == 0
+	if doc.parsed {
+		// half-typed regular expressions are reported, they cannot be used to count matching series
+		rules := []Rule{}
+		for _, r := range doc.ast.RulesTree {
+			rules = append(rules, leafRules(&r.Rs)...)
+		}
+		for _, h := range doc.ast.HavingRules {
+			rules = append(rules, leafRules(h.Rs)...)
+		}
+		for _, r := range rules {
+			if r.Operator != "regexp" {
+				continue
+			}
+			pattern := fmt.Sprintf("%v", r.Value)
+			if _, err := regexp.Compile(pattern); err != nil {
+				doc.regexErrs = append(doc.regexErrs, lspRegexpError{pattern: pattern, err: err})
+			}
+		}
+	}
+	return doc
+}
+
+// position converts an offset in the statement into a line and character (UTF-16) of the document
+func (doc lspDocument) position(offset int) lspPosition {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(doc.offsets) {
+		offset = len(doc.offsets) - 1
+	}
+	o := doc.offsets[offset]
+	line, character := 0, 0
+	for i, r := range doc.text {
+		if i >= o {
+			break
+		}
+		if r == '\n' {
+			line++
+			character = 0
+		} else {
+			character += len(utf16.Encode([]rune{r}))
+		}
+	}
+	return lspPosition{Line: line, Character: character}
+}
+
+// offset converts a line and character of the document into an offset in the statement, -1 if outside
+func (doc lspDocument) offset(p lspPosition) int {
+	line, character := 0, 0
+	o := len(doc.text)
+	for i, r := range doc.text {
+		if line == p.Line && character >= p.Character {
+			o = i
+			break
+		}
+		if r == '\n' {
+			if line == p.Line {
+				o = i
+				break
+			}
+			line++
+			character = 0
+		} else {
+			character += len(utf16.Encode([]rune{r}))
+		}
+	}
+	for i, d := range doc.offsets {
+		if d >= o {
+			return i
+		}
+	}
+	return -1
+}
+
+// wordRange returns the word (tag name, keyword, value) at an offset of the statement
+func (doc lspDocument) wordRange(offset int) (int, int) {
+	isWord := func(c byte) bool {
+		return c == '_' || c == '.' || c == '[' || c == ']' || c == '$' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+	}
+	start, end := offset, offset
+	for start > 0 && start-1 < len(doc.statement) && isWord(doc.statement[start-1]) {
+		start--
+	}
+	for end < len(doc.statement) && isWord(doc.statement[end]) {
+		end++
+	}
+	return start, end
+}
+
+func (doc lspDocument) rangeOf(start int, end int) lspRange {
+	if end <= start {
+		end = start + 1
+	}
+	return lspRange{Start: doc.position(start), End: doc.position(end)}
+}
+
+// findWord returns the offset of the first occurrence of a word outside of comments, -1 if not found
+func (doc lspDocument) findWord(word string) int {
+	re, err := regexp.Compile(`(^|[^A-Za-z0-9_$])` + regexp.QuoteMeta(word) + `($|[^A-Za-z0-9_])`)
+	if err != nil {
+		return -1
+	}
+	if loc := re.FindStringIndex(doc.masked); loc != nil {
+		return loc[0] + strings.Index(doc.masked[loc[0]:loc[1]], word)
+	}
+	return -1
+}
+
+// leafRules returns all rules of a rule tree
+func leafRules(n *RuleSetL) []Rule {
+	if n == nil {
+		return nil
+	}
+	rules := []Rule{}
+	if n.Leaf1 != nil {
+		rules = append(rules, *n.Leaf1)
+	}
+	if n.Leaf2 != nil {
+		rules = append(rules, *n.Leaf2)
+	}
+	rules = append(rules, leafRules(n.Rs1)...)
+	return append(rules, leafRules(n.Rs2)...)
+}
+
+// clauseAt returns the index of the where-clause at an offset of the statement, -1 if none
+func (doc lspDocument) clauseAt(offset int) int {
+	_, wherePos, checkPos, havingPos := selectSlots(doc.masked)
+	for i := len(wherePos) - 1; i >= 0; i-- {
+		if offset < wherePos[i] {
+			continue
+		}
+		if (checkPos > wherePos[i] && offset >= checkPos) || (havingPos > wherePos[i] && offset >= havingPos) {
+			return -1
+		}
+		if i < len(doc.ast.RulesTree) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *lspServer) publishDiagnostics(uri string) {
+	text, ok := s.documents[uri]
+	if !ok {
+		return
+	}
+	doc := newLSPDocument(text)
+	diagnostics := []lspDiagnostic{}
+	if doc.paramErr != nil {
+		for _, problem := range strings.Split(doc.paramErr.Error(), "\n") {
+			pos := 0
+			if m := regexp.MustCompile(`\$[A-Za-z_][A-Za-z0-9_]*`).FindString(problem); m != "" {
+				if p := strings.Index(doc.statement, m); p > -1 {
+					pos = p
+				}
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(doc.wordRange(pos)), Severity: 1, Source: "ror", Message: problem})
+		}
+	}
+	if !doc.parsed {
+		for _, e := range doc.errors {
+			start, end := doc.wordRange(e.Pos)
+			if start == end && e.Pos < len(doc.statement) {
+				end = e.Pos + 1
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(start, end), Severity: 1, Source: "ror", Message: e.Message})
+		}
+	} else {
+		// tags that are neither fields, DICOM keywords, private tags or tag paths
+		rules := []Rule{}
+		for _, r := range doc.ast.RulesTree {
+			rules = append(rules, leafRules(&r.Rs)...)
+		}
+		for _, h := range doc.ast.HavingRules {
+			rules = append(rules, leafRules(h.Rs)...)
+			if h.Function == "span" {
+				rules = append(rules, Rule{Tag: h.Tag})
+			}
+		}
+		reported := make(map[string]bool)
+		for _, r := range rules {
+			if len(r.Tag) != 1 || reported[r.Tag[0]] {
+				continue
+			}
+			name, _ := splitTagIndex(r.Tag[0])
+			if looksLikeTagPath(name) {
+				if _, _, err := parseTagPath(name); err != nil {
+					reported[r.Tag[0]] = true
+					pos := doc.findWord(name)
+					if pos < 0 {
+						pos = 0
+					}
+					diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(pos, pos+len(name)), Severity: 2, Source: "ror", Message: err.Error()})
+				}
+				continue
+			}
+			if _, ok := selectFields[name]; ok || isKnownTagName(name) {
+				continue
+			}
+			reported[r.Tag[0]] = true
+			pos := doc.findWord(name)
+			if pos < 0 {
+				pos = 0
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(pos, pos+len(name)), Severity: 2, Source: "ror",
+				Message: fmt.Sprintf("unknown tag name %s, not a DICOM keyword, a name from the private dictionary or one of %s", name, strings.Join(sortedKeys(selectFields), ", "))})
+		}
+		for _, e := range doc.regexErrs {
+			pos := strings.Index(doc.masked, e.pattern)
+			if pos < 0 {
+				pos = 0
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(pos, pos+len(e.pattern)), Severity: 1, Source: "ror",
+				Message: fmt.Sprintf("invalid regular expression \"%s\": %s", e.pattern, e.err.Error())})
+		}
+		// names used in CHECK and HAVING need a where-clause with that name
+		names := make(map[string]bool)
+		for _, r := range doc.ast.RulesTree {
+			names[r.Name] = true
+		}
+		used := []string{}
+		for _, h := range doc.ast.HavingRules {
+			if h.Name != "" {
+				used = append(used, h.Name)
+			}
+		}
+		for _, rs := range doc.ast.CheckRules {
+			for _, r := range rs.Rs {
+				if len(r.Tag) > 0 {
+					used = append(used, r.Tag[0])
+				}
+				if len(r.Tag2) > 0 {
+					used = append(used, r.Tag2[0])
+				}
+			}
+		}
+		for _, name := range used {
+			if names[name] || reported[name] {
+				continue
+			}
+			reported[name] = true
+			pos := doc.findWord(name)
+			if pos < 0 {
+				pos = 0
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(pos, pos+len(name)), Severity: 2, Source: "ror",
+				Message: fmt.Sprintf("there is no where-clause NAMED \"%s\"", name)})
+		}
+		// where-clauses that do not match anything in the project data
+		if config, ok := s.projectConfig(uri); ok && len(config.Data.DataInfo) > 0 && len(doc.regexErrs) == 0 {
+			_, wherePos, _, _ := selectSlots(doc.masked)
+			for idx := range doc.ast.RulesTree {
+				matches, _ := clauseMatchCount(doc.ast, idx, config.Data.DataInfo)
+				if matches > 0 || idx >= len(wherePos) {
+					continue
+				}
+				diagnostics = append(diagnostics, lspDiagnostic{Range: doc.rangeOf(wherePos[idx], wherePos[idx]+len("where")), Severity: 3, Source: "ror",
+					Message: "no series of the project data matches this where-clause, see 'ror status --explain'"})
+			}
+		}
+	}
+	s.send(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics",
+		Params: map[string]interface{}{"uri": uri, "diagnostics": diagnostics}})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clauseMatchCount returns the number of series and studies that match a where-clause
+func clauseMatchCount(ast AST, idx int, dataInfo map[string]map[string]SeriesInfo) (int, int) {
+	numSeries, numStudies := 0, 0
+	for _, study := range dataInfo {
+		found := false
+		for _, series := range study {
+			if ok, _, _ := series.evalClause(ast, idx); ok {
+				numSeries++
+				found = true
+			}
+		}
+		if found {
+			numStudies++
+		}
+	}
+	return numSeries, numStudies
+}
+
+func (s *lspServer) completion(uri string, p lspPosition) []lspCompletionItem {
+	items := []lspCompletionItem{}
+	text, ok := s.documents[uri]
+	if !ok {
+		return items
+	}
+	doc := newLSPDocument(text)
+	offset := doc.offset(p)
+	if offset < 0 {
+		return items
+	}
+	start, _ := doc.wordRange(offset)
+	prefix := strings.ToLower(strings.Trim(doc.statement[start:offset], "\""))
+	// the two words in front of the cursor
+	before := strings.Fields(strings.NewReplacer("(", " ", ")", " ", "@", " @ ").Replace(doc.masked[:start]))
+	prev, prev2 := "", ""
+	if len(before) > 0 {
+		prev = strings.ToLower(before[len(before)-1])
+	}
+	if len(before) > 1 {
+		prev2 = before[len(before)-2]
+	}
+	add := func(label string, kind int, detail string, insert string) {
+		if prefix != "" && !strings.HasPrefix(strings.ToLower(label), prefix) {
+			return
+		}
+		items = append(items, lspCompletionItem{Label: label, Kind: kind, Detail: detail, InsertText: insert})
+	}
+	config, hasConfig := s.projectConfig(uri)
+
+	// the value of ClassifyType containing <value>
+	if (prev == "containing" || prev == "contains" || prev == "=" || prev == "==") && (prev2 == "ClassifyType" || prev2 == "ClassifyTypes") {
+		types := make(map[string]bool)
+		if hasConfig {
+			for _, study := range config.Data.DataInfo {
+				for _, series := range study {
+					for _, t := range series.ClassifyTypes {
+						types[t] = true
+					}
+				}
+			}
+		}
+		list := []string{}
+		for t := range types {
+			list = append(list, t)
+		}
+		sort.Strings(list)
+		for _, t := range list {
+			add(t, 12, "ClassifyType", formatSelectValue(t))
+		}
+		return items
+	}
+	// names of the where-clauses in CHECK and HAVING
+	_, _, checkPos, havingPos := selectSlots(doc.masked)
+	if (checkPos > -1 && start > checkPos) || (havingPos > -1 && start > havingPos) || prev == "named" {
+		names := []string{}
+		for _, r := range doc.ast.RulesTree {
+			if r.Name != "" && r.Name != "no-name" {
+				names = append(names, r.Name)
+			}
+		}
+		if !doc.parsed {
+			// use the names as written, the statement does not parse yet
+			for _, m := range regexp.MustCompile(`(?i)named\s+"([^"]*)"`).FindAllStringSubmatch(doc.masked, -1) {
+				names = append(names, m[1])
+			}
+		}
+		for _, name := range names {
+			add(name, 12, "where-clause", formatSelectValue(name))
+		}
+		if prev == "named" {
+			return items
+		}
+	}
+	for _, k := range selectKeywords {
+		add(k, 14, "keyword", "")
+	}
+	for _, k := range sortedKeys(selectFields) {
+		add(k, 5, selectFields[k], "")
+	}
+	// DICOM keywords of the tags in the project data and of the per image tags
+	keywords := make(map[string]string)
+	for _, t := range instanceTags {
+		if info, err := tag.Find(t); err == nil {
+			keywords[info.Keyword] = fmt.Sprintf("(%04x,%04x) %s", t.Group, t.Element, strings.Join(info.VRs, "/"))
+		}
+	}
+	if hasConfig {
+		for _, study := range config.Data.DataInfo {
+			for _, series := range study {
+				for _, tv := range series.All {
+					if info, err := tag.Find(tv.Tag); err == nil {
+						keywords[info.Keyword] = fmt.Sprintf("(%04x,%04x) %s", tv.Tag.Group, tv.Tag.Element, strings.Join(info.VRs, "/"))
+					}
+				}
+			}
+		}
+	}
+	for _, p := range privateDictionary() {
+		keywords[p.Name] = fmt.Sprintf("private tag of %s (%s,xx%s) %s", p.Creator, p.Group, p.Element, p.VR)
+	}
+	for _, k := range sortedKeys(keywords) {
+		if _, ok := selectFields[k]; ok {
+			continue
+		}
+		add(k, 6, keywords[k], "")
+	}
+	return items
+}
+
+func (s *lspServer) hover(uri string, p lspPosition) string {
+	text, ok := s.documents[uri]
+	if !ok {
+		return ""
+	}
+	doc := newLSPDocument(text)
+	offset := doc.offset(p)
+	if offset < 0 {
+		return ""
+	}
+	lines := []string{}
+	start, end := doc.wordRange(offset)
+	if start < end {
+		word, _ := splitTagIndex(doc.statement[start:end])
+		if desc, ok := selectFields[word]; ok {
+			lines = append(lines, fmt.Sprintf("**%s**: %s", word, desc))
+		} else if info, err := tag.FindByName(word); err == nil {
+			lines = append(lines, fmt.Sprintf("**%s** (%04x,%04x) %s, VR %s", info.Keyword, info.Tag.Group, info.Tag.Element, info.Name, strings.Join(info.VRs, "/")))
+		} else if pt, ok := findPrivateTagByName(word); ok {
+			lines = append(lines, fmt.Sprintf("**%s** private tag of %s (%s,xx%s), VR %s", pt.Name, pt.Creator, pt.Group, pt.Element, pt.VR))
+		}
+	}
+	if !doc.parsed {
+		if len(lines) == 0 {
+			return ""
+		}
+		return strings.Join(lines, "\n\n")
+	}
+	config, hasConfig := s.projectConfig(uri)
+	if idx := doc.clauseAt(offset); idx > -1 {
+		name := doc.ast.RulesTree[idx].Name
+		if name == "" {
+			name = "no-name"
+		}
+		level := "series"
+		if doc.ast.isImageLevel(idx) {
+			level = "image"
+		}
+		clause := fmt.Sprintf("where-clause **%s** (%s level)", name, level)
+		if hasConfig && len(config.Data.DataInfo) > 0 {
+			numSeries, numStudies := clauseMatchCount(doc.ast, idx, config.Data.DataInfo)
+			clause = fmt.Sprintf("%s matches %d series in %d of %d studies", clause, numSeries, numStudies, len(config.Data.DataInfo))
+		}
+		lines = append(lines, clause)
+	}
+	if hasConfig && len(config.Data.DataInfo) > 0 {
+		explanation := explainMatchingSets(doc.ast, config.Data.DataInfo, "")
+		summary := fmt.Sprintf("Select %s results in %d jobs", doc.ast.Output_level, explanation.NumJobs)
+		for _, c := range explanation.Complains {
+			summary = fmt.Sprintf("%s\n\n%s", summary, c)
+		}
+		lines = append(lines, summary)
+	} else if !hasConfig {
+		lines = append(lines, "no ror project found, match counts need the data of a project (ror config --data)")
+	}
+	return strings.Join(lines, "\n\n")
+}
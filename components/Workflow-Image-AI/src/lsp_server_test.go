@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lspTestProject creates a project with a single series in the data cache
+func lspTestProject(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".ror"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{ProjectName: "lsp"}
+	config.Data.DataInfo = map[string]map[string]SeriesInfo{
+		"1.2.3": {"1.2.3.4": SeriesInfo{SeriesDescription: "T1 MPRAGE", Modality: "MR", NumImages: 176, PatientID: "P1", PatientName: "P1"}},
+	}
+	if !config.writeConfigTo(filepath.Join(dir, ".ror", "config")) {
+		t.Fatal("could not write the config")
+	}
+	return dir
+}
+
+// lspTestRequest sends a message to the server, the params are json
+func lspTestRequest(t *testing.T, s *lspServer, id int, method string, params string) {
+	msg := lspRequest{JSONRPC: "2.0", Method: method, Params: json.RawMessage(params)}
+	if id > 0 {
+		raw := json.RawMessage(fmt.Sprintf("%d", id))
+		msg.ID = &raw
+	}
+	if s.handle(msg) {
+		t.Fatalf("%s stopped the server", method)
+	}
+}
+
+// an invalid regular expression (the user is still typing) is a diagnostic and does not stop the server
+func TestLSPInvalidRegexp(t *testing.T) {
+	dir := lspTestProject(t)
+	var out bytes.Buffer
+	s := &lspServer{reader: bufio.NewReader(strings.NewReader("")), writer: &out, documents: make(map[string]string), rootDir: dir}
+	uri := "file://" + filepath.Join(dir, "stmt.sel")
+	statement := `select series from study where series named \"T1\" has SeriesDescription regexp \"((\"`
+
+	lspTestRequest(t, s, 0, "textDocument/didOpen", `{"textDocument":{"uri":"`+uri+`","text":"`+statement+`"}}`)
+	if !strings.Contains(out.String(), `invalid regular expression \"((\"`) {
+		t.Errorf("expected a diagnostic for the regular expression, got %s", out.String())
+	}
+
+	out.Reset()
+	lspTestRequest(t, s, 1, "textDocument/hover", `{"textDocument":{"uri":"`+uri+`"},"position":{"line":0,"character":40}}`)
+	if !strings.Contains(out.String(), `"id":1`) {
+		t.Errorf("expected an answer for hover, got %s", out.String())
+	}
+
+	// the rule does not match, the reason names the expression
+	ok, reason := SeriesInfo{SeriesDescription: "T1"}.evalLeaf(Rule{Tag: []string{"SeriesDescription"}, Operator: "regexp", Value: "(("})
+	if ok || !strings.Contains(reason, "Invalid regular expression") {
+		t.Errorf("expected a failure for an invalid regular expression, got %v %q", ok, reason)
+	}
+}
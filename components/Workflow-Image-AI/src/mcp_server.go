@@ -308,9 +308,18 @@ func startMCP(useHttp string, rootFolder string) {
 
 	//mcp.AddTool(server, &mcp.Tool{Name: "change/root", Description: "Change to a new ror folder."}, changeRootTool)                                                                                                                                                   // returns structured output
 
-	mcp.AddTool[any, *argsSelect](server, &mcp.Tool{
+	mcp.AddTool[*argsSelection, *argsSelect](server, &mcp.Tool{
 		Name:        "get_current_select_statement",
-		Description: "Get the current select statement used to filter the DICOM studies and series.",
+		Description: "Get the current select statement used to filter the DICOM studies and series. A project can have several named selections, the names of all selections are returned as well.",
+		InputSchema: &jsonschema.Schema{
+			Type: "object",
+			Properties: map[string]*jsonschema.Schema{
+				"selection": {
+					Type:        "string",
+					Description: "The name of the selection. A project can have several named select statements, leave empty for the default selection.",
+				},
+			},
+		},
 		OutputSchema: &jsonschema.Schema{
 			Type: "object",
 			Properties: map[string]*jsonschema.Schema{
@@ -319,6 +328,15 @@ func startMCP(useHttp string, rootFolder string) {
 					Type:        "string",
 					Description: "The current select statement as a string.",
 				},
+				"selection": {
+					Type:        "string",
+					Description: "The name of the selection, empty for the default selection.",
+				},
+				"selections": {
+					Type:        "array",
+					Description: "The names of all selections of the project.",
+					Items:       &jsonschema.Schema{Type: "string"},
+				},
 				/*				{
 								Type: "object",
 								Properties: map[string]*jsonschema.Schema{
@@ -375,6 +393,11 @@ func startMCP(useHttp string, rootFolder string) {
 									Type:        "integer",
 									Description: "The job number associated with the matching job.",
 								},
+								"sop_instance_uids": {
+									Type:        "array",
+									Description: "The SOPInstanceUIDs of the matching images if the select statement works on images, empty if all images of the series are used.",
+									Items:       &jsonschema.Schema{Type: "string"},
+								},
 							},
 						},
 					},
@@ -384,7 +407,7 @@ func startMCP(useHttp string, rootFolder string) {
 	}, showSelectTool) // support completions
 	mcp.AddTool[*setSelectMessage, *argsSelect](server, &mcp.Tool{
 		Name:        "set_new_select_statement",
-		Description: "Set a new select statement.",
+		Description: "Set a new select statement. Use a selection name to store the statement as one of several named selections of the project. A select statement can declare parameters (DECLARE $minSlices number DEFAULT 50) that get their values from params.",
 		OutputSchema: &jsonschema.Schema{
 			Type: "object",
 			Properties: map[string]*jsonschema.Schema{
@@ -418,6 +441,11 @@ func startMCP(useHttp string, rootFolder string) {
 									Type:        "integer",
 									Description: "The job number associated with the matching job.",
 								},
+								"sop_instance_uids": {
+									Type:        "array",
+									Description: "The SOPInstanceUIDs of the matching images if the select statement works on images, empty if all images of the series are used.",
+									Items:       &jsonschema.Schema{Type: "string"},
+								},
 							},
 						},
 					},
@@ -427,6 +455,10 @@ func startMCP(useHttp string, rootFolder string) {
 		InputSchema: &jsonschema.Schema{
 			Type: "object",
 			Properties: map[string]*jsonschema.Schema{
+				"selection": {
+					Type:        "string",
+					Description: "The name of the selection. A project can have several named select statements, leave empty for the default selection.",
+				},
 				"select": {
 					Type:        "string",
 					Description: "The select statement as a string.",
@@ -469,6 +501,28 @@ func startMCP(useHttp string, rootFolder string) {
 		},
 	}, validateSelectStatementTool)
 
+	mcp.AddTool[*argsExplain, *resultExplain](server, &mcp.Tool{
+		Name:        "explain_select_statement",
+		Description: "Explain why series do or do not match a SELECT statement. For each series and each named where-clause the failing rule is listed together with the actual tag value. For each study (or patient) the tool explains why no complete set of series could be formed. Use this if a select statement creates fewer jobs than expected.",
+		InputSchema: &jsonschema.Schema{
+			Type: "object",
+			Properties: map[string]*jsonschema.Schema{
+				"select": {
+					Type:        "string",
+					Description: "The select statement to explain. If empty the current select statement of the project is used.",
+				},
+				"selection": {
+					Type:        "string",
+					Description: "The name of the selection. A project can have several named select statements, leave empty for the default selection.",
+				},
+				"series_instance_uid": {
+					Type:        "string",
+					Description: "Only explain this series (DICOM tag SeriesInstanceUID) and the study or patient it belongs to. If empty all series are explained.",
+				},
+			},
+		},
+	}, explainSelectStatementTool)
+
 	mcp.AddTool[NoInput, *argsSelect](server, &mcp.Tool{
 		Name:        "suggest_select_statement",
 		Description: "Suggest a SELECT statement for the currently loaded data.",
@@ -511,6 +565,11 @@ func startMCP(useHttp string, rootFolder string) {
 									Type:        "integer",
 									Description: "The job number associated with the matching job.",
 								},
+								"sop_instance_uids": {
+									Type:        "array",
+									Description: "The SOPInstanceUIDs of the matching images if the select statement works on images, empty if all images of the series are used.",
+									Items:       &jsonschema.Schema{Type: "string"},
+								},
 							},
 						},
 					},
@@ -884,11 +943,16 @@ func embeddedResource(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.R
 		parts := strings.Split(key, "/")
 		if len(parts) == 2 {
 			name := parts[1]
+			var text string
 			info, err := tag.FindByName(name)
-			if err != nil {
+			if err == nil {
+				text = fmt.Sprintf("%04x,%04x", info.Tag.Group, info.Tag.Element)
+			} else if p, ok := findPrivateTagByName(name); ok {
+				// private tags are only unique together with their creator
+				text = fmt.Sprintf("%s,%s (private creator \"%s\")", p.Group, p.Element, p.Creator)
+			} else {
 				return nil, fmt.Errorf("tag name not found: %v", err)
 			}
-			text := fmt.Sprintf("%04x,%04x", info.Tag.Group, info.Tag.Element)
 			return &mcp.ReadResourceResult{
 				Contents: []*mcp.ResourceContents{
 					{URI: req.Params.URI, MIMEType: "text/plain", Text: text},
@@ -1022,10 +1086,30 @@ type argsSelect struct {
 	MatchCount int                           `json:"match_count" jsonschema:"the number of matching series or studies for the select statement"`
 	Matches    [][]SeriesInstanceUIDWithName `json:"matches" jsonschema:"an array with the matching series or studies for the select statement"`
 	Complains  []string                      `json:"complains" jsonschema:"an array with complains why a series or study could did not match"`
+	Selection  string                        `json:"selection,omitempty" jsonschema:"name of the selection, empty for the default selection"`
+	Selections []string                      `json:"selections,omitempty" jsonschema:"names of all selections of the project"`
+}
+
+type argsExplain struct {
+	Select            string `json:"select,omitempty" jsonschema:"the select statement to explain, defaults to the current select statement"`
+	Selection         string `json:"selection,omitempty" jsonschema:"name of the selection to explain if no select statement is provided"`
+	SeriesInstanceUID string `json:"series_instance_uid,omitempty" jsonschema:"only explain this series and its study"`
+}
+
+type resultExplain struct {
+	Message     string            `json:"message" jsonschema:"general message"`
+	Select      string            `json:"select_statement" jsonschema:"the select statement that was explained"`
+	Explanation SelectExplanation `json:"explanation" jsonschema:"per series and per study explanation of the select statement"`
 }
 
 type setSelectMessage struct {
-	Select string `json:"select" jsonschema:"the select statement to filter in DICOM series"`
+	Select    string            `json:"select" jsonschema:"the select statement to filter in DICOM series"`
+	Selection string            `json:"selection,omitempty" jsonschema:"name of the selection, empty for the default selection"`
+	Params    map[string]string `json:"params,omitempty" jsonschema:"values for the parameters declared in the select statement with DECLARE $name number|string [DEFAULT value]"`
+}
+
+type argsSelection struct {
+	Selection string `json:"selection,omitempty" jsonschema:"name of the selection, empty for the default selection"`
 }
 
 type argsData struct {
@@ -1123,6 +1207,7 @@ type TagInfo struct {
 	Name    string `json:"name" jsonschema:"the human readable DICOM tag name for this group and element, empty if unknown"`
 	Value   string `json:"value" jsonschema:"the tag value"`
 	VR      string `json:"vr" jsonschema:"the value representation"`
+	Path    string `json:"path,omitempty" jsonschema:"for tags inside sequences the path usable in select statements, like SharedFunctionalGroupsSequence[0].MRTimingAndRelatedParametersSequence[0].RepetitionTime"`
 }
 
 type resultTags struct {
@@ -1340,16 +1425,10 @@ func suggestSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest, i
 	// get dataset and ast from config
 	// create an ast
 	// fmt.Println("Suggested abstract syntax tree for your data:")
-	InitParser()
-	line := []byte("Select series from series where series has Modality containing MR")
-	yyParse(&exprLex{line: line})
-	if errorOnParse {
-		msg := ""
-		for _, em := range errorMessages {
-			msg += em
-		}
+	ast, errs := Parse("Select series from series where series has Modality containing MR")
+	if len(errs) > 0 {
 		return nil, &argsSelect{
-			Message:    fmt.Sprintf("could not parse default select statement:\n%s\n%s", "Select series from series where series has Modality containing MR", msg),
+			Message:    fmt.Sprintf("could not parse default select statement:\n%s\n%s", "Select series from series where series has Modality containing MR", parseErrorsString(errs, "\n")),
 			Select:     "",
 			MatchCount: 0,
 			Matches:    [][]SeriesInstanceUIDWithName{},
@@ -1360,7 +1439,7 @@ func suggestSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest, i
 	}
 
 	// TODO: this uses the old style RuleSet instead of generating a RuleSetL
-	ast, _ := ast.improveAST(config.Data.DataInfo, func(counter int, total int, bestL2 float64) {
+	ast, _ = ast.improveAST(config.Data.DataInfo, func(counter int, total int, bestL2 float64) {
 		if req.Session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
 			ProgressToken: req.Params.GetProgressToken(),
 			Progress:      float64(counter),
@@ -1389,6 +1468,47 @@ func suggestSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest, i
 	}, nil
 }
 
+func explainSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest, args *argsExplain) (*mcp.CallToolResult, *resultExplain, error) {
+	var err error
+	if input_dir, err = getInputDir(ctx); err != nil {
+		return nil, &resultExplain{Message: "Error could not get ror directory. Your workspace is expected to be a ror directory (contains a .ror/config file)."}, err
+	}
+	dir_path := input_dir + "/.ror/config"
+	config, err := readConfig(dir_path)
+	if err != nil {
+		return nil, &resultExplain{Message: "Error could not read config file from ror directory. Maybe this is caused by a permission issue? Make sure that the current user can read the content in the workspaces .ror/ folder."}, err
+	}
+	config_series_filter := args.Select
+	if config_series_filter == "" {
+		if config, err = config.useSelection(args.Selection); err != nil {
+			return nil, &resultExplain{Message: "Error " + err.Error()}, nil
+		}
+		if config.SeriesFilterType != "select" {
+			return nil, &resultExplain{Message: "Error no select statement provided and the project has no select statement yet."}, nil
+		}
+		config_series_filter = config.SeriesFilter
+	}
+
+	ast, errs := Parse(config_series_filter)
+	if len(errs) > 0 {
+		return nil, &resultExplain{
+			Message: "Error parsing the select statement, errors:\n" + parseErrorsString(errs, "\n"),
+			Select:  config_series_filter,
+		}, nil
+	}
+
+	explanation := explainMatchingSets(ast, config.Data.DataInfo, args.SeriesInstanceUID)
+	postfix := "s"
+	if explanation.NumJobs == 1 {
+		postfix = ""
+	}
+	return nil, &resultExplain{
+		Message:     fmt.Sprintf("Select statement results in %d job%s", explanation.NumJobs, postfix),
+		Select:      ast2Select(ast),
+		Explanation: explanation,
+	}, nil
+}
+
 func validateSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelectMessage) (*mcp.CallToolResult, *argsSelect, error) {
 	var err error
 	if input_dir, err = getInputDir(ctx); err != nil {
@@ -1402,17 +1522,9 @@ func validateSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest,
 	}
 	config_series_filter := string(args.Select)
 
-	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-	series_filter_no_comments := comments.ReplaceAllString(config_series_filter, " ")
-
 	// now parse the input string
-	InitParser()
-	//yyErrorVerbose = true
-	yyDebug = 0
-
-	line := []byte(series_filter_no_comments)
-	yyParse(&exprLex{line: line})
-	if !errorOnParse {
+	ast, errs := Parse(config_series_filter)
+	if len(errs) == 0 {
 		//s, _ := json.MarshalIndent(ast, "", "  ")
 		//ss := humanizeFilter(ast)
 		//type Msg struct {
@@ -1458,10 +1570,7 @@ func validateSelectStatementTool(ctx context.Context, req *mcp.CallToolRequest,
 	// config.SeriesFilterType = "glob"
 
 	// in case of an error we can print out the error messages collected during parsing
-	msg := ", errors:\n"
-	for _, em := range errorMessages {
-		msg += em
-	}
+	msg := ", errors:\n" + parseErrorsString(errs, "\n")
 	//fmt.Println("Assuming a simple glob type filter now.")
 
 	return nil, &argsSelect{
@@ -1488,18 +1597,18 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 	if len(config_series_filter) == 0 {
 		return nil, &argsSelect{Message: "Error, the select statement is empty."}, err
 	}
-
-	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-	series_filter_no_comments := comments.ReplaceAllString(config_series_filter, " ")
+	series_filter_template := config_series_filter
+	config_series_filter, err = bindSelectParameters(series_filter_template, args.Params)
+	if err != nil {
+		return nil, &argsSelect{Message: fmt.Sprintf("Error, the select statement parameters are not valid:\n%s", err.Error())}, nil
+	}
+	if config_series_filter == series_filter_template {
+		series_filter_template = ""
+	}
 
 	// now parse the input string
-	InitParser()
-	//yyErrorVerbose = true
-	yyDebug = 0
-
-	line := []byte(series_filter_no_comments)
-	yyParse(&exprLex{line: line})
-	if !errorOnParse {
+	ast, errs := Parse(config_series_filter)
+	if len(errs) == 0 {
 		//s, _ := json.MarshalIndent(ast, "", "  ")
 		//ss := humanizeFilter(ast)
 		//type Msg struct {
@@ -1509,7 +1618,6 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 		//	Complains []string `json:"complains"`
 		//}
 		//fmt.Printf("Parsing series filter successful\n%s\n%s\n", string(s), strings.Join(ss[:], "\n"))
-		config.SeriesFilterType = "select"
 		// check if we have any matches - cheap for us here
 		matches, complains := findMatchingSets(ast, config.Data.DataInfo)
 		//fmt.Printf("Given our current test data we can identify %d matching dataset%s.\n", len(matches), postfix)
@@ -1520,7 +1628,8 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 		//}
 		//msg = fmt.Sprintln(string(human_enc))
 
-		config.SeriesFilter = config_series_filter
+		config.setSelection(args.Selection, config_series_filter, "select")
+		config.setSelectionTemplate(args.Selection, series_filter_template, args.Params)
 		if !config.writeConfig() {
 			return nil, &argsSelect{Message: "Error could not write config file into ror directory."}, err
 		}
@@ -1536,6 +1645,8 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 			MatchCount: len(matches),
 			Matches:    matches,
 			Complains:  complains,
+			Selection:  args.Selection,
+			Selections: config.selectionNames(),
 		}, nil
 	}
 
@@ -1545,10 +1656,7 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 	// config.SeriesFilterType = "glob"
 
 	// in case of an error we can print out the error messages collected during parsing
-	msg := ", errors:\n"
-	for _, msg := range errorMessages {
-		msg += msg
-	}
+	msg := ", errors:\n" + parseErrorsString(errs, "\n")
 	//fmt.Println("Assuming a simple glob type filter now.")
 
 	return nil, &argsSelect{
@@ -1563,7 +1671,7 @@ func setSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *setSelec
 // got error:
 // MCP error 0: validating tool output: validating root: validating /properties/matches: type: <invalid reflect.Value> has type "null", want "array"
 
-func showSelectTool(ctx context.Context, req *mcp.CallToolRequest, _ any) (*mcp.CallToolResult, *argsSelect, error) {
+func showSelectTool(ctx context.Context, req *mcp.CallToolRequest, args *argsSelection) (*mcp.CallToolResult, *argsSelect, error) {
 	var err error
 	if input_dir, err = getInputDir(ctx); err != nil {
 		return nil, &argsSelect{Message: "Error could not get ror directory."}, err
@@ -1580,28 +1688,36 @@ func showSelectTool(ctx context.Context, req *mcp.CallToolRequest, _ any) (*mcp.
 			Complains:  []string{"Error reading configuration file"},
 		}, err
 	}
+	selectionName := ""
+	if args != nil {
+		selectionName = args.Selection
+	}
+	if config, err = config.useSelection(selectionName); err != nil {
+		return nil, &argsSelect{
+			Message:    "Error " + err.Error(),
+			Matches:    [][]SeriesInstanceUIDWithName{},
+			Complains:  []string{},
+			Selections: config.selectionNames(),
+		}, nil
+	}
 
 	space := regexp.MustCompile(`\s+`)
+	// now parse the input string
+	ast, errs := Parse(config.SeriesFilter)
 	if len(config.Data.DataInfo) == 0 {
 		return nil, &argsSelect{
 			Message:    "No data loaded, select statement could not be evaluated. Add test data using add_data tool.",
-			Select:     space.ReplaceAllString(strings.Replace(ast2Select(ast), "\n", "", -1), " "), // shouldn't this be structured information instead?
+			Select:     space.ReplaceAllString(strings.Replace(ast2Select(ast), "\n", " ", -1), " "), // shouldn't this be structured information instead?
 			MatchCount: 0,
 			Matches:    [][]SeriesInstanceUIDWithName{},
 			Complains:  []string{"No data loaded"},
 		}, nil
 	}
 
-	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-	series_filter_no_comments := comments.ReplaceAllString(config.SeriesFilter, " ")
 	select_str := ""
-	// now parse the input string
-	InitParser()
-	line := []byte(series_filter_no_comments)
-	yyParse(&exprLex{line: line})
 	matches := make([][]SeriesInstanceUIDWithName, 0)
 	complains := make([]string, 0)
-	if !errorOnParse {
+	if len(errs) == 0 {
 		s, _ := json.MarshalIndent(ast, "", "  ")
 		// ss := humanizeFilter(ast)
 		select_str += string(s) // strings.Join(ss, " ") // fmt.Sprintf("Parsing series filter\n%s\n%s\n", string(s), ss)
@@ -1624,10 +1740,12 @@ func showSelectTool(ctx context.Context, req *mcp.CallToolRequest, _ any) (*mcp.
 	//str = space.ReplaceAllString(str, " ")
 	return nil, &argsSelect{
 		Message:    "Valid select statement" + warning,
-		Select:     space.ReplaceAllString(strings.Replace(ast2Select(ast), "\n", "", -1), " "), // shouldn't this be structured information instead?
+		Select:     space.ReplaceAllString(strings.Replace(ast2Select(ast), "\n", " ", -1), " "), // shouldn't this be structured information instead?
 		MatchCount: len(matches),
 		Matches:    matches,
 		Complains:  complains,
+		Selection:  selectionName,
+		Selections: config.selectionNames(),
 	}, nil
 }
 
@@ -2042,6 +2160,23 @@ func dataListTags(ctx context.Context, req *mcp.CallToolRequest, args *argsTagsL
 					VR:      a.Type,
 				})
 			}
+			// tags inside sequences are only listed if all tags are requested
+			if args.Subset == "all" || args.Subset == "" {
+				for _, a := range element2.Sequences {
+					name := ""
+					if info, err := tag.Find(a.Tag); err == nil {
+						name = info.Name
+					}
+					tags = append(tags, TagInfo{
+						Group:   fmt.Sprintf("%#04x", a.Tag.Group),
+						Element: fmt.Sprintf("%#04x", a.Tag.Element),
+						Name:    name,
+						Value:   strings.Join(a.Value, ","),
+						VR:      a.Type,
+						Path:    pathName(a.Path, a.Tag),
+					})
+				}
+			}
 
 			resultData = append(resultData, TagsBySeriesUID{
 				SeriesInstanceUID: key2,
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// niftiHeader is the NIfTI-1 header (348 bytes, little endian)
+type niftiHeader struct {
+	SizeofHdr      int32
+	DataType       [10]byte
+	DbName         [18]byte
+	Extents        int32
+	SessionError   int16
+	Regular        byte
+	DimInfo        byte
+	Dim            [8]int16
+	IntentP1       float32
+	IntentP2       float32
+	IntentP3       float32
+	IntentCode     int16
+	Datatype       int16
+	Bitpix         int16
+	SliceStart     int16
+	Pixdim         [8]float32
+	VoxOffset      float32
+	SclSlope       float32
+	SclInter       float32
+	SliceEnd       int16
+	SliceCode      byte
+	XyztUnits      byte
+	CalMax         float32
+	CalMin         float32
+	SliceDuration  float32
+	Toffset        float32
+	Glmax          int32
+	Glmin          int32
+	Descrip        [80]byte
+	AuxFile        [24]byte
+	QformCode      int16
+	SformCode      int16
+	QuaternB       float32
+	QuaternC       float32
+	QuaternD       float32
+	QoffsetX       float32
+	QoffsetY       float32
+	QoffsetZ       float32
+	SrowX          [4]float32
+	SrowY          [4]float32
+	SrowZ          [4]float32
+	IntentName     [16]byte
+	Magic          [4]byte
+	ExtensionFlags [4]byte // not part of the header, no extensions follow
+}
+
+// NIfTI-1 data types
+const (
+	niftiInt16   = 4
+	niftiInt32   = 8
+	niftiFloat32 = 16
+	niftiUint16  = 512
+)
+
+// niftiSlice is a single 2D image of a series with the information needed to place it in a volume
+type niftiSlice struct {
+	rows, cols       int
+	pixels           []int32
+	position         []float64 // ImagePositionPatient
+	orientation      []float64 // ImageOrientationPatient
+	spacing          []float64 // PixelSpacing (row spacing, column spacing)
+	slope, intercept float64
+	instance         int     // InstanceNumber, frames of a multi-frame image are numbered in order
+	echo             int     // EchoNumbers, volumes of a multi-echo series are sorted by echo first
+	echoTime         float64 // EchoTime in ms
+	time             float64 // AcquisitionTime in seconds since midnight, -1 if unknown
+	bValue           float64
+	gradient         []float64 // DiffusionGradientOrientation
+}
+
+// niftiSeries collects the images of a series and writes them as a NIfTI volume with a BIDS sidecar.
+// Images are added one by one so the DICOM files do not have to be kept in memory.
+type niftiSeries struct {
+	slices      []niftiSlice
+	sidecar     map[string]interface{}
+	acquisition string // date and time of the acquisition (YYYY-MM-DDThh:mm:ss) for scans.tsv
+	thickness   float64
+	diffusion   bool
+	err         error // first image that could not be added, the series is not written
+}
+
+// niftiSidecarTags are copied from the first image into the JSON sidecar, "ms" values are converted to seconds
+var niftiSidecarTags = []struct {
+	name string
+	tag  tag.Tag
+	kind string // string, number, int, list or ms
+}{
+	{"Modality", tag.Modality, "string"},
+	{"MagneticFieldStrength", tag.MagneticFieldStrength, "number"},
+	{"ImagingFrequency", tag.ImagingFrequency, "number"},
+	{"Manufacturer", tag.Manufacturer, "string"},
+	{"ManufacturersModelName", tag.ManufacturerModelName, "string"},
+	{"SoftwareVersions", tag.SoftwareVersions, "string"},
+	{"BodyPartExamined", tag.BodyPartExamined, "string"},
+	{"SeriesDescription", tag.SeriesDescription, "string"},
+	{"ProtocolName", tag.ProtocolName, "string"},
+	{"ScanningSequence", tag.ScanningSequence, "string"},
+	{"SequenceVariant", tag.SequenceVariant, "string"},
+	{"ScanOptions", tag.ScanOptions, "string"},
+	{"SequenceName", tag.SequenceName, "string"},
+	{"ImageType", tag.ImageType, "list"},
+	{"SeriesNumber", tag.SeriesNumber, "int"},
+	{"SliceThickness", tag.SliceThickness, "number"},
+	{"SpacingBetweenSlices", tag.SpacingBetweenSlices, "number"},
+	{"EchoTime", tag.EchoTime, "ms"},
+	{"RepetitionTime", tag.RepetitionTime, "ms"},
+	{"InversionTime", tag.InversionTime, "ms"},
+	{"FlipAngle", tag.FlipAngle, "number"},
+	{"EchoNumber", tag.EchoNumbers, "int"},
+	{"EchoTrainLength", tag.EchoTrainLength, "int"},
+	{"PixelBandwidth", tag.PixelBandwidth, "number"},
+	{"InPlanePhaseEncodingDirectionDICOM", tag.InPlanePhaseEncodingDirection, "string"},
+	{"KVP", tag.KVP, "number"},
+	{"XRayExposure", tag.Exposure, "number"},
+	{"ConvolutionKernel", tag.ConvolutionKernel, "string"},
+	{"ContrastBolusAgent", tag.ContrastBolusAgent, "string"},
+}
+
+// vendor tags for diffusion images that do not use the standard tags
+var (
+	siemensBValue   = tag.Tag{Group: 0x0019, Element: 0x100c}
+	siemensGradient = tag.Tag{Group: 0x0019, Element: 0x100e}
+)
+
+// datasetValues returns the values of a tag, for multi-frame images the tag is also searched in the
+// functional groups of the frame and the shared functional groups
+func datasetValues(dataset dicom.Dataset, t tag.Tag, frame int) []string {
+	if element, err := dataset.FindElementByTag(t); err == nil {
+		if tav, ok := elementToTagAndValue(element); ok {
+			return tav.Value
+		}
+	}
+	for _, group := range []struct {
+		sequence tag.Tag
+		item     int
+	}{{tag.PerFrameFunctionalGroupsSequence, frame}, {tag.SharedFunctionalGroupsSequence, 0}} {
+		element, err := dataset.FindElementByTag(group.sequence)
+		if err != nil || element.Value.ValueType() != dicom.Sequences {
+			continue
+		}
+		items := element.Value.GetValue().([]*dicom.SequenceItemValue)
+		if group.item >= len(items) {
+			continue
+		}
+		if e := findInItem(items[group.item], t, 0); e != nil {
+			if tav, ok := elementToTagAndValue(e); ok {
+				return tav.Value
+			}
+		}
+	}
+	return nil
+}
+
+// findInItem searches a tag in a sequence item and the sequences inside of it
+func findInItem(item *dicom.SequenceItemValue, t tag.Tag, depth int) *dicom.Element {
+	if depth >= maxSequenceDepth {
+		return nil
+	}
+	for _, e := range item.GetValue().([]*dicom.Element) {
+		if e.Tag == t {
+			return e
+		}
+		if e.Value.ValueType() == dicom.Sequences {
+			for _, sub := range e.Value.GetValue().([]*dicom.SequenceItemValue) {
+				if found := findInItem(sub, t, depth+1); found != nil {
+					return found
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parseFloats(values []string) []float64 {
+	floats := []float64{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, "\\") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil
+			}
+			floats = append(floats, f)
+		}
+	}
+	return floats
+}
+
+// dicomSeconds converts a DICOM time (hhmmss.ffffff) to seconds since midnight
+func dicomSeconds(t string) float64 {
+	t = strings.TrimSpace(t)
+	if len(t) < 6 {
+		return -1
+	}
+	h, err1 := strconv.Atoi(t[0:2])
+	m, err2 := strconv.Atoi(t[2:4])
+	s, err3 := strconv.ParseFloat(t[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return -1
+	}
+	return float64(h*3600+m*60) + s
+}
+
+// add reads the pixels of all frames of a DICOM image. The first image also fills the sidecar.
+func (s *niftiSeries) add(dataset dicom.Dataset) error {
+	pixelDataElement, err := dataset.FindElementByTag(tag.PixelData)
+	if err != nil {
+		return fmt.Errorf("image has no pixel data")
+	}
+	pixelDataInfo := dicom.MustGetPixelDataInfo(pixelDataElement.Value)
+	if pixelDataInfo.IsEncapsulated {
+		return fmt.Errorf("compressed pixel data (TransferSyntaxUID %s) cannot be converted", strings.Join(datasetValues(dataset, tag.TransferSyntaxUID, 0), ""))
+	}
+	if s.sidecar == nil {
+		s.initSidecar(dataset)
+	}
+	signed := false
+	if v := parseFloats(datasetValues(dataset, tag.PixelRepresentation, 0)); len(v) > 0 && v[0] == 1 {
+		signed = true
+	}
+	instance := 0
+	if v := parseFloats(datasetValues(dataset, tag.InstanceNumber, 0)); len(v) > 0 {
+		instance = int(v[0])
+	}
+	for idx, fr := range pixelDataInfo.Frames {
+		native, err := fr.GetNativeFrame()
+		if err != nil {
+			return err
+		}
+		if native.SamplesPerPixel() != 1 {
+			return fmt.Errorf("color images (%d samples per pixel) cannot be converted", native.SamplesPerPixel())
+		}
+		slice := niftiSlice{
+			rows:        native.Rows(),
+			cols:        native.Cols(),
+			position:    parseFloats(datasetValues(dataset, tag.ImagePositionPatient, idx)),
+			orientation: parseFloats(datasetValues(dataset, tag.ImageOrientationPatient, idx)),
+			spacing:     parseFloats(datasetValues(dataset, tag.PixelSpacing, idx)),
+			slope:       1,
+			instance:    instance*len(pixelDataInfo.Frames) + idx,
+			time:        -1,
+		}
+		if v := parseFloats(datasetValues(dataset, tag.RescaleSlope, idx)); len(v) > 0 && v[0] != 0 {
+			slice.slope = v[0]
+		}
+		if v := parseFloats(datasetValues(dataset, tag.RescaleIntercept, idx)); len(v) > 0 {
+			slice.intercept = v[0]
+		}
+		if v := parseFloats(datasetValues(dataset, tag.EchoNumbers, idx)); len(v) > 0 {
+			slice.echo = int(v[0])
+		}
+		if v := parseFloats(datasetValues(dataset, tag.EchoTime, idx)); len(v) > 0 {
+			slice.echoTime = v[0]
+		}
+		if v := datasetValues(dataset, tag.AcquisitionTime, idx); len(v) > 0 {
+			slice.time = dicomSeconds(v[0])
+		}
+		if v := parseFloats(datasetValues(dataset, tag.DiffusionBValue, idx)); len(v) > 0 {
+			slice.bValue = v[0]
+			s.diffusion = true
+		} else if v := parseFloats(datasetValues(dataset, siemensBValue, idx)); len(v) > 0 {
+			slice.bValue = v[0]
+			s.diffusion = true
+		}
+		if v := parseFloats(datasetValues(dataset, tag.DiffusionGradientOrientation, idx)); len(v) == 3 {
+			slice.gradient = v
+		} else if v := parseFloats(datasetValues(dataset, siemensGradient, idx)); len(v) == 3 {
+			slice.gradient = v
+		}
+		slice.pixels = make([]int32, slice.rows*slice.cols)
+		switch raw := native.RawDataSlice().(type) {
+		case []uint8:
+			for i := range slice.pixels {
+				slice.pixels[i] = int32(raw[i])
+			}
+		case []uint16:
+			for i := range slice.pixels {
+				if signed {
+					slice.pixels[i] = int32(int16(raw[i]))
+				} else {
+					slice.pixels[i] = int32(raw[i])
+				}
+			}
+		case []uint32:
+			for i := range slice.pixels {
+				slice.pixels[i] = int32(raw[i])
+			}
+		case []int:
+			for i := range slice.pixels {
+				slice.pixels[i] = int32(raw[i])
+			}
+		default:
+			return fmt.Errorf("unsupported pixel data %T", raw)
+		}
+		s.slices = append(s.slices, slice)
+	}
+	return nil
+}
+
+// initSidecar copies the acquisition parameters of the first image into the sidecar
+func (s *niftiSeries) initSidecar(dataset dicom.Dataset) {
+	s.sidecar = make(map[string]interface{})
+	for _, entry := range niftiSidecarTags {
+		values := datasetValues(dataset, entry.tag, 0)
+		if len(values) == 0 || strings.TrimSpace(strings.Join(values, "")) == "" {
+			continue
+		}
+		switch entry.kind {
+		case "string":
+			s.sidecar[entry.name] = strings.TrimSpace(strings.Join(values, "\\"))
+		case "list":
+			list := []string{}
+			for _, v := range values {
+				list = append(list, strings.Split(v, "\\")...)
+			}
+			s.sidecar[entry.name] = list
+		case "number", "int", "ms":
+			f := parseFloats(values)
+			if len(f) == 0 {
+				continue
+			}
+			switch entry.kind {
+			case "int":
+				s.sidecar[entry.name] = int(f[0])
+			case "ms":
+				s.sidecar[entry.name] = f[0] / 1000.0
+			default:
+				s.sidecar[entry.name] = f[0]
+			}
+		}
+	}
+	if v := parseFloats(datasetValues(dataset, tag.SliceThickness, 0)); len(v) > 0 {
+		s.thickness = v[0]
+	}
+	date := ""
+	for _, t := range []tag.Tag{tag.AcquisitionDate, tag.SeriesDate, tag.StudyDate} {
+		if v := datasetValues(dataset, t, 0); len(v) > 0 && len(strings.TrimSpace(v[0])) == 8 {
+			date = strings.TrimSpace(v[0])
+			break
+		}
+	}
+	clock := ""
+	for _, t := range []tag.Tag{tag.AcquisitionTime, tag.SeriesTime, tag.StudyTime} {
+		if v := datasetValues(dataset, t, 0); len(v) > 0 && len(strings.TrimSpace(v[0])) >= 6 {
+			clock = strings.TrimSpace(v[0])
+			break
+		}
+	}
+	if clock != "" {
+		s.sidecar["AcquisitionTime"] = fmt.Sprintf("%s:%s:%s", clock[0:2], clock[2:4], clock[4:])
+	}
+	if date != "" {
+		s.acquisition = fmt.Sprintf("%s-%s-%s", date[0:4], date[4:6], date[6:8])
+		if clock != "" {
+			s.acquisition += fmt.Sprintf("T%s:%s:%s", clock[0:2], clock[2:4], clock[4:6])
+		}
+	}
+	s.sidecar["ConversionSoftware"] = "ror"
+	s.sidecar["ConversionSoftwareVersion"] = version
+}
+
+func cross(a []float64, b []float64) []float64 {
+	return []float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func dot(a []float64, b []float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+// quaternion returns the quaternion (b, c, d) and qfac of a rotation matrix (columns are the directions of the axes)
+func quaternion(r [3][3]float64) (float64, float64, float64, float64) {
+	qfac := 1.0
+	det := r[0][0]*(r[1][1]*r[2][2]-r[1][2]*r[2][1]) - r[0][1]*(r[1][0]*r[2][2]-r[1][2]*r[2][0]) + r[0][2]*(r[1][0]*r[2][1]-r[1][1]*r[2][0])
+	if det < 0 {
+		qfac = -1
+		for i := 0; i < 3; i++ {
+			r[i][2] = -r[i][2]
+		}
+	}
+	var a, b, c, d float64
+	a = r[0][0] + r[1][1] + r[2][2] + 1
+	if a > 0.5 {
+		a = 0.5 * math.Sqrt(a)
+		b = 0.25 * (r[2][1] - r[1][2]) / a
+		c = 0.25 * (r[0][2] - r[2][0]) / a
+		d = 0.25 * (r[1][0] - r[0][1]) / a
+	} else {
+		xd := 1.0 + r[0][0] - (r[1][1] + r[2][2])
+		yd := 1.0 + r[1][1] - (r[0][0] + r[2][2])
+		zd := 1.0 + r[2][2] - (r[0][0] + r[1][1])
+		if xd > 1.0 {
+			b = 0.5 * math.Sqrt(xd)
+			c = 0.25 * (r[0][1] + r[1][0]) / b
+			d = 0.25 * (r[0][2] + r[2][0]) / b
+			a = 0.25 * (r[2][1] - r[1][2]) / b
+		} else if yd > 1.0 {
+			c = 0.5 * math.Sqrt(yd)
+			b = 0.25 * (r[0][1] + r[1][0]) / c
+			d = 0.25 * (r[1][2] + r[2][1]) / c
+			a = 0.25 * (r[0][2] - r[2][0]) / c
+		} else {
+			d = 0.5 * math.Sqrt(zd)
+			b = 0.25 * (r[0][2] + r[2][0]) / d
+			c = 0.25 * (r[1][2] + r[2][1]) / d
+			a = 0.25 * (r[1][0] - r[0][1]) / d
+		}
+		if a < 0 {
+			b, c, d = -b, -c, -d
+		}
+	}
+	return b, c, d, qfac
+}
+
+// write sorts the images into a 3D or 4D volume and writes <base>.nii.gz and the sidecar <base>.json.
+// Diffusion series also get <base>.bval and <base>.bvec (FSL format). Returns the files written.
+func (s *niftiSeries) write(base string) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if len(s.slices) == 0 {
+		return nil, fmt.Errorf("no images to convert")
+	}
+	first := s.slices[0]
+	orientation := []float64{1, 0, 0, 0, 1, 0}
+	if len(first.orientation) == 6 {
+		orientation = first.orientation
+	}
+	spacing := []float64{1, 1}
+	if len(first.spacing) == 2 {
+		spacing = first.spacing
+	}
+	row, col := orientation[0:3], orientation[3:6]
+	normal := cross(row, col)
+	positions := make([]float64, len(s.slices))
+	for i, slice := range s.slices {
+		if slice.rows != first.rows || slice.cols != first.cols {
+			return nil, fmt.Errorf("images have different sizes (%dx%d and %dx%d)", first.rows, first.cols, slice.rows, slice.cols)
+		}
+		if len(slice.orientation) == 6 {
+			for j := range orientation {
+				if math.Abs(slice.orientation[j]-orientation[j]) > 0.01 {
+					return nil, fmt.Errorf("images have different orientations, a localizer?")
+				}
+			}
+		}
+		if len(slice.position) == 3 {
+			positions[i] = dot(slice.position, normal)
+		} else {
+			positions[i] = float64(i) // no position, keep the order of the images
+		}
+	}
+	// sort by position along the normal, images at the same position by echo and instance number (time, b-value)
+	order := make([]int, len(s.slices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if math.Abs(positions[order[a]]-positions[order[b]]) > 0.01 {
+			return positions[order[a]] < positions[order[b]]
+		}
+		if s.slices[order[a]].echo != s.slices[order[b]].echo {
+			return s.slices[order[a]].echo < s.slices[order[b]].echo
+		}
+		return s.slices[order[a]].instance < s.slices[order[b]].instance
+	})
+	unique := []float64{}
+	perPosition := [][]int{}
+	for _, idx := range order {
+		if len(unique) == 0 || positions[idx]-unique[len(unique)-1] > 0.01 {
+			unique = append(unique, positions[idx])
+			perPosition = append(perPosition, []int{})
+		}
+		perPosition[len(perPosition)-1] = append(perPosition[len(perPosition)-1], idx)
+	}
+	nz := len(unique)
+	nt := len(perPosition[0])
+	for _, p := range perPosition {
+		if len(p) != nt {
+			return nil, fmt.Errorf("the %d images do not form a regular volume (%d slice positions with %d to %d images)", len(s.slices), nz, nt, len(p))
+		}
+	}
+	dz := s.thickness
+	if nz > 1 {
+		distances := []float64{}
+		for i := 1; i < nz; i++ {
+			distances = append(distances, unique[i]-unique[i-1])
+		}
+		dz = median(distances)
+	}
+	if dz <= 0 {
+		dz = 1
+	}
+	// voxel (i, j, k): i along the row direction (column index), j along the column direction (row index)
+	origin := []float64{0, 0, 0}
+	if p := s.slices[perPosition[0][0]].position; len(p) == 3 {
+		origin = p
+	}
+	dx, dy := spacing[1], spacing[0]
+	var hdr niftiHeader
+	hdr.SizeofHdr = 348
+	hdr.Regular = 'r'
+	hdr.Dim = [8]int16{3, int16(first.cols), int16(first.rows), int16(nz), 1, 1, 1, 1}
+	if nt > 1 {
+		hdr.Dim[0] = 4
+		hdr.Dim[4] = int16(nt)
+	}
+	hdr.Pixdim = [8]float32{1, float32(dx), float32(dy), float32(dz), 1, 0, 0, 0}
+	if tr, ok := s.sidecar["RepetitionTime"].(float64); ok && nt > 1 {
+		hdr.Pixdim[4] = float32(tr)
+	}
+	hdr.XyztUnits = 2 | 8 // mm and seconds
+	// DICOM uses LPS, NIfTI uses RAS
+	var rotation [3][3]float64
+	flip := []float64{-1, -1, 1}
+	for i := 0; i < 3; i++ {
+		rotation[i] = [3]float64{flip[i] * row[i], flip[i] * col[i], flip[i] * normal[i]}
+	}
+	hdr.SrowX = [4]float32{float32(rotation[0][0] * dx), float32(rotation[0][1] * dy), float32(rotation[0][2] * dz), float32(flip[0] * origin[0])}
+	hdr.SrowY = [4]float32{float32(rotation[1][0] * dx), float32(rotation[1][1] * dy), float32(rotation[1][2] * dz), float32(flip[1] * origin[1])}
+	hdr.SrowZ = [4]float32{float32(rotation[2][0] * dx), float32(rotation[2][1] * dy), float32(rotation[2][2] * dz), float32(flip[2] * origin[2])}
+	b, c, d, qfac := quaternion(rotation)
+	hdr.QuaternB, hdr.QuaternC, hdr.QuaternD = float32(b), float32(c), float32(d)
+	hdr.Pixdim[0] = float32(qfac)
+	hdr.QoffsetX, hdr.QoffsetY, hdr.QoffsetZ = hdr.SrowX[3], hdr.SrowY[3], hdr.SrowZ[3]
+	hdr.QformCode, hdr.SformCode = 1, 1 // scanner coordinates
+	copy(hdr.Descrip[:79], fmt.Sprintf("ror %s", version))
+	copy(hdr.Magic[:], "n+1\x00")
+	hdr.VoxOffset = 352
+
+	// a single scaling for all images is stored in the header, otherwise the values are scaled here
+	sameScaling := true
+	minValue, maxValue := int32(math.MaxInt32), int32(math.MinInt32)
+	for _, slice := range s.slices {
+		if slice.slope != first.slope || slice.intercept != first.intercept {
+			sameScaling = false
+		}
+		for _, v := range slice.pixels {
+			minValue = min(minValue, v)
+			maxValue = max(maxValue, v)
+		}
+	}
+	switch {
+	case !sameScaling:
+		hdr.Datatype, hdr.Bitpix = niftiFloat32, 32
+	case minValue >= math.MinInt16 && maxValue <= math.MaxInt16:
+		hdr.Datatype, hdr.Bitpix = niftiInt16, 16
+	case minValue >= 0 && maxValue <= math.MaxUint16:
+		hdr.Datatype, hdr.Bitpix = niftiUint16, 16
+	default:
+		hdr.Datatype, hdr.Bitpix = niftiInt32, 32
+	}
+	hdr.SclSlope, hdr.SclInter = 1, 0
+	if sameScaling {
+		hdr.SclSlope, hdr.SclInter = float32(first.slope), float32(first.intercept)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	for t := 0; t < nt; t++ {
+		for z := 0; z < nz; z++ {
+			slice := s.slices[perPosition[z][t]]
+			var err error
+			switch hdr.Datatype {
+			case niftiFloat32:
+				values := make([]float32, len(slice.pixels))
+				for i, v := range slice.pixels {
+					values[i] = float32(float64(v)*slice.slope + slice.intercept)
+				}
+				err = binary.Write(&buf, binary.LittleEndian, values)
+			case niftiInt16:
+				values := make([]int16, len(slice.pixels))
+				for i, v := range slice.pixels {
+					values[i] = int16(v)
+				}
+				err = binary.Write(&buf, binary.LittleEndian, values)
+			case niftiUint16:
+				values := make([]uint16, len(slice.pixels))
+				for i, v := range slice.pixels {
+					values[i] = uint16(v)
+				}
+				err = binary.Write(&buf, binary.LittleEndian, values)
+			default:
+				err = binary.Write(&buf, binary.LittleEndian, slice.pixels)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	files := []string{base + ".nii.gz", base + ".json"}
+	f, err := os.Create(files[0])
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	// the echo time of each volume of a multi-echo series
+	echoTimes := []float64{}
+	different := false
+	for t := 0; t < nt; t++ {
+		echoTimes = append(echoTimes, s.slices[perPosition[0][t]].echoTime/1000.0)
+		different = different || echoTimes[t] != echoTimes[0]
+	}
+	if different {
+		s.sidecar["EchoTimes"] = echoTimes
+	}
+	// slice timing of the first volume, only if the images have different acquisition times
+	if nt > 1 {
+		times := []float64{}
+		start := math.MaxFloat64
+		for z := 0; z < nz; z++ {
+			tm := s.slices[perPosition[z][0]].time
+			if tm < 0 {
+				times = nil
+				break
+			}
+			times = append(times, tm)
+			start = math.Min(start, tm)
+		}
+		varying := false
+		for i := range times {
+			times[i] = math.Round((times[i]-start)*10000) / 10000
+			varying = varying || times[i] != 0
+		}
+		if varying {
+			s.sidecar["SliceTiming"] = times
+		}
+	}
+	sidecar, err := json.MarshalIndent(s.sidecar, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(files[1], sidecar, 0644); err != nil {
+		return nil, err
+	}
+
+	if s.diffusion {
+		// gradient directions relative to the voxel axes, x is flipped for a positive determinant (FSL)
+		var bvals []string
+		var bvecs [3][]string
+		for t := 0; t < nt; t++ {
+			slice := s.slices[perPosition[0][t]]
+			bvals = append(bvals, strconv.FormatFloat(slice.bValue, 'f', -1, 64))
+			g := []float64{0, 0, 0}
+			if len(slice.gradient) == 3 && slice.bValue > 0 {
+				g = []float64{-dot(slice.gradient, row), dot(slice.gradient, col), dot(slice.gradient, normal)}
+			}
+			for i := 0; i < 3; i++ {
+				bvecs[i] = append(bvecs[i], strconv.FormatFloat(g[i]+0, 'f', 6, 64)) // +0 turns -0 into 0
+			}
+		}
+		if err := os.WriteFile(base+".bval", []byte(strings.Join(bvals, " ")+"\n"), 0644); err != nil {
+			return nil, err
+		}
+		content := ""
+		for i := 0; i < 3; i++ {
+			content += strings.Join(bvecs[i], " ") + "\n"
+		}
+		if err := os.WriteFile(base+".bvec", []byte(content), 0644); err != nil {
+			return nil, err
+		}
+		files = append(files, base+".bval", base+".bvec")
+	}
+	return files, nil
+}
+
+var niftiFileName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// writeInputNifti writes the series into the input_nifti/ folder of a trigger, the file is named after
+// the series in the select statement. Returns the path of the .nii.gz relative to the trigger folder.
+func writeInputNifti(dir string, name string, s *niftiSeries) (string, error) {
+	folder := filepath.Join(dir, "input_nifti")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", err
+	}
+	name = niftiFileName.ReplaceAllString(name, "_")
+	if name == "" || name == "no-name" {
+		name = "series"
+	}
+	base := name
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(folder, base+".nii.gz")); os.IsNotExist(err) {
+			break
+		}
+		base = fmt.Sprintf("%s_%d", name, i)
+	}
+	if _, err := s.write(filepath.Join(folder, base)); err != nil {
+		return "", err
+	}
+	return filepath.Join("input_nifti", base+".nii.gz"), nil
+}
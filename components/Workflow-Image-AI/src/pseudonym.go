@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The pseudonyms of a project are derived from a keyed hash (HMAC-SHA256) with a key that never leaves
+// the project folder. The same PatientID, UID or date always gets the same replacement, in every
+// trigger run and export. The pseudonyms of the patients are stored in the format of the AutoID
+// instrument (components/DataMigration/AutoID.csv) so they can be exchanged with REDCap.
+const (
+	pseudonymKeyFile = "pseudonym.key" // .ror/pseudonym.key, hex encoded random key
+	autoidFile       = "autoid.csv"    // .ror/autoid.csv, the AutoID records of the project
+	// autoid_method of the AutoID instrument for pseudonyms derived by ror
+	autoidMethodKeyedHash = "2"
+)
+
+var autoidColumns = []string{"record_id", "autoid_project_name", "autoid_hash", "autoid_value", "autoid_method"}
+
+// AutoID is a record of the AutoID instrument, the hash of a PatientID and the pseudonym linked to it.
+// The RecordID is assigned by REDCap, it is empty for pseudonyms that were not imported into REDCap yet.
+type AutoID struct {
+	RecordID string
+	Hash     string
+	Value    string
+	Method   string
+}
+
+type pseudonymizer struct {
+	dir     string
+	project string
+	key     []byte
+	ids     []AutoID
+	changed bool
+}
+
+// projectPseudonymizer reads (or creates) the key of the project and the stored AutoID records
+func projectPseudonymizer(dir string, project string) (*pseudonymizer, error) {
+	keyFile := filepath.Join(dir, ".ror", pseudonymKeyFile)
+	content, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		content = []byte(hex.EncodeToString(key) + "\n")
+		if err := os.WriteFile(keyFile, content, 0600); err != nil {
+			return nil, fmt.Errorf("could not create the pseudonym key: %s", err.Error())
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) < 16 {
+		return nil, fmt.Errorf("%s is not a valid pseudonym key (at least 32 hex digits)", keyFile)
+	}
+	p := &pseudonymizer{dir: dir, project: project, key: key}
+	if f, err := os.Open(filepath.Join(dir, ".ror", autoidFile)); err == nil {
+		defer f.Close()
+		ids, err := readAutoID(f, project)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Join(dir, ".ror", autoidFile), err.Error())
+		}
+		p.ids = ids
+	}
+	return p, nil
+}
+
+// mac is the keyed hash of a value, the project name is part of the message so projects that share
+// a key still get different pseudonyms
+func (p *pseudonymizer) mac(kind string, value string) []byte {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(p.project + "\x00" + kind + "\x00" + value))
+	return h.Sum(nil)
+}
+
+// hash is the autoid_hash of a PatientID
+func (p *pseudonymizer) hash(patientID string) string {
+	return hex.EncodeToString(p.mac("PatientID", patientID))
+}
+
+// lookup returns the AutoID record of a PatientID
+func (p *pseudonymizer) lookup(patientID string) (AutoID, bool) {
+	h := p.hash(patientID)
+	for _, id := range p.ids {
+		if id.Hash == h {
+			return id, true
+		}
+	}
+	return AutoID{}, false
+}
+
+// patientID returns the pseudonym of a PatientID, a new pseudonym is added to the AutoID records
+func (p *pseudonymizer) patientID(patientID string) string {
+	if id, ok := p.lookup(patientID); ok {
+		return id.Value
+	}
+	h := p.hash(patientID)
+	// the first hex digits of the hash, longer if another patient has the same pseudonym already
+	value := ""
+	for n := 8; n <= len(h); n += 2 {
+		value = "ANON" + strings.ToUpper(h[:n])
+		if !slices.ContainsFunc(p.ids, func(id AutoID) bool { return id.Value == value }) {
+			break
+		}
+	}
+	p.ids = append(p.ids, AutoID{Hash: h, Value: value, Method: autoidMethodKeyedHash})
+	p.changed = true
+	return value
+}
+
+// uid returns the pseudonym of a UID as a UUID derived UID (2.25.<128 bit integer>)
+func (p *pseudonymizer) uid(uid string) string {
+	b := p.mac("UID", uid)[:16]
+	b[6] = (b[6] & 0x0f) | 0x80 // version 8, a custom UUID
+	b[8] = (b[8] & 0x3f) | 0x80 // variant
+	return "2.25." + new(big.Int).SetBytes(b).String()
+}
+
+// dateShift is the number of days (1 to 365) all dates of a patient are moved into the past,
+// intervals between the dates of a patient stay the same
+func (p *pseudonymizer) dateShift(patientID string) int {
+	return 1 + int(binary.BigEndian.Uint32(p.mac("Date", patientID)[:4])%365)
+}
+
+// shiftDate moves a DA (YYYYMMDD) or DT (YYYYMMDDHHMMSS...) value by days into the past, values that
+// are not a date are removed
+func shiftDate(value string, days int) string {
+	value = strings.TrimSpace(value)
+	if len(value) < 8 {
+		return ""
+	}
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return ""
+	}
+	return date.AddDate(0, 0, -days).Format("20060102") + value[8:]
+}
+
+// readAutoID reads AutoID records (a REDCap export of the AutoID instrument), records of other
+// projects are ignored
+func readAutoID(r io.Reader, project string) ([]AutoID, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	column := make(map[string]int)
+	for i, name := range rows[0] {
+		column[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	for _, name := range []string{"autoid_hash", "autoid_value"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("missing column %s, expected a records export of the AutoID instrument (%s)", name, strings.Join(autoidColumns, ","))
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := column[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	ids := []AutoID{}
+	for _, row := range rows[1:] {
+		if name := get(row, "autoid_project_name"); name != "" && name != project {
+			continue
+		}
+		id := AutoID{RecordID: get(row, "record_id"), Hash: strings.ToLower(get(row, "autoid_hash")), Value: get(row, "autoid_value"), Method: get(row, "autoid_method")}
+		if id.Hash == "" || id.Value == "" {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// writeAutoID writes the records in the format of the AutoID instrument. New records have no record_id,
+// REDCap numbers them on import (auto-numbering), onlyNew skips the records REDCap knows already.
+func (p *pseudonymizer) writeAutoID(w io.Writer, onlyNew bool) error {
+	writer := csv.NewWriter(w)
+	writer.Write(autoidColumns)
+	for _, id := range p.ids {
+		if onlyNew && id.RecordID != "" {
+			continue
+		}
+		writer.Write([]string{id.RecordID, p.project, id.Hash, id.Value, id.Method})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// save stores new AutoID records in the project
+func (p *pseudonymizer) save() error {
+	if !p.changed {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(p.dir, ".ror", autoidFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := p.writeAutoID(f, false); err != nil {
+		return err
+	}
+	p.changed = false
+	return nil
+}
+
+// importAutoID adds the records of a REDCap export to the project and learns the record_id of known
+// records. A hash that is known with another pseudonym or record_id or a pseudonym used for another
+// hash is an error and nothing is imported.
+func (p *pseudonymizer) importAutoID(r io.Reader) (int, int, error) {
+	ids, err := readAutoID(r, p.project)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, id := range ids {
+		for _, other := range p.ids {
+			if other.Hash == id.Hash && other.Value != id.Value {
+				return 0, 0, fmt.Errorf("hash %s is linked to %s and to %s", id.Hash, other.Value, id.Value)
+			}
+			if other.Hash == id.Hash && other.RecordID != "" && id.RecordID != "" && other.RecordID != id.RecordID {
+				return 0, 0, fmt.Errorf("hash %s is stored in record %s and in record %s", id.Hash, other.RecordID, id.RecordID)
+			}
+			if other.Hash != id.Hash && other.Value == id.Value {
+				return 0, 0, fmt.Errorf("pseudonym %s is used for two different hashes", id.Value)
+			}
+		}
+	}
+	added, learned := 0, 0
+	for _, id := range ids {
+		i := slices.IndexFunc(p.ids, func(other AutoID) bool { return other.Hash == id.Hash })
+		if i < 0 {
+			p.ids = append(p.ids, id)
+			p.changed = true
+			added++
+		} else if p.ids[i].RecordID == "" && id.RecordID != "" {
+			p.ids[i].RecordID = id.RecordID
+			p.changed = true
+			learned++
+		}
+	}
+	return added, learned, p.save()
+}
@@ -28,11 +28,13 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/mkmik/argsort"
@@ -168,6 +170,13 @@ type DataInfo struct {
 	Path     string
 	DataInfo map[string]map[string]SeriesInfo
 	Message  string
+	// fingerprint of the classification rules used for ClassifyTypes, if the rules change
+	// the series are classified again (see reclassify)
+	ClassifyRules string `json:",omitempty"`
+	// split series into virtual sub-series by these instance tags (config --split-series)
+	SplitSeries []string `json:",omitempty"`
+	// what to do with SeriesInstanceUIDs used in several studies and duplicated images (config --duplicates)
+	DuplicatePolicy string `json:",omitempty"`
 }
 
 type Viewer struct {
@@ -190,17 +199,35 @@ type Config struct {
 	CallString       string
 	ProjectName      string
 	SortDICOM        bool
+	Nifti            bool   `json:",omitempty"` // also write the series as NIfTI into input_nifti/ (config --nifti)
+	Deidentify       string `json:",omitempty"` // de-identification profile applied by trigger (config --deidentify)
 	ProjectType      string
 	ProjectToken     string
 	LastDataFolder   string
 	Viewer           Viewer
 	Annotate         Annotate
+	Selections       map[string]Selection // named select statements in addition to SeriesFilter
+	// select statements with DECLARE $name are stored as a template with the values of the parameters,
+	// SeriesFilter contains the statement with the values filled in
+	SeriesFilterTemplate   string            `json:",omitempty"`
+	SeriesFilterParameters map[string]string `json:",omitempty"`
+	reclassified           bool              // readConfig classified the data cache again, not stored yet
+}
+
+// Selection is a named select statement, a project can have several of them,
+// for example one per processing pipeline.
+type Selection struct {
+	SeriesFilter           string
+	SeriesFilterType       string
+	SeriesFilterTemplate   string            `json:",omitempty"`
+	SeriesFilterParameters map[string]string `json:",omitempty"`
 }
 
 type TagAndValue struct {
 	Tag   tag.Tag  `json:"tag"`
 	Value []string `json:"value"`
 	Type  string   `json:"type"`
+	Path  string   `json:"path,omitempty"` // for tags inside sequences the sequence items, like "5200,9229[0].0018,9112[0]"
 }
 
 type Annotation struct {
@@ -223,9 +250,35 @@ type SeriesInfo struct {
 	PatientID             string
 	PatientName           string
 	ClassifyTypes         []string
+	ClassifyTypeCounts    map[string]int `json:",omitempty"` // number of images that have each of the ClassifyTypes
 	All                   []TagAndValue
+	Sequences             []TagAndValue // tags inside sequences, each entry has a Path
 	Annotations           []Annotation
 	SOPInstanceUIDs       []string
+	Instances             []InstanceInfo `json:",omitempty"` // per image information, used by 'select image'
+	// virtual sub-series (config --split-series) are stored under "<SeriesInstanceUID>#<SubSeries>"
+	ParentSeriesInstanceUID string          `json:",omitempty"`
+	SubSeries               string          `json:",omitempty"` // the values that define the sub-series, e.g. "EchoNumbers=2"
+	Geometry                *SeriesGeometry `json:",omitempty"` // plane, slice spacing and coverage computed from all images
+	QCStatus                string          `json:",omitempty"` // complete, incomplete or unknown
+	QCIssues                []string        `json:",omitempty"` // missing instance numbers, duplicate positions, ...
+	Duplicates              []string        `json:",omitempty"` // re-used UIDs and duplicated images found during import
+}
+
+// InstanceInfo stores the tags that change from image to image in a series
+type InstanceInfo struct {
+	SOPInstanceUID string
+	Path           string        // absolute path of the DICOM file
+	Tags           []TagAndValue // only the tags listed in instanceTags
+}
+
+// instanceTags are stored for each image of a series (SeriesInfo.Instances), all other tags are only
+// stored once per series in SeriesInfo.All
+var instanceTags = []tag.Tag{
+	tag.InstanceNumber, tag.ImageType, tag.SOPClassUID, tag.TransferSyntaxUID,
+	tag.AcquisitionNumber, tag.AcquisitionTime, tag.ContentTime, tag.TemporalPositionIdentifier, tag.TriggerTime,
+	tag.SliceLocation, tag.ImagePositionPatient, tag.ImageOrientationPatient, tag.PixelSpacing, tag.SliceThickness,
+	tag.Rows, tag.Columns, tag.EchoNumbers, tag.EchoTime, tag.DiffusionBValue,
 }
 
 // patientIdentifier returns a single display string identifying the patient:
@@ -276,12 +329,17 @@ func readConfig(path_string string) (Config, error) {
 	}
 
 	cacheKey := filepath.Clean(path_string)
+	projectDir := filepath.Dir(filepath.Dir(path_string))
 	configCache.Lock()
 	if entry, ok := configCache.entries[cacheKey]; ok && entry.mtime.Equal(fileInfo.ModTime()) {
 		configCache.Unlock()
-		return entry.config, nil
+		// the cached config is only good if the classification rules did not change
+		if classifier, _, err := projectClassifier(projectDir); err != nil || classifier.Fingerprint == entry.config.Data.ClassifyRules {
+			return entry.config, nil
+		}
+	} else {
+		configCache.Unlock()
 	}
-	configCache.Unlock()
 
 	// var buf bytes.Buffer
 	fi, err := os.Open(path_string)
@@ -310,6 +368,11 @@ func readConfig(path_string string) (Config, error) {
 		return Config{}, err
 	}
 
+	// the classification rules of the project changed since the last time we looked, classify the
+	// data cache again. Reading the config never writes it (ror lsp and ror mcp read it while other
+	// commands run), the new ClassifyTypes are stored by the next command that writes the config.
+	config.reclassified = config.reclassify(projectDir)
+
 	// cache the parsed config together with the modification time we
 	// checked above, so subsequent calls can skip re-parsing while the
 	// file on disk is unchanged.
@@ -320,13 +383,335 @@ func readConfig(path_string string) (Config, error) {
 	return config, nil
 }
 
+// reclassify sets the ClassifyTypes of all series again if the classification rules of the project
+// changed since the data was classified. The tags are taken from the data cache (All and Instances),
+// the DICOM files are not read again. Returns true if the config changed.
+func (config *Config) reclassify(dir string) bool {
+	classifier, _, err := projectClassifier(dir)
+	if err != nil || classifier.Fingerprint == config.Data.ClassifyRules {
+		return false
+	}
+	// the maps can be shared with the config cache, create new ones
+	dataInfo := make(map[string]map[string]SeriesInfo, len(config.Data.DataInfo))
+	for studyInstanceUID, study := range config.Data.DataInfo {
+		dataInfo[studyInstanceUID] = make(map[string]SeriesInfo, len(study))
+		for seriesInstanceUID, series := range study {
+			series.ClassifyTypes, series.ClassifyTypeCounts = classifier.ClassifySeriesCounts(series)
+			dataInfo[studyInstanceUID][seriesInstanceUID] = series
+		}
+	}
+	if config.Data.DataInfo != nil {
+		config.Data.DataInfo = dataInfo
+	}
+	config.Data.ClassifyRules = classifier.Fingerprint
+	return true
+}
+
+// storeReclassified writes the ClassifyTypes readConfig found with new classification rules, used by
+// the commands that write the config anyway
+func (config Config) storeReclassified(path_string string) {
+	if config.reclassified && !config.writeConfigTo(path_string) {
+		fmt.Fprintf(os.Stderr, "Warning: could not store the new ClassifyTypes in %s\n", path_string)
+	}
+}
+
+// classifyRulesSummary is a single line that tells the user which classification rules are used
+func classifyRulesSummary(dir string) string {
+	classifier, usage, err := projectClassifier(dir)
+	if err != nil {
+		return fmt.Sprintf("Classification rules are not valid, ClassifyTypes are from the last import:\n%s\n", err.Error())
+	}
+	summary := fmt.Sprintf("Classification rules: %s (%s), %d classes\n", classifier.Source, usage, len(classifier.classes))
+	// the built-in rules have conditions on unknown names as well, only the ones of the project are counted
+	ignored := len(classifier.Warnings)
+	if builtin, err := compileClassifier("built-in rules", classifyRules); err == nil && !strings.HasPrefix(usage, "replaces the built-in rules") {
+		ignored -= len(builtin.Warnings)
+	}
+	if ignored > 0 {
+		summary += fmt.Sprintf("Warning: %d conditions on unknown tag names are ignored, see %s classify test\n", ignored, own_name)
+	}
+	return summary + rulePacksSummary(dir)
+}
+
+// defaultSelection is the name used for the select statement stored in SeriesFilter
+const defaultSelection = "default"
+
+// selectionNames returns the names of all selections of the project, the default selection first
+func (config Config) selectionNames() []string {
+	names := []string{}
+	for name := range config.Selections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{defaultSelection}, names...)
+}
+
+// useSelection returns a copy of the config where SeriesFilter and SeriesFilterType are
+// taken from the named selection. All the code that reads SeriesFilter works with the
+// named selection afterwards.
+func (config Config) useSelection(name string) (Config, error) {
+	if name == "" || name == defaultSelection {
+		return config, nil
+	}
+	selection, ok := config.Selections[name]
+	if !ok {
+		return config, fmt.Errorf("no selection named \"%s\" in this project, known selections are: %s", name, strings.Join(config.selectionNames(), ", "))
+	}
+	config.SeriesFilter = selection.SeriesFilter
+	config.SeriesFilterType = selection.SeriesFilterType
+	config.SeriesFilterTemplate = selection.SeriesFilterTemplate
+	config.SeriesFilterParameters = selection.SeriesFilterParameters
+	return config, nil
+}
+
+// setSelection stores a select statement under a name, an empty name sets the default selection
+func (config *Config) setSelection(name string, seriesFilter string, seriesFilterType string) {
+	if name == "" || name == defaultSelection {
+		config.SeriesFilter = seriesFilter
+		config.SeriesFilterType = seriesFilterType
+		return
+	}
+	// copy the map, readConfig caches the config and we should not change the cached version
+	selections := make(map[string]Selection)
+	for key, value := range config.Selections {
+		selections[key] = value
+	}
+	selections[name] = Selection{SeriesFilter: seriesFilter, SeriesFilterType: seriesFilterType}
+	config.Selections = selections
+}
+
+// setSelectionTemplate remembers the select statement with its DECLARE'd parameters for a selection,
+// call after setSelection. An empty template removes a previous template.
+func (config *Config) setSelectionTemplate(name string, template string, params map[string]string) {
+	if template == "" {
+		params = nil
+	}
+	if name == "" || name == defaultSelection {
+		config.SeriesFilterTemplate = template
+		config.SeriesFilterParameters = params
+		return
+	}
+	selection := config.Selections[name]
+	selection.SeriesFilterTemplate = template
+	selection.SeriesFilterParameters = params
+	config.Selections[name] = selection
+}
+
+// selectParameterDeclaration is "DECLARE $name number|string [DEFAULT value]", the semicolon at the end is optional
+var selectParameterDeclaration = regexp.MustCompile(`(?i)\bDECLARE\s+\$([A-Za-z_][A-Za-z0-9_]*)\s+(number|string)(\s+DEFAULT\s+("[^"]*"|'[^']*'|[^\s;]+))?\s*;?`)
+
+// selectParameterUse finds $name
+var selectParameterUse = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// parseSelectParameters parses a "name=value" list as given by --param
+func parseSelectParameters(list []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, entry := range list {
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "$")
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("parameter \"%s\" should look like name=value", entry)
+		}
+		params[name] = parts[1]
+	}
+	return params, nil
+}
+
+// stringList collects the values of a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// bindSelectParameters replaces the declared $parameters of a select statement with their values.
+// Numbers are inserted as they are, strings are quoted. The declarations are removed from the statement.
+// Parameters inside comments and quoted strings are ignored. A statement without parameters is
+// returned unchanged.
+func bindSelectParameters(statement string, params map[string]string) (string, error) {
+	// blank out the comments but keep the positions
+	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
+	masked := comments.ReplaceAllStringFunc(statement, func(c string) string { return strings.Repeat(" ", len(c)) })
+
+	type declaration struct {
+		Type    string
+		Default *string
+	}
+	declared := make(map[string]declaration)
+	problems := []string{}
+	locations := selectParameterDeclaration.FindAllStringSubmatchIndex(masked, -1)
+	for _, loc := range locations {
+		name := masked[loc[2]:loc[3]]
+		if _, ok := declared[name]; ok {
+			problems = append(problems, fmt.Sprintf("parameter $%s is declared more than once", name))
+			continue
+		}
+		d := declaration{Type: strings.ToLower(masked[loc[4]:loc[5]])}
+		if loc[8] != -1 {
+			def := masked[loc[8]:loc[9]]
+			if len(def) > 1 && (def[0] == '"' || def[0] == '\'') {
+				def = def[1 : len(def)-1]
+			}
+			d.Default = &def
+		}
+		declared[name] = d
+	}
+
+	// the values for all declared parameters
+	values := make(map[string]string)
+	names := []string{}
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := declared[name]
+		value, ok := params[name]
+		if !ok {
+			if d.Default == nil {
+				problems = append(problems, fmt.Sprintf("missing value for parameter $%s (%s), use --param %s=<value>", name, d.Type, name))
+				continue
+			}
+			value = *d.Default
+		}
+		if d.Type == "number" {
+			value = strings.TrimSpace(value)
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				problems = append(problems, fmt.Sprintf("parameter $%s should be a number, got \"%s\"", name, value))
+				continue
+			}
+		} else if strings.Contains(value, "\"") {
+			value = "'" + value + "'"
+		} else {
+			value = "\"" + value + "\""
+		}
+		values[name] = value
+	}
+	unknown := []string{}
+	for name := range params {
+		if _, ok := declared[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown parameter %s, the select statement does not DECLARE $%s", name, name))
+	}
+
+	// remove the declarations and replace the parameters outside of comments and strings
+	var out strings.Builder
+	var quote byte
+	used := make(map[string]bool)
+	next := 0 // index of the next declaration
+	for i := 0; i < len(statement); i++ {
+		if next < len(locations) && i == locations[next][0] {
+			// the declaration can contain comments (masked as spaces), these are kept
+			for _, c := range comments.FindAllString(statement[i:locations[next][1]], -1) {
+				out.WriteString(c + " ")
+			}
+			i = locations[next][1] - 1
+			next++
+			continue
+		}
+		c := statement[i]
+		if quote == 0 && masked[i] != c {
+			// inside a comment
+			out.WriteByte(c)
+			continue
+		}
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			out.WriteByte(c)
+			continue
+		}
+		if c == '"' || c == '\'' {
+			quote = c
+			out.WriteByte(c)
+			continue
+		}
+		if c == '$' {
+			if m := selectParameterUse.FindStringSubmatch(statement[i:]); m != nil {
+				name := m[1]
+				if _, ok := declared[name]; !ok {
+					if !used[name] {
+						problems = append(problems, fmt.Sprintf("parameter $%s is used but not declared, add \"DECLARE $%s number\" (or string)", name, name))
+					}
+				} else {
+					out.WriteString(values[name])
+				}
+				used[name] = true
+				i += len(m[0]) - 1
+				continue
+			}
+		}
+		out.WriteByte(c)
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return out.String(), nil
+}
+
+// selectionJobCount returns the number of jobs the select statement of the config would create
+func selectionJobCount(config Config) (int, error) {
+	if config.SeriesFilterType != "select" {
+		return 0, fmt.Errorf("not a select statement")
+	}
+	ast, errs := Parse(config.SeriesFilter)
+	if len(errs) > 0 {
+		return 0, fmt.Errorf("could not parse the select statement: %s", parseErrorsString(errs, " "))
+	}
+	// explain does not stop if more than one where-clause matches a series
+	explanation := explainMatchingSets(ast, config.Data.DataInfo, "")
+	for _, c := range explanation.Complains {
+		if strings.HasPrefix(c, "Error:") {
+			return 0, errors.New(c)
+		}
+	}
+	return explanation.NumJobs, nil
+}
+
+// selectionsSummary lists the selections of the project together with the number of jobs each creates
+func selectionsSummary(config Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Selections:\n")
+	for _, name := range config.selectionNames() {
+		selected, _ := config.useSelection(name)
+		if selected.SeriesFilterType != "select" {
+			fmt.Fprintf(&b, "  %s: %s filter \"%s\"\n", name, selected.SeriesFilterType, selected.SeriesFilter)
+			continue
+		}
+		numJobs, err := selectionJobCount(selected)
+		if err != nil {
+			fmt.Fprintf(&b, "  %s: %s\n", name, err.Error())
+			continue
+		}
+		postfix := "s"
+		if numJobs == 1 {
+			postfix = ""
+		}
+		fmt.Fprintf(&b, "  %s: %d job%s\n", name, numJobs, postfix)
+	}
+	return b.String()
+}
+
 // writeConfig writes the provided config to the given path
 func (config Config) writeConfig() bool {
+	return config.writeConfigTo(input_dir + "/.ror/config")
+}
+
+// writeConfigTo writes the config to a file, writeConfig uses the config of the current project
+func (config Config) writeConfigTo(dir_path string) bool {
 	var buf bytes.Buffer
 	zw := gzip.NewWriter(&buf)
 
-	dir_path := input_dir + "/.ror/config"
-
 	// Setting the Header fields is optional.
 	zw.Name = dir_path
 	zw.Comment = "see github.com/MMIV-Center/Research-Information-System/"
@@ -340,15 +725,11 @@ func (config Config) writeConfig() bool {
 	}
 
 	if err := zw.Close(); err != nil {
-		log.Fatal(err)
+		return false
 	}
 
 	err = os.WriteFile(dir_path, buf.Bytes(), 0600)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return true
+	return err == nil
 }
 
 type Description struct {
@@ -369,6 +750,11 @@ type Description struct {
 	ProcessDataPath          string
 	ClassifyTypes            []string
 	InputViewDICOMSeriesPath string
+	SOPInstanceUIDs          []string `json:",omitempty"` // only these images are exported (select image)
+	SubSeries                string   `json:",omitempty"` // the images of a virtual sub-series (config --split-series)
+	NiftiPath                string   `json:",omitempty"` // the series as NIfTI in input_nifti/ (config --nifti, trigger --nifti)
+	NiftiError               string   `json:",omitempty"` // why the series could not be converted to NIfTI
+	Deidentification         string   `json:",omitempty"` // the de-identification profile applied to the images in input/
 }
 
 // img.At(x, y).RGBA() returns four uint32 values; we want a Pixel
@@ -1270,7 +1656,7 @@ func showDataset(dataset dicom.Dataset, counter int, path string, info string, v
 
 // copyFiles will copy all DICOM files that fit the string to the dest_path directory.
 // we could display those images as well on the command line - just to impress
-func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string, source_path string, dest_path string, sort_dicom bool, classifyTypes []string, clip []float32, startCounter int) (int, Description) {
+func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string, SelectedSOPInstanceUIDs []string, source_path string, dest_path string, sort_dicom bool, classifyTypes []string, clip []float32, startCounter int, nifti *niftiSeries, deid *deidentifier) (int, Description) {
 
 	destination_path := dest_path + "/input"
 
@@ -1285,6 +1671,12 @@ func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string
 	description.ReferringPhysician = ""
 	description.ProcessDataPath = dest_path
 	description.ClassifyTypes = classifyTypes
+	description.SOPInstanceUIDs = SelectedSOPInstanceUIDs
+	// if we have a list of images only those are copied (select image)
+	selectedSOPs := make(map[string]bool)
+	for _, sop := range SelectedSOPInstanceUIDs {
+		selectedSOPs[sop] = true
+	}
 	counter := startCounter // we are using this to name DICOM files, not possible here!
 	if stdoutIsTTY {
 		fmt.Printf("\033[2J\n") // clear the screen
@@ -1323,6 +1715,29 @@ func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string
 						if SeriesInstanceUID != SelectedSeriesInstanceUID || StudyInstanceUID != SelectedStudyInstanceUID {
 							return nil // ignore that file
 						}
+						if len(selectedSOPs) > 0 {
+							SOPInstanceUIDVal, err := dataset.FindElementByTag(tag.SOPInstanceUID)
+							if err != nil || !selectedSOPs[dicom.MustGetStrings(SOPInstanceUIDVal.Value)[0]] {
+								return nil // not one of the selected images
+							}
+						}
+
+						// the copy in input/ is de-identified, everything below only sees the de-identified image
+						var deidentified []byte
+						if deid != nil {
+							deidentified, err = deid.encode(&dataset)
+							if err != nil {
+								fmt.Printf("Warning: could not de-identify %s, file is not copied: %s\n", path, err.Error())
+								return nil
+							}
+						}
+
+						// the images for input_nifti/, showDataset below changes the pixel values for the terminal
+						if nifti != nil && nifti.err == nil {
+							if err := nifti.add(dataset); err != nil {
+								nifti.err = fmt.Errorf("%s: %s", path, err.Error())
+							}
+						}
 
 						// we can get a version of the image, scale it and print out on the command line
 						// for a trigger call this has to work without the tui interface
@@ -1448,8 +1863,11 @@ func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string
 						}
 
 						outputPath := destination_path
-						inputFile, _ := os.Open(path)
-						data, _ := io.ReadAll(inputFile)
+						data := deidentified
+						if deid == nil {
+							inputFile, _ := os.Open(path)
+							data, _ = io.ReadAll(inputFile)
+						}
 						// what is the next unused filename? We can have this case if other series are exported as well
 						fname := fmt.Sprintf("%06d.dcm", counter)
 						if Modality != "" {
@@ -1530,9 +1948,354 @@ func copyFiles(SelectedSeriesInstanceUID string, SelectedStudyInstanceUID string
 		}
 	}
 	description.NumFiles = counter - startCounter
+	if deid != nil {
+		// the container only knows the new UIDs
+		description.SeriesInstanceUID = deid.uid(description.SeriesInstanceUID)
+		sops := []string{}
+		for _, sop := range description.SOPInstanceUIDs {
+			sops = append(sops, deid.uid(sop))
+		}
+		description.SOPInstanceUIDs = sops
+		description.Deidentification = deid.profile.String()
+	}
 	return description.NumFiles, description
 }
 
+// elementToTagAndValue converts a (non-sequence) DICOM element into the representation we keep in SeriesInfo.All
+func elementToTagAndValue(element *dicom.Element) (TagAndValue, bool) {
+	var tav TagAndValue
+	tav.Tag.Element = element.Tag.Element
+	tav.Tag.Group = element.Tag.Group
+
+	// special treatments for known value representations
+	if element.RawValueRepresentation == "TM" {
+		tav.Value = element.Value.GetValue().([]string)
+		tav.Type = "time"
+		return tav, true
+	}
+
+	if element.RawValueRepresentation == "DT" {
+		tav.Value = element.Value.GetValue().([]string)
+		tav.Type = "datetime"
+		return tav, true
+	}
+
+	if element.RawValueRepresentation == "UI" {
+		tav.Value = element.Value.GetValue().([]string)
+		tav.Type = "uid"
+		return tav, true
+	}
+
+	// private tags of implicit VR files are read as UN, keep their bytes as text so the names of the
+	// private dictionary (and the private creators) can be found
+	if isShortUN(element) {
+		value := strings.TrimRight(string(element.Value.GetValue().([]byte)), "\x00 ")
+		tav.Value = strings.Split(value, "\\")
+		tav.Type = "categorical"
+		if _, err := strconv.ParseFloat(strings.TrimSpace(tav.Value[0]), 64); err == nil {
+			tav.Type = "numeric"
+		}
+		return tav, true
+	}
+
+	switch element.Value.ValueType() {
+	case dicom.Strings:
+		// First try to parse as numeric if possible
+		strValues := element.Value.GetValue().([]string)
+		isNumeric := true
+
+		// Check if all values can be parsed as numbers
+		for _, val := range strValues {
+			// Skip empty strings
+			if val == "" {
+				continue
+			}
+
+			// Try to parse as float first (more general than int)
+			_, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				isNumeric = false
+				break
+			}
+		}
+
+		tav.Value = strValues
+		if isNumeric && len(strValues) > 0 {
+			tav.Type = "numeric"
+		} else {
+			tav.Type = "categorical"
+		}
+		return tav, true
+
+	case dicom.Ints:
+		tav.Value = []string{}
+		for _, v := range element.Value.GetValue().([]int) {
+			tav.Value = append(tav.Value, fmt.Sprintf("%d", v))
+			tav.Type = "numeric"
+		}
+		return tav, len(tav.Value) > 0
+	case dicom.Floats:
+		tav.Value = []string{}
+		for _, v := range element.Value.GetValue().([]float64) {
+			// keep the full precision, %f would round small values like diffusion gradients
+			tav.Value = append(tav.Value, strconv.FormatFloat(v, 'g', -1, 64))
+			tav.Type = "numeric"
+		}
+		return tav, len(tav.Value) > 0
+	}
+	// sequences are handled by sequenceValues
+	//fmt.Printf("Warning: we don't know that type yet %v\n", element.Value.ValueType())
+	return tav, false
+}
+
+// maxUNLength is the size of the largest UN element kept in SeriesInfo.All, longer ones are binary blobs
+// like the Siemens CSA headers
+const maxUNLength = 1024
+
+// isShortUN is true for elements with an unknown value representation that are short enough to be text
+func isShortUN(element *dicom.Element) bool {
+	if element.RawValueRepresentation != "UN" || element.Value.ValueType() != dicom.Bytes {
+		return false
+	}
+	return len(element.Value.GetValue().([]byte)) <= maxUNLength
+}
+
+// limits for indexing sequences, per-frame functional groups can have thousands of items
+const maxSequenceItems = 10
+const maxSequenceDepth = 4
+
+// sequenceValues returns the values of all (non-binary) elements inside the items of a sequence. Each value
+// gets the path of sequence items it was found in, e.g. "5200,9229[0].0018,9112[0]".
+func sequenceValues(element *dicom.Element, prefix string, depth int) []TagAndValue {
+	var values []TagAndValue = make([]TagAndValue, 0)
+	if depth >= maxSequenceDepth || element.Value.ValueType() != dicom.Sequences {
+		return values
+	}
+	for idx, item := range element.Value.GetValue().([]*dicom.SequenceItemValue) {
+		if idx >= maxSequenceItems {
+			break
+		}
+		path := fmt.Sprintf("%04x,%04x[%d]", element.Tag.Group, element.Tag.Element, idx)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		for _, e := range item.GetValue().([]*dicom.Element) {
+			if (e.ValueRepresentation == tag.VRBytes && !isShortUN(e)) || e.ValueRepresentation == tag.VRPixelData {
+				continue
+			}
+			if e.Value.ValueType() == dicom.Sequences {
+				values = append(values, sequenceValues(e, path, depth+1)...)
+				continue
+			}
+			if (e.ValueRepresentation == tag.VRUInt16List || e.ValueRepresentation == tag.VRUInt32List) &&
+				e.Value.ValueType() == dicom.Ints && len(e.Value.GetValue().([]int)) > 16 {
+				continue
+			}
+			if tav, ok := elementToTagAndValue(e); ok {
+				tav.Path = path
+				values = append(values, tav)
+			}
+		}
+	}
+	return values
+}
+
+// instanceInfo extracts the per image information (instanceTags) of a DICOM file
+func instanceInfo(dataset dicom.Dataset, SOPInstanceUID string, path string) InstanceInfo {
+	info := InstanceInfo{SOPInstanceUID: SOPInstanceUID, Path: path, Tags: make([]TagAndValue, 0)}
+	for _, t := range instanceTags {
+		element, err := dataset.FindElementByTag(t)
+		if err != nil {
+			continue
+		}
+		if tav, ok := elementToTagAndValue(element); ok {
+			info.Tags = append(info.Tags, tav)
+		}
+	}
+	return info
+}
+
+// instanceView returns the series as seen from a single image. The image tags replace the
+// tags of the series so rules can be evaluated for each image using evalRulesTree.
+func (data SeriesInfo) instanceView(instance InstanceInfo) SeriesInfo {
+	all := make([]TagAndValue, 0, len(data.All)+len(instance.Tags))
+	for _, tav := range data.All {
+		replaced := false
+		for _, itav := range instance.Tags {
+			if itav.Tag == tav.Tag {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			all = append(all, tav)
+		}
+	}
+	all = append(all, instance.Tags...)
+	data.All = all
+	data.NumImages = 1
+	data.SOPInstanceUIDs = []string{instance.SOPInstanceUID}
+	data.Instances = []InstanceInfo{instance}
+	data.Geometry = nil // the geometry of the single image
+	data.QCStatus, data.QCIssues = "", nil
+	return data
+}
+
+// withComputedFields stores the geometry and the QCStatus of the series, they are computed from
+// the tags of all images
+func (info SeriesInfo) withComputedFields() SeriesInfo {
+	geometry := info.computeGeometry()
+	info.Geometry = &geometry
+	info.QCStatus, info.QCIssues = info.computeQC()
+	return info
+}
+
+// countTypes returns the number of images for the types of a single image
+func countTypes(types []string) map[string]int {
+	counts := make(map[string]int, len(types))
+	for _, t := range types {
+		counts[t]++
+	}
+	return counts
+}
+
+// classifyTypesSummary lists the ClassifyTypes of a series, types that only some of the images
+// have show the number of images, e.g. "axial, localizer (3/120)"
+func (info SeriesInfo) classifyTypesSummary() string {
+	types := []string{}
+	for _, t := range info.ClassifyTypes {
+		if c, ok := info.ClassifyTypeCounts[t]; ok && c < info.NumImages {
+			types = append(types, fmt.Sprintf("%s (%d/%d)", t, c, info.NumImages))
+		} else {
+			types = append(types, t)
+		}
+	}
+	return strings.Join(types, ", ")
+}
+
+// seriesInstanceUID returns the DICOM SeriesInstanceUID of the series stored under key, for
+// sub-series this is the SeriesInstanceUID of the series they are part of
+func (info SeriesInfo) seriesInstanceUID(key string) string {
+	if info.ParentSeriesInstanceUID != "" {
+		return info.ParentSeriesInstanceUID
+	}
+	return key
+}
+
+// subSeriesKey returns the values of the split tags for an image, e.g. "EchoNumbers=2". Images
+// without a tag use an empty value.
+func (instance InstanceInfo) subSeriesKey(splitTags []tag.Tag, names []string) string {
+	parts := []string{}
+	for i, t := range splitTags {
+		value := ""
+		for _, tav := range instance.Tags {
+			if tav.Tag == t {
+				value = strings.Join(tav.Value, "\\")
+				break
+			}
+		}
+		parts = append(parts, names[i]+"="+value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitSeries creates virtual sub-series for series whose images have different values for the tags
+// in splitBy (like EchoNumbers, ImageType or DiffusionBValue). A sub-series is stored as
+// "<SeriesInstanceUID>#<tag>=<value>" next to the other series of the study so select statements can
+// use each of them on its own. Sub-series of an earlier split are merged again first, without tags
+// the series are restored. Only tags stored for each image (instanceTags) can be used.
+func splitSeries(dataInfo map[string]map[string]SeriesInfo, splitBy []string, classifier *Classifier) map[string]map[string]SeriesInfo {
+	splitTags := []tag.Tag{}
+	names := []string{}
+	for _, name := range splitBy {
+		if info, err := tag.FindByName(name); err == nil && slices.Contains(instanceTags, info.Tag) {
+			splitTags = append(splitTags, info.Tag)
+			names = append(names, name)
+		}
+	}
+	classify := func(series SeriesInfo) SeriesInfo {
+		// rules can use the geometry so we compute it first
+		series = series.withComputedFields()
+		if classifier != nil {
+			series.ClassifyTypes, series.ClassifyTypeCounts = classifier.ClassifySeriesCounts(series)
+		}
+		return series
+	}
+	result := make(map[string]map[string]SeriesInfo, len(dataInfo))
+	for studyInstanceUID, study := range dataInfo {
+		// merge sub-series with the images of their series
+		keys := make([]string, 0, len(study))
+		for key := range study {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		merged := make(map[string]SeriesInfo)
+		wasSplit := make(map[string]bool)
+		order := []string{}
+		for _, key := range keys {
+			series := study[key]
+			uid := series.seriesInstanceUID(key)
+			if series.ParentSeriesInstanceUID != "" {
+				wasSplit[uid] = true
+			}
+			m, ok := merged[uid]
+			if !ok {
+				order = append(order, uid)
+				series.ParentSeriesInstanceUID = ""
+				series.SubSeries = ""
+				merged[uid] = series
+				continue
+			}
+			m.NumImages += series.NumImages
+			m.SOPInstanceUIDs = append(append([]string{}, m.SOPInstanceUIDs...), series.SOPInstanceUIDs...)
+			m.Instances = append(append([]InstanceInfo{}, m.Instances...), series.Instances...)
+			for _, a := range series.Annotations {
+				if !slices.Contains(m.Annotations, a) {
+					m.Annotations = append(append([]Annotation{}, m.Annotations...), a)
+				}
+			}
+			merged[uid] = m
+		}
+		result[studyInstanceUID] = make(map[string]SeriesInfo)
+		for _, uid := range order {
+			series := merged[uid]
+			groups := make(map[string][]InstanceInfo)
+			groupKeys := []string{}
+			if len(splitTags) > 0 {
+				for _, instance := range series.Instances {
+					k := instance.subSeriesKey(splitTags, names)
+					if _, ok := groups[k]; !ok {
+						groupKeys = append(groupKeys, k)
+					}
+					groups[k] = append(groups[k], instance)
+				}
+			}
+			if len(groupKeys) < 2 {
+				if wasSplit[uid] {
+					series = classify(series)
+				} else {
+					series = series.withComputedFields()
+				}
+				result[studyInstanceUID][uid] = series
+				continue
+			}
+			for _, k := range groupKeys {
+				sub := series.instanceView(groups[k][0])
+				sub.NumImages = len(groups[k])
+				sub.Instances = groups[k]
+				sub.SOPInstanceUIDs = make([]string, 0, len(groups[k]))
+				for _, instance := range groups[k] {
+					sub.SOPInstanceUIDs = append(sub.SOPInstanceUIDs, instance.SOPInstanceUID)
+				}
+				sub.ParentSeriesInstanceUID = uid
+				sub.SubSeries = k
+				result[studyInstanceUID][uid+"#"+k] = classify(sub)
+			}
+		}
+	}
+	return result
+}
+
 // dataSets parses the config.Data path for DICOM files.
 // It returns the detected studies and series as collections of paths.
 func dataSets(config Config, previous map[string]map[string]SeriesInfo, processCallback func(counter int, nonDICOM int, numStudies int, numSeries int)) (map[string]map[string]SeriesInfo, error) {
@@ -1541,15 +2304,27 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 
 	if previous != nil {
 		datasets = previous
-		for _, study := range datasets {
-			for seriesInstanceUID := range study {
-				initial_list_of_seriesinstanceuids = append(initial_list_of_seriesinstanceuids, seriesInstanceUID)
+		for studyInstanceUID, study := range datasets {
+			for seriesInstanceUID, series := range study {
+				// the files of a sub-series have the SeriesInstanceUID of the series
+				if series.ParentSeriesInstanceUID != "" {
+					seriesInstanceUID = series.ParentSeriesInstanceUID
+				}
+				// the same SeriesInstanceUID can be used in another study (see duplicateCheck)
+				initial_list_of_seriesinstanceuids = append(initial_list_of_seriesinstanceuids, studyInstanceUID+"/"+seriesInstanceUID)
 			}
 		}
 	}
+	duplicates := newDuplicateCheck(config.Data.DuplicatePolicy, datasets)
+	var duplicateErr error
 	if config.Data.Path == "" {
 		return datasets, fmt.Errorf("\033[1mWhat's next?\033[0m\nNo data path for example data has been specified. Use\n\tror config --data \"path-to-data\" to set such a directory of DICOM data")
 	}
+	// the classification rules are checked and compiled once for the whole import
+	classifier, _, err := projectClassifier(input_dir)
+	if err != nil {
+		return datasets, fmt.Errorf("the classification rules are not valid:\n%s", err.Error())
+	}
 	var input_path_list []string
 	if _, err := os.Stat(config.Data.Path); err != nil && os.IsNotExist(err) {
 		// could be list of paths if we have a glob string
@@ -1652,9 +2427,9 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 						SeriesInstanceUID = dicom.MustGetStrings(SeriesInstanceUIDVal.Value)[0]
 					}
 					for _, entry := range initial_list_of_seriesinstanceuids {
-						if entry == SeriesInstanceUID {
+						if entry == StudyInstanceUID+"/"+SeriesInstanceUID {
 							if app != nil {
-								fmt.Fprint(footer, langFmt.Sprintf("SeriesInstanceUID already in cache: %s\n", entry))
+								fmt.Fprint(footer, langFmt.Sprintf("SeriesInstanceUID already in cache: %s\n", SeriesInstanceUID))
 							}
 							return nil
 						}
@@ -1669,6 +2444,18 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 					var all_dicom []*dicom.Element = make([]*dicom.Element, 0)
 					// we should clean out the larger elements based on VR
 					for i := 0; i < len(dataset.Elements); i++ {
+						// short lists of US/UL values are numeric tags we want to select on (e.g. Rows, Columns)
+						if (dataset.Elements[i].ValueRepresentation == tag.VRUInt16List ||
+							dataset.Elements[i].ValueRepresentation == tag.VRUInt32List) &&
+							dataset.Elements[i].Value.ValueType() == dicom.Ints &&
+							len(dataset.Elements[i].Value.GetValue().([]int)) <= 16 {
+							all_dicom = append(all_dicom, dataset.Elements[i])
+							continue
+						}
+						if isShortUN(dataset.Elements[i]) {
+							all_dicom = append(all_dicom, dataset.Elements[i])
+							continue
+						}
 						if !(dataset.Elements[i].ValueRepresentation == tag.VRUInt16List ||
 							dataset.Elements[i].ValueRepresentation == tag.VRUInt32List ||
 							dataset.Elements[i].ValueRepresentation == tag.VRBytes ||
@@ -1676,105 +2463,16 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 							all_dicom = append(all_dicom, dataset.Elements[i]) // append(all[:i], all[i+1:]...)
 						}
 					}
-					// now convert for the All secion
+					// now convert for the All secion, sequences are stored separately with their path
 					var all []TagAndValue = make([]TagAndValue, 0)
+					var sequences []TagAndValue = make([]TagAndValue, 0)
 					for i := 0; i < len(all_dicom); i++ {
-						var tav TagAndValue
-						tav.Tag.Element = all_dicom[i].Tag.Element
-						tav.Tag.Group = all_dicom[i].Tag.Group
-
-						// special treatments for known value representations
-						if all_dicom[i].RawValueRepresentation == "TM" {
-							tav.Value = all_dicom[i].Value.GetValue().([]string)
-							tav.Type = "time"
-							all = append(all, tav)
-							continue // do not check more
-						}
-
-						if all_dicom[i].RawValueRepresentation == "DT" {
-							tav.Value = all_dicom[i].Value.GetValue().([]string)
-							tav.Type = "datetime"
-							all = append(all, tav)
-							continue // do not check more
-						}
-
-						if all_dicom[i].RawValueRepresentation == "UI" {
-							tav.Value = all_dicom[i].Value.GetValue().([]string)
-							tav.Type = "uid"
-							all = append(all, tav)
-							continue // do not check more
+						if all_dicom[i].Value.ValueType() == dicom.Sequences {
+							sequences = append(sequences, sequenceValues(all_dicom[i], "", 0)...)
+							continue
 						}
-
-						switch all_dicom[i].Value.ValueType() {
-						case dicom.Strings:
-							//tav.Value = all_dicom[i].Value.GetValue().([]string)
-							//tav.Type = "categorical"
-							//all = append(all, tav)
-							// First try to parse as numeric if possible
-							strValues := all_dicom[i].Value.GetValue().([]string)
-							isNumeric := true
-
-							// Check if all values can be parsed as numbers
-							for _, val := range strValues {
-								// Skip empty strings
-								if val == "" {
-									continue
-								}
-
-								// Try to parse as float first (more general than int)
-								_, err := strconv.ParseFloat(val, 64)
-								if err != nil {
-									isNumeric = false
-									break
-								}
-							}
-
-							tav.Value = strValues
-							if isNumeric && len(strValues) > 0 {
-								// Convert to numeric representation for consistency
-								numericValues := make([]string, len(strValues))
-								for i, val := range strValues {
-									if val != "" {
-										// fval, _ := strconv.ParseFloat(val, 64)
-										// Format with reasonable precision
-										numericValues[i] = val // fmt.Sprintf("%.6g", fval) // %.6g handles both int and float nicely
-									} else {
-										numericValues[i] = ""
-									}
-								}
-								tav.Value = numericValues
-								tav.Type = "numeric"
-							} else {
-								tav.Type = "categorical"
-							}
+						if tav, ok := elementToTagAndValue(all_dicom[i]); ok {
 							all = append(all, tav)
-
-						case dicom.Ints:
-							tav.Value = []string{}
-							did := false
-							for _, v := range all_dicom[i].Value.GetValue().([]int) {
-								tav.Value = append(tav.Value, fmt.Sprintf("%d", v))
-								tav.Type = "numeric"
-								did = true
-							}
-							if did {
-								all = append(all, tav)
-							}
-						case dicom.Floats:
-							tav.Value = []string{}
-							did := false
-							for _, v := range all_dicom[i].Value.GetValue().([]float64) {
-								tav.Value = append(tav.Value, fmt.Sprintf("%f", v))
-								tav.Type = "numeric"
-								did = true
-							}
-							if did {
-								all = append(all, tav)
-							}
-						default:
-							// todo: handle sequences here
-							//fmt.Printf("Warning: we don't know that type yet %v\n", all_dicom[i].Value.ValueType())
-							// ...
 						}
 					}
 
@@ -1867,6 +2565,13 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 						fmt.Printf("We could not find a SeriesInstanceUID here: %v\n", SeriesInstanceUIDVal)
 						return nil
 					}
+					// re-used SeriesInstanceUIDs and SOPInstanceUIDs (config --duplicates)
+					if keep, err := duplicates.check(StudyInstanceUID, SeriesInstanceUID, SOPInstanceUID, path); err != nil {
+						duplicateErr = err
+						return err
+					} else if !keep {
+						return nil
+					}
 					SeriesDescriptionVal, err := dataset.FindElementByTag(tag.SeriesDescription)
 					if err == nil {
 						SeriesDescription = dicom.MustGetStrings(SeriesDescriptionVal.Value)[0]
@@ -1903,6 +2608,8 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 						abs_path = path
 					}
 					var path_pieces string = filepath.Dir(abs_path)
+					// every image is classified, the series counts how many images have each type
+					instanceTypes := classifier.Classify(dataset)
 
 					if _, ok := datasets[StudyInstanceUID]; ok {
 						if val, ok := datasets[StudyInstanceUID][SeriesInstanceUID]; ok {
@@ -1923,7 +2630,7 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 									break
 								}
 							}
-							tmp_with_double := append(val.ClassifyTypes, ClassifyDICOM(dataset)...)
+							tmp_with_double := append(val.ClassifyTypes, instanceTypes...)
 							// compute a unique list of entries in val.Classify
 							var unique_map map[string]string = make(map[string]string)
 							for _, v := range tmp_with_double {
@@ -1933,6 +2640,14 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 							for k := range unique_map {
 								val.ClassifyTypes = append(val.ClassifyTypes, k)
 							}
+							// the map can be shared with a previous version of the data cache
+							counts := make(map[string]int, len(val.ClassifyTypeCounts)+len(instanceTypes))
+							for k, v := range val.ClassifyTypeCounts {
+								counts[k] = v
+							}
+							for _, t := range instanceTypes {
+								counts[t]++
+							}
 							datasets[StudyInstanceUID][SeriesInstanceUID] = SeriesInfo{NumImages: val.NumImages + 1,
 								SeriesDescription:     SeriesDescription,
 								SeriesNumber:          SeriesNumber,
@@ -1945,8 +2660,11 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 								PatientID:             PatientID,
 								PatientName:           PatientName,
 								All:                   all,
+								Sequences:             sequences,
 								ClassifyTypes:         val.ClassifyTypes, // only parse the first image? No, we need to parse all because we have to collect all possible classes for Localizer (aixal + coronal + sagittal)
+								ClassifyTypeCounts:    counts,
 								SOPInstanceUIDs:       append(val.SOPInstanceUIDs, SOPInstanceUID),
+								Instances:             append(val.Instances, instanceInfo(dataset, SOPInstanceUID, abs_path)),
 							}
 						} else {
 							// if there is no SeriesInstanceUID but there is a StudyInstanceUID we could have
@@ -1967,8 +2685,11 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 								PatientName:           PatientName,
 								Path:                  path_pieces,
 								All:                   all,
-								ClassifyTypes:         ClassifyDICOM(dataset),
+								Sequences:             sequences,
+								ClassifyTypes:         instanceTypes,
+								ClassifyTypeCounts:    countTypes(instanceTypes),
 								SOPInstanceUIDs:       firstSOP,
+								Instances:             []InstanceInfo{instanceInfo(dataset, SOPInstanceUID, abs_path)},
 							}
 						}
 					} else {
@@ -1987,8 +2708,11 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 							PatientName:           PatientName,
 							Path:                  path_pieces,
 							All:                   all,
-							ClassifyTypes:         ClassifyDICOM(dataset),
+							Sequences:             sequences,
+							ClassifyTypes:         instanceTypes,
+							ClassifyTypeCounts:    countTypes(instanceTypes),
 							SOPInstanceUIDs:       firstSOP,
+							Instances:             []InstanceInfo{instanceInfo(dataset, SOPInstanceUID, abs_path)},
 						}
 					}
 				} else {
@@ -2006,12 +2730,19 @@ func dataSets(config Config, previous map[string]map[string]SeriesInfo, processC
 			}
 			return nil
 		})
+		if duplicateErr != nil {
+			return datasets, fmt.Errorf("duplicate found during import (config --duplicates %s): %s", duplicatesFail, duplicateErr.Error())
+		}
 		if err != nil {
 			fmt.Println("Warning: could not walk this path")
 		}
 	}
+	if n := duplicates.apply(datasets); n > 0 && processCallback == nil {
+		fmt.Printf("Warning: found %d problems with duplicated UIDs, see Duplicates in %s status --all\n", n, own_name)
+	}
 
-	return datasets, nil
+	// series with several echoes, b-values or image types can be split into sub-series
+	return splitSeries(datasets, config.Data.SplitSeries, classifier), nil
 }
 
 // createStub will check if the folder exists and create a text file
@@ -2614,6 +3345,42 @@ type SeriesInstanceUIDWithName struct {
 	PatientName       string `json:"patient_name" jsonschema:"DICOM tag PatientName for this series"`
 	Name              string `json:"name" jsonschema:"name assigned to this series by the select statement"`
 	Order             int    `json:"job_number" jsonschema:"job number for this series for processing"`
+	// for 'select image' or 'where image has' only the matching images are exported
+	SOPInstanceUIDs []string `json:"sop_instance_uids,omitempty" jsonschema:"DICOM tag SOPInstanceUID of the matching images, empty if all images of the series are used"`
+}
+
+// isImageLevel returns true if the where-clause idx is evaluated for each image of a series
+func (ast AST) isImageLevel(idx int) bool {
+	if ast.Output_level == "image" {
+		return true
+	}
+	return idx < len(ast.Select_level_by_rule) && ast.Select_level_by_rule[idx] == "image"
+}
+
+// evalClause checks if the where-clause idx matches the series. For image level clauses
+// the clause is evaluated for each image and the matching SOPInstanceUIDs are returned.
+func (data SeriesInfo) evalClause(ast AST, idx int) (bool, string, []string) {
+	if !ast.isImageLevel(idx) {
+		ok, failureReason := data.evalRulesTree(ast.RulesTree[idx].Rs)
+		return ok, failureReason, nil
+	}
+	if len(data.Instances) == 0 {
+		return false, "No per image information for this series, re-import the data to use 'select image'", nil
+	}
+	sops := make([]string, 0)
+	firstFailureReason := ""
+	for _, instance := range data.Instances {
+		ok, failureReason := data.instanceView(instance).evalRulesTree(ast.RulesTree[idx].Rs)
+		if ok {
+			sops = append(sops, instance.SOPInstanceUID)
+		} else if firstFailureReason == "" {
+			firstFailureReason = failureReason
+		}
+	}
+	if len(sops) == 0 {
+		return false, fmt.Sprintf("None of the %d images matches, first image: %s", len(data.Instances), firstFailureReason), nil
+	}
+	return true, "", sops
 }
 
 // findMatchingSets returns all matching sets for this rule and the provided data
@@ -2625,14 +3392,15 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 	// not needed anymore...
 	//var names [][]string = make([][]string, 0)
 	// can only access the information in config.Data for these matches
-	// TODO: make sure that the keys are secured by StudyInstanceUID and SeriesInstanceUID
-	// Users might re-use a seriesInstanceUID in several studies
+	// Users might re-use a SeriesInstanceUID in several studies, series of a patient are
+	// therefore stored by StudyInstanceUID and SeriesInstanceUID (seriesKey)
 
 	type IndexWithMeta struct {
 		SeriesInstanceUID string
 		StudyInstanceUID  string
 		PatientName       string
-		idx               int // the index of the matching RulesTreeSet
+		idx               int      // the index of the matching RulesTreeSet
+		sops              []string // matching images for image level where-clauses
 	}
 
 	seriesByStudy := make(map[string]map[string][]IndexWithMeta)
@@ -2660,6 +3428,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 			// we assume here that we are in the series level...
 			var matches bool = false
 			var matchesIdx int = -1
+			var matchesSOPs []string
 			/*for idx := 0; idx < len(ast.RulesTree); idx++ {
 				if value2.evalRulesTree(ast.RulesTree[idx].Rs) {
 					fmt.Printf("YES THIS RULE WORKS")
@@ -2667,10 +3436,11 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 			}*/
 
 			for idx := 0; idx < len(ast.RulesTree); idx++ {
-				ruleset := ast.RulesTree[idx]
 				//for idx, ruleset := range ast.Rules { // todo: check if this works if a ruleset matches the 2 series
-				if ok, failureReason := value2.evalRulesTree(ruleset.Rs); ok { // check if this ruleset fits with this series
+				// the failure reasons are collected by explainMatchingSets (ror status --explain)
+				if ok, _, sops := value2.evalClause(ast, idx); ok { // check if this ruleset fits with this series
 					matches = true
+					matchesSOPs = sops
 					matchesIdx = idx // this corresponds to the ruleset but only ast.Rules_list_names contains the name for it <-  no longer true
 					// we assume here that if one rule works that none of the other rules will work as well
 					// we should check this and warn the user (go throught the rest of the list to make sure)
@@ -2678,20 +3448,14 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 						if idx2 == matchesIdx {
 							continue
 						}
-						ruleset := ast.RulesTree[idx2]
-						if ok, failureReason := value2.evalRulesTree(ruleset.Rs); ok {
+						if ok, _, _ := value2.evalClause(ast, idx2); ok {
 							// error case
 							var str string = fmt.Sprintf("Error: More than one rule matches a series. Series %s could be both \"%s\" and \"%s\". This would result in a random assignment.", SeriesInstanceUID, ast.RulesTree[matchesIdx].Name, ast.RulesTree[idx2].Name)
 							fmt.Println(str)
 							exitGracefully(fmt.Errorf("Stop here, fix the select statement\n%s\n%s", ast2Select(ast), str))
-						} else {
-							// when do we want to display the failure reason?
-							_ = failureReason
 						}
 					}
 					break
-				} else {
-					_ = failureReason
 				}
 			}
 
@@ -2729,6 +3493,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 					StudyInstanceUID:  StudyInstanceUID,
 					PatientName:       PatientName,
 					idx:               matchesIdx,
+					sops:              matchesSOPs,
 				}
 				if _, ok := seriesByStudy[StudyInstanceUID][SeriesInstanceUID]; !ok {
 					seriesByStudy[StudyInstanceUID][SeriesInstanceUID] = []IndexWithMeta{one_index}
@@ -2738,11 +3503,8 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 				if _, ok := seriesByPatient[PatientName]; !ok {
 					seriesByPatient[PatientName] = make(map[string][]IndexWithMeta)
 				}
-				if _, ok := seriesByPatient[PatientName][SeriesInstanceUID]; !ok {
-					seriesByPatient[PatientName][SeriesInstanceUID] = []IndexWithMeta{one_index}
-				} else {
-					seriesByPatient[PatientName][SeriesInstanceUID] = append(seriesByPatient[PatientName][SeriesInstanceUID], one_index)
-				}
+				seriesKey := StudyInstanceUID + "/" + SeriesInstanceUID
+				seriesByPatient[PatientName][seriesKey] = append(seriesByPatient[PatientName][seriesKey], one_index)
 				// single level append here
 				var series_instance_uid_with_name = SeriesInstanceUIDWithName{
 					SeriesInstanceUID: SeriesInstanceUID,
@@ -2750,6 +3512,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 					PatientName:       PatientName,
 					Name:              ast.Rules[matchesIdx].Name,
 					Order:             len(selectFromB),
+					SOPInstanceUIDs:   matchesSOPs,
 				}
 				selectFromB = append(selectFromB, []SeriesInstanceUIDWithName{series_instance_uid_with_name})
 				// we should not need this anymore...
@@ -2761,46 +3524,52 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 	// the same SeriesInstanceUID is used for more than one StudyInstanceUID we should
 	// warn/refuse to process.
 	var complains []string = make([]string, 0)
-	for pid, value := range seriesByPatient {
-		for SeriesInstanceUID := range value {
-			// build a cache of SOPInstanceUIDs as a map
-			sopMap := make(map[string]struct{})
-			var indexwithmeta = value[SeriesInstanceUID][0]
-			var sops []string = dataInfo[indexwithmeta.StudyInstanceUID][indexwithmeta.SeriesInstanceUID].SOPInstanceUIDs
-			for _, sop := range sops {
-				sopMap[sop] = struct{}{}
-			}
-
-			// do we have that SeriesInstanceUID somewhere else?
-			for pid2, value2 := range seriesByPatient {
-				if pid == pid2 {
-					continue
-				}
-
-				for SeriesInstanceUID2 := range value2 {
-					if SeriesInstanceUID == SeriesInstanceUID2 {
-						// add a complain
-						complains = append(complains, "Warning: Patient "+pid+" series "+SeriesInstanceUID+" also present in patient "+pid2+". SeriesInstanceUID should be unique!")
-						//break
-					}
-					// check for duplicate sopinstanceuids...
-					for vv := range value[SeriesInstanceUID2] {
-						var indexwithmeta2 = value[SeriesInstanceUID2][vv]
-						var sops []string = dataInfo[indexwithmeta2.StudyInstanceUID][indexwithmeta2.SeriesInstanceUID].SOPInstanceUIDs
-						for _, sop := range sops {
-							if _, ok := sopMap[sop]; !ok {
-								// found a duplicate key
-								complains = append(complains, "Warning: Patient "+pid+" study "+indexwithmeta.StudyInstanceUID+" and "+indexwithmeta2.StudyInstanceUID+" series "+indexwithmeta.SeriesInstanceUID+" and "+indexwithmeta2.SeriesInstanceUID+" have a duplicate SOPInstanceUID "+sop+". SOPInstanceUIDs should be unique!")
-							}
-						}
-					}
-				}
+	patientsBySeries := make(map[string][]string)
+	patientsBySOP := make(map[string][]string)
+	pids := make([]string, 0, len(seriesByPatient))
+	for pid := range seriesByPatient {
+		pids = append(pids, pid)
+	}
+	sort.Strings(pids)
+	for _, pid := range pids {
+		for _, indexes := range seriesByPatient[pid] {
+			indexwithmeta := indexes[0]
+			if !slices.Contains(patientsBySeries[indexwithmeta.SeriesInstanceUID], pid) {
+				patientsBySeries[indexwithmeta.SeriesInstanceUID] = append(patientsBySeries[indexwithmeta.SeriesInstanceUID], pid)
 			}
-			if len(complains) > 0 {
-				break // only show the first set
+			for _, sop := range dataInfo[indexwithmeta.StudyInstanceUID][indexwithmeta.SeriesInstanceUID].SOPInstanceUIDs {
+				if !slices.Contains(patientsBySOP[sop], pid) {
+					patientsBySOP[sop] = append(patientsBySOP[sop], pid)
+				}
 			}
 		}
 	}
+	for SeriesInstanceUID, patients := range patientsBySeries {
+		if len(patients) > 1 {
+			complains = append(complains, "Warning: series "+SeriesInstanceUID+" is present in patients "+strings.Join(patients, ", ")+". SeriesInstanceUID should be unique!")
+		}
+	}
+	for sop, patients := range patientsBySOP {
+		if len(patients) > 1 {
+			complains = append(complains, "Warning: SOPInstanceUID "+sop+" is present in patients "+strings.Join(patients, ", ")+". SOPInstanceUIDs should be unique!")
+			break // only show the first one
+		}
+	}
+	sort.Strings(complains)
+
+	// HAVING rules are evaluated on all series of a study (or patient) after grouping
+	havingOK := func(level string, key string, value map[string][]IndexWithMeta) bool {
+		if len(ast.HavingRules) == 0 {
+			return true
+		}
+		names := make(map[string]string)
+		for k := range value {
+			names[value[k][0].SeriesInstanceUID] = ast.Rules[value[k][0].idx].Name
+		}
+		// the failure reasons are collected by explainMatchingSets (ror status --explain)
+		ok, _ := ast.evalHaving(havingGroup(dataInfo, level, key, names))
+		return ok
+	}
 
 	// TODO: should we have a series level here as well?
 	if ast.Output_level == "study" {
@@ -2809,7 +3578,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 		selectFromB = make([][]SeriesInstanceUIDWithName, 0)
 		// don't need this anymore
 		//names = make([][]string, 0)
-		for _, value := range seriesByStudy {
+		for StudyInstanceUID, value := range seriesByStudy {
 			// which rules need to match?
 			// all rules from 0..len(ast.Rules)
 			allThere := true
@@ -2830,6 +3599,9 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 					break
 				}
 			}
+			if allThere && !havingOK("study", StudyInstanceUID, value) {
+				allThere = false
+			}
 			if allThere {
 				// only append our series for this study
 				// append all SeriesInstanceUIDs now
@@ -2837,11 +3609,12 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 				//var snames []string
 				for k := range value {
 					sss := SeriesInstanceUIDWithName{
-						SeriesInstanceUID: k,
+						SeriesInstanceUID: value[k][0].SeriesInstanceUID,
 						StudyInstanceUID:  value[k][0].StudyInstanceUID,
 						PatientName:       value[k][0].PatientName,
 						Name:              ast.Rules[value[k][0].idx].Name,
 						Order:             len(selectFromB),
+						SOPInstanceUIDs:   value[k][0].sops,
 					}
 					ss = append(ss, sss)
 					//snames = append(snames, ast.Rules[value[k][0]].Name)
@@ -2857,7 +3630,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 		selectFromB = make([][]SeriesInstanceUIDWithName, 0)
 		// should not need this anymore
 		//names = make([][]string, 0)
-		for _, value := range seriesByPatient {
+		for PatientName, value := range seriesByPatient {
 			// which rules need to match?
 			// all rules from 0..len(ast.Rules)
 			allThere := true
@@ -2878,6 +3651,9 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 					break
 				}
 			}
+			if allThere && !havingOK("patient", PatientName, value) {
+				allThere = false
+			}
 			if allThere {
 				// only append our series for this study
 				// append all SeriesInstanceUIDs now
@@ -2885,11 +3661,12 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 				//var snames []string
 				for k := range value {
 					sss := SeriesInstanceUIDWithName{
-						SeriesInstanceUID: k,
+						SeriesInstanceUID: value[k][0].SeriesInstanceUID,
 						StudyInstanceUID:  value[k][0].StudyInstanceUID,
 						PatientName:       value[k][0].PatientName,
 						Name:              ast.Rules[value[k][0].idx].Name,
 						Order:             len(selectFromB),
+						SOPInstanceUIDs:   value[k][0].sops,
 					}
 					ss = append(ss, sss)
 					// should not be needed anymore
@@ -2909,7 +3686,7 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 		var ss []SeriesInstanceUIDWithName
 		//var snames []string
 		//currentNamesByRule := make([]string, 0)
-		for _, value := range seriesByPatient {
+		for PatientName, value := range seriesByPatient {
 			// which rules need to match?
 			// all rules from 0..len(ast.Rules)
 			allThere := true
@@ -2929,14 +3706,19 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 					break
 				}
 			}
+			if allThere && !havingOK("patient", PatientName, value) {
+				allThere = false
+			}
 			if allThere {
 				// only append our series for this study
 				// append all SeriesInstanceUIDs now
 				for k := range value {
 					sss := SeriesInstanceUIDWithName{
-						SeriesInstanceUID: k,
+						SeriesInstanceUID: value[k][0].SeriesInstanceUID,
+						StudyInstanceUID:  value[k][0].StudyInstanceUID,
 						Name:              ast.Rules[value[k][0].idx].Name,
 						Order:             len(selectFromB),
+						SOPInstanceUIDs:   value[k][0].sops,
 					}
 					ss = append(ss, sss)
 					// should not be needed anymore
@@ -2947,11 +3729,38 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 		selectFromB = append(selectFromB, ss)
 		// should not be needed anymore
 		//names = append(names, snames)
-	} else if ast.Output_level == "series" {
-		// we don't need to do anything here, series is default
+	} else if ast.Output_level == "series" || ast.Output_level == "image" {
+		// series is default, only HAVING rules (evaluated on the study of each series) can remove series here
+		if len(ast.HavingRules) > 0 {
+			studyOK := make(map[string]bool)
+			for StudyInstanceUID, value := range seriesByStudy {
+				studyOK[StudyInstanceUID] = havingOK("study", StudyInstanceUID, value)
+			}
+			selectFromHaving := make([][]SeriesInstanceUIDWithName, 0)
+			for _, set := range selectFromB {
+				if studyOK[set[0].StudyInstanceUID] {
+					set[0].Order = len(selectFromHaving)
+					selectFromHaving = append(selectFromHaving, set)
+				}
+			}
+			selectFromB = selectFromHaving
+		}
+		if ast.Output_level == "image" {
+			// each matching image is a job
+			selectFromImages := make([][]SeriesInstanceUIDWithName, 0)
+			for _, set := range selectFromB {
+				for _, sop := range set[0].SOPInstanceUIDs {
+					entry := set[0]
+					entry.SOPInstanceUIDs = []string{sop}
+					entry.Order = len(selectFromImages)
+					selectFromImages = append(selectFromImages, []SeriesInstanceUIDWithName{entry})
+				}
+			}
+			selectFromB = selectFromImages
+		}
 	} else {
 		// give up here, no valid info and error message
-		return [][]SeriesInstanceUIDWithName{}, []string{"Error: unknown \"SELECT FROM XXX...\" statement, should be \"SELECT FROM series|study|project|participant...\""}
+		return [][]SeriesInstanceUIDWithName{}, []string{"Error: unknown \"SELECT FROM XXX...\" statement, should be \"SELECT FROM image|series|study|project|participant...\""}
 	}
 
 	// we need to check the CheckRules as well - if we have those we might loose some more entries here
@@ -3129,6 +3938,440 @@ func findMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo) ([][]S
 	return outSelect, complains // , outNames
 }
 
+// havingSeries is one series of a study or patient used to evaluate the HAVING rules
+type havingSeries struct {
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	Name              string // name of the where-clause the series is assigned to, empty if none
+	Info              SeriesInfo
+}
+
+// havingGroup returns all series of a study (level "study") or of a patient (any other level) together
+// with the names the where-clauses assigned to them
+func havingGroup(dataInfo map[string]map[string]SeriesInfo, level string, key string, names map[string]string) []havingSeries {
+	group := make([]havingSeries, 0)
+	for StudyInstanceUID, study := range dataInfo {
+		if level == "study" && StudyInstanceUID != key {
+			continue
+		}
+		for SeriesInstanceUID, series := range study {
+			if level != "study" && series.patientIdentifier() != key {
+				continue
+			}
+			group = append(group, havingSeries{
+				StudyInstanceUID:  StudyInstanceUID,
+				SeriesInstanceUID: SeriesInstanceUID,
+				Name:              names[SeriesInstanceUID],
+				Info:              series,
+			})
+		}
+	}
+	return group
+}
+
+// spanValue converts a tag value to a number, dates (DA) are counted in days, times (TM) in seconds
+func spanValue(vr string, value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	switch vr {
+	case "DA", "DT":
+		if len(value) < 8 {
+			return 0, false
+		}
+		t, err := time.Parse("20060102", value[:8])
+		if err != nil {
+			return 0, false
+		}
+		return float64(t.Unix()) / (24 * 60 * 60), true
+	case "TM":
+		if len(value) < 6 {
+			return 0, false
+		}
+		h, err1 := strconv.Atoi(value[0:2])
+		m, err2 := strconv.Atoi(value[2:4])
+		sec, err3 := strconv.ParseFloat(value[4:], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return 0, false
+		}
+		return float64(h*3600+m*60) + sec, true
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	return v, err == nil
+}
+
+// tagVR returns the value representation of a rule tag from the DICOM dictionary
+func tagVR(t []string) string {
+	var info tag.Info
+	var err error
+	if len(t) == 2 {
+		g, _ := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(t[0]), "0x"), 16, 64)
+		e, _ := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(t[1]), "0x"), 16, 64)
+		info, err = tag.Find(tag.Tag{Group: uint16(g), Element: uint16(e)})
+	} else if len(t) == 1 {
+		name := t[0]
+		if isTagPath(name) {
+			name = name[strings.LastIndex(name, ".")+1:]
+		}
+		info, err = tag.FindByName(name)
+	} else {
+		return ""
+	}
+	if err != nil || len(info.VRs) == 0 {
+		return ""
+	}
+	return info.VRs[0]
+}
+
+// value computes the aggregate of the having rule for a group of series
+func (h HavingRule) value(group []havingSeries) (float64, error) {
+	if h.Function == "span" {
+		vr := tagVR(h.Tag)
+		found := false
+		minV, maxV := 0.0, 0.0
+		for _, s := range group {
+			values, failureReason := s.Info.ruleValues(Rule{Tag: h.Tag, Index: h.Index})
+			if failureReason != "" {
+				continue
+			}
+			for _, v := range values {
+				if num, ok := spanValue(vr, v); ok {
+					if !found || num < minV {
+						minV = num
+					}
+					if !found || num > maxV {
+						maxV = num
+					}
+					found = true
+				}
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("no values found")
+		}
+		return maxV - minV, nil
+	}
+	// count
+	studies := make(map[string]bool)
+	patients := make(map[string]bool)
+	numSeries := 0
+	numImages := 0
+	for _, s := range group {
+		if h.Name != "" && s.Name != h.Name {
+			continue
+		}
+		images := s.Info.NumImages
+		if h.Rs != nil {
+			if h.Level == "image" && len(s.Info.Instances) > 0 {
+				images = 0
+				for _, instance := range s.Info.Instances {
+					if ok, _ := s.Info.instanceView(instance).evalRulesTree(*h.Rs); ok {
+						images++
+					}
+				}
+				if images == 0 {
+					continue
+				}
+			} else if ok, _ := s.Info.evalRulesTree(*h.Rs); !ok {
+				continue
+			}
+		}
+		studies[s.StudyInstanceUID] = true
+		patients[s.Info.patientIdentifier()] = true
+		numSeries++
+		numImages += images
+	}
+	switch h.Level {
+	case "project", "patient":
+		return float64(len(patients)), nil
+	case "study":
+		return float64(len(studies)), nil
+	case "image":
+		return float64(numImages), nil
+	}
+	return float64(numSeries), nil
+}
+
+// toString returns the having rule in the syntax of the select statement
+func (h HavingRule) toString() string {
+	arg := ""
+	if h.Function == "span" {
+		arg = formatSelectTag(h.Tag, h.Index)
+	} else {
+		arg = h.Level
+		if h.Name != "" {
+			arg = fmt.Sprintf("%s NAMED %s", arg, formatSelectValue(h.Name))
+		} else if h.Rs != nil {
+			arg = fmt.Sprintf("%s WHERE %s", arg, formatSelectRuleList(h.Rs.Rs1, " "))
+		}
+	}
+	return fmt.Sprintf("%s(%s) %s %g", h.Function, arg, h.Operator, h.Value)
+}
+
+// evalHaving checks all HAVING rules for a group of series, the reason explains the first failing rule
+func (ast AST) evalHaving(group []havingSeries) (bool, string) {
+	for _, h := range ast.HavingRules {
+		v, err := h.value(group)
+		if err != nil {
+			return false, fmt.Sprintf("HAVING %s failed, %s", h.toString(), err.Error())
+		}
+		ok := false
+		if h.Operator == "==" {
+			ok = math.Abs(v-h.Value) < approxEpsilon
+		} else {
+			ok = compareNumeric(h.Operator, v, h.Value)
+		}
+		if !ok {
+			return false, fmt.Sprintf("HAVING %s failed, value is %g", h.toString(), v)
+		}
+	}
+	return true, ""
+}
+
+// ClauseExplanation is the result of one named where-clause for a single series
+type ClauseExplanation struct {
+	Name    string `json:"name" jsonschema:"name of the where-clause (series NAMED ...)"`
+	Matches bool   `json:"matches" jsonschema:"true if the series matches this where-clause"`
+	Reason  string `json:"reason,omitempty" jsonschema:"the failing leaf rule(s) with the actual tag value"`
+}
+
+// SeriesExplanation lists for a series the result of each where-clause
+type SeriesExplanation struct {
+	SeriesInstanceUID string              `json:"series_instance_uid" jsonschema:"DICOM tag SeriesInstanceUID"`
+	StudyInstanceUID  string              `json:"study_instance_uid" jsonschema:"DICOM tag StudyInstanceUID"`
+	PatientName       string              `json:"patient_name" jsonschema:"patient identifier"`
+	SeriesDescription string              `json:"series_description" jsonschema:"DICOM tag SeriesDescription"`
+	Assigned          string              `json:"assigned" jsonschema:"name of the where-clause this series is assigned to, empty if none matches"`
+	Clauses           []ClauseExplanation `json:"clauses" jsonschema:"result for each where-clause"`
+}
+
+// SetExplanation explains for a study (or patient) why a complete set of series could (not) be formed
+type SetExplanation struct {
+	Level    string   `json:"level" jsonschema:"study or patient"`
+	Key      string   `json:"key" jsonschema:"StudyInstanceUID or patient identifier"`
+	Complete bool     `json:"complete" jsonschema:"true if this set results in a job"`
+	Missing  []string `json:"missing" jsonschema:"names of where-clauses without a matching series"`
+	Reason   string   `json:"reason" jsonschema:"human readable explanation"`
+}
+
+// SelectExplanation is the output of explain mode
+type SelectExplanation struct {
+	OutputLevel string              `json:"output_level" jsonschema:"the output level of the select statement"`
+	NumJobs     int                 `json:"num_jobs" jsonschema:"number of jobs the select statement creates"`
+	Series      []SeriesExplanation `json:"series" jsonschema:"per series results"`
+	Sets        []SetExplanation    `json:"sets" jsonschema:"per study or patient results"`
+	Complains   []string            `json:"complains" jsonschema:"problems found in the data or the select statement"`
+}
+
+// explainMatchingSets evaluates every where-clause for every series (or only for the series
+// provided) and explains for each study/patient why it does (not) form a complete set. It
+// uses the same rules as findMatchingSets but collects the failure reasons instead of dropping them.
+func explainMatchingSets(ast AST, dataInfo map[string]map[string]SeriesInfo, onlySeriesInstanceUID string) SelectExplanation {
+	explanation := SelectExplanation{
+		OutputLevel: ast.Output_level,
+		Series:      make([]SeriesExplanation, 0),
+		Sets:        make([]SetExplanation, 0),
+		Complains:   make([]string, 0),
+	}
+	clauseName := func(idx int) string {
+		if idx < len(ast.RulesTree) && ast.RulesTree[idx].Name != "" {
+			return ast.RulesTree[idx].Name
+		}
+		return fmt.Sprintf("unnamed_rule_%d", idx)
+	}
+
+	// for each set (study or patient) which clauses have a matching series
+	setLevel := "study"
+	if ast.Output_level == "patient" || ast.Output_level == "project" {
+		setLevel = "patient"
+	}
+	found := make(map[string]map[int]int) // set key -> clause -> number of series
+	assigned := make(map[string]string)   // SeriesInstanceUID -> name of the where-clause
+	onlySet := ""
+	ambiguous := false
+
+	StudyInstanceUIDKeys := []string{}
+	for key := range dataInfo {
+		StudyInstanceUIDKeys = append(StudyInstanceUIDKeys, key)
+	}
+	sort.Strings(StudyInstanceUIDKeys)
+	for _, StudyInstanceUID := range StudyInstanceUIDKeys {
+		SeriesInstanceUIDKeys := []string{}
+		for key := range dataInfo[StudyInstanceUID] {
+			SeriesInstanceUIDKeys = append(SeriesInstanceUIDKeys, key)
+		}
+		sort.Strings(SeriesInstanceUIDKeys)
+		for _, SeriesInstanceUID := range SeriesInstanceUIDKeys {
+			series := dataInfo[StudyInstanceUID][SeriesInstanceUID]
+			setKey := StudyInstanceUID
+			if setLevel == "patient" {
+				setKey = series.patientIdentifier()
+			}
+			if _, ok := found[setKey]; !ok {
+				found[setKey] = make(map[int]int)
+			}
+			se := SeriesExplanation{
+				SeriesInstanceUID: SeriesInstanceUID,
+				StudyInstanceUID:  StudyInstanceUID,
+				PatientName:       series.patientIdentifier(),
+				SeriesDescription: series.SeriesDescription,
+				Clauses:           make([]ClauseExplanation, 0),
+			}
+			matched := make([]string, 0)
+			for idx := 0; idx < len(ast.RulesTree); idx++ {
+				ok, failureReason, _ := series.evalClause(ast, idx)
+				ce := ClauseExplanation{Name: clauseName(idx), Matches: ok}
+				if !ok {
+					ce.Reason = strings.TrimSpace(failureReason)
+				} else {
+					if len(matched) == 0 {
+						se.Assigned = ce.Name
+						assigned[SeriesInstanceUID] = ast.Rules[idx].Name
+						found[setKey][idx]++
+					}
+					matched = append(matched, ce.Name)
+				}
+				se.Clauses = append(se.Clauses, ce)
+			}
+			if len(matched) > 1 {
+				ambiguous = true
+				explanation.Complains = append(explanation.Complains, fmt.Sprintf("Error: More than one rule matches a series. Series %s could be %s. This would result in a random assignment.", SeriesInstanceUID, strings.Join(matched, " and ")))
+			}
+			if onlySeriesInstanceUID == "" || onlySeriesInstanceUID == SeriesInstanceUID {
+				explanation.Series = append(explanation.Series, se)
+				if onlySeriesInstanceUID != "" {
+					onlySet = setKey
+				}
+			}
+		}
+	}
+	if onlySeriesInstanceUID != "" && onlySet == "" {
+		explanation.Complains = append(explanation.Complains, fmt.Sprintf("Series %s not found in the loaded data.", onlySeriesInstanceUID))
+	}
+
+	// the final list of jobs also knows about the check rules
+	var matches [][]SeriesInstanceUIDWithName
+	if ambiguous {
+		explanation.Complains = append(explanation.Complains, "Fix the select statement, no jobs can be created while a series matches more than one where-clause.")
+	} else {
+		var complains []string
+		matches, complains = findMatchingSets(ast, dataInfo)
+		explanation.NumJobs = len(matches)
+		explanation.Complains = append(explanation.Complains, complains...)
+	}
+	inJob := make(map[string]bool)
+	for _, set := range matches {
+		for _, s := range set {
+			inJob[s.SeriesInstanceUID] = true
+		}
+	}
+
+	setKeys := []string{}
+	for key := range found {
+		setKeys = append(setKeys, key)
+	}
+	sort.Strings(setKeys)
+	for _, key := range setKeys {
+		if onlySet != "" && key != onlySet {
+			continue
+		}
+		if onlySeriesInstanceUID != "" && onlySet == "" {
+			continue
+		}
+		sx := SetExplanation{Level: setLevel, Key: key, Missing: make([]string, 0)}
+		numMatched := 0
+		for idx := 0; idx < len(ast.RulesTree); idx++ {
+			if found[key][idx] == 0 {
+				sx.Missing = append(sx.Missing, clauseName(idx))
+			}
+			numMatched += found[key][idx]
+		}
+		if ast.Output_level == "series" || ast.Output_level == "image" {
+			// every matching series (image) is its own job
+			sx.Complete = numMatched > 0
+			if sx.Complete {
+				sx.Reason = fmt.Sprintf("%d series match, each series is a job", numMatched)
+				if len(ast.HavingRules) > 0 {
+					// HAVING rules look at all series of the study
+					if ok, reason := ast.evalHaving(havingGroup(dataInfo, setLevel, key, assigned)); !ok {
+						sx.Complete = false
+						sx.Reason = reason
+					}
+				}
+			} else {
+				sx.Reason = "no series matches any where-clause"
+			}
+		} else if len(sx.Missing) > 0 {
+			sx.Reason = fmt.Sprintf("no series for %s", strings.Join(sx.Missing, ", "))
+		} else {
+			// all clauses are there, check rules could still remove the series
+			sx.Complete = true
+			sx.Reason = "all where-clauses have a matching series"
+			if len(ast.HavingRules) > 0 {
+				// HAVING rules look at all series of the study (patient)
+				if ok, reason := ast.evalHaving(havingGroup(dataInfo, setLevel, key, assigned)); !ok {
+					sx.Complete = false
+					sx.Reason = reason
+				}
+			}
+			for _, s := range explanation.Series {
+				if !sx.Complete {
+					break
+				}
+				if s.Assigned == "" || inJob[s.SeriesInstanceUID] || ambiguous {
+					continue
+				}
+				if (setLevel == "study" && s.StudyInstanceUID == key) || (setLevel == "patient" && s.PatientName == key) {
+					sx.Complete = false
+					sx.Reason = fmt.Sprintf("series %s (%s) was removed by a CHECK rule", s.SeriesInstanceUID, s.Assigned)
+					break
+				}
+			}
+		}
+		if ambiguous {
+			sx.Complete = false
+		}
+		explanation.Sets = append(explanation.Sets, sx)
+	}
+	return explanation
+}
+
+// toString returns a human readable version of the explanation
+func (e SelectExplanation) toString() string {
+	var b strings.Builder
+	for _, s := range e.Series {
+		assigned := "no match"
+		if s.Assigned != "" {
+			assigned = fmt.Sprintf("matches \"%s\"", s.Assigned)
+		}
+		fmt.Fprintf(&b, "Series %s \"%s\" (patient %s, study %s): %s\n", s.SeriesInstanceUID, s.SeriesDescription, s.PatientName, s.StudyInstanceUID, assigned)
+		for _, c := range s.Clauses {
+			if c.Matches {
+				fmt.Fprintf(&b, "  \"%s\": yes\n", c.Name)
+			} else {
+				fmt.Fprintf(&b, "  \"%s\": no, %s\n", c.Name, strings.Replace(c.Reason, "\n", "\n      ", -1))
+			}
+		}
+	}
+	if len(e.Sets) > 0 {
+		fmt.Fprintf(&b, "\n")
+	}
+	for _, s := range e.Sets {
+		state := "incomplete"
+		if s.Complete {
+			state = "complete"
+		}
+		fmt.Fprintf(&b, "%s %s: %s, %s\n", strings.Title(s.Level), s.Key, state, s.Reason)
+	}
+	for _, c := range e.Complains {
+		fmt.Fprintf(&b, "%s\n", c)
+	}
+	postfix := "s"
+	if e.NumJobs == 1 {
+		postfix = ""
+	}
+	fmt.Fprintf(&b, "Select %s results in %d job%s.\n", e.OutputLevel, e.NumJobs, postfix)
+	return b.String()
+}
+
 func humanizeFilter(ast AST) []string {
 	// create a human readeable string from the AST
 	var ss []string
@@ -3149,7 +4392,7 @@ func humanizeFilter(ast AST) []string {
 	} else {
 		ss = append(ss, fmt.Sprintf("We will select cases with %d image series.\n", len(ast.Rules)))
 	}
-	str := strings.Replace(ast2Select(ast), "\n", "", -1)
+	str := strings.Replace(ast2Select(ast), "\n", " ", -1)
 	space := regexp.MustCompile(`\s+`)
 	str = space.ReplaceAllString(str, " ")
 	ss = append(ss, fmt.Sprintf("To use this select statement call:\n%s config --select '%s'\n", own_name, str))
@@ -3167,29 +4410,40 @@ func (rule Rule) toString() string {
 		opstr = "<"
 	} else if rule.Operator == ">" {
 		opstr = ">"
-	} else if rule.Operator == "=" {
+	} else if rule.Operator == "<=" {
+		opstr = "<="
+	} else if rule.Operator == ">=" {
+		opstr = ">="
+	} else if rule.Operator == "=" || rule.Operator == "==" {
 		opstr = "="
 	} else if rule.Operator == "regexp" {
 		opstr = "regexp"
+	} else if rule.Operator == "approx" {
+		opstr = "approx"
 	}
 	// convert rule.Value so that if we have spaces (string) we use doubble quotes
 	ruleValue := fmt.Sprintf("%v", rule.Value)
 	if strings.Contains(ruleValue, " ") {
 		ruleValue = fmt.Sprintf("\"%v\"", rule.Value)
 	}
+	indexStr := ""
+	if rule.Index != nil {
+		indexStr = fmt.Sprintf("[%d]", *rule.Index)
+	}
 	if len(rule.Tag) == 2 {
-		t1, err := strconv.ParseInt(rule.Tag[0], 16, 64)
-		t2, err2 := strconv.ParseInt(rule.Tag[1], 16, 64)
+		// tags can be stored with or without the 0x prefix
+		t1, err := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(rule.Tag[0]), "0x"), 16, 64)
+		t2, err2 := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(rule.Tag[1]), "0x"), 16, 64)
 
 		if err == nil && err2 == nil {
-			s = fmt.Sprintf("%s%s (\"%#04x\",\"%#04x\") %s %s", s, a, t1, t2, opstr, ruleValue)
+			s = fmt.Sprintf("%s%s (\"%#04x\",\"%#04x\")%s %s %s", s, a, t1, t2, indexStr, opstr, ruleValue)
 		}
 	} else {
 		tag0 := ""
 		if len(rule.Tag) > 0 {
 			tag0 = rule.Tag[0]
 		}
-		s = fmt.Sprintf("%s%s %s %s %s", s, a, tag0, opstr, ruleValue)
+		s = fmt.Sprintf("%s%s %s%s %s %s", s, a, tag0, indexStr, opstr, ruleValue)
 	}
 	return s
 }
@@ -3224,101 +4478,420 @@ func (s RuleSetL) toString() string {
 	return erg
 }
 
-// ast2Select create a select statement from the AST
+// ast2Select create a select statement from the AST, parsing the statement again results in the same AST
 func ast2Select(ast AST) string {
-	//sep1 := "  "
-	//sep2 := "\n"
-	stm := fmt.Sprintf("SELECT %s\n  FROM study", ast.Output_level)
-	// parse the RulesTree here
-	for idx2, rules := range ast.RulesTree {
-		var list_name string
-		if len(ast.Rule_list_names) <= idx2 {
-			list_name = fmt.Sprintf("unnamed_rule_%d", idx2)
+	return formatSelectAST(ast, nil)
+}
+
+// selectUnquotedWord matches the words the select lexer reads without quotes
+var selectUnquotedWord = regexp.MustCompile(`^[A-Za-z_^$.\[\]|][A-Za-z0-9_^$.*\[\]/\\|]*$`)
+
+// formatSelectValue prints a string (quoted) or a number so the select lexer reads it back unchanged
+func formatSelectValue(v interface{}) string {
+	switch value := v.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case string:
+		if strings.Contains(value, "\"") {
+			return "'" + value + "'"
+		}
+		return "\"" + value + "\""
+	}
+	return fmt.Sprintf("\"%v\"", v)
+}
+
+// formatSelectTag prints a tag as a DICOM keyword if the parser maps the keyword back to the same tag,
+// as a ("group","element") pair otherwise. Names that are not DICOM tags (ClassifyType, tag paths) are kept.
+func formatSelectTag(t []string, index *int) string {
+	indexStr := ""
+	if index != nil {
+		indexStr = fmt.Sprintf("[%d]", *index)
+	}
+	if len(t) == 2 {
+		if !strings.HasPrefix(strings.ToLower(t[0]), "0x") {
+			g, err1 := strconv.ParseInt(t[0], 16, 64)
+			e, err2 := strconv.ParseInt(t[1], 16, 64)
+			if err1 == nil && err2 == nil {
+				if info, err := tag.Find(tag.Tag{Group: uint16(g), Element: uint16(e)}); err == nil {
+					if s, err := tag.FindByName(info.Keyword); err == nil && fmt.Sprintf("%0x", s.Tag.Group) == t[0] && fmt.Sprintf("%0x", s.Tag.Element) == t[1] {
+						return info.Keyword + indexStr
+					}
+				}
+			}
+		}
+		return fmt.Sprintf("(\"%s\",\"%s\")%s", t[0], t[1], indexStr)
+	}
+	if len(t) == 1 {
+		if selectUnquotedWord.MatchString(t[0]) {
+			return t[0] + indexStr
+		}
+		return formatSelectValue(t[0] + indexStr)
+	}
+	return ""
+}
+
+// formatSelectLeaf prints a single rule like: SeriesDescription regexp "^T1"
+func formatSelectLeaf(rule Rule) string {
+	if rule.Operator == "true" {
+		return "everything"
+	}
+	op := rule.Operator
+	if op == "==" {
+		op = "="
+	} else if op == "contains" {
+		op = "containing"
+	}
+	return fmt.Sprintf("%s %s %s", formatSelectTag(rule.Tag, rule.Index), op, formatSelectValue(rule.Value))
+}
+
+// formatSelectRuleList prints a node created by the rule_list grammar rule, sep is used
+// in front of the AND/OR operators
+func formatSelectRuleList(n *RuleSetL, sep string) string {
+	if n == nil {
+		return ""
+	}
+	if n.Operator == "AND" || n.Operator == "OR" {
+		left := ""
+		if n.Leaf1 != nil {
+			left = formatSelectLeaf(*n.Leaf1)
 		} else {
-			list_name = ast.Rule_list_names[idx2]
+			left = formatSelectRuleList(n.Rs1, sep)
 		}
+		right := ""
+		if n.Leaf2 != nil {
+			right = formatSelectLeaf(*n.Leaf2)
+		} else {
+			right = formatSelectRule(n.Rs2)
+		}
+		return fmt.Sprintf("%s%s%s %s", left, sep, n.Operator, right)
+	}
+	if n.Leaf1 != nil {
+		return formatSelectLeaf(*n.Leaf1)
+	}
+	return formatSelectRule(n.Rs1)
+}
+
+// formatSelectRule prints a node created by the rule grammar rule, brackets or NOT
+func formatSelectRule(n *RuleSetL) string {
+	if n == nil {
+		return ""
+	}
+	if n.Operator == "NOT" {
+		if n.Leaf1 != nil {
+			return "NOT " + formatSelectLeaf(*n.Leaf1)
+		}
+		return "NOT " + formatSelectRule(n.Rs1)
+	}
+	if n.Leaf1 != nil {
+		return "(" + formatSelectLeaf(*n.Leaf1) + ")"
+	}
+	return "(" + formatSelectRuleList(n.Rs1, " ") + ")"
+}
 
-		s := rules.Rs.toString()
-		if len(s) == 0 {
-			// this is a default always true rule
-			s = "everything"
+// formatSelectCheckRule prints a check rule like: "T1"@StudyInstanceUID = "T2"@StudyInstanceUID
+func formatSelectCheckRule(rule Rule) string {
+	negate := ""
+	if rule.Negate == "yes" {
+		negate = "NOT "
+	} else if rule.Negate == "no" {
+		negate = "NOT NOT "
+	}
+	side := func(t []string) string {
+		if len(t) == 0 {
+			return ""
 		}
+		return formatSelectValue(t[0]) + "@" + formatSelectTag(t[1:], nil)
+	}
+	return fmt.Sprintf("%s%s = %s", negate, side(rule.Tag), side(rule.Tag2))
+}
 
-		if idx2 > 0 {
-			stm = fmt.Sprintf("%s\n  ALSO\n    WHERE series NAMED \"%s\" HAS\n      %s", stm, list_name, s)
+// formatSelectAST prints the AST as a select statement. The comments are printed in front of the
+// parts of the statement: 0 before SELECT, 1..n before the n where-clauses, n+1 before CHECK,
+// n+2 before HAVING and n+3 at the end.
+func formatSelectAST(ast AST, comments [][]string) string {
+	var b strings.Builder
+	commentsAt := func(slot int, indent string) {
+		if slot < len(comments) {
+			for _, c := range comments[slot] {
+				b.WriteString(indent + c + "\n")
+			}
+		}
+	}
+	knownLevel := func(level string) bool {
+		return level == "project" || level == "patient" || level == "study" || level == "series" || level == "image"
+	}
+	commentsAt(0, "")
+	b.WriteString("SELECT")
+	if knownLevel(ast.Output_level) {
+		b.WriteString(" " + ast.Output_level)
+	}
+	b.WriteString(" FROM")
+	if knownLevel(ast.Select_level) {
+		b.WriteString(" " + ast.Select_level)
+	}
+	n := len(ast.RulesTree)
+	for idx, rules := range ast.RulesTree {
+		b.WriteString("\n")
+		commentsAt(idx+1, "  ")
+		if idx > 0 {
+			b.WriteString("  ALSO\n")
+		}
+		if rules.Name == "" {
+			// where-clause without level and name
+			b.WriteString("  WHERE")
+		} else {
+			b.WriteString("  WHERE")
+			if idx < len(ast.Select_level_by_rule) && knownLevel(ast.Select_level_by_rule[idx]) {
+				b.WriteString(" " + ast.Select_level_by_rule[idx])
+			}
+			if rules.Name != "no-name" {
+				b.WriteString(" NAMED " + formatSelectValue(rules.Name))
+			}
+			b.WriteString(" HAS")
+		}
+		b.WriteString("\n    ")
+		if rules.Rs.Leaf1 != nil {
+			b.WriteString(formatSelectLeaf(*rules.Rs.Leaf1))
 		} else {
-			stm = fmt.Sprintf("%s\n    WHERE series NAMED \"%s\" HAS\n      %s", stm, list_name, s)
+			b.WriteString(formatSelectRuleList(rules.Rs.Rs1, "\n    "))
+		}
+	}
+	// CHECK a AND b AND c is parsed into the rule sets [a] and [b, c]
+	for i := 0; i < len(ast.CheckRules); i++ {
+		b.WriteString("\n")
+		if i == 0 {
+			commentsAt(n+1, "")
+		}
+		rules := append([]Rule{}, ast.CheckRules[i].Rs...)
+		if len(rules) == 1 && i+1 < len(ast.CheckRules) {
+			rules = append(rules, ast.CheckRules[i+1].Rs...)
+			i++
+		}
+		list := []string{}
+		for _, rule := range rules {
+			list = append(list, formatSelectCheckRule(rule))
+		}
+		b.WriteString("CHECK " + strings.Join(list, "\n  AND "))
+	}
+	if len(ast.HavingRules) > 0 {
+		b.WriteString("\n")
+		commentsAt(n+2, "")
+		list := []string{}
+		for _, h := range ast.HavingRules {
+			list = append(list, h.toString())
+		}
+		b.WriteString("HAVING " + strings.Join(list, "\n  AND "))
+	}
+	if n+3 < len(comments) && len(comments[n+3]) > 0 {
+		b.WriteString("\n")
+		b.WriteString(strings.TrimSuffix(strings.Join(comments[n+3], "\n"), "\n"))
+	}
+	return b.String()
+}
+
+// sameSelect compares the parts of two parsed select statements that are used to find series,
+// the second return value names the part that differs
+func sameSelect(a AST, b AST) (bool, string) {
+	names := func(ast AST) []string {
+		n := []string{}
+		for _, r := range ast.Rules {
+			n = append(n, r.Name)
+		}
+		return n
+	}
+	parts := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"output level", a.Output_level, b.Output_level},
+		{"select level", a.Select_level, b.Select_level},
+		{"where-clause levels", a.Select_level_by_rule, b.Select_level_by_rule},
+		{"where-clause names", names(a), names(b)},
+		{"where-clause names", a.Rule_list_names, b.Rule_list_names},
+		{"where-clauses", a.RulesTree, b.RulesTree},
+		{"CHECK rules", a.CheckRules, b.CheckRules},
+		{"HAVING rules", a.HavingRules, b.HavingRules},
+	}
+	for _, p := range parts {
+		if !reflect.DeepEqual(p.a, p.b) {
+			as, _ := json.Marshal(p.a)
+			bs, _ := json.Marshal(p.b)
+			return false, fmt.Sprintf("%s: %s != %s", p.name, string(as), string(bs))
+		}
+	}
+	return true, ""
+}
+
+// parseSelect parses a select statement without comments and returns a copy of the AST
+func parseSelect(statement string) (AST, error) {
+	ast, errs := Parse(statement)
+	if len(errs) > 0 {
+		return ast, fmt.Errorf("could not parse the select statement: %s", parseErrorsString(errs, " "))
+	}
+	return ast, nil
+}
+
+// selectSlots returns the positions of the first SELECT, the top-level WHERE's, the first CHECK and the
+// first HAVING in a select statement (comments removed), -1 if they do not exist
+func selectSlots(statement string) (int, []int, int, int) {
+	selectPos, checkPos, havingPos := -1, -1, -1
+	wherePos := []int{}
+	var quote byte
+	depth := 0
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case unicode.IsLetter(rune(c)) && (i == 0 || !(unicode.IsLetter(rune(statement[i-1])) || unicode.IsDigit(rune(statement[i-1])) || statement[i-1] == '_')):
+			j := i
+			for j < len(statement) && unicode.IsLetter(rune(statement[j])) {
+				j++
+			}
+			switch strings.ToLower(statement[i:j]) {
+			case "select":
+				if selectPos == -1 {
+					selectPos = i
+				}
+			case "where":
+				if depth == 0 {
+					wherePos = append(wherePos, i)
+				}
+			case "check":
+				if checkPos == -1 {
+					checkPos = i
+				}
+			case "having":
+				if havingPos == -1 {
+					havingPos = i
+				}
+			}
+			i = j - 1
 		}
 	}
+	return selectPos, wherePos, checkPos, havingPos
+}
 
-	/*	for idx2, rules := range ast.Rules {
-		s := ""
-		for idx, rule := range rules.Rs {
-			a := ""
-			if idx > 0 {
-				a = "\n    AND\n"
-			}
-			opstr := "containing"
-			if rule.Operator == "contains" {
-				opstr = "containing"
-			} else if rule.Operator == "<" {
-				opstr = "<"
-			} else if rule.Operator == ">" {
-				opstr = ">"
-			} else if rule.Operator == "=" {
-				opstr = "="
-			} else if rule.Operator == "regexp" {
-				opstr = "regexp"
-			}
-			// convert rule.Value so that if we have spaces (string) we use doubble quotes
-			ruleValue := fmt.Sprintf("%v", rule.Value)
-			if strings.Contains(ruleValue, " ") {
-				ruleValue = fmt.Sprintf("\"%v\"", rule.Value)
-			}
-			if len(rule.Tag) == 2 {
-				s = fmt.Sprintf("%s%s (\"%s\",\"%s\") %s %s", s, a, rule.Tag[0], rule.Tag[1], opstr, ruleValue)
+// formatSelect pretty-prints a select statement. Comments are kept and printed in front of the
+// next part of the statement (SELECT, WHERE, CHECK or HAVING), DECLARE'd parameters are kept as well
+// in the order of the comments around them.
+// The result is checked, it has to parse into the same AST as the input statement.
+func formatSelect(statement string) (string, error) {
+	comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
+	masked := comments.ReplaceAllStringFunc(statement, func(c string) string { return strings.Repeat(" ", len(c)) })
+
+	// parameters are replaced by unique values that are replaced back after printing
+	declarations := []string{}
+	declarationPos := []int{}
+	sentinels := make(map[string]string)
+	replaceBack := make(map[string]string)
+	for idx, loc := range selectParameterDeclaration.FindAllStringSubmatchIndex(masked, -1) {
+		name := masked[loc[2]:loc[3]]
+		typ := strings.ToLower(masked[loc[4]:loc[5]])
+		decl := fmt.Sprintf("DECLARE $%s %s", name, typ)
+		if loc[8] != -1 {
+			def := masked[loc[8]:loc[9]]
+			if len(def) > 1 && (def[0] == '"' || def[0] == '\'') {
+				def = def[1 : len(def)-1]
+			}
+			if typ == "number" {
+				decl = fmt.Sprintf("%s DEFAULT %s", decl, def)
 			} else {
-				s = fmt.Sprintf("%s%s %s %s %s", s, a, rule.Tag[0], opstr, ruleValue)
+				decl = fmt.Sprintf("%s DEFAULT %s", decl, formatSelectValue(def))
 			}
 		}
-		if idx2 > 0 {
-			stm = fmt.Sprintf("%s\n  ALSO\n    WHERE series NAMED \"%s\" HAS\n      %s", stm, ast.Rule_list_names[idx2], s)
+		declarations = append(declarations, decl)
+		declarationPos = append(declarationPos, loc[0])
+		if typ == "number" {
+			v := 987654321.0 + float64(idx)*0.125
+			sentinels[name] = strconv.FormatFloat(v, 'g', -1, 64)
+			replaceBack[formatSelectValue(v)] = "$" + name
 		} else {
-			stm = fmt.Sprintf("%s\n    WHERE series NAMED \"%s\" HAS\n      %s", stm, ast.Rule_list_names[idx2], s)
+			sentinels[name] = fmt.Sprintf("ror_parameter_%s", name)
+			replaceBack[formatSelectValue(sentinels[name])] = "$" + name
 		}
-	} */
-	// Now add a section for the CheckRules if there are any
-	if ast.CheckRules != nil {
-		stm = fmt.Sprintf("%s\nCheck\n  ", stm)
-		for _, rulesets := range ast.CheckRules {
-			for idx, rule := range rulesets.Rs {
-				a := ""
-				if idx > 0 {
-					a = "\n    AND\n"
-				}
-				s := ""
-				opstr := "containing"
-				if rule.Operator == "contains" {
-					opstr = "containing"
-				} else if rule.Operator == "==" {
-					opstr = "="
-				}
-				if len(rule.Tag) == 3 {
-					// print the Tag[1] and Tag[2] entries as hexadecimals
-					t1, err1 := strconv.ParseInt(rule.Tag[1], 16, 64)
-					t2, err2 := strconv.ParseInt(rule.Tag[2], 16, 64)
-					t21, _ := strconv.ParseInt(rule.Tag[1], 16, 64)
-					t22, _ := strconv.ParseInt(rule.Tag[2], 16, 64)
-
-					if err1 == nil && err2 == nil {
-						stm = fmt.Sprintf("%s%s%s %s@(%#04x,%#04x) %s %s@(%#04x,%#04x)", stm, s, a, rule.Tag[0], t1, t2, opstr, rule.Tag2[0], t21, t22)
-					}
-				}
+	}
+	bound, err := bindSelectParameters(statement, sentinels)
+	if err != nil {
+		return "", err
+	}
+
+	boundMasked := comments.ReplaceAllStringFunc(bound, func(c string) string { return strings.Repeat(" ", len(c)) })
+	ast1, err := parseSelect(boundMasked)
+	if err != nil {
+		return "", err
+	}
+
+	// comments are printed in front of the next part of the statement
+	selectPos, wherePos, checkPos, havingPos := selectSlots(boundMasked)
+	n := len(ast1.RulesTree)
+	slotPos := make([]int, n+3)
+	slotPos[0] = selectPos
+	for i := 0; i < n; i++ {
+		slotPos[i+1] = -1
+		if i < len(wherePos) {
+			slotPos[i+1] = wherePos[i]
+		}
+	}
+	slotPos[n+1] = checkPos
+	slotPos[n+2] = havingPos
+	slotComments := make([][]string, n+4)
+	for _, loc := range comments.FindAllStringIndex(bound, -1) {
+		slot := n + 3
+		for s, pos := range slotPos {
+			if pos >= loc[0] && (slot == n+3 || pos < slotPos[slot]) {
+				slot = s
 			}
 		}
+		slotComments[slot] = append(slotComments[slot], bound[loc[0]:loc[1]])
 	}
 
-	return stm
+	// the comments in front of SELECT are printed with the declarations, in the order of the input
+	slotComments[0] = nil
+	type headerLine struct {
+		pos  int
+		text string
+	}
+	header := []headerLine{}
+	for i, decl := range declarations {
+		header = append(header, headerLine{declarationPos[i], decl})
+	}
+	originalSelectPos, _, _, _ := selectSlots(masked)
+	for _, loc := range comments.FindAllStringIndex(statement, -1) {
+		if loc[0] < originalSelectPos {
+			header = append(header, headerLine{loc[0], statement[loc[0]:loc[1]]})
+		}
+	}
+	sort.SliceStable(header, func(i, j int) bool { return header[i].pos < header[j].pos })
+	out := formatSelectAST(ast1, slotComments)
+	ast2, err := parseSelect(comments.ReplaceAllString(out, " "))
+	if err != nil {
+		return "", fmt.Errorf("the formatted select statement does not parse, please report this:\n%s\n%w", out, err)
+	}
+	if ok, diff := sameSelect(ast1, ast2); !ok {
+		return "", fmt.Errorf("the formatted select statement is different from the input, please report this:\n%s\n%s", out, diff)
+	}
+	for sentinel, name := range replaceBack {
+		out = strings.Replace(out, sentinel, name, -1)
+	}
+	lines := []string{}
+	for _, h := range header {
+		lines = append(lines, h.text)
+	}
+	if len(lines) > 0 {
+		out = strings.Join(lines, "\n") + "\n" + out
+	}
+	return out, nil
 }
 
 // parseCallString tokenizes a shell-style command string into an argument slice.
@@ -3717,6 +5290,14 @@ func getDetailedStatusInfo(config Config) string {
 	// TODO: add the reason for failure to match for each participant, study and series
 	statusInfo += "\nData summary\n\n"
 
+	var ast AST
+	if config.SeriesFilterType == "select" {
+		var errs []ParseError
+		if ast, errs = Parse(config.SeriesFilter); len(errs) > 0 {
+			exitGracefully(fmt.Errorf("could not parse select statement:\n%s\n%s", config.SeriesFilter, parseErrorsString(errs, "\n")))
+		}
+	}
+
 	for pidx, p := range participants {
 		counter3 := 0
 		for key, element := range config.Data.DataInfo {
@@ -3760,20 +5341,6 @@ func getDetailedStatusInfo(config Config) string {
 				// check if the current series is part of the selection, if not show the reason (evalRulesTree)
 				reasonNotInSelection := ""
 				if config.SeriesFilterType == "select" {
-					// set ast based on config.SeriesFilter, if we do this several times we would add more rules - does not set RulesTree to length 0
-					if len(ast.RulesTree) == 0 {
-						InitParser()
-						line := []byte(config.SeriesFilter)
-						yyParse(&exprLex{line: line})
-						if errorOnParse {
-							msg := ""
-							for _, msg := range errorMessages {
-								msg += msg
-							}
-							exitGracefully(fmt.Errorf("could not parse select statement:\n%s\n%s", config.SeriesFilter, msg))
-						}
-					}
-
 					// we have to check if this series is part of the selection
 					// need something like value2.evalRulesTree(ruleset.Rs)
 					for idx := 0; idx < len(ast.RulesTree); idx++ {
@@ -3800,7 +5367,7 @@ func getDetailedStatusInfo(config Config) string {
 				if element2.NumImages == 1 {
 					postfix = ""
 				}
-				statusInfo += fmt.Sprintf("    %s (%d/%d) %d %s image%s, series: %d, %s (%s)\n",
+				statusInfo += fmt.Sprintf("    %s (%d/%d) %d %s image%s, series: %d, %s, %s (%s)\n",
 					key2,
 					counter2,
 					len(element),
@@ -3809,7 +5376,11 @@ func getDetailedStatusInfo(config Config) string {
 					postfix,
 					element2.SeriesNumber,
 					de,
+					element2.qcSummary(),
 					reasonNotInSelection)
+				for _, problem := range element2.Duplicates {
+					statusInfo += fmt.Sprintf("      duplicate: %s\n", problem)
+				}
 			}
 		}
 		statusInfo += fmt.Sprintln("")
@@ -3827,6 +5398,17 @@ func isFlagPassed(name string) bool {
 	return found
 }
 
+// isFlagPassedTo is isFlagPassed for the flags of a sub-command
+func isFlagPassedTo(flags *flag.FlagSet, name string) bool {
+	found := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
 func createTemplateFolders(dir_path string, init_type string, author_name string, author_email string, repo_url string, project_token string) error {
 	// we need to clone a github repo here before we can add the .ror folder
 	if init_type == "repo-url" {
@@ -3948,7 +5530,7 @@ func createTemplateFolders(dir_path string, init_type string, author_name string
 	}
 	// classification rules so we can overwrite what ror does on its own
 	classify_dicom_path2 := input_dir + "/.ror/classifyDICOM.json"
-	createStub(classify_dicom_path2, classifyRules)
+	createStub(classify_dicom_path2, classifyRulesStub)
 
 	// example ontology
 	ontology_path := input_dir + "/.ror/ontologies"
@@ -4004,9 +5586,74 @@ func main() {
 	buildCommand := flag.NewFlagSet("build", flag.ContinueOnError)
 	annotateCommand := flag.NewFlagSet("annotate", flag.ContinueOnError)
 	mcpCommand := flag.NewFlagSet("mcp", flag.ContinueOnError)
+	lspCommand := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	selectCommand := flag.NewFlagSet("select fmt", flag.ContinueOnError)
+	classifyTestCommand := flag.NewFlagSet("classify test", flag.ContinueOnError)
+	classifyLearnCommand := flag.NewFlagSet("classify learn", flag.ContinueOnError)
+	classifyAddPackCommand := flag.NewFlagSet("classify add-pack", flag.ContinueOnError)
+	exportBIDSCommand := flag.NewFlagSet("export bids", flag.ContinueOnError)
+	autoidCommand := flag.NewFlagSet("autoid", flag.ContinueOnError)
+	routeCommand := flag.NewFlagSet("route", flag.ContinueOnError)
 
 	mcpCommand.StringVar(&mcp_http, "http", "", "if set, use streamable HTTP at this address, instead of stdin/stdout")
+
+	selectCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	classifyTestCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var classify_rules_file string
+	classifyTestCommand.StringVar(&classify_rules_file, "rules", "", "Test the classification rules in this file instead of the rules of the project (.ror/classifyDICOM.json).")
+	var classify_expected string
+	classifyTestCommand.StringVar(&classify_expected, "expected", "", "CSV file with a SeriesInstanceUID and the expected classes per row. Prints a confusion matrix\nand fails if a series has other classes than expected.")
+	var classify_annotations bool
+	classifyTestCommand.BoolVar(&classify_annotations, "annotations", false, "Use the annotations (ror annotate) of the series as expected classes.")
+	var classify_exclusive stringList
+	classifyTestCommand.Var(&classify_exclusive, "exclusive", "Comma separated list of classes that should not match the same series, e.g. axial,coronal,sagittal.\nCan be used more than once.")
+	var classify_help bool
+	classifyTestCommand.BoolVar(&classify_help, "help", false, "Show help for classify test.")
+	classifyLearnCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var classify_learn_labels stringList
+	classifyLearnCommand.Var(&classify_learn_labels, "label", "Name of the annotation (ror annotate) to learn classification rules for. Can be used more than once.")
+	var classify_learn_all bool
+	classifyLearnCommand.BoolVar(&classify_learn_all, "all", false, "Use the series without annotations as examples without the label as well.")
+	var classify_learn_output string
+	classifyLearnCommand.StringVar(&classify_learn_output, "output", "", "Write the learned rules to this file instead of printing them.")
+	var classify_learn_help bool
+	classifyLearnCommand.BoolVar(&classify_learn_help, "help", false, "Show help for classify learn.")
+	classifyAddPackCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var classify_add_pack_help bool
+	classifyAddPackCommand.BoolVar(&classify_add_pack_help, "help", false, "Show help for classify add-pack.")
+	autoidCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var autoid_out string
+	autoidCommand.StringVar(&autoid_out, "out", "", "Write the AutoID records of 'autoid export' to this file instead of printing them.")
+	var autoid_new bool
+	autoidCommand.BoolVar(&autoid_new, "new", false, "Export only the AutoID records without a record_id (not in REDCap yet) for an import with auto-numbering.")
+	var autoid_help bool
+	autoidCommand.BoolVar(&autoid_help, "help", false, "Show help for autoid.")
+	routeCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var route_rules string
+	routeCommand.StringVar(&route_rules, "rules", "", "Records export (CSV) of the Routing instrument with the routing rules.")
+	var route_incoming_aetitle string
+	routeCommand.StringVar(&route_incoming_aetitle, "incoming-aetitle", "", "AETitle addressed on FIONA for all studies, by default ReceivingApplicationEntityTitle (0002,0018).")
+	var route_sending_aetitle string
+	routeCommand.StringVar(&route_sending_aetitle, "sending-aetitle", "", "AETitle of the sender for all studies, by default SendingApplicationEntityTitle (0002,0017)\nor SourceApplicationEntityTitle (0002,0016).")
+	var route_out string
+	routeCommand.StringVar(&route_out, "out", "", "Write the transfer requests to this file instead of printing them.")
+	var route_help bool
+	routeCommand.BoolVar(&route_help, "help", false, "Show help for route.")
+	exportBIDSCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	var export_out string
+	exportBIDSCommand.StringVar(&export_out, "out", "", "Folder for the BIDS dataset, existing files are overwritten.")
+	var export_selection string
+	exportBIDSCommand.StringVar(&export_selection, "selection", "", "Use the named selection (see 'config --select-name') instead of the default select statement.")
+	var export_help bool
+	exportBIDSCommand.BoolVar(&export_help, "help", false, "Show help for export bids.")
+	var select_write bool
+	selectCommand.BoolVar(&select_write, "write", false, "Write the formatted select statement back to the file.")
+	var select_selection string
+	selectCommand.StringVar(&select_selection, "selection", "", "Format the named selection of the project if no file or statement is provided.")
+	var select_help bool
+	selectCommand.BoolVar(&select_help, "help", false, "Show help for select fmt.")
 	mcpCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
+	lspCommand.StringVar(&input_dir, "working_directory", ".", "Project used for completion and match counts if the edited file is not inside a project.")
 
 	initCommand.StringVar(&input_dir, "input_dir", ".", defaultInputDir)
 	var init_help bool
@@ -4043,6 +5690,23 @@ func main() {
 	var config_static_folder string
 	configCommand.StringVar(&config_static_folder, "static", "", "If defined add a static folder location visible as /static inside the container. This folder is read-write and can be used as shared storage between workflows.")
 
+	var config_split_series string
+	configCommand.StringVar(&config_split_series, "split-series", "", "Split series with images that differ in these tags into virtual sub-series, a comma separated list of\n"+
+		"EchoNumbers, ImageType, DiffusionBValue, EchoTime, ImageOrientationPatient, ... Each sub-series is classified on its own\n"+
+		"and can be used in select statements (SubSeries containing \"EchoNumbers=2\"). Use \"none\" to merge the sub-series again.")
+
+	var config_nifti bool
+	configCommand.BoolVar(&config_nifti, "nifti", false, "Trigger writes each series also as NIfTI (.nii.gz) with a JSON sidecar into input_nifti/,\nthe path is stored in descr.json (NiftiPath). Turn off again with --nifti=false.")
+	var config_deidentify string
+	configCommand.StringVar(&config_deidentify, "deidentify", "", "De-identify the images trigger copies into input/ with the DICOM PS3.15 Basic Application Level\n"+
+		"Confidentiality Profile (\"basic\") and its options retain-dates, retain-uids, retain-patient-characteristics\n"+
+		"and clean-descriptors (\"basic,retain-dates\"). With pseudonymize the PatientIDs, UIDs and dates are replaced by\n"+
+		"stable pseudonyms from a keyed hash of the project (see 'ror autoid'). A mapping to the original values is stored in .ror/deidentify/.\n"+
+		"Use \"none\" to copy the images unchanged.")
+	var config_duplicates string
+	configCommand.StringVar(&config_duplicates, "duplicates", "", "What to do during import with a SeriesInstanceUID that is used in several studies and with\n"+
+		"images (SOPInstanceUID) found in more than one file: keep-first (default), keep-all or fail.")
+
 	var config_clip_0 float64
 	configCommand.Float64Var(&config_clip_0, "clip0", 5.0, "DICOM image data is displayed with a computed data range based on two percentages.\nThe lower percentage display range removes dark regions - usually background.")
 	var config_clip_1 float64
@@ -4079,6 +5743,12 @@ func main() {
 	triggerCommand.StringVar(&trigger_job_folder, "folder", "", "Specify the directory name where the data folder should be placed. The folder will still be placed into the specified temp directory.")
 	var trigger_cont_options string
 	triggerCommand.StringVar(&trigger_cont_options, "envs", "", "Specify an environment variable set inside the docker container. Inside the container the value will be assigned to $ROR_CONT_OPTIONS ('{\"-z\":1}').")
+	var trigger_selection string
+	var trigger_deidentify string
+	triggerCommand.StringVar(&trigger_deidentify, "deidentify", "", "De-identification profile for the images in input/ (overrides 'config --deidentify', \"none\" turns it off).")
+	var trigger_nifti bool
+	triggerCommand.BoolVar(&trigger_nifti, "nifti", false, "Also write each series as NIfTI with a JSON sidecar into input_nifti/ (overrides 'config --nifti').")
+	triggerCommand.StringVar(&trigger_selection, "selection", "", "Use the named selection (see 'config --select-name') instead of the default select statement.")
 
 	// allow to specify the ror directory when you do status
 	statusCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
@@ -4092,6 +5762,10 @@ func main() {
 	statusCommand.BoolVar(&status_jobs, "jobs", false, "Show the list of jobs in json format.")
 	var status_data bool
 	statusCommand.BoolVar(&status_data, "data", false, "Show the list of imported data in json format.")
+	var status_selection string
+	statusCommand.StringVar(&status_selection, "selection", "", "Use the named selection (see 'config --select-name') for --jobs, --explain, --tui and --all.")
+	var status_explain bool
+	statusCommand.BoolVar(&status_explain, "explain", false, "Explain for each series which where-clause of the select statement fails and why, and for each study why no\ncomplete set of series could be formed. Add a SeriesInstanceUID to only explain that series and its study.")
 
 	// allow to specify the ror directory when you do build
 	buildCommand.StringVar(&input_dir, "working_directory", ".", defaultInputDir)
@@ -4116,6 +5790,24 @@ func main() {
 			"Select study where ClassifyTypes containing T1 and SeriesDescription regexp \"^B\"\n"+
 			"\talso where ClassifyType containing DIFFUSION also where ClassifyTypes containing RESTING")
 
+	var config_select_file string
+	configCommand.StringVar(&config_select_file, "select-file", "", "Read the select statement from this file (text or the json select.statement of a project\n"+
+		"with \"select\" and \"params\" keys). The statement can declare parameters like\n"+
+		"\tDECLARE $minSlices number DEFAULT 50\n"+
+		"\tSelect series from study where series has NumImages > $minSlices\n"+
+		"that get their values from --param.")
+
+	var config_params stringList
+	configCommand.Var(&config_params, "param", "Value for a parameter declared in the select statement, can be used more than once.\n"+
+		"Example: --select-file stmt.sel --param minSlices=100 --param desc=\"^T1\". Without --select or\n"+
+		"--select-file the stored select statement is updated with the new values.")
+
+	var config_select_name string
+	configCommand.StringVar(&config_select_name, "select-name", "", "Store the --select statement under this name instead of replacing the default selection.\n"+
+		"A project can have several named selections, for example one for each processing pipeline.\n"+
+		"Use the name with 'trigger --selection <name>'. Example:\n"+
+		"\t--select-name seg --select \"Select series from study where series has ClassifyType containing T1\"")
+
 	var config_temp_directory string
 	configCommand.StringVar(&config_temp_directory, "temp_directory", "", "Specify a directory for the temporary folders used in the trigger")
 
@@ -4158,6 +5850,22 @@ func main() {
 		annotateCommand.PrintDefaults()
 		fmt.Printf("\nOption mcp:\n  Model context protocol (MCP) for LLMs.\n\n")
 		mcpCommand.PrintDefaults()
+		fmt.Printf("\nOption lsp:\n  Language server (LSP) for select statements, editors talk to it over stdin/stdout.\n\n")
+		lspCommand.PrintDefaults()
+		fmt.Printf("\nOption select fmt [<file>|<statement>]:\n  Format a select statement, comments are kept.\n\n")
+		selectCommand.PrintDefaults()
+		fmt.Printf("\nOption classify test:\n  Run the classification rules over all series of the project and report matches per class.\n\n")
+		classifyTestCommand.PrintDefaults()
+		fmt.Printf("\nOption classify learn --label <annotation>:\n  Learn classification rules for annotated series, prints the rules with precision and recall.\n\n")
+		classifyLearnCommand.PrintDefaults()
+		fmt.Printf("\nOption classify add-pack <file|dir|name>:\n  Add a versioned rule pack to the classification rules of the project. Without an argument\n  the rule packs that come with ror (%s) and the installed packs are listed.\n\n", strings.Join(shippedRulePackNames(), ", "))
+		classifyAddPackCommand.PrintDefaults()
+		fmt.Printf("\nOption export bids --out <folder>:\n  Convert the series of the select statement to NIfTI and write a BIDS dataset. The names of the\n  series (series named \"T1w\") are the BIDS suffixes, patients are subjects and studies are sessions.\n\n")
+		exportBIDSCommand.PrintDefaults()
+		fmt.Printf("\nOption autoid [import <file>|export|lookup <PatientID>]:\n  Pseudonyms of the project (config --deidentify basic,pseudonymize) as AutoID records for REDCap.\n  Import a records export of the AutoID instrument, export the records or look up PatientIDs.\n\n")
+		autoidCommand.PrintDefaults()
+		fmt.Printf("\nOption route --rules <Routing records.csv>:\n  Evaluate the routing rules for all studies of the project. Prints the transfer requests as records of\n  the transfers form for REDCap and explains for every study why each rule did or did not fire.\n\n")
+		routeCommand.PrintDefaults()
 		fmt.Println("")
 	}
 
@@ -4170,24 +5878,21 @@ func main() {
 		//
 		// test the expression parser for select
 		//
-		InitParser()
-		line := []byte("select patient from study")
-		fmt.Printf("TEST EXPRESSION PARSER: %s\n", string(line))
-		yyParse(&exprLex{line: line})
+		line := "select patient from study"
+		fmt.Printf("TEST EXPRESSION PARSER: %s\n", line)
+		ast, _ := Parse(line)
 		s, _ := json.MarshalIndent(ast, "", "  ")
 		fmt.Printf("ast is: %s\n", string(s))
 
-		InitParser()
-		line = []byte("select patient from study where series has ClassifyType containing T1 and SeriesDescription containing axial")
-		fmt.Printf("TEST EXPRESSION PARSER: %s\n", string(line))
-		yyParse(&exprLex{line: line})
+		line = "select patient from study where series has ClassifyType containing T1 and SeriesDescription containing axial"
+		fmt.Printf("TEST EXPRESSION PARSER: %s\n", line)
+		ast, _ = Parse(line)
 		s, _ = json.MarshalIndent(ast, "", "  ")
 		fmt.Printf("ast is: %s\n", string(s))
 
-		InitParser()
-		line = []byte("select patient from study where series has ClassifyType containing T1 and SeriesDescription containing axial also where series has ClassifyType containing DIFFUSION also where series has ClassifyType containing RESTING")
-		fmt.Printf("TEST EXPRESSION PARSER: %s\n", string(line))
-		yyParse(&exprLex{line: line})
+		line = "select patient from study where series has ClassifyType containing T1 and SeriesDescription containing axial also where series has ClassifyType containing DIFFUSION also where series has ClassifyType containing RESTING"
+		fmt.Printf("TEST EXPRESSION PARSER: %s\n", line)
+		ast, _ = Parse(line)
 		s, _ = json.MarshalIndent(ast, "", "  ")
 		fmt.Printf("ast is: %s\n", string(s))
 	}
@@ -4198,6 +5903,14 @@ func main() {
 			// start the mcp server
 			startMCP(mcp_http, input_dir)
 		}
+	case "lsp":
+		if err := lspCommand.Parse(os.Args[2:]); err == nil {
+			dir, err := filepath.Abs(input_dir)
+			if err != nil {
+				dir = input_dir
+			}
+			startLSP(dir)
+		}
 	case "init", "create":
 		if len(os.Args[2:]) == 0 {
 			initCommand.PrintDefaults()
@@ -4428,7 +6141,7 @@ func main() {
 				}
 				// classification rules so we can overwrite what ror does on its own
 				classify_dicom_path2 := input_dir + "/.ror/classifyDICOM.json"
-				createStub(classify_dicom_path2, classifyRules)
+				createStub(classify_dicom_path2, classifyRulesStub)
 
 				// example ontology
 				ontology_path := input_dir + "/.ror/ontologies"
@@ -4493,6 +6206,13 @@ func main() {
 				exitGracefully(errors.New(errorConfigFile))
 			}
 
+			if config_duplicates != "" {
+				if !slices.Contains(duplicatePolicies, config_duplicates) {
+					exitGracefully(fmt.Errorf("unknown policy for duplicates \"%s\", use one of %s", config_duplicates, strings.Join(duplicatePolicies, ", ")))
+				}
+				config.Data.DuplicatePolicy = config_duplicates
+			}
+
 			var studies map[string]map[string]SeriesInfo
 			if data_path != "" {
 				if _, err := os.Stat(data_path); os.IsNotExist(err) {
@@ -4593,6 +6313,51 @@ func main() {
 			if project_token != "" {
 				config.ProjectToken = project_token
 			}
+			if config_select_file != "" {
+				if config_series_filter != "" {
+					exitGracefully(fmt.Errorf("use either --select or --select-file, not both"))
+				}
+				b, err := os.ReadFile(config_select_file)
+				if err != nil {
+					exitGracefully(fmt.Errorf("could not read the select statement from %s: %w", config_select_file, err))
+				}
+				config_series_filter = string(b)
+			}
+			select_params, err := parseSelectParameters(config_params)
+			if err != nil {
+				exitGracefully(err)
+			}
+			if config_select_file != "" {
+				// the select.statement file of a project is json with the statement and values for its parameters
+				var statementFile struct {
+					Select string                 `json:"select"`
+					Params map[string]interface{} `json:"params"`
+				}
+				if err := json.Unmarshal([]byte(config_series_filter), &statementFile); err == nil && statementFile.Select != "" {
+					config_series_filter = statementFile.Select
+					for key, value := range statementFile.Params {
+						if _, ok := select_params[key]; !ok {
+							select_params[key] = fmt.Sprintf("%v", value)
+						}
+					}
+				}
+			}
+			if config_series_filter == "" && len(select_params) > 0 {
+				// new values for the parameters of the stored select statement
+				selected, err := config.useSelection(config_select_name)
+				if err != nil {
+					exitGracefully(err)
+				}
+				if selected.SeriesFilterTemplate == "" {
+					exitGracefully(fmt.Errorf("the current select statement does not declare parameters, use --select-file together with --param"))
+				}
+				for key, value := range selected.SeriesFilterParameters {
+					if _, ok := select_params[key]; !ok {
+						select_params[key] = value
+					}
+				}
+				config_series_filter = selected.SeriesFilterTemplate
+			}
 			if config_series_filter != "" {
 				// As an option we can specify a filename as a select statement, the file will be read as ascii and
 				// its content used instead.
@@ -4612,6 +6377,16 @@ func main() {
 					}
 				}
 
+				// fill in the values of the DECLARE'd parameters, the statement with the parameters is kept as a template
+				series_filter_template := config_series_filter
+				config_series_filter, err = bindSelectParameters(series_filter_template, select_params)
+				if err != nil {
+					exitGracefully(fmt.Errorf("the select statement parameters are not valid:\n%w", err))
+				}
+				if config_series_filter == series_filter_template {
+					series_filter_template = ""
+				}
+
 				// if we want comments we should use /* */, would be good if we can keep them in the code
 				// we can remove them before we parse...
 				// we might have newlines in the filter string, remove those first before we safe
@@ -4619,17 +6394,12 @@ func main() {
 				// we might also have too many spaces in the filter string, remove those as well
 				//	space := regexp.MustCompile(`\s+`)
 				//	config_series_filter := space.ReplaceAllString(config_series_filter, " ")
-				comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-				series_filter_no_comments := comments.ReplaceAllString(config_series_filter, " ")
-
-				// now parse the input string
-				InitParser()
+				// now parse the input string (comments are ignored by the parser)
 				//yyErrorVerbose = true
 				yyDebug = 1
 
-				line := []byte(series_filter_no_comments)
-				yyParse(&exprLex{line: line})
-				if !errorOnParse {
+				ast, errs := Parse(config_series_filter)
+				if len(errs) == 0 {
 					//s, _ := json.MarshalIndent(ast, "", "  ")
 					ss := humanizeFilter(ast)
 					type Msg struct {
@@ -4639,7 +6409,8 @@ func main() {
 						Complains []string `json:"complains"`
 					}
 					//fmt.Printf("Parsing series filter successful\n%s\n%s\n", string(s), strings.Join(ss[:], "\n"))
-					config.SeriesFilterType = "select"
+					config.setSelection(config_select_name, config_series_filter, "select")
+					config.setSelectionTemplate(config_select_name, series_filter_template, select_params)
 					// check if we have any matches - cheap for us here
 					matches, complains := findMatchingSets(ast, config.Data.DataInfo)
 					/*postfix := "s"
@@ -4656,10 +6427,11 @@ func main() {
 				} else {
 					// maybe its a simple glob expression? We should add in any case
 					//fmt.Println("We tried to parse the series filter but failed. Maybe you just want to grep?")
-					exitGracefully(errors.New("we tried to parse the series filter but failed"))
-					config.SeriesFilterType = "glob"
+					exitGracefully(fmt.Errorf("we tried to parse the series filter but failed:\n%s", parseErrorsString(errs, "\n")))
+					config.setSelection(config_select_name, config_series_filter, "glob")
 				}
-				config.SeriesFilter = config_series_filter
+			} else if config_select_name != "" {
+				exitGracefully(fmt.Errorf("--select-name requires a select statement, use\n\t%s config --select-name %s --select <statement>", own_name, config_select_name))
 			}
 			if call_string != "" {
 				//fmt.Println("Set the call string to :", call_string)
@@ -4670,6 +6442,19 @@ func main() {
 			} else {
 				config.SortDICOM = true
 			}
+			if isFlagPassedTo(configCommand, "nifti") {
+				config.Nifti = config_nifti
+			}
+			if config_deidentify != "" {
+				profile, err := parseDeidentifyProfile(config_deidentify)
+				if err != nil {
+					exitGracefully(err)
+				}
+				config.Deidentify = ""
+				if profile != nil {
+					config.Deidentify = profile.String()
+				}
+			}
 			if config.Viewer.Clip == nil {
 				config.Viewer.Clip = make([]float32, 2)
 				config.Viewer.Clip[0] = float32(config_clip_0)
@@ -4682,6 +6467,44 @@ func main() {
 			if isFlagPassed("clip1") {
 				config.Viewer.Clip[1] = float32(config_clip_1)
 			}
+			if config_duplicates != "" {
+				// the config was read again after the import
+				config.Data.DuplicatePolicy = config_duplicates
+			}
+			if config_split_series != "" {
+				splitBy := []string{}
+				if config_split_series != "none" {
+					for _, name := range strings.Split(config_split_series, ",") {
+						name = strings.TrimSpace(name)
+						info, err := tag.FindByName(name)
+						if err != nil || !slices.Contains(instanceTags, info.Tag) {
+							names := []string{}
+							for _, t := range instanceTags {
+								if i, err := tag.Find(t); err == nil {
+									names = append(names, i.Keyword)
+								}
+							}
+							exitGracefully(fmt.Errorf("cannot split series by \"%s\", only tags stored for each image can be used:\n\t%s", name, strings.Join(names, ", ")))
+						}
+						splitBy = append(splitBy, name)
+					}
+				}
+				classifier, _, err := projectClassifier(input_dir)
+				if err != nil {
+					exitGracefully(fmt.Errorf("the classification rules are not valid:\n%s", err.Error()))
+				}
+				config.Data.SplitSeries = splitBy
+				before := 0
+				for _, study := range config.Data.DataInfo {
+					before += len(study)
+				}
+				config.Data.DataInfo = splitSeries(config.Data.DataInfo, splitBy, classifier)
+				after := 0
+				for _, study := range config.Data.DataInfo {
+					after += len(study)
+				}
+				fmt.Printf("%d series are now %d series.\n", before, after)
+			}
 			if project_name_string != "" {
 				project_name_string = strings.Replace(project_name_string, " ", "_", -1)
 				project_name_string = strings.ToLower(project_name_string)
@@ -4702,14 +6525,9 @@ func main() {
 				// get dataset and ast from config
 				// create an ast
 				// fmt.Println("Suggested abstract syntax tree for your data:")
-				InitParser()
-				line := []byte("Select series from series where series has Modality containing MR")
-				yyParse(&exprLex{line: line})
-				if errorOnParse {
-					msg := ""
-					for _, msg := range errorMessages {
-						msg += msg
-					}
+				ast, errs := Parse("Select series from series where series has Modality containing MR")
+				if len(errs) > 0 {
+					msg := parseErrorsString(errs, "\n")
 					exitGracefully(fmt.Errorf("could not parse select statement:\n%s\n%s", config.SeriesFilter, msg))
 				}
 
@@ -4726,7 +6544,7 @@ func main() {
 				//				generateAST(config.Data.DataInfo)
 
 				// TODO: this uses the old style RuleSet instead of generating a RuleSetL
-				ast, _ := ast.improveAST(config.Data.DataInfo, nil)
+				ast, _ = ast.improveAST(config.Data.DataInfo, nil)
 
 				//s, l := json.MarshalIndent(ast, "", "  ")
 				//fmt.Printf("Suggested abstract syntax tree for your data [%f]\n%s\n", l, string(s))
@@ -4763,8 +6581,14 @@ func main() {
 
 			// we might have a folder name after all the arguments to look into
 			values := statusCommand.Args()
+			explainSeriesInstanceUID := ""
 			if len(values) == 1 {
-				input_dir = statusCommand.Arg(0)
+				// with --explain the argument can also be a SeriesInstanceUID
+				if _, err := os.Stat(filepath.Join(statusCommand.Arg(0), ".ror")); status_explain && err != nil {
+					explainSeriesInstanceUID = statusCommand.Arg(0)
+				} else {
+					input_dir = statusCommand.Arg(0)
+				}
 			}
 
 			dir_path := input_dir + "/.ror/config"
@@ -4772,6 +6596,10 @@ func main() {
 			if err != nil {
 				exitGracefully(errors.New(errorConfigFile))
 			}
+			projectConfig := config // printed below, the selection only changes which select statement is used
+			if config, err = config.useSelection(status_selection); err != nil {
+				exitGracefully(err)
+			}
 
 			if status_tui {
 				// We want to setup a screen where we can see the list of raw data and the list of
@@ -4782,14 +6610,9 @@ func main() {
 				if config.SeriesFilterType != "select" {
 					exitGracefully(fmt.Errorf("we can only work with select filters. No filter defined.\n\t%s config --suggest\nor fix your current selection filter", own_name))
 				}
-				InitParser()
-				line := []byte(config.SeriesFilter)
-				yyParse(&exprLex{line: line})
-				if errorOnParse {
-					msg := ""
-					for _, msg := range errorMessages {
-						msg += msg
-					}
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) > 0 {
+					msg := parseErrorsString(errs, "\n")
 					fmt.Printf("Warning: could not parse select statement:\n%s\n%s", config.SeriesFilter, msg)
 				}
 
@@ -4803,15 +6626,24 @@ func main() {
 				return
 			}
 
+			if status_explain {
+				if config.SeriesFilterType != "select" {
+					exitGracefully(fmt.Errorf("we can only explain select filters. No filter defined.\n\t%s config --suggest\nor fix your current selection filter", own_name))
+				}
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) > 0 {
+					exitGracefully(fmt.Errorf("could not parse the select statement:\n%s\n%s", config.SeriesFilter, parseErrorsString(errs, "\n")))
+				}
+				explanation := explainMatchingSets(ast, config.Data.DataInfo, explainSeriesInstanceUID)
+				fmt.Print(explanation.toString())
+				return
+			}
+
 			if status_jobs { // this is slow because of loop inside loops
-				comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-				series_filter_no_comments := comments.ReplaceAllString(config.SeriesFilter, " ")
 
 				// now parse the input string
-				InitParser()
-				line := []byte(series_filter_no_comments)
-				yyParse(&exprLex{line: line})
-				if !errorOnParse {
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) == 0 {
 					matches, _ := findMatchingSets(ast, config.Data.DataInfo)
 					// a more informative output would include information for each job
 					// so we look into config.Data.DataInfo to find the image series and copy those values over
@@ -4831,7 +6663,7 @@ func main() {
 							found := false
 							for StudyInstanceUID, study := range config.Data.DataInfo {
 								for SeriesInstanceUID, series := range study {
-									if SeriesInstanceUID == jobSeriesInstanceUID.SeriesInstanceUID {
+									if SeriesInstanceUID == jobSeriesInstanceUID.SeriesInstanceUID && StudyInstanceUID == jobSeriesInstanceUID.StudyInstanceUID {
 										job := SeriesForJobInfo{
 											SeriesInstanceUID: SeriesInstanceUID,
 											StudyInstanceUID:  StudyInstanceUID,
@@ -4866,7 +6698,7 @@ func main() {
 				// 	config.Data.DataInfo = nil
 				// is not an option as we need the field again later
 				// try to make a copy of the config using Marshal and Unmarshal
-				tt, err := json.Marshal(config)
+				tt, err := json.Marshal(projectConfig)
 				if err == nil {
 					var newConfig Config
 					json.Unmarshal(tt, &newConfig)
@@ -4880,23 +6712,21 @@ func main() {
 					fmt.Printf("Error: could not marshal the config again %s", string(tt))
 				}
 			} else {
-				file, _ := json.MarshalIndent(config, "", "  ")
+				file, _ := json.MarshalIndent(projectConfig, "", "  ")
 				fmt.Println(string(file))
 			}
+			fmt.Print(selectionsSummary(projectConfig))
+			fmt.Print(classifyRulesSummary(input_dir))
 			if status_detailed {
 				detailedInfo := getDetailedStatusInfo(config)
 				fmt.Println(detailedInfo)
 			} // fmt.Fprintf(os.Stderr, "This short status does not contain data information. Use the --all option to obtain all info.")
 
 			if status_detailed && config.SeriesFilterType == "select" {
-				comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-				series_filter_no_comments := comments.ReplaceAllString(config.SeriesFilter, " ")
 
 				// now parse the input string
-				InitParser()
-				line := []byte(series_filter_no_comments)
-				yyParse(&exprLex{line: line})
-				if !errorOnParse {
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) == 0 {
 					s, _ := json.MarshalIndent(ast, "", "  ")
 					ss := humanizeFilter(ast)
 					fmt.Printf("Parsing series filter\n%s\n%s\n", string(s), ss)
@@ -4915,9 +6745,7 @@ func main() {
 				// get dataset and ast from config
 				// create an ast
 				// fmt.Println("Suggested abstract syntax tree for your data:")
-				InitParser()
-				line := []byte("Select series from series where series has ClassifyType containing CT")
-				yyParse(&exprLex{line: line})
+				ast, _ := Parse("Select series from series where series has ClassifyType containing CT")
 
 				ast, l := ast.improveAST(config.Data.DataInfo, nil)
 
@@ -4946,6 +6774,16 @@ func main() {
 			if err != nil {
 				exitGracefully(errors.New(errorConfigFile))
 			}
+			config.storeReclassified(dir_path)
+			if config, err = config.useSelection(trigger_selection); err != nil {
+				exitGracefully(err)
+			}
+			if isFlagPassedTo(triggerCommand, "nifti") {
+				config.Nifti = trigger_nifti
+			}
+			if trigger_deidentify != "" {
+				config.Deidentify = trigger_deidentify
+			}
 
 			// a trigger with static folder overwrites the value from the config file
 			if trigger_static_folder == "" && config.StaticFolder != "" {
@@ -4968,18 +6806,10 @@ func main() {
 				callProgram(config, triggerWaitTime, trigger_container, trigger_cont_options, folder, trigger_memory, trigger_cpus, trigger_static_folder)
 			}
 
-			// make sure we have updated classifyRules.json loaded here ... just in case if the user
-			// puts his/her own rules into .ror/classifyRules.json
-			classifyDICOM_path := input_dir + "/.ror/classifyDICOM.json"
-			if _, err := os.Stat(classifyDICOM_path); !os.IsNotExist(err) {
-				// read the classifyDICOM
-				classifyDICOMFile, err := os.Open(classifyDICOM_path)
-				if err != nil {
-					classifyRules_new_set, err := io.ReadAll(classifyDICOMFile)
-					if err != nil {
-						classifyRules = string(classifyRules_new_set)
-					}
-				}
+			// the classification rules of the project are applied by readConfig, if they are not valid we
+			// continue with the classes of the last import
+			if _, _, err := projectClassifier(input_dir); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: the classification rules are not valid, ClassifyTypes are from the last import:\n%s\n", err.Error())
 			}
 
 			selectFromA := make(map[string]string)
@@ -5038,14 +6868,10 @@ func main() {
 			} else if config.SeriesFilterType == "select" {
 				// We need to do things differently if we select Output_level that is not
 				// "series"
-				comments := regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
-				series_filter_no_comments := comments.ReplaceAllString(config.SeriesFilter, " ")
 
 				// its a rule so behave accordingly, check for each rule set if the current series matches
-				InitParser()
-				line := []byte(series_filter_no_comments)
-				yyParse(&exprLex{line: line})
-				if !errorOnParse {
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) == 0 {
 					//if ast.Output_level != "series" && ast.Output_level != "study" {
 					//	exitGracefully(fmt.Errorf("we only support \"Select <series>\" and \"Select <study>\" for now as the output level"))
 					//}
@@ -5182,6 +7008,11 @@ func main() {
 				// export each series from the current set in selectFromB
 				var description []Description
 				var startCounter int = 0
+				// all series of the job share the replaced UIDs and patient pseudonyms
+				deid, err := projectDeidentifier(input_dir, config)
+				if err != nil {
+					exitGracefully(err)
+				}
 				// we need to look for the correct entry in selectFromB using Order (same for all entries in map)
 				for _, tmp := range selectFromB {
 					if len(tmp) < 1 || tmp[0].Order != idx {
@@ -5190,12 +7021,23 @@ func main() {
 					for _, thisSeriesInstanceUID := range tmp {
 						var closestPath string = ""
 						var classifyTypes []string
+						seriesInstanceUID := thisSeriesInstanceUID.SeriesInstanceUID
+						sopInstanceUIDs := thisSeriesInstanceUID.SOPInstanceUIDs
+						subSeries := ""
 					loop:
 						for StudyInstanceUID, value := range config.Data.DataInfo {
 							for SeriesInstanceUID, value2 := range value {
 								if SeriesInstanceUID == thisSeriesInstanceUID.SeriesInstanceUID && StudyInstanceUID == thisSeriesInstanceUID.StudyInstanceUID {
 									closestPath = value2.Path
 									classifyTypes = value2.ClassifyTypes
+									// a sub-series exports only its own images of the series
+									if value2.ParentSeriesInstanceUID != "" {
+										seriesInstanceUID = value2.ParentSeriesInstanceUID
+										subSeries = value2.SubSeries
+										if len(sopInstanceUIDs) == 0 {
+											sopInstanceUIDs = value2.SOPInstanceUIDs
+										}
+									}
 									break loop
 								}
 							}
@@ -5204,17 +7046,38 @@ func main() {
 							closestPath = config.Data.Path
 							fmt.Println("Warning: Could not detect the closest PATH, use instead", closestPath)
 						}
+						var nifti *niftiSeries
+						if config.Nifti {
+							nifti = &niftiSeries{}
+						}
 						// this only works if we have unqiue SeriesInstanceUIDs for all studies and patients
-						numFiles, descr := copyFiles(thisSeriesInstanceUID.SeriesInstanceUID, thisSeriesInstanceUID.StudyInstanceUID, closestPath, dir, config.SortDICOM, classifyTypes, config.Viewer.Clip, startCounter)
+						numFiles, descr := copyFiles(seriesInstanceUID, thisSeriesInstanceUID.StudyInstanceUID, sopInstanceUIDs, closestPath, dir, config.SortDICOM, classifyTypes, config.Viewer.Clip, startCounter, nifti, deid)
 						startCounter += numFiles
+						descr.SubSeries = subSeries
 
 						descr.NameFromSelect = thisSeriesInstanceUID.Name // selectFromBNames[idx][idx2]
+						if nifti != nil {
+							if niftiPath, err := writeInputNifti(dir, descr.NameFromSelect, nifti); err != nil {
+								fmt.Printf("Warning: could not convert %s to NIfTI: %s\n", descr.SeriesDescription, err.Error())
+								descr.NiftiError = err.Error()
+							} else {
+								descr.NiftiPath = niftiPath
+							}
+						}
 						// we should merge the different descr together to get description
 						description = append(description, descr)
 						fmt.Println("Found", numFiles, "files.")
 					}
 					break
 				}
+				if deid != nil {
+					// the mapping back to the original values stays in the project, not in the mounted folder
+					mappingFile, err := deid.writeMapping(input_dir, dir)
+					if err != nil {
+						exitGracefully(fmt.Errorf("could not write the de-identification mapping: %s", err.Error()))
+					}
+					fmt.Printf("De-identified with profile %s, mapping in %s\n", deid.profile, mappingFile)
+				}
 				// write out a description
 				file, _ := json.MarshalIndent(description, "", "  ")
 				_ = os.WriteFile(dir+"/descr.json", file, 0644)
@@ -5342,6 +7205,329 @@ func main() {
 			fmt.Println("")
 			fmt.Println("If the above call was sufficient to run your workflow, we can now submit.")
 		}
+	case "classify":
+		if len(os.Args) < 3 {
+			exitGracefully(fmt.Errorf("missing classify command, use\n\t%s classify test\n\t%s classify learn --label <annotation>\n\t%s classify add-pack <file|dir|name>", own_name, own_name, own_name))
+		}
+		switch os.Args[2] {
+		case "test":
+			if err := classifyTestCommand.Parse(os.Args[3:]); err == nil {
+				if classify_help {
+					classifyTestCommand.PrintDefaults()
+					return
+				}
+				config, err := readConfig(input_dir + "/.ror/config")
+				if err != nil {
+					exitGracefully(errors.New(errorConfigFile))
+				}
+				if len(config.Data.DataInfo) == 0 {
+					exitGracefully(fmt.Errorf("no data to test the rules with, add some with\n\t%s config --data <path to DICOMs>", own_name))
+				}
+				var classifier *Classifier
+				if classify_rules_file != "" {
+					source, content, _, err := readClassifyRules(classify_rules_file)
+					if err == nil {
+						classifier, err = compileClassifier(source, content)
+					}
+					if err != nil {
+						exitGracefully(err)
+					}
+				} else if classifier, _, err = projectClassifier(input_dir); err != nil {
+					exitGracefully(err)
+				}
+				var expected map[string][]string
+				if classify_expected != "" {
+					if expected, err = readExpectedLabels(classify_expected); err != nil {
+						exitGracefully(err)
+					}
+				}
+				if classify_annotations {
+					if expected == nil {
+						expected = make(map[string][]string)
+					}
+					for uid, labels := range annotationLabels(config.Data.DataInfo) {
+						expected[uid] = append(expected[uid], labels...)
+					}
+				}
+				exclusive := [][]string{}
+				for _, e := range classify_exclusive {
+					group := []string{}
+					for _, t := range strings.Split(e, ",") {
+						if t = strings.TrimSpace(t); t != "" {
+							group = append(group, t)
+						}
+					}
+					exclusive = append(exclusive, group)
+				}
+				for _, w := range classifier.Warnings {
+					fmt.Printf("Warning: %s\n", w)
+				}
+				report, regressions := classifyTest(classifier, config.Data.DataInfo, expected, exclusive)
+				fmt.Print(report)
+				if regressions > 0 {
+					exitGracefully(fmt.Errorf("%d series have other classes than expected", regressions))
+				}
+			}
+		case "learn":
+			if err := classifyLearnCommand.Parse(os.Args[3:]); err == nil {
+				if classify_learn_help {
+					classifyLearnCommand.PrintDefaults()
+					return
+				}
+				if len(classify_learn_labels) == 0 {
+					exitGracefully(fmt.Errorf("specify the annotation to learn rules for with --label"))
+				}
+				config, err := readConfig(input_dir + "/.ror/config")
+				if err != nil {
+					exitGracefully(errors.New(errorConfigFile))
+				}
+				rules, report, err := classifyLearn(config.Data.DataInfo, classify_learn_labels, classify_learn_all)
+				fmt.Fprint(os.Stderr, report)
+				if err != nil {
+					exitGracefully(err)
+				}
+				if classify_learn_output == "" {
+					fmt.Print(rules)
+				} else if err := os.WriteFile(classify_learn_output, []byte(rules), 0644); err != nil {
+					exitGracefully(err)
+				} else {
+					fmt.Fprintf(os.Stderr, "Rules written to %s, test them with\n\t%s classify test --rules %s --annotations\n", classify_learn_output, own_name, classify_learn_output)
+				}
+			}
+		case "add-pack":
+			if err := classifyAddPackCommand.Parse(os.Args[3:]); err == nil {
+				if classify_add_pack_help {
+					classifyAddPackCommand.PrintDefaults()
+					return
+				}
+				if classifyAddPackCommand.NArg() == 0 {
+					fmt.Printf("Rule packs that come with ror: %s\n", strings.Join(shippedRulePackNames(), ", "))
+					if summary := rulePacksSummary(input_dir); summary != "" {
+						fmt.Print(summary)
+					} else {
+						fmt.Println("No rule packs installed in this project.")
+					}
+					return
+				}
+				if _, err := os.Stat(filepath.Join(input_dir, ".ror")); err != nil {
+					exitGracefully(errors.New(errorConfigFile))
+				}
+				for _, arg := range classifyAddPackCommand.Args() {
+					messages, err := addRulePacks(input_dir, arg)
+					if err != nil {
+						exitGracefully(err)
+					}
+					for _, message := range messages {
+						fmt.Println(message)
+					}
+				}
+				// the data cache is classified again with the new rules
+				config, err := readConfig(input_dir + "/.ror/config")
+				if err != nil {
+					exitGracefully(errors.New(errorConfigFile))
+				}
+				config.storeReclassified(input_dir + "/.ror/config")
+				fmt.Print(classifyRulesSummary(input_dir))
+			}
+		default:
+			exitGracefully(fmt.Errorf("unknown classify command \"%s\", use\n\t%s classify test\n\t%s classify learn --label <annotation>\n\t%s classify add-pack <file|dir|name>", os.Args[2], own_name, own_name, own_name))
+		}
+	case "autoid":
+		action := ""
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		if err := autoidCommand.Parse(args); err == nil {
+			if autoid_help {
+				autoidCommand.PrintDefaults()
+				return
+			}
+			config, err := readConfig(input_dir + "/.ror/config")
+			if err != nil {
+				exitGracefully(errors.New(errorConfigFile))
+			}
+			pseudo, err := projectPseudonymizer(input_dir, config.ProjectName)
+			if err != nil {
+				exitGracefully(err)
+			}
+			switch action {
+			case "":
+				fmt.Printf("Project \"%s\" has %d pseudonyms, key in %s\n", config.ProjectName, len(pseudo.ids), filepath.Join(input_dir, ".ror", pseudonymKeyFile))
+				if profile, _ := parseDeidentifyProfile(config.Deidentify); profile == nil || !profile.Pseudonymize {
+					fmt.Printf("Trigger and export bids use the pseudonyms after\n\t%s config --deidentify basic,pseudonymize\n", own_name)
+				}
+			case "import":
+				if autoidCommand.NArg() != 1 {
+					exitGracefully(fmt.Errorf("specify the AutoID records to import, use\n\t%s autoid import <file>", own_name))
+				}
+				f, err := os.Open(autoidCommand.Arg(0))
+				if err != nil {
+					exitGracefully(err)
+				}
+				added, learned, err := pseudo.importAutoID(f)
+				f.Close()
+				if err != nil {
+					exitGracefully(fmt.Errorf("could not import %s: %s", autoidCommand.Arg(0), err.Error()))
+				}
+				fmt.Printf("Imported %d pseudonyms and %d record ids for project \"%s\", %d pseudonyms in total\n", added, learned, config.ProjectName, len(pseudo.ids))
+			case "export":
+				out := os.Stdout
+				if autoid_out != "" {
+					if out, err = os.OpenFile(autoid_out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+						exitGracefully(err)
+					}
+					defer out.Close()
+				}
+				if err := pseudo.writeAutoID(out, autoid_new); err != nil {
+					exitGracefully(err)
+				}
+			case "lookup":
+				// a lookup only reads the stored records, new pseudonyms are added by trigger and export bids
+				for _, id := range autoidCommand.Args() {
+					if record, ok := pseudo.lookup(id); ok {
+						fmt.Printf("%s\t%s\t%s\n", id, record.Hash, record.Value)
+					} else {
+						fmt.Printf("%s\tnot found\n", id)
+					}
+				}
+			default:
+				exitGracefully(fmt.Errorf("unknown autoid command \"%s\", use\n\t%s autoid import <file>\n\t%s autoid export [--new] [--out <file>]\n\t%s autoid lookup <PatientID>", action, own_name, own_name, own_name))
+			}
+		}
+	case "route":
+		if err := routeCommand.Parse(os.Args[2:]); err == nil {
+			if route_help {
+				routeCommand.PrintDefaults()
+				return
+			}
+			if route_rules == "" {
+				exitGracefully(fmt.Errorf("specify the routing rules (records export of the Routing instrument) with --rules"))
+			}
+			rules, err := readRoutingRulesFile(route_rules)
+			if err != nil {
+				exitGracefully(err)
+			}
+			config, err := readConfig(input_dir + "/.ror/config")
+			if err != nil {
+				exitGracefully(errors.New(errorConfigFile))
+			}
+			studies := routingStudies(config.Data.DataInfo, route_incoming_aetitle, route_sending_aetitle)
+			out := os.Stdout
+			if route_out != "" {
+				if out, err = os.Create(route_out); err != nil {
+					exitGracefully(err)
+				}
+				defer out.Close()
+			}
+			// the AutoID pseudonyms are only known for this project, transfers to other projects get no name
+			pseudo, err := projectPseudonymizer(input_dir, config.ProjectName)
+			if err != nil {
+				exitGracefully(err)
+			}
+			pseudonym := func(project string, patientID string) string {
+				if project != config.ProjectName {
+					return ""
+				}
+				return pseudo.patientID(patientID)
+			}
+			report, err := routeStudies(rules, studies, pseudonym, out)
+			fmt.Fprint(os.Stderr, report)
+			if err != nil {
+				exitGracefully(err)
+			}
+			if err := pseudo.save(); err != nil {
+				exitGracefully(err)
+			}
+		}
+	case "export":
+		if len(os.Args) < 3 || os.Args[2] != "bids" {
+			exitGracefully(fmt.Errorf("unknown export command, use\n\t%s export bids --out <folder>", own_name))
+		}
+		if err := exportBIDSCommand.Parse(os.Args[3:]); err == nil {
+			if export_help {
+				exportBIDSCommand.PrintDefaults()
+				return
+			}
+			if export_out == "" {
+				exitGracefully(fmt.Errorf("specify the folder for the BIDS dataset with --out"))
+			}
+			config, err := readConfig(input_dir + "/.ror/config")
+			if err != nil {
+				exitGracefully(errors.New(errorConfigFile))
+			}
+			if config, err = config.useSelection(export_selection); err != nil {
+				exitGracefully(err)
+			}
+			if err := exportBIDS(config, export_out); err != nil {
+				exitGracefully(err)
+			}
+		}
+	case "select":
+		if len(os.Args) < 3 || os.Args[2] != "fmt" {
+			exitGracefully(fmt.Errorf("unknown select command, use\n\t%s select fmt [<file>|<statement>]", own_name))
+		}
+		if err := selectCommand.Parse(os.Args[3:]); err == nil {
+			if select_help {
+				selectCommand.PrintDefaults()
+				return
+			}
+			statement := ""
+			fileName := ""
+			if selectCommand.NArg() > 0 {
+				arg := strings.Join(selectCommand.Args(), " ")
+				if _, err := os.Stat(arg); err == nil {
+					b, err := os.ReadFile(arg)
+					if err != nil {
+						exitGracefully(err)
+					}
+					statement = string(b)
+					fileName = arg
+					// the select.statement file of a project is json
+					var statementFile struct {
+						Select string `json:"select"`
+					}
+					if err := json.Unmarshal(b, &statementFile); err == nil && statementFile.Select != "" {
+						statement = statementFile.Select
+						if select_write {
+							exitGracefully(fmt.Errorf("--write only works for text files, %s is json", arg))
+						}
+					}
+				} else {
+					statement = arg
+				}
+			} else {
+				config, err := readConfig(input_dir + "/.ror/config")
+				if err != nil {
+					exitGracefully(errors.New(errorConfigFile))
+				}
+				if config, err = config.useSelection(select_selection); err != nil {
+					exitGracefully(err)
+				}
+				if config.SeriesFilterType != "select" {
+					exitGracefully(fmt.Errorf("no select statement found, use\n\t%s config --select <statement>", own_name))
+				}
+				statement = config.SeriesFilter
+				if config.SeriesFilterTemplate != "" {
+					statement = config.SeriesFilterTemplate
+				}
+			}
+			formatted, err := formatSelect(statement)
+			if err != nil {
+				exitGracefully(err)
+			}
+			if select_write {
+				if fileName == "" {
+					exitGracefully(fmt.Errorf("--write needs a file with a select statement"))
+				}
+				if err := os.WriteFile(fileName, []byte(formatted+"\n"), 0644); err != nil {
+					exitGracefully(err)
+				}
+				return
+			}
+			fmt.Println(formatted)
+		}
 	case "annotate":
 		if err := annotateCommand.Parse(os.Args[2:]); err == nil {
 			if annotate_help {
@@ -5388,14 +7574,9 @@ func main() {
 				if config.SeriesFilterType != "select" {
 					exitGracefully(fmt.Errorf("need a Select filter, use\n\t%s config --suggest\nto create one", own_name))
 				}
-				InitParser()
-				line := []byte(config.SeriesFilter)
-				yyParse(&exprLex{line: line})
-				if errorOnParse {
-					msg := ""
-					for _, msg := range errorMessages {
-						msg += msg
-					}
+				ast, errs := Parse(config.SeriesFilter)
+				if len(errs) > 0 {
+					msg := parseErrorsString(errs, "\n")
 					fmt.Printf("could not parse select statement:\n%s\n%s", config.SeriesFilter, msg)
 				}
 				annotateTui.ast = ast
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// RoutingRule is a record of the Routing instrument (components/DataMigration/Routing.csv)
+type RoutingRule struct {
+	RecordID           string
+	Active             bool
+	DestProject        string
+	IncomingAETitle    string
+	SendingAETitle     string
+	AllowedPatientID   string
+	AllowedPatientName string
+	EventName          string
+	patientIDPattern   *regexp.Regexp
+	patientNamePattern *regexp.Regexp
+}
+
+// routingStudy is what the rules are tested against, the AETitles come from the DICOM meta header
+// (or from route --incoming-aetitle and --sending-aetitle)
+type routingStudy struct {
+	StudyInstanceUID string
+	PatientID        string
+	PatientName      string
+	StudyDate        string
+	IncomingAETitle  string
+	SendingAETitle   string
+}
+
+// transferColumns are the fields of the transfers form of the Incoming project (Incoming_DataDictionary.csv)
+var transferColumns = []string{"study_instance_uid", "redcap_repeat_instrument", "redcap_repeat_instance", "transfer_requested_date", "transfer_project_name", "transfer_name", "transfer_event_name"}
+
+// routingPattern compiles a regular expression of the rules, like Python's re.match it has to match at the
+// start of the value
+func routingPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")")
+}
+
+// readRoutingRules reads a records export of the Routing instrument
+func readRoutingRules(r io.Reader) ([]RoutingRule, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no routing rules found")
+	}
+	column := make(map[string]int)
+	for i, name := range rows[0] {
+		column[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	for _, name := range []string{"record_id", "routing_dest_project"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("missing column %s, expected a records export of the Routing instrument", name)
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := column[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	rules := []RoutingRule{}
+	for _, row := range rows[1:] {
+		rule := RoutingRule{
+			RecordID:           get(row, "record_id"),
+			DestProject:        get(row, "routing_dest_project"),
+			IncomingAETitle:    get(row, "routing_incoming_aetitle"),
+			SendingAETitle:     get(row, "routing_sending_aetitle"),
+			AllowedPatientID:   get(row, "routing_allowed_patientid"),
+			AllowedPatientName: get(row, "routing_allowed_patientname"),
+			EventName:          get(row, "routing_event_name"),
+		}
+		if rule.RecordID == "" {
+			continue
+		}
+		switch strings.ToLower(get(row, "routing_active")) {
+		case "1", "yes", "true":
+			rule.Active = true
+		}
+		if rule.patientIDPattern, err = routingPattern(rule.AllowedPatientID); err != nil {
+			return nil, fmt.Errorf("rule %s: routing_allowed_patientid is not a valid regular expression: %s", rule.RecordID, err.Error())
+		}
+		if rule.patientNamePattern, err = routingPattern(rule.AllowedPatientName); err != nil {
+			return nil, fmt.Errorf("rule %s: routing_allowed_patientname is not a valid regular expression: %s", rule.RecordID, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule RoutingRule) String() string {
+	if rule.DestProject == "" {
+		return "rule " + rule.RecordID
+	}
+	return fmt.Sprintf("rule %s (%s)", rule.RecordID, rule.DestProject)
+}
+
+// fires tests a rule against a study, the reasons explain the result
+func (rule RoutingRule) fires(study routingStudy) (bool, []string) {
+	reasons := []string{}
+	if !rule.Active {
+		reasons = append(reasons, "the rule is not active")
+	}
+	if rule.DestProject == "" {
+		reasons = append(reasons, "the rule has no destination project")
+	}
+	// the addressed AETitle or the AETitle of the sender select the rule
+	switch {
+	case rule.IncomingAETitle == "" && rule.SendingAETitle == "":
+		reasons = append(reasons, "the rule has neither an incoming nor a sending AETitle")
+	case rule.IncomingAETitle != "" && rule.IncomingAETitle == study.IncomingAETitle:
+	case rule.SendingAETitle != "" && rule.SendingAETitle == study.SendingAETitle:
+	default:
+		wanted := []string{}
+		if rule.IncomingAETitle != "" {
+			wanted = append(wanted, fmt.Sprintf("addressed AETitle \"%s\" is not \"%s\"", study.IncomingAETitle, rule.IncomingAETitle))
+		}
+		if rule.SendingAETitle != "" {
+			wanted = append(wanted, fmt.Sprintf("sending AETitle \"%s\" is not \"%s\"", study.SendingAETitle, rule.SendingAETitle))
+		}
+		reasons = append(reasons, strings.Join(wanted, " and "))
+	}
+	if rule.patientIDPattern != nil && !rule.patientIDPattern.MatchString(study.PatientID) {
+		reasons = append(reasons, fmt.Sprintf("PatientID \"%s\" does not match \"%s\"", study.PatientID, rule.AllowedPatientID))
+	}
+	if rule.patientNamePattern != nil && !rule.patientNamePattern.MatchString(study.PatientName) {
+		reasons = append(reasons, fmt.Sprintf("PatientName \"%s\" does not match \"%s\"", study.PatientName, rule.AllowedPatientName))
+	}
+	if len(reasons) > 0 {
+		return false, reasons
+	}
+	why := []string{}
+	if rule.IncomingAETitle != "" && rule.IncomingAETitle == study.IncomingAETitle {
+		why = append(why, fmt.Sprintf("addressed AETitle \"%s\"", study.IncomingAETitle))
+	} else {
+		why = append(why, fmt.Sprintf("sending AETitle \"%s\"", study.SendingAETitle))
+	}
+	if rule.patientIDPattern != nil {
+		why = append(why, fmt.Sprintf("PatientID matches \"%s\"", rule.AllowedPatientID))
+	}
+	if rule.patientNamePattern != nil {
+		why = append(why, fmt.Sprintf("PatientName matches \"%s\"", rule.AllowedPatientName))
+	}
+	// without an event the transfer goes to the project, transfer_event_name stays empty
+	if rule.EventName == "" {
+		why = append(why, "no event assigned")
+	}
+	return true, why
+}
+
+// routingStudies collects the studies of the data cache, the flags replace the AETitles of the images
+func routingStudies(dataInfo map[string]map[string]SeriesInfo, incoming string, sending string) []routingStudy {
+	studies := []routingStudy{}
+	for studyInstanceUID, series := range dataInfo {
+		study := routingStudy{StudyInstanceUID: studyInstanceUID}
+		uids := []string{}
+		for uid := range series {
+			uids = append(uids, uid)
+		}
+		sort.Strings(uids)
+		for _, uid := range uids {
+			s := series[uid]
+			if study.PatientID == "" {
+				study.PatientID = s.PatientID
+			}
+			if study.PatientName == "" {
+				study.PatientName = s.PatientName
+			}
+			if study.StudyDate == "" {
+				study.StudyDate = tagValue(s.All, tag.StudyDate)
+			}
+			if study.IncomingAETitle == "" {
+				study.IncomingAETitle = strings.TrimSpace(tagValue(s.All, tag.ReceivingApplicationEntityTitle))
+			}
+			if study.SendingAETitle == "" {
+				study.SendingAETitle = strings.TrimSpace(tagValue(s.All, tag.SendingApplicationEntityTitle))
+			}
+			if study.SendingAETitle == "" {
+				study.SendingAETitle = strings.TrimSpace(tagValue(s.All, tag.SourceApplicationEntityTitle))
+			}
+		}
+		if incoming != "" {
+			study.IncomingAETitle = incoming
+		}
+		if sending != "" {
+			study.SendingAETitle = sending
+		}
+		studies = append(studies, study)
+	}
+	sort.Slice(studies, func(i, j int) bool {
+		a, b := studies[i], studies[j]
+		if a.PatientID != b.PatientID {
+			return a.PatientID < b.PatientID
+		}
+		if a.StudyDate != b.StudyDate {
+			return a.StudyDate < b.StudyDate
+		}
+		return a.StudyInstanceUID < b.StudyInstanceUID
+	})
+	return studies
+}
+
+// routeStudies evaluates the rules for all studies. It writes the transfer requests as records of the
+// transfers form and returns the explanation for every study and rule. The transfer_name is the
+// pseudonym of the patient in the destination project, pseudonym returns "" if there is none and the
+// field stays empty, the PatientID is never written.
+func routeStudies(rules []RoutingRule, studies []routingStudy, pseudonym func(project string, patientID string) string, out io.Writer) (string, error) {
+	writer := csv.NewWriter(out)
+	writer.Write(transferColumns)
+	requested := time.Now().Format("2006-01-02 15:04")
+	var report strings.Builder
+	transfers := 0
+	routed := 0
+	for _, study := range studies {
+		fmt.Fprintf(&report, "Study %s (PatientID \"%s\", StudyDate %s, addressed AETitle \"%s\", sending AETitle \"%s\")\n",
+			study.StudyInstanceUID, study.PatientID, orNA(study.StudyDate), study.IncomingAETitle, study.SendingAETitle)
+		count := 0
+		done := make(map[string]string) // project and event -> rule that created the transfer
+		for _, rule := range rules {
+			ok, reasons := rule.fires(study)
+			if !ok {
+				fmt.Fprintf(&report, "  %s does not fire: %s\n", rule, strings.Join(reasons, ", "))
+				continue
+			}
+			key := rule.DestProject + "/" + rule.EventName
+			if first, found := done[key]; found {
+				fmt.Fprintf(&report, "  %s fires, but %s already requested a transfer to %s for event %s\n", rule, first, rule.DestProject, orNA(rule.EventName))
+				continue
+			}
+			done[key] = rule.String()
+			count++
+			// REDCap adds a new instance on import, the transfers of earlier runs are not overwritten
+			name := pseudonym(rule.DestProject, study.PatientID)
+			writer.Write([]string{study.StudyInstanceUID, "transfers", "new", requested, rule.DestProject, name, rule.EventName})
+			fmt.Fprintf(&report, "  %s fires: %s -> transfer to %s as %s, event %s\n", rule, strings.Join(reasons, ", "), rule.DestProject, orNA(name), orNA(rule.EventName))
+		}
+		if count > 0 {
+			routed++
+		} else {
+			fmt.Fprintf(&report, "  no rule fires, the study is not routed\n")
+		}
+		transfers += count
+	}
+	writer.Flush()
+	fmt.Fprintf(&report, "%d transfer requests for %d of %d studies\n", transfers, routed, len(studies))
+	return report.String(), writer.Error()
+}
+
+// readRoutingRulesFile reads the rules from a file
+func readRoutingRulesFile(file string) ([]RoutingRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := readRoutingRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return rules, nil
+}
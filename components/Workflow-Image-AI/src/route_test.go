@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// the transfer requests are imported into REDCap, they contain the pseudonym and never the PatientID
+func TestRouteStudiesNoPatientID(t *testing.T) {
+	rules, err := readRoutingRules(strings.NewReader("record_id,routing_active,routing_dest_project,routing_event_name,routing_incoming_aetitle\n" +
+		"1,1,OWN,baseline,FIONA\n" +
+		"2,1,OTHER,,FIONA\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	studies := []routingStudy{
+		{StudyInstanceUID: "1.2.3", PatientID: "SECRET-0001", PatientName: "Doe^Jane", IncomingAETitle: "FIONA"},
+		{StudyInstanceUID: "1.2.4", PatientID: "SECRET-0002", PatientName: "Doe^John", IncomingAETitle: "FIONA"},
+	}
+	pseudonym := func(project string, patientID string) string {
+		if project != "OWN" {
+			return ""
+		}
+		return "ANON" + patientID[len(patientID)-4:]
+	}
+	var out bytes.Buffer
+	if _, err := routeStudies(rules, studies, pseudonym, &out); err != nil {
+		t.Fatal(err)
+	}
+	csv := out.String()
+	for _, study := range studies {
+		if strings.Contains(csv, study.PatientID) || strings.Contains(csv, study.PatientName) {
+			t.Errorf("the transfer requests contain the patient %s:\n%s", study.PatientID, csv)
+		}
+	}
+	for _, expected := range []string{"1.2.3,transfers,new,", ",OWN,ANON0001,baseline\n", ",OTHER,,\n"} {
+		if !strings.Contains(csv, expected) {
+			t.Errorf("expected %q in the transfer requests:\n%s", expected, csv)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// select statements that use all parts of the grammar
+var selectFormatStatements = []string{
+	"select series from study where series has Modality = MR",
+	"select study where ClassifyType containing T1",
+	"select from study where series has SeriesNumber = 3",
+	"select participant from study where series has ClassifyType containing DIFFUSION",
+	"select project from study where series has everything",
+	"select study from study where series named \"T1\" has ClassifyType containing T1 and SeriesDescription regexp \"^B\" also where image named \"first\" has InstanceNumber = 1",
+	"select study from study where series named \"no-name\" has Modality = CT also where NAMED \"any\" has Modality = PT",
+	"select patient from study where series has (Modality = MR or Modality = CT) and not (SeriesDescription containing \"loc\") and not not NumImages > 10",
+	"select series from study where series has ((Modality = MR) or (Modality = CT and NumImages > 1)) or SeriesNumber = 1",
+	"select series from study where series has NumImages < 5 and NumImages > 1 and NumImages <= 4 and NumImages >= 2 and SliceThickness approx 1.5 and PixelSpacing[0] approx 0.5",
+	"select series from study where series has (\"0x0008\",\"0x0060\") = \"MR\" and (\"0x0028\",\"0x0030\")[1] > 0 and SeriesDescription = \"with spaces\" and StudyDescription = 'single quotes'",
+	"select series from study where series has ReferencedImageSequence.ReferencedSOPClassUID containing \"1.2.840.10008.5.1.4.1.1.4\" and ClassifyType containing T1",
+	"select study from study where series named \"T1\" has Modality = MR also where series named \"T2\" has Modality = MR check \"T1\"@StudyInstanceUID = \"T2\"@StudyInstanceUID and not \"T1\"@SeriesNumber = \"T2\"@SeriesNumber",
+	"select study from study where series named \"T1\" has Modality = MR check \"T1\"@(\"0x0020\",\"0x000d\") = \"T1\"@StudyInstanceUID check T1@Modality = T1@Modality",
+	"select patient from study where series named \"T1\" has Modality = MR having count(study) >= 3 and count(series named \"T1\") == 1 and count(image where (InstanceNumber > 1 or InstanceNumber = 0)) > 10 and span(StudyDate) > 365 and span((\"0x0008\",\"0x0020\")) < 10 and count() <= 100",
+}
+
+func TestFormatSelectAST(t *testing.T) {
+	for _, statement := range selectFormatStatements {
+		ast, err := parseSelect(statement)
+		if err != nil {
+			t.Errorf("%s: %s", statement, err)
+			continue
+		}
+		formatted := formatSelectAST(ast, nil)
+		again, err := parseSelect(formatted)
+		if err != nil {
+			t.Errorf("%s: formatted statement does not parse: %s\n%s", statement, err, formatted)
+			continue
+		}
+		if ok, diff := sameSelect(ast, again); !ok {
+			t.Errorf("%s: formatted statement is different\n%s\n%s", statement, formatted, diff)
+		}
+	}
+}
+
+func TestFormatSelectStable(t *testing.T) {
+	statements := append([]string{
+		"/* header */ select series from study /* first */ where series named \"a\" has Modality = MR /* second */ also where series named \"b\" has Modality = CT /* having */ having count(series) > 1 /* end */",
+		"/* parameters */ DECLARE $min number DEFAULT 3 DECLARE $desc string select series from study where series has NumImages > $min and SeriesDescription regexp $desc having count(series) >= $min",
+	}, selectFormatStatements...)
+	for _, statement := range statements {
+		formatted, err := formatSelect(statement)
+		if err != nil {
+			t.Errorf("%s: %s", statement, err)
+			continue
+		}
+		again, err := formatSelect(formatted)
+		if err != nil {
+			t.Errorf("%s: formatted statement does not format: %s\n%s", statement, err, formatted)
+			continue
+		}
+		if again != formatted {
+			t.Errorf("%s: formatting is not stable\n%s\n%s", statement, formatted, again)
+		}
+	}
+}
+
+func TestFormatSelectErrors(t *testing.T) {
+	for _, statement := range []string{
+		"select series from study where",
+		"select series from study where series has Modality =",
+		"select series from study where series has (Modality = MR",
+		"select series from study where series has NumImages > $min",
+	} {
+		if formatted, err := formatSelect(statement); err == nil {
+			t.Errorf("%s: expected an error, got\n%s", statement, formatted)
+		}
+	}
+}
+
+// comments inside a where-clause are not kept at their place, they move in front of the next part of the statement,
+// comments between declarations stay where they are
+func TestFormatSelectComments(t *testing.T) {
+	tests := []struct {
+		statement string
+		formatted string
+	}{
+		{
+			"select series from study where series named \"a\" has (Modality = MR /* inside */ or Modality = CT) having count(series) > 1",
+			"SELECT series FROM study\n  WHERE series NAMED \"a\" HAS\n    (Modality = \"MR\" OR Modality = \"CT\")\n/* inside */\nHAVING count(series) > 1",
+		},
+		{
+			"select series from study where series has (Modality = MR /* inside */ or Modality = CT)",
+			"SELECT series FROM study\n  WHERE series HAS\n    (Modality = \"MR\" OR Modality = \"CT\")\n/* inside */",
+		},
+		{
+			"DECLARE $d string /* between */ select series from study where series has SeriesDescription = $d",
+			"DECLARE $d string\n/* between */\nSELECT series FROM study\n  WHERE series HAS\n    SeriesDescription = $d",
+		},
+		{
+			"/* first */ DECLARE $n number DEFAULT 3; /* between */ DECLARE $d string /* last */ select series from study where series has SeriesDescription = $d and NumImages > $n",
+			"/* first */\nDECLARE $n number DEFAULT 3\n/* between */\nDECLARE $d string\n/* last */\nSELECT series FROM study\n  WHERE series HAS\n    SeriesDescription = $d\n    AND NumImages > $n",
+		},
+	}
+	for _, test := range tests {
+		formatted, err := formatSelect(test.statement)
+		if err != nil {
+			t.Errorf("%s: %s", test.statement, err)
+			continue
+		}
+		if formatted != test.formatted {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.statement, formatted, test.formatted)
+		}
+		for _, c := range regexp.MustCompile(`/\*[^*]*\*/`).FindAllString(test.statement, -1) {
+			if !strings.Contains(formatted, c) {
+				t.Errorf("%s: comment %s is lost", test.statement, c)
+			}
+		}
+	}
+}
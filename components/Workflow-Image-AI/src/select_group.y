@@ -15,6 +15,7 @@ import (
     "strconv"
 	"github.com/suyashkumar/dicom/pkg/tag"
     "errors"
+    "regexp"
 )
 
 // represents a select statement
@@ -26,21 +27,43 @@ type AST struct {
     Rules []RuleSet // we need sets of rules for each series we describe
     CheckRules []RuleSet // we capture the special check rules here
     RulesTree []RuleTreeSet
+    HavingRules []HavingRule // aggregate tests on all series of a study or patient
 }
 
-var ast AST                 // our abstract syntax tree
-var charpos int             // the char position in the string
-var program string          // just a copy of the string to parse
+// parseState is everything the parser needs while it works on one statement. Each
+// call of Parse uses its own state so several statements can be parsed at the same time.
+type parseState struct {
+    ast AST                     // our abstract syntax tree
+    charpos int                 // the char position in the string
+    program string              // just a copy of the string to parse
+
+    Rules2 RuleSetL
+    currentRulesL []RuleSetL    // we store the ruleSet information in this array so we can use an index
+    currentRules []Rule         // we store one rules information here
+    currentCheckRules []Rule    // for checks there is a separate list
+    errorOnParse bool
+    errorMessages []string
+    lastGroupTag []string       // a pair of group, tag in decimal format
+    lastTagIndex *int           // optional value index of the last tag (e.g. PixelSpacing[0])
+    currentCheckTag1 []string   // a pair of named series '.' DICOM name
+    currentCheckTag2 []string   // a pair of named series '.' DICOM name
+    currentHaving HavingRule    // the aggregate of the having rule we are parsing
+    lastTokenPos int            // byte offset of the last token the lexer returned
+    errorPositions []int        // byte offsets of the tokens with parse errors
+}
+
+// ParseError is a problem found in a select statement, Pos is the byte offset of
+// the token in the statement, Line and Column (both starting at 1) are computed from it.
+type ParseError struct {
+    Pos int
+    Line int
+    Column int
+    Message string
+}
 
-var Rules2 RuleSetL
-var currentRulesL []RuleSetL = nil  // we store the ruleSet information in this array so we can use an index
-var currentRules []Rule = nil       // we store one rules information here
-var currentCheckRules []Rule = nil  // for checks there is a separate list
-var errorOnParse = false
-var errorMessages []string = make([]string, 0)
-var lastGroupTag []string           // a pair of group, tag in decimal format
-var currentCheckTag1 []string       // a pair of named series '.' DICOM name
-var currentCheckTag2 []string       // a pair of named series '.' DICOM name
+func (e ParseError) Error() string {
+    return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
 
 // get index from $$
 func getCurrentRuleIdx(entry string) (int64, error) {
@@ -69,6 +92,28 @@ func getCurrentRulesLIdx(entry string) (int64, error) {
     return -1, errors.New("not found currentRulesL");
 }
 
+// ruleSetFromEntry converts the $$ of a rule_list (an index into currentRules or currentRulesL) into a RuleSetL
+func (p *parseState) ruleSetFromEntry(entry string) RuleSetL {
+    retRule := RuleSetL{
+        Operator: "FIRST",
+    }
+    if idx, err := getCurrentRuleIdx(entry); err == nil {
+        cr := p.currentRules[idx]
+        retRule.Leaf1 = &cr
+    } else if idx, err := getCurrentRulesLIdx(entry); err == nil {
+        retRule.Rs1 = &p.currentRulesL[idx]
+    }
+    return retRule
+}
+
+// havingLevel returns the level counted by count(), the default is series
+func havingLevel(level string) string {
+    if level == "project" || level == "patient" || level == "study" || level == "series" || level == "image" {
+        return level
+    }
+    return "series"
+}
+
 
 %}
 
@@ -81,10 +126,12 @@ func getCurrentRulesLIdx(entry string) (int64, error) {
 %type <word> where_clause, where_clauses, level_types_with_name
 %type <word> check_stmt base_check check_rule_list check_rule tag_string 
 %type <word> group_tag_pair check_tag1 check_tag2 command_list
+%type <word> having_stmt having_rule_list having_rule aggregate compare_op
 
 %token '+' '-' '*' '/' '"' '\''
 %token SELECT FROM PATIENT STUDY SERIES IMAGE WHERE EQUALS HAS AND OR ALSO LBRACKET RBRACKET COMMA
-%token CONTAINING SMALLER LARGER REGEXP NOT NAMED PROJECT CHECK AT SMALLEREQUAL LARGEREQUAL EVERYTHING
+%token CONTAINING SMALLER LARGER REGEXP NOT NAMED PROJECT CHECK AT SMALLEREQUAL LARGEREQUAL EVERYTHING APPROX
+%token HAVING COUNT SPAN
 
 %token	<num>	NUM
 %token  <word>  STRING NOT
@@ -120,6 +167,10 @@ command:
         $$ = $1
     }
 |   check_stmt
+    {
+        $$ = $1
+    }
+|   having_stmt
     {
         $$ = $1
     };
@@ -139,40 +190,42 @@ check_stmt:
 base_select:
     SELECT level_types FROM level_types where_clauses 
     {
+        p := yylex.(*exprLex)
         // the FROM should be more complex. Something like:
         // FROM earliest study BY StudyDate AS DICOM
 
-        ast.Output_level = string($2)
-        ast.Select_level = string($4)
-        currentRules = nil
-        currentRulesL = nil
+        p.ast.Output_level = string($2)
+        p.ast.Select_level = string($4)
+        p.currentRules = nil
+        p.currentRulesL = nil
         // get space in Rules now for rules
-        if ast.Rules == nil {
-            ast.Rules = make([]RuleSet, 0)
+        if p.ast.Rules == nil {
+            p.ast.Rules = make([]RuleSet, 0)
         }
-        if ast.RulesTree == nil {
-            ast.RulesTree = make([]RuleTreeSet,0)
+        if p.ast.RulesTree == nil {
+            p.ast.RulesTree = make([]RuleTreeSet,0)
         }
 
         $$ = fmt.Sprintf("\nlevel types: %s, from: %s", $2, $4)
     }
 |   SELECT level_types where_clauses 
     {
+        p := yylex.(*exprLex)
         // the FROM should be more complex. Something like:
         // FROM earliest study BY StudyDate AS DICOM
 
-        ast.Output_level = string($2)
-        ast.Select_level = "series"
-        if ast.Rule_list_names == nil {
-            ast.Rule_list_names = make([]string,0)
+        p.ast.Output_level = string($2)
+        p.ast.Select_level = "series"
+        if p.ast.Rule_list_names == nil {
+            p.ast.Rule_list_names = make([]string,0)
         }
-        currentRules = nil
-        currentRulesL = nil
-        if ast.Rules == nil {
-            ast.Rules = make([]RuleSet, 0)
+        p.currentRules = nil
+        p.currentRulesL = nil
+        if p.ast.Rules == nil {
+            p.ast.Rules = make([]RuleSet, 0)
         }
-        if ast.RulesTree == nil {
-            ast.RulesTree = make([]RuleTreeSet,0)
+        if p.ast.RulesTree == nil {
+            p.ast.RulesTree = make([]RuleTreeSet,0)
         }
 
         $$ = fmt.Sprintf("\nlevel types: %s, from: %s", $2, $3)
@@ -196,9 +249,10 @@ where_clause:
     }
 |   WHERE level_types_with_name HAS rule_list
     {
+        p := yylex.(*exprLex)
         name_for_ruleset := ""
-        if len(ast.Rule_list_names) > 0 {
-            name_for_ruleset = ast.Rule_list_names[len(ast.Rule_list_names)-1]
+        if len(p.ast.Rule_list_names) > 0 {
+            name_for_ruleset = p.ast.Rule_list_names[len(p.ast.Rule_list_names)-1]
         }
 
         // could be a simple rule or a ruleSetL in $4
@@ -209,7 +263,7 @@ where_clause:
         var cr1 Rule
         entry, err1 := getCurrentRuleIdx($4)
         if (err1 == nil) {
-            cr1 = currentRules[entry]
+            cr1 = p.currentRules[entry]
             retRule.Operator = "FIRST"
             retRule.Rs1 = nil
             retRule.Rs2 = nil
@@ -221,7 +275,7 @@ where_clause:
             if err2 == nil {
                 //fmt.Println("SHOULD BE HERE, so Rs1 ", $4, "should not be empty but is ", currentRulesL[entry], "with entry", entry)
                 retRule.Operator = "FIRST"
-                retRule.Rs1 = &currentRulesL[entry]
+                retRule.Rs1 = &p.currentRulesL[entry]
                 retRule.Rs2 = nil
                 retRule.Leaf1 = nil
                 retRule.Leaf2 = nil
@@ -233,20 +287,21 @@ where_clause:
         // add the currentRules if they are not already in the list
         var rs RuleSet = RuleSet{
             Name: name_for_ruleset,
-            Rs: currentRules,
+            Rs: p.currentRules,
         }
-        ast.Rules = append(ast.Rules, rs)
-        ast.Select_level_by_rule = append(ast.Select_level_by_rule, $2)
+        p.ast.Rules = append(p.ast.Rules, rs)
+        p.ast.Select_level_by_rule = append(p.ast.Select_level_by_rule, $2)
         var rts RuleTreeSet = RuleTreeSet {
             Name: name_for_ruleset,
             Rs: retRule,
         }
-        ast.RulesTree = append(ast.RulesTree, rts)
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1)
+        p.ast.RulesTree = append(p.ast.RulesTree, rts)
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1)
     }
 |   WHERE rule_list
     {
+        p := yylex.(*exprLex)
         // could be a simple rule or a ruleSetL in $2
         retRule := RuleSetL{
             Operator: "FIRST",
@@ -255,7 +310,7 @@ where_clause:
         var cr1 Rule
         entry, err1 := getCurrentRuleIdx($2)
         if (err1 == nil) {
-            cr1 = currentRules[entry]
+            cr1 = p.currentRules[entry]
             retRule.Operator = "FIRST"
             retRule.Rs1 = nil
             retRule.Rs2 = nil
@@ -266,7 +321,7 @@ where_clause:
             entry, err2 := getCurrentRulesLIdx($2)
             if err2 == nil {
                 retRule.Operator = "FIRST"
-                retRule.Rs1 = &currentRulesL[entry]
+                retRule.Rs1 = &p.currentRulesL[entry]
                 retRule.Rs2 = nil
                 retRule.Leaf1 = nil
                 retRule.Leaf2 = nil
@@ -278,35 +333,38 @@ where_clause:
         // add the currentRules if they are not already in the list
         var rs RuleSet = RuleSet{
             Name: "",
-            Rs: currentRules,
+            Rs: p.currentRules,
         }
-        ast.Rules = append(ast.Rules, rs)
-        ast.Select_level_by_rule = append(ast.Select_level_by_rule, "series")
+        p.ast.Rules = append(p.ast.Rules, rs)
+        p.ast.Select_level_by_rule = append(p.ast.Select_level_by_rule, "series")
         var rts RuleTreeSet = RuleTreeSet {
             Name: "",
             Rs: retRule,
         }
-        ast.RulesTree = append(ast.RulesTree, rts)
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1)
+        p.ast.RulesTree = append(p.ast.RulesTree, rts)
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1)
     }
 
 level_types_with_name:
     level_types
     {
+        p := yylex.(*exprLex)
         // need to add the name to the current RuleSet, will use the last added name
-        ast.Rule_list_names = append(ast.Rule_list_names, "no-name")
+        p.ast.Rule_list_names = append(p.ast.Rule_list_names, "no-name")
         $$ = $1
     }
 |   level_types NAMED STRING
     {
+        p := yylex.(*exprLex)
         $$ = $1
-        ast.Rule_list_names = append(ast.Rule_list_names, $3)
+        p.ast.Rule_list_names = append(p.ast.Rule_list_names, $3)
     }
 
 rule_list:
     rule 
     {
+        p := yylex.(*exprLex)
         retRule := RuleSetL{
             Operator: "FIRST",
         }
@@ -315,7 +373,7 @@ rule_list:
         var cr1 Rule
         entry, err1 := getCurrentRuleIdx($1)
         if (err1 == nil) {
-            cr1 = currentRules[entry]
+            cr1 = p.currentRules[entry]
             retRule.Operator = "FIRST" // only evaluate the first term, NO-OP
             retRule.Rs1 = nil
             retRule.Rs2 = nil
@@ -326,7 +384,7 @@ rule_list:
             entry, err2 := getCurrentRulesLIdx($1)
             if err2 == nil {
                 retRule.Operator = "FIRST" // only evaluate the first term, NO-OP
-                retRule.Rs1 = &currentRulesL[entry]
+                retRule.Rs1 = &p.currentRulesL[entry]
                 retRule.Rs2 = nil
                 retRule.Leaf1 = nil
                 retRule.Leaf2 = nil
@@ -335,11 +393,12 @@ rule_list:
                fmt.Println("Error: nether this or that, a single rule without complex stuff inside, should not happen")
             }
         }
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1)
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1)
     }
 |   rule_list AND rule
     {
+        p := yylex.(*exprLex)
         retRule := RuleSetL{
             Operator: "AND",
         }
@@ -348,12 +407,12 @@ rule_list:
         entry, err1 := getCurrentRuleIdx($1)
         if (err1 == nil) {
             retRule.Rs1 = nil
-            retRule.Leaf1 = &currentRules[entry]
+            retRule.Leaf1 = &p.currentRules[entry]
         } else {
             entry, err2 := getCurrentRulesLIdx($1)
             if err2 == nil {
                 retRule.Leaf1 = nil
-                retRule.Rs1 = &currentRulesL[entry]
+                retRule.Rs1 = &p.currentRulesL[entry]
             } else {
                 fmt.Println("ERROR should not happen")
             }
@@ -361,19 +420,20 @@ rule_list:
         entry, err2 := getCurrentRuleIdx($3)
         if (err2 == nil) {
             retRule.Rs2 = nil
-            retRule.Leaf2 = &currentRules[entry]
+            retRule.Leaf2 = &p.currentRules[entry]
         } else {
             entry, err2 := getCurrentRulesLIdx($3)
             if err2 == nil {
                 retRule.Leaf2 = nil
-                retRule.Rs2 = &currentRulesL[entry]
+                retRule.Rs2 = &p.currentRulesL[entry]
             }
         }
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1) // return an index to the last rule
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1) // return an index to the last rule
     }
 |   rule_list OR rule
     {
+        p := yylex.(*exprLex)
         retRule := RuleSetL{
             Operator: "OR",
         }
@@ -384,41 +444,41 @@ rule_list:
         var cr2 Rule
         entry, err2 := getCurrentRuleIdx($3)
         if (err2 == nil) {
-            cr2 = currentRules[entry]
+            cr2 = p.currentRules[entry]
         }
         entry, err1 := getCurrentRuleIdx($1)
         if (err1 == nil) {
-            cr1 = currentRules[entry]
+            cr1 = p.currentRules[entry]
         }
         retRule.Operator = "OR"
         if err1 == nil {
             retRule.Rs1 = nil
             retRule.Leaf1 = &cr1
-            fmt.Println("IN OR, found Leaf1 with", cr1)
+            //fmt.Println("IN OR, found Leaf1 with", cr1)
         } else {
             entry, err2 := getCurrentRulesLIdx($1)
             if err2 == nil {
                 retRule.Leaf1 = nil
-                retRule.Rs1 = &currentRulesL[entry]
+                retRule.Rs1 = &p.currentRulesL[entry]
                 //fmt.Println("IN OR, found Rs1 with", currentRulesL[entry], "entry is", entry)
             }
         }
         if err2 == nil {
             retRule.Rs2 = nil
             retRule.Leaf2 = &cr2
-            fmt.Println("IN OR, found Leaf2 with", cr2)
+            //fmt.Println("IN OR, found Leaf2 with", cr2)
         } else {
             entry, err2 := getCurrentRulesLIdx($3)
             if err2 == nil {
                 retRule.Leaf2 = nil
-                retRule.Rs2 = &currentRulesL[entry]
+                retRule.Rs2 = &p.currentRulesL[entry]
                 //fmt.Println("IN OR, found Rs2 with", currentRulesL[entry], "entry is", entry)
             } else {
                 fmt.Println("Error: should never happen because its either Leaf or Rs")
             }
         }
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1) // return an index to the last rule
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1) // return an index to the last rule
     }
 //|   NOT rule
 //    {
@@ -451,6 +511,7 @@ rule_list:
 rule:
     LBRACKET rule_list RBRACKET
     {
+        p := yylex.(*exprLex)
         // where to put Rules2?? 
         // Lets ignore Rule2 and just take what comes back as $$ for now
         retRule := RuleSetL{
@@ -460,7 +521,7 @@ rule:
         entry, err2 := getCurrentRuleIdx($2)
         if (err2 == nil) {
             //fmt.Println("Found bracket current rule as :", entry)
-            cr2 = currentRules[entry]
+            cr2 = p.currentRules[entry]
 
             retRule.Operator = "FIRST" // only evaluate the first term, NO-OP
             retRule.Rs1 = nil
@@ -472,7 +533,7 @@ rule:
             entry, err2 = getCurrentRulesLIdx($2)
             if err2 == nil {
                 retRule.Operator = "FIRST"
-                retRule.Rs1 = &currentRulesL[entry] // maybe that is empty right now?
+                retRule.Rs1 = &p.currentRulesL[entry] // maybe that is empty right now?
                 retRule.Leaf2 = nil
                 retRule.Leaf1 = nil
                 retRule.Rs2 = nil
@@ -481,11 +542,12 @@ rule:
                 fmt.Println("ERROR: should never happen, we need at least an index for something here")
             }
         }
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1) // return an index to the last rule
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1) // return an index to the last rule
     }
 |   NOT rule
     {
+        p := yylex.(*exprLex)
         retRule := RuleSetL{
             Operator: "NOT",
         }
@@ -493,7 +555,7 @@ rule:
         var cr2 Rule
         entry, err2 := getCurrentRuleIdx($2)
         if (err2 == nil) {
-            cr2 = currentRules[entry]
+            cr2 = p.currentRules[entry]
             retRule.Operator = "NOT"
             retRule.Rs1 = nil
             retRule.Rs2 = nil
@@ -503,7 +565,7 @@ rule:
             entry, err2 = getCurrentRulesLIdx($2)
             if err2 == nil {
                 retRule.Operator = "NOT"
-                retRule.Rs1 = &currentRulesL[entry] // maybe that is empty right now?
+                retRule.Rs1 = &p.currentRulesL[entry] // maybe that is empty right now?
                 retRule.Leaf2 = nil
                 retRule.Leaf1 = nil
                 retRule.Rs2 = nil 
@@ -512,8 +574,8 @@ rule:
                 fmt.Println("Error: Should never happen in NOT rule")
             }
         }
-        currentRulesL = append(currentRulesL, retRule)
-        $$ = fmt.Sprintf("currentRulesL:%d", len(currentRulesL)-1) // return an index to the last rule
+        p.currentRulesL = append(p.currentRulesL, retRule)
+        $$ = fmt.Sprintf("currentRulesL:%d", len(p.currentRulesL)-1) // return an index to the last rule
     }
 //|   NOT rule
 //    {
@@ -526,139 +588,198 @@ rule:
 //    }
 |   tag_string EQUALS STRING
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "==",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        p.currentRules = append(p.currentRules, r)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string EQUALS NUM
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "==",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        p.currentRules = append(p.currentRules, r)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string CONTAINING STRING
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "contains",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
 
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string SMALLER NUM
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "<",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
 
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string LARGER NUM
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: ">",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
 
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string SMALLEREQUAL NUM
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "<=",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
 
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   tag_string LARGEREQUAL NUM
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: ">=",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
 
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+    }
+|   tag_string APPROX NUM
+    {
+        p := yylex.(*exprLex)
+        r := Rule{
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
+            Operator: "approx",
+            Value: $3,
+        }
+        p.currentRules = append(p.currentRules, r)
+
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s approx %s", $1, $3)
     }
 |   tag_string REGEXP STRING
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
             Operator: "regexp",
             Value: $3,
         }
-        currentRules = append(currentRules, r)
+        p.currentRules = append(p.currentRules, r)
         //fmt.Printf("store a currentRule as regexp %s \"%s\" (id: %d)\n", lastGroupTag, $3, len(currentRules)-1)
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1) // fmt.Sprintf("Variable %s contains %s", $1, $3)
     }
 |   EVERYTHING
     {
-        // always true
+        p := yylex.(*exprLex)
+        // always true, does not look at a tag
         r := Rule{
-            Tag: lastGroupTag,
+            Tag: nil,
             Operator: "true",
             Value: "",
         }
-        currentRules = append(currentRules, r)
-        $$ = fmt.Sprintf("currentRules:%d", len(currentRules)-1)
+        p.currentRules = append(p.currentRules, r)
+        $$ = fmt.Sprintf("currentRules:%d", len(p.currentRules)-1)
     }    
 
 tag_string:
     STRING
-    { 
+    {
+        p := yylex.(*exprLex) 
         $$ = $1
+        // a tag name can end with a value index, e.g. PixelSpacing[0]
+        name, idx := splitTagIndex($1)
+        p.lastTagIndex = nil
+        if idx > -1 {
+            p.lastTagIndex = &idx
+        }
         // we should also set the lastGroupTag here so wherever we use
         // tag_string we would have such a pair (mapping from string to tag pair)
-        s, err := tag.FindByName($1)
-        if err == nil {
-            lastGroupTag = []string{fmt.Sprintf("%0x", s.Tag.Group), fmt.Sprintf("%0x", s.Tag.Element)}
+        s, err := tag.FindByName(name)
+        if _, computed := geometryFields[name]; err == nil && !computed {
+            p.lastGroupTag = []string{fmt.Sprintf("%0x", s.Tag.Group), fmt.Sprintf("%0x", s.Tag.Element)}
         } else {
-            lastGroupTag = []string{$1} // This could be classifyType, keep the value provided
+            p.lastGroupTag = []string{name} // This could be classifyType or a computed field like Plane, keep the value provided
         }
     }
 |   LBRACKET group_tag_pair RBRACKET
     {
+        p := yylex.(*exprLex)
         //fmt.Println("We are in the group tag pair now")
+        p.lastTagIndex = nil
         $$ = $2
     }
+|   LBRACKET group_tag_pair RBRACKET STRING
+    {
+        p := yylex.(*exprLex)
+        // value index after a group tag pair, e.g. ("0x0028","0x0030")[0]
+        _, idx := splitTagIndex("x" + $4)
+        p.lastTagIndex = nil
+        if idx < 0 {
+            p.errorOnParse = true
+            p.errorPositions = append(p.errorPositions, p.lastTokenPos)
+            p.errorMessages = append(p.errorMessages, fmt.Sprintf("parse error (before pos %d): expected an index like [0] after %s, got \"%s\"\n", p.charpos, $2, $4))
+        } else {
+            p.lastTagIndex = &idx
+        }
+        $$ = $2 + $4
+    }
 
 group_tag_pair:
     STRING COMMA STRING
     {
+        p := yylex.(*exprLex)
         // get the corresponding group and tag from hexadecimal
         group_str := strings.Replace($1,"0x","",-1)
         group_str = strings.Replace(group_str, "0X","", -1)
         group, err := strconv.ParseInt(group_str, 16, 64)
         if err != nil {
-            exitGracefully(err)
+            p.errorOnParse = true
+            p.errorPositions = append(p.errorPositions, p.lastTokenPos)
+            p.errorMessages = append(p.errorMessages, fmt.Sprintf("parse error (before pos %d): group \"%s\" is not a hexadecimal number\n", p.charpos, $1))
         }
         tag_str := strings.Replace($3,"0x","",-1)
         tag_str = strings.Replace(tag_str, "0X","", -1)
         tag, err := strconv.ParseInt(tag_str, 16, 64)
         if err != nil {
-            exitGracefully(err)
+            p.errorOnParse = true
+            p.errorPositions = append(p.errorPositions, p.lastTokenPos)
+            p.errorMessages = append(p.errorMessages, fmt.Sprintf("parse error (before pos %d): element \"%s\" is not a hexadecimal number\n", p.charpos, $3))
         }
         //lastGroupTag = []int{int(group), int(tag)}
-        lastGroupTag = []string{$1, $3}
+        p.lastGroupTag = []string{$1, $3}
         $$ = fmt.Sprintf("(%x,%x)", group, tag)
     }
 /*|   NUM COMMA NUM
@@ -713,32 +834,34 @@ level_types:
 base_check:
     CHECK check_rule_list
     {
-        if ast.CheckRules == nil {
-           ast.CheckRules = make([]RuleSet,0)
+        p := yylex.(*exprLex)
+        if p.ast.CheckRules == nil {
+           p.ast.CheckRules = make([]RuleSet,0)
         }
-        if len(currentCheckRules)  > 0 {
+        if len(p.currentCheckRules)  > 0 {
             var rs RuleSet = RuleSet{
                 Name: "",
-                Rs: currentCheckRules,
+                Rs: p.currentCheckRules,
             }
-            ast.CheckRules  = append(ast.CheckRules, rs)
+            p.ast.CheckRules  = append(p.ast.CheckRules, rs)
         }
-        currentCheckRules = nil
+        p.currentCheckRules = nil
         $$ = $2
     }
 
 check_rule_list:
     check_rule 
     {
+        p := yylex.(*exprLex)
         //fmt.Printf("found a rule: \"%s\"\n", $1)
         // add the rule to the current list of rules
-        if len(currentCheckRules) > 0 {
+        if len(p.currentCheckRules) > 0 {
             var rs RuleSet = RuleSet{
                 Name: "",
-                Rs: currentCheckRules,
+                Rs: p.currentCheckRules,
             }
-            ast.CheckRules  = append(ast.CheckRules, rs)
-            currentCheckRules = nil 
+            p.ast.CheckRules  = append(p.ast.CheckRules, rs)
+            p.currentCheckRules = nil 
         }
         $$ = $1
     }
@@ -758,31 +881,132 @@ check_rule:
     }
 |   NOT check_rule
     {
-        if currentCheckRules[len(currentCheckRules)-1].Negate == "" || currentCheckRules[len(currentCheckRules)-1].Negate == "no" {
-            currentCheckRules[len(currentCheckRules)-1].Negate = "yes"
+        p := yylex.(*exprLex)
+        if p.currentCheckRules[len(p.currentCheckRules)-1].Negate == "" || p.currentCheckRules[len(p.currentCheckRules)-1].Negate == "no" {
+            p.currentCheckRules[len(p.currentCheckRules)-1].Negate = "yes"
         } else {
-            currentCheckRules[len(currentCheckRules)-1].Negate = "no"
+            p.currentCheckRules[len(p.currentCheckRules)-1].Negate = "no"
         }
         $$ = fmt.Sprintf("%s NOT %s", $$, $1)
     }
 |   check_tag1 EQUALS check_tag2
     {
+        p := yylex.(*exprLex)
         r := Rule{
-            Tag: currentCheckTag1,
-            Tag2: currentCheckTag2,
+            Tag: p.currentCheckTag1,
+            Tag2: p.currentCheckTag2,
             Operator: "==",
             Value: $1 + " == " + $1, // fmt.Sprintf("%s == %s", $1, $3),
         }
-        currentCheckRules = append(currentCheckRules, r)
+        p.currentCheckRules = append(p.currentCheckRules, r)
         $$ = $1 + " == " + $3 // fmt.Sprintf("Variable %s == %s", $1, $3)
     }
 
+having_stmt:
+    HAVING having_rule_list
+    {
+        $$ = $2
+    }
+
+having_rule_list:
+    having_rule
+    {
+        $$ = $1
+    }
+|   having_rule_list AND having_rule
+    {
+        $$ = $1 + " AND " + $3
+    }
+
+having_rule:
+    aggregate compare_op NUM
+    {
+        p := yylex.(*exprLex)
+        p.currentHaving.Operator = $2
+        p.currentHaving.Value = $3
+        if p.ast.HavingRules == nil {
+            p.ast.HavingRules = make([]HavingRule, 0)
+        }
+        p.ast.HavingRules = append(p.ast.HavingRules, p.currentHaving)
+        p.currentHaving = HavingRule{}
+        $$ = fmt.Sprintf("%s %s %g", $1, $2, $3)
+    }
+
+compare_op:
+    EQUALS
+    {
+        $$ = "=="
+    }
+|   SMALLER
+    {
+        $$ = "<"
+    }
+|   LARGER
+    {
+        $$ = ">"
+    }
+|   SMALLEREQUAL
+    {
+        $$ = "<="
+    }
+|   LARGEREQUAL
+    {
+        $$ = ">="
+    }
+
+aggregate:
+    COUNT LBRACKET level_types RBRACKET
+    {
+        p := yylex.(*exprLex)
+        // count(study) is the number of studies, count(series) the number of series
+        p.currentHaving = HavingRule{
+            Function: "count",
+            Level: havingLevel($3),
+        }
+        $$ = "count"
+    }
+|   COUNT LBRACKET level_types NAMED STRING RBRACKET
+    {
+        p := yylex.(*exprLex)
+        // only count the series that are assigned to this named where-clause
+        p.currentHaving = HavingRule{
+            Function: "count",
+            Level: havingLevel($3),
+            Name: $5,
+        }
+        $$ = "count"
+    }
+|   COUNT LBRACKET level_types WHERE rule_list RBRACKET
+    {
+        p := yylex.(*exprLex)
+        // only count the series that match the rules
+        rs := p.ruleSetFromEntry($5)
+        p.currentHaving = HavingRule{
+            Function: "count",
+            Level: havingLevel($3),
+            Rs: &rs,
+        }
+        $$ = "count"
+    }
+|   SPAN LBRACKET tag_string RBRACKET
+    {
+        p := yylex.(*exprLex)
+        // difference between the largest and the smallest value of a tag
+        p.currentHaving = HavingRule{
+            Function: "span",
+            Tag: p.lastGroupTag,
+            Index: p.lastTagIndex,
+        }
+        $$ = "span"
+    }
+
 check_tag1:
     STRING AT tag_string
     {
-        currentCheckTag1 = []string{$1, lastGroupTag[0]}
-        if len(lastGroupTag) > 1 {
-            currentCheckTag1 =  append(currentCheckTag1, lastGroupTag[1])
+        p := yylex.(*exprLex)
+        p.currentCheckTag1 = []string{$1, p.lastGroupTag[0]}
+        if len(p.lastGroupTag) > 1 {
+            p.currentCheckTag1 =  append(p.currentCheckTag1, p.lastGroupTag[1])
         }
         $$ = $1 + " @ " + $3 // fmt.Sprintf("%s @ %s", $1, $3)
     }
@@ -790,9 +1014,10 @@ check_tag1:
 check_tag2:
     STRING AT tag_string
     {
-        currentCheckTag2 = []string{$1, lastGroupTag[0]}
-        if len(lastGroupTag) > 1 {
-            currentCheckTag2 =  append(currentCheckTag2, lastGroupTag[1])
+        p := yylex.(*exprLex)
+        p.currentCheckTag2 = []string{$1, p.lastGroupTag[0]}
+        if len(p.lastGroupTag) > 1 {
+            p.currentCheckTag2 =  append(p.currentCheckTag2, p.lastGroupTag[1])
         }
         $$ = $1 + " @ " + $3 // fmt.Sprintf("%s @ %s", $1, $3)
     }
@@ -800,24 +1025,77 @@ check_tag2:
 
 %%
 
-func InitParser() {
-    currentRules = nil
-    ast.Rules = nil
-    ast.Output_level = ""
-    ast.Select_level = ""
-    ast.Select_level_by_rule = make([]string, 0)
-    ast.Rule_list_names = make([]string, 0)
-    ast.CheckRules = nil // make([]RuleSet, 0)
-    ast.RulesTree = nil // make([]RuleTreeSet, 0)
-    currentCheckRules = nil
-    currentRules = nil
-    currentRulesL = nil
-    //currentCheckTag1 = make([]string,0)
-    //currentCheckTag2 = make([]string,0)
-    errorOnParse = false
-    errorMessages = make([]string,0)
-    charpos = 0
-    program = ""
+var selectComments = regexp.MustCompile("/[*]([^*]|[\r\n]|([*]+([^*/]|[\r\n])))*[*]+/")
+
+// Parse reads a select statement and returns its abstract syntax tree. The parser
+// keeps its state in the lexer so Parse can be called from several go-routines.
+func Parse(statement string) (AST, []ParseError) {
+    // comments are replaced by spaces so positions in errors match the statement
+    masked := selectComments.ReplaceAllStringFunc(statement, func(c string) string {
+        b := []byte(c)
+        for i := range b {
+            if b[i] != '\n' {
+                b[i] = ' '
+            }
+        }
+        return string(b)
+    })
+    lex := &exprLex{line: []byte(masked), parseState: &parseState{
+        program: masked,
+        errorMessages: make([]string, 0),
+        errorPositions: make([]int, 0),
+    }}
+    lex.ast.Select_level_by_rule = make([]string, 0)
+    lex.ast.Rule_list_names = make([]string, 0)
+    yyNewParser().Parse(lex)
+    if !lex.errorOnParse {
+        return lex.ast, nil
+    }
+    errs := make([]ParseError, 0)
+    for i, msg := range lex.errorMessages {
+        pos := 0
+        if i < len(lex.errorPositions) {
+            pos = lex.errorPositions[i]
+        }
+        if pos > len(statement) {
+            pos = len(statement)
+        }
+        line := strings.Count(statement[:pos], "\n") + 1
+        column := utf8.RuneCountInString(statement[strings.LastIndex(statement[:pos], "\n")+1:pos]) + 1
+        errs = append(errs, ParseError{Pos: pos, Line: line, Column: column, Message: parseErrorReason(msg)})
+    }
+    if len(errs) == 0 {
+        errs = append(errs, ParseError{Line: 1, Column: 1, Message: "syntax error"})
+    }
+    return lex.ast, errs
+}
+
+// parseErrorReason removes the copy of the statement from a parser error message
+func parseErrorReason(msg string) string {
+    msg = strings.TrimSpace(msg)
+    quoted := false
+    if idx := strings.Index(msg, "\" program:"); idx > -1 {
+        msg = msg[:idx]
+        quoted = true
+    }
+    if strings.HasPrefix(msg, "parse error (before pos ") {
+        if idx := strings.Index(msg, "): "); idx > -1 {
+            msg = msg[idx+3:]
+        }
+    }
+    if quoted {
+        msg = strings.TrimPrefix(msg, "\"")
+    }
+    return msg
+}
+
+// parseErrorsString joins the messages of parse errors for error output
+func parseErrorsString(errs []ParseError, sep string) string {
+    msgs := make([]string, 0, len(errs))
+    for _, e := range errs {
+        msgs = append(msgs, e.Error())
+    }
+    return strings.Join(msgs, sep)
 }
 
 // The parser expects the lexer to return 0 on EOF.  Give it a name
@@ -829,6 +1107,7 @@ const eof = 0
 type exprLex struct {
 	line []byte
 	peek rune
+	*parseState
 }
 
 // The parser calls this method to get each new token. This
@@ -836,6 +1115,12 @@ type exprLex struct {
 func (x *exprLex) Lex(yylval *yySymType) int {
 	for {
 		c := x.next()
+		if c == eof {
+			x.lastTokenPos = len(x.program)
+		} else if !unicode.IsSpace(c) {
+			// remember where the token starts for error messages
+			x.lastTokenPos = len(x.program) - len(x.line) - utf8.RuneLen(c)
+		}
 		switch c {
 		case eof:
 			return eof
@@ -847,16 +1132,16 @@ func (x *exprLex) Lex(yylval *yySymType) int {
             }
 			return x.num(c, yylval)
 		case '+', '-', '*', '/':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 			return int(c)
 
 		// Recognize Unicode multiplication and division
 		// symbols, returning what the parser expects.
 		case '×':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 			return '*'
 		case '÷':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 			return '/'
         case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ø', 'å', 'æ':
             return x.word(c, yylval, rune(0))
@@ -869,42 +1154,42 @@ func (x *exprLex) Lex(yylval *yySymType) int {
             peek := x.nextButKeep()
             if peek == '=' {
                 _ = x.next()
-                charpos = charpos + 2
+                x.charpos = x.charpos + 2
                 return SMALLEREQUAL
             }
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return SMALLER
         case '>':
             // how about >= ?
             peek := x.nextButKeep()
             if peek == '=' {
                 _ = x.next()
-                charpos = charpos + 2
+                x.charpos = x.charpos + 2
                 return LARGEREQUAL
             }
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return LARGER
         case '=':
             // how about == ?
             peek := x.nextButKeep()
             if peek == '=' {
                 _ = x.next()
-                charpos = charpos + 2
+                x.charpos = x.charpos + 2
                 return EQUALS
             }
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return EQUALS
         case '(':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return LBRACKET
         case ')':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return RBRACKET
         case ',':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return COMMA
         case '@':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             return AT
         case '"':
             // read until the next delimiter (eat up spaces as well)
@@ -913,7 +1198,7 @@ func (x *exprLex) Lex(yylval *yySymType) int {
             // read until the next delimiter (eat up spaces as well)
             return x.word(c, yylval, rune('\''))
 		case ' ', '\t', '\n', '\r':
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 		default:
 			log.Printf("unrecognized character %q", c)
 		}
@@ -933,34 +1218,45 @@ func (x *exprLex) word(c rune, yylval *yySymType, delimiter rune) int {
     }
 	L: for {
 		c = x.next()
+        if delimiter == rune(0) {
+            // count(, span( and not( are followed by a bracket, and a closing bracket
+            // ends a word unless the word opened one itself (regular expressions)
+            if c == '(' && (strings.ToLower(b.String()) == "count" || strings.ToLower(b.String()) == "span" || strings.ToLower(b.String()) == "not") {
+                break L
+            }
+            if c == ')' && !strings.Contains(b.String(), "(") {
+                break L
+            }
+        }
         if unicode.IsSpace(c) {
             if delimiter == rune(0) {
-                charpos = charpos + 1
+                x.charpos = x.charpos + 1
                 break L
             } else {
                 add(&b, c)
-                charpos = charpos + 1
+                x.charpos = x.charpos + 1
                 continue L
             }
         }
 		switch c {
 		case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ø', 'å', 'æ':
 			add(&b, c)
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'Ø', 'Å', 'Æ':
 			add(&b, c)
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '^', '$', '.', '*', '[', ']', '/', '\\', '_', '|', '(', ')':
 			add(&b, c)
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case delimiter:
             c = x.next() // make sure we will not look at it if it stays in peek
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
             break L
 		default:
-            if delimiter != rune(0) && (c == '-' || c == '_') {
+            // a quoted string can contain anything but its delimiter, e.g. "EchoNumbers=2,ImageType=ORIGINAL"
+            if delimiter != rune(0) && c != eof {
     			add(&b, c)
-                charpos = charpos + 1
+                x.charpos = x.charpos + 1
             } else {
 			    break L
             }
@@ -1012,6 +1308,14 @@ func (x *exprLex) word(c rune, yylval *yySymType, delimiter rune) int {
         return NAMED
     } else if strings.ToLower(b.String()) == "check" {
         return CHECK
+    } else if strings.ToLower(b.String()) == "approx" {
+        return APPROX
+    } else if strings.ToLower(b.String()) == "having" {
+        return HAVING
+    } else if strings.ToLower(b.String()) == "count" {
+        return COUNT
+    } else if strings.ToLower(b.String()) == "span" {
+        return SPAN
     } else {
 		log.Printf("unknown word %s", b.String())
         yylval.word = b.String()
@@ -1035,7 +1339,7 @@ func (x *exprLex) num(c rune, yylval *yySymType) int {
 		switch c {
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.', 'e', 'E', '+':
 			add(&b, c)
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 		default:
 			break L
 		}
@@ -1044,7 +1348,7 @@ func (x *exprLex) num(c rune, yylval *yySymType) int {
 		x.peek = c
 	}
 	yylval.num = 0 // &big.Rat{}
-    t_val, err := strconv.ParseFloat(b.String(), 32)
+    t_val, err := strconv.ParseFloat(b.String(), 64)
     if err != nil {
         yylval.num = 0.0
     } else {
@@ -1072,22 +1376,22 @@ func (x *exprLex) hex(c rune, yylval *yySymType) int {
 		switch c {
         case 'A':
             add(&b, 'a')
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case 'B':
             add(&b, 'b')
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case 'C':
             add(&b, 'c')
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case 'E':
             add(&b, 'e')
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
         case 'F':
             add(&b, 'f')
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
 			add(&b, c)
-            charpos = charpos + 1
+            x.charpos = x.charpos + 1
 		default:
 			break L
 		}
@@ -1102,8 +1406,8 @@ func (x *exprLex) hex(c rune, yylval *yySymType) int {
 
 // Return the next rune for the lexer.
 func (x *exprLex) next() rune {
-    if program == "" {
-        program = string(x.line[0:])
+    if x.program == "" {
+        x.program = string(x.line[0:])
         //fmt.Println("SETTING OF program to ", program)
     }
 	if x.peek != eof {
@@ -1126,8 +1430,8 @@ func (x *exprLex) next() rune {
 
 // Return the next rune but don't advance the lexer.
 func (x *exprLex) nextButKeep() rune {
-    if program == "" {
-        program = string(x.line[0:])
+    if x.program == "" {
+        x.program = string(x.line[0:])
         //fmt.Println("SETTING OF program to ", program)
     }
 	if x.peek != eof {
@@ -1151,12 +1455,13 @@ func (x *exprLex) nextButKeep() rune {
 
 // The parser calls this method on a parse error.
 func (x *exprLex) Error(s string) {
-    errorOnParse = true
-    if charpos < len(program) {
+    x.errorOnParse = true
+    x.errorPositions = append(x.errorPositions, x.lastTokenPos)
+    if x.charpos < len(x.program) {
     	//fmt.Printf("parse error (before pos %d): \"%s\" program: \"%s\"\n", charpos, s, program)
-        errorMessages = append(errorMessages, fmt.Sprintf("parse error (before pos %d): \"%s\" program: %s\n", charpos, s, program))
+        x.errorMessages = append(x.errorMessages, fmt.Sprintf("parse error (before pos %d): \"%s\" program: %s\n", x.charpos, s, x.program))
     } else {
     	//fmt.Printf("parse error (before pos %d): \"%s\" program: \"%s\"\nline: \"%v\"\n", charpos, s, program, x.line)
-        errorMessages = append(errorMessages, fmt.Sprintf("parse error (before pos %d): \"%s\" program: %s\nline: \"%v\"\n", charpos, s, program, x.line))
+        x.errorMessages = append(x.errorMessages, fmt.Sprintf("parse error (before pos %d): \"%s\" program: %s\nline: \"%v\"\n", x.charpos, s, x.program, x.line))
     }
 }
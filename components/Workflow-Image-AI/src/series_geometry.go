@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// SeriesGeometry are facts about the image geometry of a series computed from ImageOrientationPatient,
+// ImagePositionPatient, PixelSpacing and SliceThickness of all images. Select statements can use the
+// fields by name, e.g. 'Plane == axial and Coverage > 150'.
+type SeriesGeometry struct {
+	Plane          string  // plane of most images: axial, sagittal, coronal or oblique, empty if there is no orientation
+	Isotropic3D    bool    // contiguous slices with about the same spacing in all three directions
+	SlicePositions int     // number of different slice positions, images at the same position (echoes, time points) count once
+	SliceSpacing   float64 // median distance between neighboring slice positions in mm
+	SliceGap       float64 // median gap between neighboring slices (spacing - thickness) in mm, negative for overlapping slices
+	Coverage       float64 // distance covered by the slices along the slice normal in mm (including one slice thickness)
+	Localizer      bool    // ImageType LOCALIZER or images in more than one plane
+}
+
+// geometryFields are the names of SeriesGeometry that can be used in select statements
+var geometryFields = map[string]string{
+	"Plane":          "plane of most images of the series: axial, sagittal, coronal or oblique",
+	"Isotropic3D":    "true if the series is a 3D volume with about the same voxel size in all directions",
+	"SlicePositions": "number of different slice positions of the series",
+	"SliceSpacing":   "median distance between neighboring slices in mm",
+	"SliceGap":       "median gap between neighboring slices in mm (negative if slices overlap)",
+	"Coverage":       "distance covered by the slices in mm",
+	"Localizer":      "true if ImageType contains LOCALIZER or the images are in more than one plane",
+}
+
+// an image is oblique if its normal is more than 30 degrees away from the closest axis
+const obliqueLimit = 0.866
+
+// value returns a computed geometry field as a string for select statements
+func (g SeriesGeometry) value(name string) (string, bool) {
+	switch name {
+	case "Plane":
+		return g.Plane, g.Plane != ""
+	case "Isotropic3D":
+		return strconv.FormatBool(g.Isotropic3D), g.Plane != ""
+	case "SlicePositions":
+		return fmt.Sprintf("%d", g.SlicePositions), g.Plane != ""
+	case "SliceSpacing":
+		return strconv.FormatFloat(g.SliceSpacing, 'f', -1, 64), g.SlicePositions > 1
+	case "SliceGap":
+		return strconv.FormatFloat(g.SliceGap, 'f', -1, 64), g.SlicePositions > 1
+	case "Coverage":
+		return strconv.FormatFloat(g.Coverage, 'f', -1, 64), g.Plane != ""
+	case "Localizer":
+		return strconv.FormatBool(g.Localizer), true
+	}
+	return "", false
+}
+
+// floatValues returns the numbers of a tag, nil if the tag is missing or not a list of numbers
+func floatValues(tags []TagAndValue, t tag.Tag) []float64 {
+	for _, tav := range tags {
+		if tav.Tag != t {
+			continue
+		}
+		values := make([]float64, 0, len(tav.Value))
+		for _, v := range tav.Value {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil
+			}
+			values = append(values, f)
+		}
+		return values
+	}
+	return nil
+}
+
+// planeOf returns the plane of an image orientation and the normal of the image
+func planeOf(orientation []float64) (string, [3]float64) {
+	row := [3]float64{orientation[0], orientation[1], orientation[2]}
+	col := [3]float64{orientation[3], orientation[4], orientation[5]}
+	normal := [3]float64{
+		row[1]*col[2] - row[2]*col[1],
+		row[2]*col[0] - row[0]*col[2],
+		row[0]*col[1] - row[1]*col[0],
+	}
+	if l := math.Sqrt(normal[0]*normal[0] + normal[1]*normal[1] + normal[2]*normal[2]); l > 0 {
+		for i := range normal {
+			normal[i] /= l
+		}
+	}
+	// the normal of a sagittal image points along x (left-right), coronal along y, axial along z
+	planes := []string{"sagittal", "coronal", "axial"}
+	best := 0
+	for i := 1; i < 3; i++ {
+		if math.Abs(normal[i]) > math.Abs(normal[best]) {
+			best = i
+		}
+	}
+	if math.Abs(normal[best]) < obliqueLimit {
+		return "oblique", normal
+	}
+	return planes[best], normal
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	if len(sorted)%2 == 1 {
+		return sorted[len(sorted)/2]
+	}
+	return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+}
+
+// computeGeometry uses the tags stored for each image, data imported with an older version of ror
+// only has the tags of a single image (All).
+func (info SeriesInfo) computeGeometry() SeriesGeometry {
+	var g SeriesGeometry
+	images := [][]TagAndValue{}
+	for _, instance := range info.Instances {
+		images = append(images, info.instanceView(instance).All)
+	}
+	if len(images) == 0 {
+		images = append(images, info.All)
+	}
+
+	type slice struct {
+		plane     string
+		normal    [3]float64
+		position  []float64
+		thickness float64
+		spacing   []float64
+	}
+	planeCount := make(map[string]int)
+	slices := []slice{}
+	for _, tags := range images {
+		for _, tav := range tags {
+			if tav.Tag == tag.ImageType {
+				for _, v := range tav.Value {
+					if strings.Contains(strings.ToUpper(v), "LOCALIZER") || strings.Contains(strings.ToUpper(v), "SCOUT") {
+						g.Localizer = true
+					}
+				}
+			}
+		}
+		orientation := floatValues(tags, tag.ImageOrientationPatient)
+		if len(orientation) != 6 {
+			continue
+		}
+		plane, normal := planeOf(orientation)
+		planeCount[plane]++
+		s := slice{plane: plane, normal: normal, position: floatValues(tags, tag.ImagePositionPatient), spacing: floatValues(tags, tag.PixelSpacing)}
+		if thickness := floatValues(tags, tag.SliceThickness); len(thickness) > 0 {
+			s.thickness = thickness[0]
+		}
+		slices = append(slices, s)
+	}
+	if len(slices) == 0 {
+		return g
+	}
+	for plane, count := range planeCount {
+		if count > planeCount[g.Plane] || (count == planeCount[g.Plane] && plane < g.Plane) {
+			g.Plane = plane
+		}
+	}
+	if len(planeCount) > 1 {
+		g.Localizer = true
+	}
+
+	// slice positions along the normal of the images in the main plane
+	var normal [3]float64
+	for _, s := range slices {
+		if s.plane == g.Plane {
+			normal = s.normal
+			break
+		}
+	}
+	positions := []float64{}
+	thickness := []float64{}
+	pixelSpacing := []float64{}
+	for _, s := range slices {
+		if math.Abs(normal[0]*s.normal[0]+normal[1]*s.normal[1]+normal[2]*s.normal[2]) < 0.99 {
+			continue // not parallel to the main plane
+		}
+		if len(s.position) != 3 {
+			continue
+		}
+		positions = append(positions, normal[0]*s.position[0]+normal[1]*s.position[1]+normal[2]*s.position[2])
+		if s.thickness > 0 {
+			thickness = append(thickness, s.thickness)
+		}
+		if len(s.spacing) == 2 {
+			pixelSpacing = append(pixelSpacing, s.spacing[0], s.spacing[1])
+		}
+	}
+	sort.Float64s(positions)
+	unique := []float64{}
+	for _, p := range positions {
+		// echoes, time points or b-values share the same position
+		if len(unique) == 0 || p-unique[len(unique)-1] > 0.01 {
+			unique = append(unique, p)
+		}
+	}
+	g.SlicePositions = len(unique)
+	sliceThickness := median(thickness)
+	if len(unique) > 1 {
+		distances := []float64{}
+		for i := 1; i < len(unique); i++ {
+			distances = append(distances, unique[i]-unique[i-1])
+		}
+		g.SliceSpacing = median(distances)
+		if sliceThickness > 0 {
+			g.SliceGap = g.SliceSpacing - sliceThickness
+		}
+		g.Coverage = unique[len(unique)-1] - unique[0]
+	}
+	if sliceThickness > 0 {
+		g.Coverage += sliceThickness
+	} else {
+		g.Coverage += g.SliceSpacing
+	}
+	// a volume needs enough contiguous slices and voxels that are about as deep as they are wide
+	if g.SlicePositions >= 10 && len(pixelSpacing) > 0 && !g.Localizer {
+		voxel := []float64{median(pixelSpacing), g.SliceSpacing}
+		contiguous := sliceThickness == 0 || g.SliceGap <= 0.1*sliceThickness
+		g.Isotropic3D = contiguous && voxel[0] > 0 && math.Max(voxel[0], voxel[1])/math.Min(voxel[0], voxel[1]) <= 1.25
+	}
+	g.SliceSpacing = math.Round(g.SliceSpacing*1000) / 1000
+	g.SliceGap = math.Round(g.SliceGap*1000) / 1000
+	g.Coverage = math.Round(g.Coverage*1000) / 1000
+	return g
+}
+
+// geometry returns the stored geometry of the series, or computes it for data imported with an
+// older version of ror
+func (info SeriesInfo) geometry() SeriesGeometry {
+	if info.Geometry != nil {
+		return *info.Geometry
+	}
+	return info.computeGeometry()
+}
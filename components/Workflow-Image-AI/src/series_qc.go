@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// QCStatus values of a series
+const (
+	qcComplete   = "complete"   // no problems found
+	qcIncomplete = "incomplete" // see QCIssues for the problems
+	qcUnknown    = "unknown"    // data imported with an older version of ror has no per image information
+)
+
+// tagValue returns the value of a tag as a single string, empty if it is missing
+func tagValue(tags []TagAndValue, t tag.Tag) string {
+	for _, tav := range tags {
+		if tav.Tag == t {
+			return strings.Join(tav.Value, "\\")
+		}
+	}
+	return ""
+}
+
+// numberRanges prints a sorted list of numbers as ranges, e.g. "3, 7-9"
+func numberRanges(numbers []int) string {
+	parts := []string{}
+	for i := 0; i < len(numbers); i++ {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", numbers[i]))
+		}
+		i = j
+	}
+	if len(parts) > 10 {
+		parts = append(parts[:10], "...")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// computeQC checks if the images of a series look complete. It reports missing instance numbers,
+// images at the same slice position, inconsistent slice spacing, mixed image dimensions and mixed
+// transfer syntaxes. Series that have several images at every slice position (echoes, time points)
+// are fine.
+func (info SeriesInfo) computeQC() (string, []string) {
+	if len(info.Instances) == 0 {
+		return qcUnknown, nil
+	}
+	issues := []string{}
+
+	// missing instance numbers, the images of a sub-series are not numbered consecutively
+	numbers := []int{}
+	seen := make(map[int]bool)
+	for _, instance := range info.Instances {
+		v := tagValue(instance.Tags, tag.InstanceNumber)
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			numbers = nil
+			break
+		}
+		if !seen[n] {
+			seen[n] = true
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) > 1 && info.SubSeries == "" {
+		sort.Ints(numbers)
+		missing := []int{}
+		for n := numbers[0] + 1; n < numbers[len(numbers)-1]; n++ {
+			if !seen[n] {
+				missing = append(missing, n)
+			}
+		}
+		if len(missing) > 0 {
+			issues = append(issues, fmt.Sprintf("missing InstanceNumber %s", numberRanges(missing)))
+		}
+	}
+
+	// slice positions along the normal of the main plane
+	var normal [3]float64
+	plane := info.geometry().Plane
+	for _, instance := range info.Instances {
+		if orientation := floatValues(instance.Tags, tag.ImageOrientationPatient); len(orientation) == 6 {
+			if p, n := planeOf(orientation); p == plane {
+				normal = n
+				break
+			}
+		}
+	}
+	positions := []float64{}
+	for _, instance := range info.Instances {
+		orientation := floatValues(instance.Tags, tag.ImageOrientationPatient)
+		position := floatValues(instance.Tags, tag.ImagePositionPatient)
+		if len(orientation) != 6 || len(position) != 3 {
+			continue
+		}
+		if _, n := planeOf(orientation); math.Abs(n[0]*normal[0]+n[1]*normal[1]+n[2]*normal[2]) < 0.99 {
+			continue // a localizer in another plane
+		}
+		positions = append(positions, normal[0]*position[0]+normal[1]*position[1]+normal[2]*position[2])
+	}
+	sort.Float64s(positions)
+	unique := []float64{}
+	perPosition := []int{}
+	for _, p := range positions {
+		if len(unique) == 0 || p-unique[len(unique)-1] > 0.01 {
+			unique = append(unique, p)
+			perPosition = append(perPosition, 0)
+		}
+		perPosition[len(perPosition)-1]++
+	}
+	// the usual number of images at a slice position, e.g. the number of echoes
+	counts := make(map[int]int)
+	typical := 0
+	for _, count := range perPosition {
+		counts[count]++
+		if counts[count] > counts[typical] || (counts[count] == counts[typical] && count < typical) {
+			typical = count
+		}
+	}
+	for i, count := range perPosition {
+		if count > typical {
+			issues = append(issues, fmt.Sprintf("duplicate slice position (%d images at %.2fmm instead of %d)", count, unique[i], typical))
+			break
+		} else if count < typical {
+			issues = append(issues, fmt.Sprintf("missing images at slice position %.2fmm (%d instead of %d)", unique[i], count, typical))
+			break
+		}
+	}
+	if len(unique) > 2 {
+		distances := []float64{}
+		for i := 1; i < len(unique); i++ {
+			distances = append(distances, unique[i]-unique[i-1])
+		}
+		spacing := median(distances)
+		for _, d := range distances {
+			if math.Abs(d-spacing) > math.Max(0.1*spacing, 0.01) {
+				issues = append(issues, fmt.Sprintf("inconsistent slice spacing (%.2fmm instead of %.2fmm)", d, spacing))
+				break
+			}
+		}
+	}
+
+	// all images should have the same size and transfer syntax
+	dimensions := []string{}
+	transferSyntaxes := []string{}
+	for _, instance := range info.Instances {
+		d := fmt.Sprintf("%sx%s", tagValue(instance.Tags, tag.Rows), tagValue(instance.Tags, tag.Columns))
+		if d != "x" && !slices.Contains(dimensions, d) {
+			dimensions = append(dimensions, d)
+		}
+		if ts := tagValue(instance.Tags, tag.TransferSyntaxUID); ts != "" && !slices.Contains(transferSyntaxes, ts) {
+			transferSyntaxes = append(transferSyntaxes, ts)
+		}
+	}
+	if len(dimensions) > 1 {
+		issues = append(issues, fmt.Sprintf("mixed image dimensions %s", strings.Join(dimensions, ", ")))
+	}
+	if len(transferSyntaxes) > 1 {
+		issues = append(issues, fmt.Sprintf("mixed transfer syntaxes %s", strings.Join(transferSyntaxes, ", ")))
+	}
+
+	if len(issues) > 0 {
+		return qcIncomplete, issues
+	}
+	return qcComplete, nil
+}
+
+// qc returns the stored QCStatus and QCIssues of the series, or computes them for data imported
+// with an older version of ror
+func (info SeriesInfo) qc() (string, []string) {
+	if info.QCStatus != "" {
+		return info.QCStatus, info.QCIssues
+	}
+	return info.computeQC()
+}
+
+// qcSummary is a short description of the QCStatus for status and the status TUI
+func (info SeriesInfo) qcSummary() string {
+	status, issues := info.qc()
+	if len(issues) > 0 {
+		return fmt.Sprintf("QC: %s (%s)", status, strings.Join(issues, "; "))
+	}
+	return fmt.Sprintf("QC: %s", status)
+}
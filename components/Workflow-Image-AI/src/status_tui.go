@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -53,8 +52,8 @@ func addDataset(statusTUI *StatusTUI, dataset dicom.Dataset) {
 			//fmt.Printf("IN FIRST DATASET! %s", sAllInfo)
 
 			(*statusTUI).summary.Clear()
-			fmt.Fprintf((*statusTUI).summary, "%s\n%s\n\n%s", (*statusTUI).selectedSeriesInformation.SeriesDescription, strings.Join((*statusTUI).selectedSeriesInformation.ClassifyTypes, ","),
-				sAllInfo)
+			fmt.Fprintf((*statusTUI).summary, "%s\n%s\n%s\n\n%s", (*statusTUI).selectedSeriesInformation.SeriesDescription, (*statusTUI).selectedSeriesInformation.classifyTypesSummary(),
+				(*statusTUI).selectedSeriesInformation.qcSummary(), sAllInfo)
 		}
 	}
 